@@ -0,0 +1,551 @@
+package kuling
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+var (
+	// ErrPermissionDenied when the principal is not granted the permission
+	// the command requires
+	ErrPermissionDenied = errors.New("acl: permission denied")
+
+	// ErrACLDisabled when managing ACLs on a server without them
+	ErrACLDisabled = errors.New("acl: ACLs are not enabled")
+
+	// ErrACLMalformed when a rule cannot be parsed
+	ErrACLMalformed = errors.New("acl: malformed rule")
+)
+
+// Permission is a set of operations granted by a rule
+type Permission uint8
+
+// Permissions that rules grant
+const (
+	// PermRead reads messages from topics and describes topics and groups
+	PermRead Permission = 1 << iota
+	// PermWrite appends messages to topics
+	PermWrite
+	// PermCreate creates topics
+	PermCreate
+	// PermDelete removes consumers from groups
+	PermDelete
+	// PermCommit commits and moves the iterators of groups
+	PermCommit
+	// PermAdmin manages the ACLs
+	PermAdmin
+
+	// PermAll is every permission
+	PermAll = PermRead | PermWrite | PermCreate | PermDelete | PermCommit | PermAdmin
+)
+
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermRead, "read"},
+	{PermWrite, "write"},
+	{PermCreate, "create"},
+	{PermDelete, "delete"},
+	{PermCommit, "commit"},
+	{PermAdmin, "admin"},
+}
+
+func (p Permission) String() string {
+	if p == PermAll {
+		return "all"
+	}
+
+	var names []string
+	for _, pn := range permissionNames {
+		if p&pn.perm != 0 {
+			names = append(names, pn.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// parsePermission parses a comma separated list of permission names
+func parsePermission(s string) (Permission, error) {
+	var p Permission
+	for _, name := range strings.Split(s, ",") {
+		if name == "all" {
+			p |= PermAll
+			continue
+		}
+
+		found := false
+		for _, pn := range permissionNames {
+			if pn.name == name {
+				p |= pn.perm
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("%w: unknown permission %q", ErrACLMalformed, name)
+		}
+	}
+
+	return p, nil
+}
+
+// Kinds of resources rules grant permissions on
+const (
+	ResourceTopic   = "topic"
+	ResourceGroup   = "group"
+	ResourceCluster = "cluster"
+)
+
+// ACLRule grants the principal permissions on the resources of a kind whose
+// names match the pattern. The principal * matches every authenticated
+// principal. Patterns are matched with path.Match.
+type ACLRule struct {
+	Principal  string
+	Permission Permission
+	Kind       string
+	Pattern    string
+}
+
+// ParseACLRule parses a rule written as
+//
+//	<principal> <permission[,permission...]> topic:<pattern>|group:<pattern>|cluster
+func ParseACLRule(fields []string) (ACLRule, error) {
+	if len(fields) != 3 {
+		return ACLRule{}, fmt.Errorf("%w: expected principal, permissions and resource", ErrACLMalformed)
+	}
+
+	perm, err := parsePermission(fields[1])
+	if err != nil {
+		return ACLRule{}, err
+	}
+
+	rule := ACLRule{Principal: fields[0], Permission: perm}
+	switch kind, pattern, _ := strings.Cut(fields[2], ":"); kind {
+	case ResourceTopic, ResourceGroup:
+		if pattern == "" {
+			return ACLRule{}, fmt.Errorf("%w: %s without pattern", ErrACLMalformed, kind)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return ACLRule{}, fmt.Errorf("%w: pattern %q: %s", ErrACLMalformed, pattern, err)
+		}
+		rule.Kind, rule.Pattern = kind, pattern
+	case ResourceCluster:
+		if pattern != "" {
+			return ACLRule{}, fmt.Errorf("%w: cluster takes no pattern", ErrACLMalformed)
+		}
+		rule.Kind = kind
+	default:
+		return ACLRule{}, fmt.Errorf("%w: unknown resource %q", ErrACLMalformed, fields[2])
+	}
+
+	return rule, nil
+}
+
+func (r ACLRule) String() string {
+	resource := r.Kind
+	if r.Pattern != "" {
+		resource += ":" + r.Pattern
+	}
+
+	return fmt.Sprintf("%s %s %s", r.Principal, r.Permission, resource)
+}
+
+// matches reports if the rule grants the principal the permission on the
+// resource
+func (r ACLRule) matches(principal string, perm Permission, kind, name string) bool {
+	if r.Principal != "*" && r.Principal != principal {
+		return false
+	}
+	if r.Permission&perm != perm || r.Kind != kind {
+		return false
+	}
+	if kind == ResourceCluster {
+		return true
+	}
+
+	ok, _ := path.Match(r.Pattern, name)
+	return ok
+}
+
+// ACL is the set of rules the server authorizes commands with. Everything
+// that is not granted by a rule is denied. The rules are read from a file
+// with one rule per line, blank lines and lines starting with # are
+// ignored. Rules added or removed with the ACL command are written back to
+// the file.
+type ACL struct {
+	file string
+
+	rules []ACLRule
+	lock  sync.RWMutex
+}
+
+// NewACL loads the rules from the file
+func NewACL(file string) (*ACL, error) {
+	a := &ACL{file: file}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload the rules from the file. On error the current rules are kept.
+func (a *ACL) Reload() error {
+	f, err := os.Open(a.file)
+	if err != nil {
+		return fmt.Errorf("acl: could not open ACL file: %s", err)
+	}
+	defer f.Close()
+
+	var rules []ACLRule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := ParseACLRule(strings.Fields(line))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", a.file, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("acl: could not read ACL file: %s", err)
+	}
+
+	a.lock.Lock()
+	a.rules = rules
+	a.lock.Unlock()
+
+	return nil
+}
+
+// Rules returns a copy of the rules
+func (a *ACL) Rules() []ACLRule {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return append([]ACLRule(nil), a.rules...)
+}
+
+// Allowed reports if any rule grants the principal the permission on the
+// resource
+func (a *ACL) Allowed(principal string, perm Permission, kind, name string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, r := range a.rules {
+		if r.matches(principal, perm, kind, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add the rule and write the rules to the file. Adding a rule that exists
+// does nothing.
+func (a *ACL) Add(rule ACLRule) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, r := range a.rules {
+		if r == rule {
+			return nil
+		}
+	}
+
+	return a.save(append(append([]ACLRule(nil), a.rules...), rule))
+}
+
+// Remove the rule and write the rules to the file. Returns false if there
+// was no such rule.
+func (a *ACL) Remove(rule ACLRule) (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rules := make([]ACLRule, 0, len(a.rules))
+	for _, r := range a.rules {
+		if r != rule {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == len(a.rules) {
+		return false, nil
+	}
+
+	return true, a.save(rules)
+}
+
+// save writes the rules to the file and makes them the current rules. The
+// file is replaced by renaming so that it is never half written. Must be
+// called with the lock held.
+func (a *ACL) save(rules []ACLRule) error {
+	var b strings.Builder
+	b.WriteString("# principal permissions resource, managed by the ACL command\n")
+	for _, r := range rules {
+		b.WriteString(r.String())
+		b.WriteByte('\n')
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(a.file), filepath.Base(a.file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("acl: could not write ACL file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("acl: could not write ACL file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("acl: could not write ACL file: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), a.file); err != nil {
+		return fmt.Errorf("acl: could not write ACL file: %s", err)
+	}
+
+	a.rules = rules
+	return nil
+}
+
+// access is a permission a command requires on a resource
+type access struct {
+	perm Permission
+	kind string
+	name string
+}
+
+func (a access) resource() string {
+	if a.name == "" {
+		return a.kind
+	}
+
+	return a.kind + " " + a.name
+}
+
+// aclAuthorizer finds the permissions commands require and checks them
+// against the ACL before the command runs
+type aclAuthorizer struct {
+	acl *ACL
+	l   *LogStore
+}
+
+// middleware denies commands the principal of the session is not granted
+// every required permission for, and commands without listed permissions
+func (z *aclAuthorizer) middleware(c *resp.Command, next resp.HandleFunc) resp.HandleFunc {
+	return func(w resp.ResponseWriter, r *resp.Request) {
+		principal := sessionPrincipal(r.Session)
+
+		accesses, ok := commandAccesses(z.l, r)
+		if !ok {
+			err := fmt.Errorf("%w: no permissions are defined for the command", ErrPermissionDenied)
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
+		}
+		for _, a := range accesses {
+			if !z.acl.Allowed(principal, a.perm, a.kind, a.name) {
+				err := fmt.Errorf("%w: %s has no %s permission on %s", ErrPermissionDenied, principal, a.perm, a.resource())
+				w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// internalTopicGuard rejects commands on internal topics whether or not
+// ACLs are enabled
+func internalTopicGuard(l *LogStore) resp.Middleware {
+	return func(c *resp.Command, next resp.HandleFunc) resp.HandleFunc {
+		return func(w resp.ResponseWriter, r *resp.Request) {
+			accesses, _ := commandAccesses(l, r)
+			for _, a := range accesses {
+				if a.kind == ResourceTopic && IsInternalTopic(a.name) {
+					err := fmt.Errorf("%w %s", ErrInternalTopic, a.name)
+					w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+					return
+				}
+			}
+
+			next(w, r)
+		}
+	}
+}
+
+// commandAccesses are the permissions the request requires. PING, HELLO,
+// AUTH, HELP, LIST and ACL WHOAMI require none, LIST only shows the topics
+// the principal may read. It returns false for commands that are not
+// listed, they are denied. Requests with arguments the command cannot parse
+// are left for the command to reject.
+func commandAccesses(l *LogStore, r *resp.Request) ([]access, bool) {
+	topic := func(i int, perm Permission) access { return access{perm, ResourceTopic, r.String(i)} }
+	group := func(i int, perm Permission) access { return access{perm, ResourceGroup, r.String(i)} }
+	// stream keys are topic or topic/shard
+	stream := func(key string, perm Permission) access {
+		t, _, _ := strings.Cut(key, "/")
+		return access{perm, ResourceTopic, t}
+	}
+	// creating missing topics on write requires create as well
+	streamCreate := func(key string) []access {
+		t, _, _ := strings.Cut(key, "/")
+		if _, err := l.Shards(t); errors.Is(err, ErrUnknownTopic) {
+			return []access{stream(key, PermCreate)}
+		}
+		return nil
+	}
+
+	switch r.Cmd {
+	case "PING", "HELLO", "AUTH", "HELP", "LIST":
+		return nil, true
+	case "CREATE":
+		return []access{topic(0, PermCreate)}, true
+	case "DESCRIBE", "GET":
+		return []access{topic(0, PermRead)}, true
+	case "PUT", "PUT_BATCH":
+		return []access{topic(0, PermWrite)}, true
+	case "ITERS":
+		return []access{group(0, PermRead), topic(2, PermRead)}, true
+	case "ITER_COMMIT":
+		it, err := IterDecode(r.String(0))
+		if err != nil {
+			return nil, true
+		}
+		return []access{{PermCommit, ResourceGroup, it.Group()}, {PermRead, ResourceTopic, it.Topic()}}, true
+	case "GRP_LEAVE":
+		return []access{group(0, PermRead)}, true
+	case "DESCRIBE_GROUP":
+		return []access{group(0, PermRead), topic(1, PermRead)}, true
+	case "RESET_GROUP":
+		return []access{group(0, PermCommit), topic(1, PermRead)}, true
+
+	case "XADD":
+		accesses := []access{stream(r.String(0), PermWrite)}
+		if !strings.EqualFold(r.String(1), "NOMKSTREAM") {
+			accesses = append(accesses, streamCreate(r.String(0))...)
+		}
+		return accesses, true
+	case "XRANGE", "XLEN":
+		return []access{stream(r.String(0), PermRead)}, true
+	case "XINFO":
+		return []access{stream(r.String(1), PermRead)}, true
+	case "XREAD", "XREADGROUP":
+		start := 0
+		var accesses []access
+		if r.Cmd == "XREADGROUP" {
+			if len(r.Args) < 3 {
+				return nil, true
+			}
+			start = 3
+			accesses = append(accesses, group(1, PermRead))
+		}
+		opts, err := parseStreamRead(r, start)
+		if err != nil {
+			return nil, true
+		}
+		for _, key := range opts.keys {
+			accesses = append(accesses, stream(key, PermRead))
+		}
+		return accesses, true
+	case "XGROUP":
+		switch strings.ToUpper(r.String(0)) {
+		case "CREATE":
+			accesses := []access{group(2, PermCommit), stream(r.String(1), PermRead)}
+			if len(r.Args) > 4 && strings.EqualFold(r.String(4), "MKSTREAM") {
+				accesses = append(accesses, streamCreate(r.String(1))...)
+			}
+			return accesses, true
+		case "SETID":
+			return []access{group(2, PermCommit), stream(r.String(1), PermRead)}, true
+		case "DELCONSUMER":
+			return []access{group(2, PermDelete)}, true
+		}
+	case "XACK":
+		return []access{group(1, PermCommit), stream(r.String(0), PermRead)}, true
+
+	case "ACL":
+		if strings.EqualFold(r.String(0), "WHOAMI") {
+			return nil, true
+		}
+		return []access{{PermAdmin, ResourceCluster, ""}}, true
+	case "MONITOR":
+		return []access{{PermAdmin, ResourceCluster, ""}}, true
+	}
+
+	return nil, false
+}
+
+// createACLHandler manages the ACL. A nil ACL means ACLs are not enabled.
+func createACLHandler(a *ACL) resp.HandleFunc {
+	return func(w resp.ResponseWriter, r *resp.Request) {
+		sub := strings.ToUpper(r.String(0))
+		if sub == "WHOAMI" {
+			w.WriteString(sessionPrincipal(r.Session))
+			return
+		}
+
+		if a == nil {
+			w.WriteErr(errorCode(ErrACLDisabled), fmt.Sprintf("%s : %s", r.Cmd, ErrACLDisabled))
+			return
+		}
+
+		var err error
+		switch sub {
+		case "LIST":
+			rules := a.Rules()
+			w.WriteInstruction('*', len(rules))
+			for _, rule := range rules {
+				w.WriteString(rule.String())
+			}
+			return
+		case "ADD", "DEL":
+			fields := make([]string, 0, len(r.Args)-1)
+			for i := 1; i < len(r.Args); i++ {
+				fields = append(fields, r.String(i))
+			}
+
+			var rule ACLRule
+			if rule, err = ParseACLRule(fields); err != nil {
+				break
+			}
+			if sub == "ADD" {
+				err = a.Add(rule)
+				break
+			}
+
+			var removed bool
+			if removed, err = a.Remove(rule); err == nil {
+				var n int64
+				if removed {
+					n = 1
+				}
+				w.WriteInt64(n)
+				return
+			}
+		case "RELOAD":
+			err = a.Reload()
+		default:
+			err = fmt.Errorf("%w: unknown subcommand %s", ErrACLMalformed, r.String(0))
+		}
+
+		if err != nil {
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
+		}
+
+		w.WriteStatus("OK")
+	}
+}
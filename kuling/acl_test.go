@@ -0,0 +1,230 @@
+package kuling
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+func TestInternalTopicGuard(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	createTestTopic(t, l, IterTopic, 1)
+
+	served := false
+	guarded := internalTopicGuard(l)(nil, func(w resp.ResponseWriter, r *resp.Request) { served = true })
+
+	for _, tc := range []struct {
+		topic   string
+		allowed bool
+	}{
+		{"emails", true},
+		{IterTopic, false},
+		{"__new", false},
+	} {
+		served = false
+		var b bytes.Buffer
+		w := resp.NewWriter(&b)
+		guarded(w, &resp.Request{Cmd: "GET", Args: []interface{}{[]byte(tc.topic), []byte(firstShard), int64(0), int64(1)}})
+		w.Flush()
+
+		if served != tc.allowed {
+			t.Errorf("GET %s served %t, want %t", tc.topic, served, tc.allowed)
+		}
+		if !tc.allowed && !strings.HasPrefix(b.String(), "-"+CodeInternalTopic) {
+			t.Errorf("GET %s replied %q", tc.topic, b.String())
+		}
+	}
+}
+
+func TestACLRuleMatches(t *testing.T) {
+	for _, tc := range []struct {
+		rule      string
+		principal string
+		perm      Permission
+		kind      string
+		name      string
+		allowed   bool
+	}{
+		{"alice read,write topic:emails.*", "alice", PermRead, ResourceTopic, "emails.eu", true},
+		{"alice read,write topic:emails.*", "alice", PermRead | PermWrite, ResourceTopic, "emails.eu", true},
+		{"alice read,write topic:emails.*", "alice", PermCreate, ResourceTopic, "emails.eu", false},
+		{"alice read,write topic:emails.*", "bob", PermRead, ResourceTopic, "emails.eu", false},
+		{"alice read,write topic:emails.*", "alice", PermRead, ResourceTopic, "orders", false},
+		{"alice read,write topic:emails.*", "alice", PermRead, ResourceGroup, "emails.eu", false},
+		{"* read group:*", "bob", PermRead, ResourceGroup, "billing", true},
+		{"admin admin cluster", "admin", PermAdmin, ResourceCluster, "", true},
+	} {
+		rule, err := ParseACLRule(strings.Fields(tc.rule))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.rule, err)
+		}
+		if got := rule.matches(tc.principal, tc.perm, tc.kind, tc.name); got != tc.allowed {
+			t.Errorf("%s: %s %s on %s %s allowed %t, want %t", tc.rule, tc.principal, tc.perm, tc.kind, tc.name, got, tc.allowed)
+		}
+		if rule.String() != tc.rule {
+			t.Errorf("rule %q written as %q", tc.rule, rule.String())
+		}
+	}
+
+	for _, rule := range []string{
+		"alice read",
+		"alice fly topic:emails",
+		"alice read topic:",
+		"alice read topic:[",
+		"alice admin cluster:x",
+		"alice read queue:emails",
+	} {
+		if _, err := ParseACLRule(strings.Fields(rule)); !errors.Is(err, ErrACLMalformed) {
+			t.Errorf("parsing %q gave %v", rule, err)
+		}
+	}
+}
+
+func TestACLAddRemovePersist(t *testing.T) {
+	file := path.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(file, []byte("# rules\nadmin admin cluster\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule, _ := ParseACLRule([]string{"alice", "read", "topic:emails"})
+	if err := a.Add(rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add(rule); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(a.Rules()); n != 2 {
+		t.Fatalf("%d rules after adding one twice, want 2", n)
+	}
+
+	// Rules added are written to the file
+	reloaded, err := NewACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.Allowed("alice", PermRead, ResourceTopic, "emails") {
+		t.Error("added rule not in the file")
+	}
+
+	if removed, err := a.Remove(rule); err != nil || !removed {
+		t.Fatalf("remove gave %t, %v", removed, err)
+	}
+	if removed, err := a.Remove(rule); err != nil || removed {
+		t.Fatalf("removing again gave %t, %v", removed, err)
+	}
+	if err := reloaded.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Allowed("alice", PermRead, ResourceTopic, "emails") {
+		t.Error("removed rule still in the file")
+	}
+
+	// A broken file keeps the rules
+	if err := os.WriteFile(file, []byte("alice fly topic:emails\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err == nil {
+		t.Fatal("reloaded a malformed file")
+	}
+	if !a.Allowed("admin", PermAdmin, ResourceCluster, "") {
+		t.Error("rules lost on a failed reload")
+	}
+}
+
+func TestACLEnforced(t *testing.T) {
+	var users []string
+	for _, user := range []string{"alice", "admin"} {
+		hash, err := HashPassword("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, fmt.Sprintf("user %s %s", user, hash))
+	}
+	auth, err := NewAuthenticator(writeUserFile(t, users...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(file, []byte("alice read topic:emails\nadmin admin cluster\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := NewACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1, "a")
+	createTestTopic(t, l, "orders", 1, "b")
+	addr := startTestServer(t, ServerConfig{Authenticator: auth, ACL: acl}, l, newTestBroker(t, l))
+
+	dial := func(user string) *Client {
+		c, err := DialConfig(ClientConfig{Address: addr, Credentials: Credentials{User: user, Password: "secret"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	alice, admin := dial("alice"), dial("admin")
+	denied := &resp.Error{Code: CodePermissionDenied}
+
+	if msgs, err := alice.Get("emails", firstShard, 0, 10); err != nil || len(msgs) != 1 {
+		t.Errorf("GET emails gave %d messages, %v", len(msgs), err)
+	}
+	if _, err := alice.Get("orders", firstShard, 0, 10); !errors.Is(err, denied) {
+		t.Errorf("GET orders gave %v", err)
+	}
+	if _, err := alice.Put("emails", firstShard, []byte("k"), []byte("v")); !errors.Is(err, denied) {
+		t.Errorf("PUT emails gave %v", err)
+	}
+	if _, err := alice.call(context.Background(), "ACL", "LIST"); !errors.Is(err, denied) {
+		t.Errorf("ACL LIST gave %v", err)
+	}
+	if topics, err := alice.List(); err != nil || len(topics) != 1 || topics[0] != "emails" {
+		t.Errorf("LIST gave %v, %v", topics, err)
+	}
+	if topics, err := admin.List(); err != nil || len(topics) != 0 {
+		t.Errorf("LIST by the admin without read gave %v, %v", topics, err)
+	}
+
+	// Rules added by an admin apply to the next command
+	if _, err := admin.call(context.Background(), "ACL", "ADD", "alice", "write", "topic:emails"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Put("emails", firstShard, []byte("k"), []byte("v")); err != nil {
+		t.Errorf("PUT emails after the grant gave %v", err)
+	}
+}
+
+func TestCommandAccessesDenyUnlisted(t *testing.T) {
+	l := openTestStore(t, "")
+
+	for _, tc := range []struct {
+		cmd  string
+		args []interface{}
+		ok   bool
+	}{
+		{"PING", nil, true},
+		{"LIST", nil, true},
+		{"ACL", []interface{}{[]byte("WHOAMI")}, true},
+		{"FLUSHALL", nil, false},
+		{"XGROUP", []interface{}{[]byte("DESTROY"), []byte("emails"), []byte("g")}, false},
+	} {
+		if _, ok := commandAccesses(l, &resp.Request{Cmd: tc.cmd, Args: tc.args}); ok != tc.ok {
+			t.Errorf("%s %v listed %v", tc.cmd, tc.args, ok)
+		}
+	}
+}
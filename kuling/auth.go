@@ -0,0 +1,313 @@
+package kuling
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+var (
+	// ErrAuthRequired when a connection sends commands before authenticating
+	ErrAuthRequired = errors.New("auth: authentication required")
+
+	// ErrAuthFailed when the user, password or token is not valid
+	ErrAuthFailed = errors.New("auth: invalid username, password or token")
+
+	// ErrAuthDisabled when a client authenticates with a server that does
+	// not require authentication
+	ErrAuthDisabled = errors.New("auth: authentication is not enabled")
+)
+
+// Password hashing parameters, the iterations are stored with every hash so
+// they can be raised without invalidating the user file
+const (
+	passwordHashScheme     = "pbkdf2-sha256"
+	passwordHashIterations = 100000
+	passwordSaltBytes      = 16
+	passwordKeyBytes       = 32
+	tokenBytes             = 32
+)
+
+// principalSessionKey is the session key the authenticated principal is
+// stored under
+const principalSessionKey = "principal"
+
+// Credentials a client authenticates with, either a user and password or a
+// token. Empty credentials do not authenticate.
+type Credentials struct {
+	User     string
+	Password string
+	Token    string
+}
+
+// args are the AUTH command arguments for the credentials, nil when there
+// is nothing to authenticate with
+func (c Credentials) args() []interface{} {
+	switch {
+	case c.Token != "":
+		return []interface{}{"AUTH", c.Token}
+	case c.User != "":
+		return []interface{}{"AUTH", c.User, c.Password}
+	}
+
+	return nil
+}
+
+// Authenticator checks credentials against a user file. The file holds one
+// entry per line, blank lines and lines starting with # are ignored:
+//
+//	user <name> pbkdf2-sha256$<iterations>$<salt>$<key>
+//	token <name> <sha256 of the token in hex>
+//
+// Salt and key are base64 encoded. Entries are created with server passwd.
+// The name of the user or token is the principal the connection acts as.
+type Authenticator struct {
+	file string
+
+	users  map[string]string
+	tokens map[string]string
+	lock   sync.RWMutex
+}
+
+// NewAuthenticator loads the user file. Without a file only clients with a
+// verified TLS certificate are authenticated.
+func NewAuthenticator(file string) (*Authenticator, error) {
+	a := &Authenticator{file: file}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload the user file. On error the previously loaded users are kept.
+func (a *Authenticator) Reload() error {
+	users := make(map[string]string)
+	tokens := make(map[string]string)
+
+	if a.file != "" {
+		f, err := os.Open(a.file)
+		if err != nil {
+			return fmt.Errorf("auth: could not open user file: %s", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				return fmt.Errorf("auth: %s:%d: expected kind, name and hash", a.file, n)
+			}
+
+			switch fields[0] {
+			case "user":
+				if _, _, _, err := parsePasswordHash(fields[2]); err != nil {
+					return fmt.Errorf("auth: %s:%d: %s", a.file, n, err)
+				}
+				users[fields[1]] = fields[2]
+			case "token":
+				if _, err := hex.DecodeString(fields[2]); err != nil || len(fields[2]) != sha256.Size*2 {
+					return fmt.Errorf("auth: %s:%d: malformed token hash", a.file, n)
+				}
+				tokens[strings.ToLower(fields[2])] = fields[1]
+			default:
+				return fmt.Errorf("auth: %s:%d: unknown entry %q", a.file, n, fields[0])
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("auth: could not read user file: %s", err)
+		}
+	}
+
+	a.lock.Lock()
+	a.users, a.tokens = users, tokens
+	a.lock.Unlock()
+
+	return nil
+}
+
+// Authenticate the user with the password and return the principal
+func (a *Authenticator) Authenticate(user, password string) (string, error) {
+	a.lock.RLock()
+	encoded, ok := a.users[user]
+	a.lock.RUnlock()
+
+	if !ok {
+		// Hash anyway so unknown users take as long as wrong passwords
+		HashPassword(password)
+		return "", ErrAuthFailed
+	}
+
+	iterations, salt, key, err := parsePasswordHash(encoded)
+	if err != nil {
+		return "", ErrAuthFailed
+	}
+
+	derived, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	if err != nil || subtle.ConstantTimeCompare(derived, key) != 1 {
+		return "", ErrAuthFailed
+	}
+
+	return user, nil
+}
+
+// AuthenticateToken returns the principal the token was issued to
+func (a *Authenticator) AuthenticateToken(token string) (string, error) {
+	sum := sha256.Sum256([]byte(token))
+
+	a.lock.RLock()
+	principal, ok := a.tokens[hex.EncodeToString(sum[:])]
+	a.lock.RUnlock()
+
+	if !ok {
+		return "", ErrAuthFailed
+	}
+
+	return principal, nil
+}
+
+// HashPassword hashes the password with a random salt for the user file
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("auth: could not create salt: %s", err)
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, passwordKeyBytes)
+	if err != nil {
+		return "", fmt.Errorf("auth: could not hash password: %s", err)
+	}
+
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// NewToken creates a random token and the hash of it for the user file
+func NewToken() (token, hash string, err error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("auth: could not create token: %s", err)
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+
+	return token, hex.EncodeToString(sum[:]), nil
+}
+
+// parsePasswordHash splits an encoded password hash into its parts
+func parsePasswordHash(encoded string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return 0, nil, nil, fmt.Errorf("expected %s password hash", passwordHashScheme)
+	}
+
+	if iterations, err = strconv.Atoi(parts[1]); err != nil || iterations < 1 {
+		return 0, nil, nil, fmt.Errorf("malformed iterations %q", parts[1])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, fmt.Errorf("malformed salt")
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("malformed key")
+	}
+
+	return iterations, salt, key, nil
+}
+
+// certPrincipal is the common name of the verified client certificate, empty
+// when the client did not present one
+func certPrincipal(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// sessionPrincipal is who the client of the session authenticated as, empty
+// if it has not
+func sessionPrincipal(s *resp.Session) string {
+	p, _ := s.Get(principalSessionKey).(string)
+	return p
+}
+
+// requireAuth rejects commands from connections that have not authenticated.
+// Clients with a verified TLS certificate are authenticated as the common
+// name of the certificate.
+type requireAuth struct {
+	next resp.Handler
+}
+
+// preAuthCommands may be sent before authenticating
+var preAuthCommands = []string{"AUTH", "HELLO"}
+
+func (h requireAuth) Serve(w resp.ResponseWriter, r *resp.Request) {
+	if sessionPrincipal(r.Session) == "" {
+		if p := certPrincipal(r.Session.TLS); p != "" {
+			r.Session.Set(principalSessionKey, p)
+		}
+	}
+
+	if sessionPrincipal(r.Session) == "" {
+		allowed := false
+		for _, c := range preAuthCommands {
+			if strings.EqualFold(r.Cmd, c) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			w.WriteErr(CodeAuthRequired, fmt.Sprintf("%s : %s", r.Cmd, ErrAuthRequired))
+			return
+		}
+	}
+
+	h.next.Serve(w, r)
+}
+
+// createAuthHandler authenticates the connection with a user and password or
+// a token. A nil authenticator means authentication is not enabled.
+func createAuthHandler(a *Authenticator) resp.HandleFunc {
+	return func(w resp.ResponseWriter, r *resp.Request) {
+		if a == nil {
+			w.WriteErr(errorCode(ErrAuthDisabled), fmt.Sprintf("%s : %s", r.Cmd, ErrAuthDisabled))
+			return
+		}
+
+		var principal string
+		var err error
+		if len(r.Args) == 1 {
+			principal, err = a.AuthenticateToken(r.String(0))
+		} else {
+			principal, err = a.Authenticate(r.String(0), r.String(1))
+		}
+		if err != nil {
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
+		}
+
+		r.Session.Set(principalSessionKey, principal)
+		w.WriteStatus("OK")
+	}
+}
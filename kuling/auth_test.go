@@ -0,0 +1,138 @@
+package kuling
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+// writeUserFile writes the entries to a user file and returns its path
+func writeUserFile(t *testing.T, entries ...string) string {
+	t.Helper()
+
+	file := path.Join(t.TempDir(), "users")
+	var content string
+	for _, e := range entries {
+		content += e + "\n"
+	}
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestAuthenticateKnownHash(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 of password and salt with one iteration, so user
+	// files written before stay valid
+	a, err := NewAuthenticator(writeUserFile(t,
+		"# known answer",
+		"user alice pbkdf2-sha256$1$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if principal, err := a.Authenticate("alice", "password"); err != nil || principal != "alice" {
+		t.Fatalf("authenticated as %q, %v", principal, err)
+	}
+	if _, err := a.Authenticate("alice", "wrong"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("wrong password gave %v", err)
+	}
+	if _, err := a.Authenticate("bob", "password"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("unknown user gave %v", err)
+	}
+}
+
+func TestAuthenticatorRejectsMalformedFile(t *testing.T) {
+	for _, entry := range []string{
+		"user alice pbkdf2-sha256$1$c2FsdA",
+		"user alice md5$1$c2FsdA$Eg",
+		"token ci abc",
+		"group admins alice",
+	} {
+		if _, err := NewAuthenticator(writeUserFile(t, entry)); err == nil {
+			t.Errorf("loaded %q", entry)
+		}
+	}
+}
+
+func TestAuthCommand(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, tokenHash, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthenticator(writeUserFile(t,
+		fmt.Sprintf("user alice %s", hash),
+		fmt.Sprintf("token ci %s", tokenHash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	addr := startTestServer(t, ServerConfig{Authenticator: a}, l, newTestBroker(t, l))
+
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.List(); !errors.Is(err, &resp.Error{Code: CodeAuthRequired}) {
+		t.Fatalf("LIST before AUTH gave %v", err)
+	}
+
+	if _, err := DialConfig(ClientConfig{Address: addr, Credentials: Credentials{User: "alice", Password: "nope"}}); err == nil {
+		t.Error("authenticated with a wrong password")
+	}
+
+	for _, creds := range []Credentials{{User: "alice", Password: "secret"}, {Token: token}} {
+		c, err := DialConfig(ClientConfig{Address: addr, Credentials: creds})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if topics, err := c.List(); err != nil || len(topics) != 1 {
+			t.Errorf("LIST after AUTH gave %v, %v", topics, err)
+		}
+		c.Close()
+	}
+}
+
+func TestAuthWithClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server", "server", 2)
+	clientCert, clientKey := ca.issue(t, "client", "ingest", 3)
+
+	st, err := NewServerTLS(serverCert, serverKey, ca.file("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthenticator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := openTestStore(t, "")
+	addr := startTestServer(t, ServerConfig{TLSConfig: st.Config(), Authenticator: a}, l, newTestBroker(t, l))
+
+	config, err := NewClientTLSConfig(ca.file("ca.pem"), clientCert, clientKey, "localhost", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := DialConfig(ClientConfig{Address: addr, TLSConfig: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The certificate authenticates the connection without AUTH
+	if _, err := c.List(); err != nil {
+		t.Fatalf("LIST with a client certificate gave %v", err)
+	}
+}
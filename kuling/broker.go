@@ -1,44 +1,137 @@
 package kuling
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"sort"
 	"sync"
+	"time"
 
 	"stathat.com/c/consistent"
 )
 
+var (
+	// ErrGroupActive returned when an operation requires the group to have
+	// no live members
+	ErrGroupActive = errors.New("broker: group is active")
+	// ErrUnknownGroup returned when the group has neither members nor
+	// committed iterators for the topic
+	ErrUnknownGroup = errors.New("broker: unknown group")
+	// ErrIterNotInFlight returned when committing an iterator that the
+	// broker has not handed out
+	ErrIterNotInFlight = errors.New("broker: iterator not in flight")
+	// ErrNotMember returned when the client is not a member of the group
+	ErrNotMember = errors.New("broker: client is not a member of group")
+	// ErrGroupExists returned when creating a group that already has members
+	// or committed iterators
+	ErrGroupExists = errors.New("broker: group already exists")
+	// ErrNotOwner returned when committing an iterator of a shard that has
+	// been handed over to another member of the group
+	ErrNotOwner = errors.New("broker: client does not own the shard")
+)
+
+// Offset reset modes that moves a group's committed iterators
+const (
+	// ResetEarliest moves the group to the first message of every shard
+	ResetEarliest = "earliest"
+	// ResetLatest moves the group to the head of every shard
+	ResetLatest = "latest"
+	// ResetSequenceID moves the group to a sequence ID in every shard
+	ResetSequenceID = "sequence"
+	// ResetTimestamp moves the group to the first message appended at or
+	// after a point in time in every shard
+	ResetTimestamp = "timestamp"
+)
+
+// OffsetReset describes where a group's committed iterators are moved to.
+// SequenceID is used by ResetSequenceID and Timestamp by ResetTimestamp.
+type OffsetReset struct {
+	Mode       string
+	SequenceID int64
+	Timestamp  time.Time
+}
+
+// GroupDescription is a snapshot of a group's members and its position in
+// every shard of a topic
+type GroupDescription struct {
+	Group   string
+	Topic   string
+	Active  bool
+	Members []string
+	Shards  []GroupShard
+}
+
+// GroupShard is a group's position in one shard. Committed is the sequence ID
+// the group will continue reading from and Lag the number of messages between
+// that position and the head of the shard.
+type GroupShard struct {
+	Shard     string
+	Owner     string
+	Committed int64
+	Head      int64
+	Lag       int64
+}
+
 // Broker b
 type Broker struct {
 	// group name to consistent hash group
 	groups map[string]*consistent.Consistent
+	// group name to client to the last time the client asked for iterators
+	members   map[string]map[string]time.Time
+	grouplock sync.Mutex
 	// inflight iterators. Iterator ID to iterator
 	inflight     map[string]string
 	inflightlock sync.RWMutex
 
 	sharder   Sharder
 	iterStore IterStore
+	// key iterators are signed with
+	iterKey []byte
+
+	// Logger for group membership changes, slog.Default() when nil
+	Logger *slog.Logger
 }
 
-// NewBroker creates a new broker
-func NewBroker(sharder Sharder, iterStore IterStore) *Broker {
+// NewBroker creates a new broker that signs the iterators it hands out with
+// the iter key
+func NewBroker(sharder Sharder, iterStore IterStore, iterKey []byte) *Broker {
 	if sharder == nil {
 		panic("broker: cannot use nil sharder")
 	}
 	if iterStore == nil {
 		panic("broker: cannot use nil iterstore")
 	}
+	if len(iterKey) == 0 {
+		panic("broker: cannot use empty iter key")
+	}
 
 	return &Broker{
 		make(map[string]*consistent.Consistent),
+		make(map[string]map[string]time.Time),
+		sync.Mutex{},
 		make(map[string]string),
 		sync.RWMutex{},
 		sharder,
 		iterStore,
+		iterKey,
+		nil,
 	}
 }
 
-// Iters returns a set of iterators for the client.
-func (b *Broker) Iters(group, client, topic string) ([]string, error) {
+func (b *Broker) logger() *slog.Logger {
+	if b.Logger == nil {
+		return slog.Default()
+	}
+	return b.Logger
+}
+
+// join adds the client to the group, or refreshes it if it already is a
+// member, and returns the group's consistent hash
+func (b *Broker) join(group, client string) *consistent.Consistent {
+	b.grouplock.Lock()
+	defer b.grouplock.Unlock()
+
 	var grp *consistent.Consistent
 	var ok bool
 
@@ -46,16 +139,76 @@ func (b *Broker) Iters(group, client, topic string) ([]string, error) {
 		grp = consistent.New()
 		grp.Add(client)
 		b.groups[group] = grp
+		b.logger().Info("broker: client joined group", "group", group, "client", client)
 	} else if !b.groupHasClient(grp, client) {
 		grp.Add(client)
+		b.logger().Info("broker: client joined group", "group", group, "client", client)
+	}
+
+	if _, ok := b.members[group]; !ok {
+		b.members[group] = make(map[string]time.Time)
+	}
+	b.members[group][client] = time.Now()
+
+	// Members that have not asked for iterators within the session timeout
+	// are considered dead, removing them hands their shards over to the
+	// live members
+	for member, seen := range b.members[group] {
+		if time.Since(seen) >= DefaultGroupSessionTimeout {
+			grp.Remove(member)
+			delete(b.members[group], member)
+			b.logger().Info("broker: group session expired", "group", group, "client", member)
+		}
+	}
+
+	return grp
+}
+
+// Leave removes the client from the group so that its shards are handed
+// over to the other members on their next request for iterators
+func (b *Broker) Leave(group, client string) error {
+	b.grouplock.Lock()
+	defer b.grouplock.Unlock()
+
+	grp, ok := b.groups[group]
+	if !ok || !b.groupHasClient(grp, client) {
+		return fmt.Errorf("%w %s: %s", ErrNotMember, group, client)
+	}
+
+	grp.Remove(client)
+	delete(b.members[group], client)
+	b.logger().Info("broker: client left group", "group", group, "client", client)
+
+	return nil
+}
+
+// liveMembers returns the sorted clients of the group that have asked for
+// iterators within the group session timeout
+func (b *Broker) liveMembers(group string) []string {
+	b.grouplock.Lock()
+	defer b.grouplock.Unlock()
+
+	var live []string
+	for client, seen := range b.members[group] {
+		if time.Since(seen) < DefaultGroupSessionTimeout {
+			live = append(live, client)
+		}
 	}
+	sort.Strings(live)
+
+	return live
+}
+
+// Iters returns a set of iterators for the client.
+func (b *Broker) Iters(group, client, topic string) ([]string, error) {
+	grp := b.join(group, client)
 
 	// For all shards in the topic find the shards that this client should
 	// iterate over
 	var shards map[string]*Shard
 	var err error
 	if shards, err = b.sharder.Shards(topic); err != nil {
-		return nil, fmt.Errorf("broker: sharder did not return shards: %s", err)
+		return nil, fmt.Errorf("broker: sharder did not return shards: %w", err)
 	}
 
 	// Get all persisted iterators for the grup and topic
@@ -70,12 +223,9 @@ func (b *Broker) Iters(group, client, topic string) ([]string, error) {
 
 			iterID := createIterID(group, topic, shard)
 
-			var iter string
-			if offset, ok := groupIters[iterID]; ok {
-				iter = createIterFromIDAndOffset(iterID, offset)
-			} else {
-				iter = createIterFromIDAndOffset(iterID, 0)
-			}
+			// Continue from the committed offset, or from the start of the
+			// shard if the group has never committed
+			iter := IterEncode(Iter{group, topic, shard, groupIters[iterID], client}, b.iterKey)
 
 			clientIters = append(clientIters, iter)
 			b.inflightlock.Lock()
@@ -101,15 +251,252 @@ func (b *Broker) groupHasClient(g *consistent.Consistent, client string) bool {
 	return false
 }
 
-// Commit c
-func (b *Broker) Commit(iterID string, offset int64) (string, error) {
-	if _, ok := b.inflight[iterID]; ok {
-		if err := b.iterStore.Commit(iterID, offset); err != nil {
-			return "", fmt.Errorf("broker: commit to iter store failed: %s", err)
+// Commit the offset for an iterator handed out by the broker. The iterator
+// must be signed by the broker, in flight and handed out to the member that
+// still owns the shard.
+func (b *Broker) Commit(iter string, offset int64) (string, error) {
+	it, err := IterVerify(iter, b.iterKey)
+	if err != nil {
+		return "", fmt.Errorf("broker: %w", err)
+	}
+
+	iterID := it.ID()
+
+	b.inflightlock.RLock()
+	_, ok := b.inflight[iterID]
+	b.inflightlock.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("%w: group %s topic %s shard %s", ErrIterNotInFlight, it.group, it.topic, it.shard)
+	}
+
+	// A member that has not yet noticed that the shard was handed over
+	// must not move the new owner's position
+	if owner := b.shardOwner(it.group, it.shard); owner != it.owner {
+		return "", fmt.Errorf("%w: group %s topic %s shard %s owned by %q not %q", ErrNotOwner, it.group, it.topic, it.shard, owner, it.owner)
+	}
+
+	if err := b.iterStore.Commit(iterID, offset); err != nil {
+		return "", fmt.Errorf("broker: commit to iter store failed: %s", err)
+	}
+	metricGroupCommits.With(it.group, it.topic).Inc()
+
+	return IterEncode(Iter{it.group, it.topic, it.shard, offset, it.owner}, b.iterKey), nil
+}
+
+// shardOwner is the member of the group the shard is assigned to, empty if
+// the group has no members
+func (b *Broker) shardOwner(group, shard string) string {
+	b.grouplock.Lock()
+	defer b.grouplock.Unlock()
+
+	grp, ok := b.groups[group]
+	if !ok {
+		return ""
+	}
+	owner, _ := grp.Get(shard)
+
+	return owner
+}
+
+// CommitOffset commits the sequence ID of the group in the shard without an
+// iterator, for clients that keep track of their own position such as Kafka
+// consumers. Like ResetGroup the group must not have any live members.
+func (b *Broker) CommitOffset(group, topic, shard string, offset int64) error {
+	if len(b.liveMembers(group)) > 0 {
+		return ErrGroupActive
+	}
+
+	if err := b.iterStore.Commit(createIterID(group, topic, shard), offset); err != nil {
+		return fmt.Errorf("broker: commit to iter store failed: %s", err)
+	}
+	metricGroupCommits.With(group, topic).Inc()
+
+	return nil
+}
+
+// CommittedOffsets returns the committed sequence ID of the group per shard
+// of the topic. Shards the group has never committed in are left out.
+func (b *Broker) CommittedOffsets(group, topic string) (map[string]int64, error) {
+	shards, err := b.sharder.Shards(topic)
+	if err != nil {
+		return nil, fmt.Errorf("broker: sharder did not return shards: %w", err)
+	}
+
+	committed, err := b.iterStore.GetAll(group, topic)
+	if err != nil {
+		return nil, fmt.Errorf("broker: issue fetching group iters: %s", err)
+	}
+
+	offsets := make(map[string]int64)
+	for name := range shards {
+		if offset, ok := committed[createIterID(group, topic, name)]; ok {
+			offsets[name] = offset
+		}
+	}
+
+	return offsets, nil
+}
+
+// DescribeGroup returns the members of the group and, for every shard in
+// the topic, the shard owner, the committed sequence ID and the lag against
+// the head of the shard.
+func (b *Broker) DescribeGroup(group, topic string) (*GroupDescription, error) {
+	shards, err := b.sharder.Shards(topic)
+	if err != nil {
+		return nil, fmt.Errorf("broker: sharder did not return shards: %w", err)
+	}
+
+	committed, err := b.iterStore.GetAll(group, topic)
+	if err != nil {
+		return nil, fmt.Errorf("broker: issue fetching group iters: %s", err)
+	}
+
+	members := b.liveMembers(group)
+	if len(members) == 0 && len(committed) == 0 {
+		return nil, ErrUnknownGroup
+	}
+
+	b.grouplock.Lock()
+	grp := b.groups[group]
+	b.grouplock.Unlock()
+
+	d := &GroupDescription{
+		Group:   group,
+		Topic:   topic,
+		Active:  len(members) > 0,
+		Members: members,
+	}
+
+	for _, name := range sortedShardNames(shards) {
+		gs := GroupShard{
+			Shard:     name,
+			Committed: committed[createIterID(group, topic, name)],
+			Head:      shards[name].Head(),
+		}
+		if grp != nil && d.Active {
+			gs.Owner, _ = grp.Get(name)
+		}
+		if gs.Lag = gs.Head - gs.Committed; gs.Lag < 0 {
+			gs.Lag = 0
+		}
+
+		d.Shards = append(d.Shards, gs)
+	}
+
+	return d, nil
+}
+
+// ResetGroup moves the committed iterators of the group in every shard of
+// the topic. The group must not have any live members as they would
+// overwrite the reset with their next commit. Returns the new committed
+// sequence ID per shard.
+func (b *Broker) ResetGroup(group, topic string, reset OffsetReset) (map[string]int64, error) {
+	if len(b.liveMembers(group)) > 0 {
+		return nil, ErrGroupActive
+	}
+
+	shards, err := b.sharder.Shards(topic)
+	if err != nil {
+		return nil, fmt.Errorf("broker: sharder did not return shards: %w", err)
+	}
+
+	// Resolve all offsets before committing any of them so that an invalid
+	// reset does not leave the group half moved
+	offsets, err := resolveOffsets(shards, reset)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, offset := range offsets {
+		if err := b.iterStore.Commit(createIterID(group, topic, name), offset); err != nil {
+			return nil, fmt.Errorf("broker: commit to iter store failed: %s", err)
+		}
+	}
+	b.logger().Info("broker: reset group", "group", group, "topic", topic)
+
+	return offsets, nil
+}
+
+// CreateGroup creates the group in the topic with its committed iterators at
+// the reset position in every shard. Groups are otherwise created when the
+// first member asks for iterators, starting at the beginning of every shard.
+func (b *Broker) CreateGroup(group, topic string, reset OffsetReset) (map[string]int64, error) {
+	committed, err := b.iterStore.GetAll(group, topic)
+	if err != nil {
+		return nil, fmt.Errorf("broker: issue fetching group iters: %s", err)
+	}
+	if len(committed) > 0 || len(b.liveMembers(group)) > 0 {
+		return nil, ErrGroupExists
+	}
+
+	return b.ResetGroup(group, topic, reset)
+}
+
+// resolveOffsets finds the sequence ID the reset moves to in every shard
+func resolveOffsets(shards map[string]*Shard, reset OffsetReset) (map[string]int64, error) {
+	var err error
+	offsets := make(map[string]int64, len(shards))
+	for name, shard := range shards {
+		var offset int64
+		switch reset.Mode {
+		case ResetEarliest:
+			offset = 0
+		case ResetLatest:
+			offset = shard.Head()
+		case ResetSequenceID:
+			if reset.SequenceID < 0 {
+				return nil, ErrShardIllegalStartSequenceID
+			}
+			// Shards are not evenly filled, a sequence ID beyond the head
+			// of a shard moves the group to the head of that shard
+			if offset = reset.SequenceID; offset > shard.Head() {
+				offset = shard.Head()
+			}
+		case ResetTimestamp:
+			if offset, err = shard.SequenceIDForTime(reset.Timestamp); err != nil {
+				return nil, fmt.Errorf("broker: could not find sequence ID for time in shard %s: %w", name, err)
+			}
+		default:
+			return nil, fmt.Errorf("broker: unknown reset mode %q", reset.Mode)
+		}
+
+		offsets[name] = offset
+	}
+
+	return offsets, nil
+}
+
+// sortedShardNames returns the shard names in a stable order
+func sortedShardNames(shards map[string]*Shard) []string {
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// groupTopics are the group and topic pairs the broker has handed out
+// iterators for, sorted
+func (b *Broker) groupTopics() [][2]string {
+	b.inflightlock.RLock()
+	seen := make(map[[2]string]bool)
+	for _, iter := range b.inflight {
+		if it, err := IterDecode(iter); err == nil {
+			seen[[2]string{it.group, it.topic}] = true
 		}
+	}
+	b.inflightlock.RUnlock()
 
-		return iterID, nil
+	pairs := make([][2]string, 0, len(seen))
+	for gt := range seen {
+		pairs = append(pairs, gt)
 	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i][0] < pairs[j][0] || pairs[i][0] == pairs[j][0] && pairs[i][1] < pairs[j][1]
+	})
 
-	return "", fmt.Errorf("broker: commiting iterator that is not in flight %v", iterID)
+	return pairs
 }
@@ -0,0 +1,144 @@
+package kuling
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestBroker(t *testing.T, l *LogStore) *Broker {
+	t.Helper()
+
+	b := NewBroker(l, newMemIterStore(), make([]byte, iterKeyLen))
+	return b
+}
+
+func TestDescribeGroupLag(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1, "a", "b", "c")
+	b := newTestBroker(t, l)
+
+	if _, err := b.DescribeGroup("g", "emails"); !errors.Is(err, ErrUnknownGroup) {
+		t.Fatalf("describe before joining gave %v", err)
+	}
+
+	iters, err := b.Iters("g", "c1", "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iters) != 1 {
+		t.Fatalf("%d iterators, want 1", len(iters))
+	}
+	if _, err := b.Commit(iters[0], 1); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := b.DescribeGroup("g", "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Active || len(d.Members) != 1 || d.Members[0] != "c1" {
+		t.Errorf("members %v active %t", d.Members, d.Active)
+	}
+	s := d.Shards[0]
+	if s.Owner != "c1" || s.Committed != 1 || s.Head != 3 || s.Lag != 2 {
+		t.Errorf("shard %+v", s)
+	}
+}
+
+func TestResetGroup(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1, "a", "b")
+	middle := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	if _, err := l.Append("emails", firstShard, []byte("key"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBroker(t, l)
+
+	tests := []struct {
+		reset OffsetReset
+		want  int64
+	}{
+		{OffsetReset{Mode: ResetLatest}, 3},
+		{OffsetReset{Mode: ResetEarliest}, 0},
+		{OffsetReset{Mode: ResetSequenceID, SequenceID: 1}, 1},
+		{OffsetReset{Mode: ResetSequenceID, SequenceID: 100}, 3},
+		{OffsetReset{Mode: ResetTimestamp, Timestamp: middle}, 2},
+	}
+	for _, tt := range tests {
+		offsets, err := b.ResetGroup("g", "emails", tt.reset)
+		if err != nil {
+			t.Fatalf("%+v: %s", tt.reset, err)
+		}
+		if offsets[firstShard] != tt.want {
+			t.Errorf("%+v: offset %d, want %d", tt.reset, offsets[firstShard], tt.want)
+		}
+	}
+
+	if _, err := b.ResetGroup("g", "emails", OffsetReset{Mode: "bogus"}); err == nil {
+		t.Error("reset with unknown mode")
+	}
+
+	// Members would overwrite the reset with their next commit
+	if _, err := b.Iters("g", "c1", "emails"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ResetGroup("g", "emails", OffsetReset{Mode: ResetEarliest}); !errors.Is(err, ErrGroupActive) {
+		t.Errorf("reset of active group gave %v", err)
+	}
+}
+
+func TestCommitRejectsFormerOwner(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 10)
+	b := newTestBroker(t, l)
+
+	before, err := b.Iters("g", "c1", "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 10 {
+		t.Fatalf("%d iterators, want all 10", len(before))
+	}
+
+	// Members joining take over some of c1's shards
+	moved := make(map[string]bool)
+	for _, client := range []string{"c2", "c3", "c4"} {
+		after, err := b.Iters("g", client, "emails")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, iter := range after {
+			it, _ := IterDecode(iter)
+			moved[it.Shard()] = true
+			if it.Owner() != client {
+				t.Errorf("iterator of %s owned by %q", client, it.Owner())
+			}
+		}
+	}
+	if len(moved) == 0 || len(moved) == len(before) {
+		t.Fatalf("%d of %d shards handed over", len(moved), len(before))
+	}
+
+	for _, iter := range before {
+		it, _ := IterDecode(iter)
+		next, err := b.Commit(iter, 1)
+		if moved[it.Shard()] {
+			if !errors.Is(err, ErrNotOwner) {
+				t.Errorf("commit of handed over shard %s gave %v", it.Shard(), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("commit of owned shard %s gave %v", it.Shard(), err)
+		}
+		if it, _ := IterDecode(next); it.Owner() != "c1" || it.Offset() != 1 {
+			t.Errorf("commit returned iterator %+v", it)
+		}
+	}
+
+	if code := errorCode(ErrNotOwner); code != CodeNotOwner {
+		t.Errorf("sent with code %s", code)
+	}
+}
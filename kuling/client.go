@@ -2,89 +2,384 @@ package kuling
 
 import (
 	"bytes"
-	"io"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
-	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/fredrikbackstrom/kuling/kuling/resp"
 )
 
+// A deadline in the past that makes blocked reads and writes on a connection
+// return immediately
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ErrUnexpectedReply returned when the server replies with another type of
+// value than the command replies with
+var ErrUnexpectedReply = errors.New("client: unexpected reply")
+
+// ClientConfig configures a client connection. Address is required.
+type ClientConfig struct {
+	// Address of the kuling server
+	Address string
+	// TLSConfig connects with TLS when set
+	TLSConfig *tls.Config
+	// ClientID identifies the client to the server in the handshake
+	ClientID string
+	// Credentials to authenticate with after the handshake, if any
+	Credentials Credentials
+	// Trace logs every command and its reply with long strings cut, for
+	// debugging
+	Trace bool
+}
+
 // Client client that can access and command a remote log store
 type Client struct {
-	conn net.Conn
+	conn   net.Conn
+	config ClientConfig
+	// what the client and server negotiated, nil for servers without HELLO
+	hello *Hello
+	// how long the server delayed the last reply for going over the quota
+	throttled time.Duration
 	*resp.Writer
 	*resp.Reader
 }
 
 // Dial connects to kuling server and returns the client connection
 func Dial(address string) (*Client, error) {
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
+	return DialConfig(ClientConfig{Address: address})
+}
+
+// DialConfig connects to the kuling server with the config and returns the
+// client connection
+func DialConfig(config ClientConfig) (*Client, error) {
+	return DialConfigContext(context.Background(), config)
+}
+
+// DialConfigContext connects to the kuling server with the config within the
+// context, which bounds connecting, the handshake and authenticating
+func DialConfigContext(ctx context.Context, config ClientConfig) (*Client, error) {
+	c := &Client{config: config}
+	if err := c.dial(ctx); err != nil {
 		return nil, err
 	}
 
-	// TODO remove multiwriter, just for debug!
-	mw := io.MultiWriter(conn, os.Stdout)
+	return c, nil
+}
 
-	return &Client{
-			conn,
-			resp.NewWriter(mw),
-			resp.NewReader(conn),
-		},
-		nil
+// dial opens the connection to the server, sets up the protocol reader and
+// writer on it and negotiates what the client and server have in common
+func (c *Client) dial(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	if c.config.TLSConfig != nil {
+		conn, err = (&tls.Dialer{Config: c.config.TLSConfig}).DialContext(ctx, "tcp", c.config.Address)
+	} else {
+		conn, err = new(net.Dialer).DialContext(ctx, "tcp", c.config.Address)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.Writer = resp.NewWriter(conn)
+	c.Reader = resp.NewReader(conn)
+
+	stop := interruptOnDone(ctx, conn)
+	err = c.handshake()
+	if err == nil {
+		err = c.auth()
+	}
+	stop()
+
+	if err != nil {
+		conn.Close()
+		c.conn = nil
+		return contextError(ctx, err)
+	}
+
+	return nil
+}
+
+// interruptOnDone applies the deadline of the context to the connection and
+// interrupts blocked writes and reads when the context is done. The returned
+// function stops watching the context and clears the deadline.
+func interruptOnDone(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// handshake sends HELLO to the server. Servers from before HELLO answer
+// with an unknown command error, the client then assumes the first version
+// of the protocol.
+func (c *Client) handshake() error {
+	reply, err := c.callConn(helloArgs(c.config.ClientID)...)
+	if errors.Is(err, &resp.Error{Code: resp.CodeUnknownCmd}) {
+		c.hello = nil
+		return nil
+	}
+	if re, ok := err.(*resp.Error); ok {
+		return newRemoteError(re)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.hello, err = parseHello(reply)
+	return err
+}
+
+// auth authenticates the connection with the credentials of the config
+func (c *Client) auth() error {
+	args := c.config.Credentials.args()
+	if args == nil {
+		return nil
+	}
+
+	_, err := c.callConn(args...)
+	if re, ok := err.(*resp.Error); ok {
+		return newRemoteError(re)
+	}
+
+	return err
+}
+
+// Hello returns what the client and the server negotiated when connecting,
+// nil if the server does not support HELLO
+func (c *Client) Hello() *Hello {
+	return c.hello
+}
+
+// persistentClient keeps one connection to the server for many requests.
+// The connection is dialed on first use and dialed again on the next
+// request after a connection error. Requests are serialized.
+type persistentClient struct {
+	config ClientConfig
+	cl     *Client
+	lock   sync.Mutex
+}
+
+// do runs the request on the connection, dialing it if needed
+func (pc *persistentClient) do(request func(cl *Client) error) error {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	// A reused connection may have been closed by the server for being idle,
+	// the request is then retried once on a new connection
+	reused := pc.cl != nil
+
+	for {
+		if pc.cl == nil {
+			cl, err := DialConfig(pc.config)
+			if err != nil {
+				return err
+			}
+			pc.cl = cl
+		}
+
+		err := request(pc.cl)
+		if err == nil || !isRetriable(err) {
+			return err
+		}
+
+		// The connection is broken, or in an unknown state, throw it away
+		pc.cl.Close()
+		pc.cl = nil
+
+		if !reused {
+			return err
+		}
+		reused = false
+	}
+}
+
+// Close the connection if it is open
+func (pc *persistentClient) Close() error {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if pc.cl == nil {
+		return nil
+	}
+
+	err := pc.cl.Close()
+	pc.cl = nil
+	return err
 }
 
 // Close connection to the server
 func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+
 	return c.conn.Close()
 }
 
+// call writes the command with its arguments and reads the reply. The
+// deadline of the context is applied to the connection and cancelling the
+// context interrupts a blocked write or read. A call that fails for any
+// other reason than an error reply, interrupted or not, leaves the
+// connection in an unknown state. The connection is then closed and the
+// next call dials a new one within its own context.
+func (c *Client) call(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if c.conn == nil {
+		if err := c.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	stop := interruptOnDone(ctx, c.conn)
+	reply, err := c.callConn(args...)
+	stop()
+
+	if reply, ok := err.(*resp.Error); ok {
+		// An error reply, the connection is fine
+		return nil, newRemoteError(reply)
+	}
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return nil, contextError(ctx, err)
+	}
+
+	return reply, nil
+}
+
+// contextError returns the error of the context when the context ended the
+// call. The deadline of the connection can expire a moment before the
+// context does, a timeout past the context's deadline is its doing.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	var netErr net.Error
+	if deadline, ok := ctx.Deadline(); ok && errors.As(err, &netErr) && netErr.Timeout() && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+// callConn writes the command and reads the reply on the connection. A
+// throttle hint before the reply is recorded and skipped.
+func (c *Client) callConn(args ...interface{}) (interface{}, error) {
+	if c.config.Trace {
+		slog.Info("client: command", "address", c.config.Address, "command", resp.FormatCommand(fmt.Sprint(args[0]), args[1:]))
+	}
+
+	if err := c.WriteArray(args...); err != nil {
+		return nil, err
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	c.throttled = 0
+	reply, err := c.Read()
+	if s, ok := reply.(string); ok && err == nil && strings.HasPrefix(s, throttleHint+" ") {
+		ms, _ := strconv.ParseInt(strings.TrimPrefix(s, throttleHint+" "), 10, 64)
+		c.throttled = time.Duration(ms) * time.Millisecond
+
+		reply, err = c.Read()
+	}
+
+	if c.config.Trace {
+		v := reply
+		if err != nil {
+			v = err
+		}
+		slog.Info("client: reply", "address", c.config.Address, "reply", resp.FormatValue(v))
+	}
+
+	return reply, err
+}
+
+// Throttled returns how long the server delayed the reply of the last call
+// for going over the client's quota. Only servers that negotiated the
+// throttle feature tell.
+func (c *Client) Throttled() time.Duration {
+	return c.throttled
+}
+
 // Ping the server and expect a PONG back! You know...
 func (c *Client) Ping() (string, error) {
-	if err := c.WriteArray("PING"); err != nil {
-		return "", err
-	}
+	return c.PingContext(context.Background())
+}
 
-	resp, err := c.Read()
+// PingContext pings the server within the context
+func (c *Client) PingContext(ctx context.Context) (string, error) {
+	resp, err := c.call(ctx, "PING")
 	if err != nil {
 		return "", err
 	}
 
-	return resp.(string), nil
+	var d replyDecoder
+	return d.status(resp), d.err
 }
 
 // Create calls the server and asks it to create topic with given number
 // of shards
 func (c *Client) Create(topic string, numShards int64) (string, error) {
-	err := c.WriteArray("CREATE", topic, numShards)
-	if err != nil {
-		return "", err
-	}
+	return c.CreateContext(context.Background(), topic, numShards)
+}
 
-	resp, err := c.Read()
+// CreateContext creates the topic within the context
+func (c *Client) CreateContext(ctx context.Context, topic string, numShards int64) (string, error) {
+	resp, err := c.call(ctx, "CREATE", topic, numShards)
 	if err != nil {
 		return "", err
 	}
 
-	return resp.(string), nil
+	var d replyDecoder
+	return d.status(resp), d.err
 }
 
 // List lists all topic names
 func (c *Client) List() ([]string, error) {
-	err := c.WriteArray("LIST")
-	if err != nil {
-		return nil, err
-	}
+	return c.ListContext(context.Background())
+}
 
-	resp, err := c.Read()
+// ListContext lists all topic names within the context
+func (c *Client) ListContext(ctx context.Context) ([]string, error) {
+	resp, err := c.call(ctx, "LIST")
 	if err != nil {
 		return nil, err
 	}
 
-	result := resp.([]interface{})
-	topics := make([]string, len(result))
-	for i, topic := range result {
-		topics[i] = string(topic.([]byte))
+	var d replyDecoder
+	topics := d.bulks(resp)
+	if d.err != nil {
+		return nil, d.err
 	}
 
 	return topics, nil
@@ -92,20 +387,20 @@ func (c *Client) List() ([]string, error) {
 
 // Describe list all shards for a topic
 func (c *Client) Describe(topic string) ([]string, error) {
-	err := c.WriteArray("DESCRIBE", topic)
-	if err != nil {
-		return nil, err
-	}
+	return c.DescribeContext(context.Background(), topic)
+}
 
-	resp, err := c.Read()
+// DescribeContext lists all shards for a topic within the context
+func (c *Client) DescribeContext(ctx context.Context, topic string) ([]string, error) {
+	resp, err := c.call(ctx, "DESCRIBE", topic)
 	if err != nil {
 		return nil, err
 	}
 
-	result := resp.([]interface{})
-	shards := make([]string, len(result))
-	for i, shard := range result {
-		shards[i] = string(shard.([]byte))
+	var d replyDecoder
+	shards := d.bulks(resp)
+	if d.err != nil {
+		return nil, d.err
 	}
 
 	return shards, nil
@@ -113,17 +408,51 @@ func (c *Client) Describe(topic string) ([]string, error) {
 
 // Put keyed message into shard of the topic
 func (c *Client) Put(topic, shard string, key, message []byte) (string, error) {
-	err := c.WriteArray("PUT", topic, shard, key, message)
+	return c.PutContext(context.Background(), topic, shard, key, message)
+}
+
+// PutContext puts keyed message into shard of the topic within the context
+func (c *Client) PutContext(ctx context.Context, topic, shard string, key, message []byte) (string, error) {
+	resp, err := c.call(ctx, "PUT", topic, shard, key, message)
 	if err != nil {
 		return "", err
 	}
 
-	resp, err := c.Read()
+	var d replyDecoder
+	return d.status(resp), d.err
+}
+
+// PutBatch puts keyed messages into shard of the topic in order. Returns
+// the sequence ID assigned to each message.
+func (c *Client) PutBatch(topic, shard string, keys, messages [][]byte) ([]int64, error) {
+	return c.PutBatchContext(context.Background(), topic, shard, keys, messages)
+}
+
+// PutBatchContext puts keyed messages into shard of the topic in order
+// within the context
+func (c *Client) PutBatchContext(ctx context.Context, topic, shard string, keys, messages [][]byte) ([]int64, error) {
+	args := make([]interface{}, 0, 3+2*len(keys))
+	args = append(args, "PUT_BATCH", topic, shard)
+	for i := range keys {
+		args = append(args, keys[i], messages[i])
+	}
+
+	resp, err := c.call(ctx, args...)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	var d replyDecoder
+	result := d.array(resp, 0)
+	sequenceIDs := make([]int64, len(result))
+	for i, sequenceID := range result {
+		sequenceIDs[i] = d.int(sequenceID)
+	}
+	if d.err != nil {
+		return nil, d.err
 	}
 
-	return resp.(string), nil
+	return sequenceIDs, nil
 }
 
 // Get messages from the kuling server on the topic and shard starting
@@ -131,16 +460,23 @@ func (c *Client) Put(topic, shard string, key, message []byte) (string, error) {
 // the server have no obligation to return exactly the number of messages
 // specified, only that it will never be more.
 func (c *Client) Get(topic, shard string, startID, maxNumMessages int64) ([]*Message, error) {
-	if err := c.WriteArray("GET", topic, shard, startID, maxNumMessages); err != nil {
-		return nil, err
-	}
+	return c.GetContext(context.Background(), topic, shard, startID, maxNumMessages)
+}
 
-	resp, err := c.Read()
+// GetContext gets messages from the topic and shard within the context
+func (c *Client) GetContext(ctx context.Context, topic, shard string, startID, maxNumMessages int64) ([]*Message, error) {
+	resp, err := c.call(ctx, "GET", topic, shard, startID, maxNumMessages)
 	if err != nil {
 		return nil, err
 	}
 
-	msgReader := NewMessageReader(bytes.NewReader(resp.([]byte)))
+	var d replyDecoder
+	p := d.bytes(resp)
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	msgReader := NewMessageReader(bytes.NewReader(p))
 	msgs, err := msgReader.ReadMessages()
 	if err != nil {
 		return nil, err
@@ -152,20 +488,20 @@ func (c *Client) Get(topic, shard string, startID, maxNumMessages int64) ([]*Mes
 // Iters gets a set of iterators belonging to the client ID for the topic and
 // group
 func (c *Client) Iters(group, client, topic string) ([]string, error) {
-	err := c.WriteArray("ITERS", group, client, topic)
-	if err != nil {
-		return nil, err
-	}
+	return c.ItersContext(context.Background(), group, client, topic)
+}
 
-	resp, err := c.Read()
+// ItersContext gets the iterators of the client within the context
+func (c *Client) ItersContext(ctx context.Context, group, client, topic string) ([]string, error) {
+	resp, err := c.call(ctx, "ITERS", group, client, topic)
 	if err != nil {
 		return nil, err
 	}
 
-	result := resp.([]interface{})
-	iters := make([]string, len(result))
-	for i, iter := range result {
-		iters[i] = string(iter.([]byte))
+	var d replyDecoder
+	iters := d.bulks(resp)
+	if d.err != nil {
+		return nil, d.err
 	}
 
 	return iters, nil
@@ -173,15 +509,257 @@ func (c *Client) Iters(group, client, topic string) ([]string, error) {
 
 // Commit an iterator at a offset
 func (c *Client) Commit(iter string, offset int64) (string, error) {
-	err := c.WriteArray("ITER_COMMIT", iter, offset)
+	return c.CommitContext(context.Background(), iter, offset)
+}
+
+// CommitContext commits an iterator at a offset within the context
+func (c *Client) CommitContext(ctx context.Context, iter string, offset int64) (string, error) {
+	resp, err := c.call(ctx, "ITER_COMMIT", iter, offset)
 	if err != nil {
 		return "", err
 	}
 
-	resp, err := c.Read()
+	var d replyDecoder
+	return d.status(resp), d.err
+}
+
+// Leave the group so that the shards of the client are handed over to the
+// other members of the group
+func (c *Client) Leave(group, client string) (string, error) {
+	return c.LeaveContext(context.Background(), group, client)
+}
+
+// LeaveContext leaves the group within the context
+func (c *Client) LeaveContext(ctx context.Context, group, client string) (string, error) {
+	resp, err := c.call(ctx, "GRP_LEAVE", group, client)
 	if err != nil {
 		return "", err
 	}
 
-	return resp.(string), nil
+	var d replyDecoder
+	return d.status(resp), d.err
+}
+
+// DescribeGroup gets the members of the group and its committed sequence ID,
+// head and lag for every shard in the topic
+func (c *Client) DescribeGroup(group, topic string) (*GroupDescription, error) {
+	return c.DescribeGroupContext(context.Background(), group, topic)
+}
+
+// DescribeGroupContext describes the group within the context
+func (c *Client) DescribeGroupContext(ctx context.Context, group, topic string) (*GroupDescription, error) {
+	resp, err := c.call(ctx, "DESCRIBE_GROUP", group, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var d replyDecoder
+	result := d.array(resp, 5)
+	g := &GroupDescription{
+		Group:   d.bulk(result[0]),
+		Topic:   d.bulk(result[1]),
+		Active:  d.int(result[2]) == 1,
+		Members: d.bulks(result[3]),
+	}
+
+	for _, s := range d.array(result[4], 0) {
+		shard := d.array(s, 5)
+		g.Shards = append(g.Shards, GroupShard{
+			Shard:     d.bulk(shard[0]),
+			Owner:     d.bulk(shard[1]),
+			Committed: d.int(shard[2]),
+			Head:      d.int(shard[3]),
+			Lag:       d.int(shard[4]),
+		})
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return g, nil
+}
+
+// ResetGroup moves the committed iterators of an inactive group for all
+// shards in the topic. Returns the new committed sequence ID per shard.
+func (c *Client) ResetGroup(group, topic string, reset OffsetReset) (map[string]int64, error) {
+	return c.ResetGroupContext(context.Background(), group, topic, reset)
+}
+
+// ResetGroupContext resets the group within the context
+func (c *Client) ResetGroupContext(ctx context.Context, group, topic string, reset OffsetReset) (map[string]int64, error) {
+	args := []interface{}{"RESET_GROUP", group, topic, reset.Mode}
+	switch reset.Mode {
+	case ResetSequenceID:
+		args = append(args, reset.SequenceID)
+	case ResetTimestamp:
+		args = append(args, reset.Timestamp.UnixNano()/int64(time.Millisecond))
+	}
+
+	resp, err := c.call(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var d replyDecoder
+	result := d.array(resp, 0)
+	offsets := make(map[string]int64, len(result))
+	for _, s := range result {
+		shard := d.array(s, 2)
+		offsets[d.bulk(shard[0])] = d.int(shard[1])
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return offsets, nil
+}
+
+// ACLList lists the ACL rules of the server
+func (c *Client) ACLList() ([]ACLRule, error) {
+	return c.ACLListContext(context.Background())
+}
+
+// ACLListContext lists the ACL rules of the server within the context
+func (c *Client) ACLListContext(ctx context.Context) ([]ACLRule, error) {
+	resp, err := c.call(ctx, "ACL", "LIST")
+	if err != nil {
+		return nil, err
+	}
+
+	var d replyDecoder
+	lines := d.bulks(resp)
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	rules := make([]ACLRule, len(lines))
+	for i, line := range lines {
+		if rules[i], err = ParseACLRule(strings.Fields(line)); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// ACLAdd adds the rule to the ACL of the server
+func (c *Client) ACLAdd(rule ACLRule) error {
+	return c.ACLAddContext(context.Background(), rule)
+}
+
+// ACLAddContext adds the rule to the ACL of the server within the context
+func (c *Client) ACLAddContext(ctx context.Context, rule ACLRule) error {
+	args := append([]interface{}{"ACL", "ADD"}, toInterfaces(strings.Fields(rule.String()))...)
+	_, err := c.call(ctx, args...)
+	return err
+}
+
+// ACLDel removes the rule from the ACL of the server, false if there was no
+// such rule
+func (c *Client) ACLDel(rule ACLRule) (bool, error) {
+	return c.ACLDelContext(context.Background(), rule)
+}
+
+// ACLDelContext removes the rule from the ACL of the server within the
+// context
+func (c *Client) ACLDelContext(ctx context.Context, rule ACLRule) (bool, error) {
+	args := append([]interface{}{"ACL", "DEL"}, toInterfaces(strings.Fields(rule.String()))...)
+	resp, err := c.call(ctx, args...)
+	if err != nil {
+		return false, err
+	}
+
+	var d replyDecoder
+	return d.int(resp) == 1, d.err
+}
+
+// ACLReload makes the server reload its ACL file
+func (c *Client) ACLReload() error {
+	return c.ACLReloadContext(context.Background())
+}
+
+// ACLReloadContext makes the server reload its ACL file within the context
+func (c *Client) ACLReloadContext(ctx context.Context) error {
+	_, err := c.call(ctx, "ACL", "RELOAD")
+	return err
+}
+
+// WhoAmI returns the principal the connection is authenticated as, empty
+// if it is not
+func (c *Client) WhoAmI() (string, error) {
+	return c.WhoAmIContext(context.Background())
+}
+
+// WhoAmIContext returns the principal of the connection within the context
+func (c *Client) WhoAmIContext(ctx context.Context) (string, error) {
+	resp, err := c.call(ctx, "ACL", "WHOAMI")
+	if err != nil {
+		return "", err
+	}
+
+	var d replyDecoder
+	return d.bulk(resp), d.err
+}
+
+// replyDecoder converts the values of a reply to the types the command
+// replies with. The first value of another type is kept in err and zero
+// values are returned for it, so that a reply is decoded whole and err
+// checked once at the end.
+type replyDecoder struct {
+	err error
+}
+
+func (d *replyDecoder) fail(v interface{}, want string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %T, want %s", ErrUnexpectedReply, v, want)
+	}
+}
+
+// status of a simple string reply
+func (d *replyDecoder) status(v interface{}) string {
+	s, ok := v.(string)
+	if !ok {
+		d.fail(v, "status")
+	}
+	return s
+}
+
+func (d *replyDecoder) bytes(v interface{}) []byte {
+	p, ok := v.([]byte)
+	if !ok {
+		d.fail(v, "bulk string")
+	}
+	return p
+}
+
+func (d *replyDecoder) bulk(v interface{}) string {
+	return string(d.bytes(v))
+}
+
+func (d *replyDecoder) int(v interface{}) int64 {
+	n, ok := v.(int64)
+	if !ok {
+		d.fail(v, "integer")
+	}
+	return n
+}
+
+// array of at least n values, n nil values when it is not
+func (d *replyDecoder) array(v interface{}, n int) []interface{} {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) < n {
+		d.fail(v, fmt.Sprintf("array of at least %d", n))
+		return make([]interface{}, n)
+	}
+	return arr
+}
+
+// bulks of an array of bulk strings
+func (d *replyDecoder) bulks(v interface{}) []string {
+	arr := d.array(v, 0)
+	s := make([]string, len(arr))
+	for i, e := range arr {
+		s[i] = d.bulk(e)
+	}
+	return s
 }
@@ -0,0 +1,130 @@
+package kuling
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+// startFakeServer serves every connection with the handler until the test
+// ends, n counts the connections from 1. Returns the address.
+func startFakeServer(t *testing.T, handle func(n int64, r *resp.Reader, w *resp.Writer)) string {
+	t.Helper()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+
+	var conns atomic.Int64
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			n := conns.Add(1)
+			go func() {
+				defer conn.Close()
+				handle(n, resp.NewReader(conn), resp.NewWriter(conn))
+			}()
+		}
+	}()
+
+	return listen.Addr().String()
+}
+
+// answerHello answers the handshake as a server from before HELLO
+func answerHello(r *resp.Reader, w *resp.Writer) {
+	r.Read()
+	w.WriteErr(resp.CodeUnknownCmd, "unknown command")
+	w.Flush()
+}
+
+func TestClientDialsAgainAfterConnectionError(t *testing.T) {
+	addr := startFakeServer(t, func(n int64, r *resp.Reader, w *resp.Writer) {
+		answerHello(r, w)
+		for {
+			// The first connection is dropped on the first command
+			if _, err := r.Read(); err != nil || n == 1 {
+				return
+			}
+			w.WriteStatus("PONG")
+			w.Flush()
+		}
+	})
+
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Ping(); err == nil {
+		t.Fatal("ping on a dropped connection succeeded")
+	}
+	if c.conn != nil {
+		t.Error("broken connection kept")
+	}
+	if pong, err := c.Ping(); err != nil || pong != "PONG" {
+		t.Fatalf("ping on a new connection gave %q, %v", pong, err)
+	}
+}
+
+func TestClientDialHonoursContext(t *testing.T) {
+	// The server never answers the handshake
+	addr := startFakeServer(t, func(n int64, r *resp.Reader, w *resp.Writer) {
+		r.Read()
+		r.Read()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := DialConfigContext(ctx, ClientConfig{Address: addr}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dial gave %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("dial returned after %s", d)
+	}
+}
+
+func TestClientUnexpectedReply(t *testing.T) {
+	addr := startFakeServer(t, func(n int64, r *resp.Reader, w *resp.Writer) {
+		answerHello(r, w)
+		for {
+			if _, err := r.Read(); err != nil {
+				return
+			}
+			// An integer where every command expects another type
+			w.WriteInt64(1)
+			w.Flush()
+		}
+	})
+
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.List(); !errors.Is(err, ErrUnexpectedReply) {
+		t.Errorf("list gave %v", err)
+	}
+	if _, err := c.Ping(); !errors.Is(err, ErrUnexpectedReply) {
+		t.Errorf("ping gave %v", err)
+	}
+	if _, err := c.DescribeGroup("group", "emails"); !errors.Is(err, ErrUnexpectedReply) {
+		t.Errorf("describe group gave %v", err)
+	}
+	if _, err := c.Get("emails", firstShard, 0, 1); !errors.Is(err, ErrUnexpectedReply) {
+		t.Errorf("get gave %v", err)
+	}
+}
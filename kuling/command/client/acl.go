@@ -0,0 +1,135 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/fredrikbackstrom/kuling/kuling"
+	"github.com/spf13/cobra"
+)
+
+var aclCmd = &cobra.Command{
+	Use:   "acl",
+	Short: "ACL commands",
+	Long:  "Manage the ACL rules of the server, requires the admin permission on\nthe cluster. Rules are written as principal permissions resource, for\nexample: alice read,write topic:orders.*",
+	Run:   nil,
+}
+
+// runACL dials the server and runs the ACL request, exits on errors
+func runACL(request func(c *kuling.Client) error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r == io.EOF {
+				fmt.Println("Connection closed before reading response")
+				os.Exit(1)
+			} else {
+				fmt.Printf("Recovered from panic %v\n", r)
+			}
+		}
+	}()
+
+	c, err := dial()
+	defer c.Close()
+	if err != nil {
+		log.Println(err)
+		os.Exit(0)
+	}
+
+	if err := request(c); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+var aclListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List rules",
+	Long:  "List the ACL rules of the server",
+	Run: func(cmd *cobra.Command, args []string) {
+		runACL(func(c *kuling.Client) error {
+			rules, err := c.ACLList()
+			for _, r := range rules {
+				fmt.Println(r)
+			}
+			return err
+		})
+	},
+}
+
+var aclAddCmd = &cobra.Command{
+	Use:   "add <principal> <permissions> <resource>",
+	Short: "Add rule",
+	Long:  "Add a rule to the ACL, the server writes it to its ACL file",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		rule, err := kuling.ParseACLRule(args)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		runACL(func(c *kuling.Client) error {
+			return c.ACLAdd(rule)
+		})
+	},
+}
+
+var aclDelCmd = &cobra.Command{
+	Use:   "del <principal> <permissions> <resource>",
+	Short: "Remove rule",
+	Long:  "Remove a rule from the ACL, the server writes the remaining rules to its\nACL file",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		rule, err := kuling.ParseACLRule(args)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		runACL(func(c *kuling.Client) error {
+			removed, err := c.ACLDel(rule)
+			if err == nil && !removed {
+				fmt.Println("no such rule")
+			}
+			return err
+		})
+	},
+}
+
+var aclReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload rules",
+	Long:  "Make the server reload its ACL file",
+	Run: func(cmd *cobra.Command, args []string) {
+		runACL(func(c *kuling.Client) error {
+			return c.ACLReload()
+		})
+	},
+}
+
+var aclWhoAmICmd = &cobra.Command{
+	Use:   "whoami",
+	Short: "Show principal",
+	Long:  "Show the principal the connection is authenticated as",
+	Run: func(cmd *cobra.Command, args []string) {
+		runACL(func(c *kuling.Client) error {
+			principal, err := c.WhoAmI()
+			if err == nil {
+				fmt.Println(principal)
+			}
+			return err
+		})
+	},
+}
+
+func bootstrapACL() {
+	aclCmd.AddCommand(
+		aclListCmd,
+		aclAddCmd,
+		aclDelCmd,
+		aclReloadCmd,
+		aclWhoAmICmd,
+	)
+}
@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 
-	"github.com/fredrikbackstrom/kuling/kuling"
 	"github.com/spf13/cobra"
 )
 
@@ -26,7 +25,7 @@ var commitCmd = &cobra.Command{
 			}
 		}()
 
-		c, err := kuling.Dial(fetchAddress)
+		c, err := dial()
 		defer c.Close()
 		if err != nil {
 			log.Println(err)
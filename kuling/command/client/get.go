@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 
-	"github.com/fredrikbackstrom/kuling/kuling"
 	"github.com/spf13/cobra"
 )
 
@@ -27,7 +26,7 @@ var getCmd = &cobra.Command{
 			}
 		}()
 
-		client, err := kuling.Dial(fetchAddress)
+		client, err := dial()
 		defer client.Close()
 		if err != nil {
 			log.Println(err)
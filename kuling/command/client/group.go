@@ -0,0 +1,173 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling"
+	"github.com/spf13/cobra"
+)
+
+var groupCmd = &cobra.Command{
+	Use:   "group",
+	Short: "Consumer group commands",
+	Long:  "Consumer group administration",
+	Run:   nil,
+}
+
+var groupDescribeCmd = &cobra.Command{
+	Use:   "describe",
+	Short: "Describe group",
+	Long:  "Describe lists the live members of a group and for every shard in the\ntopic the owner, committed sequence ID, head and lag of the group.",
+	Run: func(cmd *cobra.Command, args []string) {
+		defer func() {
+			if r := recover(); r != nil {
+				if r == io.EOF {
+					fmt.Println("Connection closed before reading response")
+					os.Exit(1)
+				} else {
+					fmt.Printf("Recovered from panic %v\n", r)
+				}
+			}
+		}()
+
+		c, err := dial()
+		defer c.Close()
+		if err != nil {
+			log.Println(err)
+			os.Exit(0)
+		}
+
+		d, err := c.DescribeGroup(group, topic)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("group: %s topic: %s active: %t\n", d.Group, d.Topic, d.Active)
+		for _, m := range d.Members {
+			fmt.Printf("member: %s\n", m)
+		}
+		for _, s := range d.Shards {
+			fmt.Printf("shard: %s owner: %s committed: %d head: %d lag: %d\n", s.Shard, s.Owner, s.Committed, s.Head, s.Lag)
+		}
+	},
+}
+
+var groupResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Reset group",
+	Long:  "Reset moves the committed iterators of a group for every shard in the\ntopic to the earliest or latest message, a sequence ID or the first\nmessage appended at or after a timestamp. The group must be inactive.",
+	Run: func(cmd *cobra.Command, args []string) {
+		defer func() {
+			if r := recover(); r != nil {
+				if r == io.EOF {
+					fmt.Println("Connection closed before reading response")
+					os.Exit(1)
+				} else {
+					fmt.Printf("Recovered from panic %v\n", r)
+				}
+			}
+		}()
+
+		var reset kuling.OffsetReset
+		switch {
+		case resetEarliest:
+			reset.Mode = kuling.ResetEarliest
+		case resetLatest:
+			reset.Mode = kuling.ResetLatest
+		case cmd.Flags().Changed("to-sequence-id"):
+			reset.Mode = kuling.ResetSequenceID
+			reset.SequenceID = int64(resetSequenceID)
+		case resetTimestamp != "":
+			t, err := time.Parse(time.RFC3339, resetTimestamp)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			reset.Mode = kuling.ResetTimestamp
+			reset.Timestamp = t
+		default:
+			fmt.Println("one of --to-earliest, --to-latest, --to-sequence-id or --to-timestamp is required")
+			os.Exit(1)
+		}
+
+		c, err := dial()
+		defer c.Close()
+		if err != nil {
+			log.Println(err)
+			os.Exit(0)
+		}
+
+		offsets, err := c.ResetGroup(group, topic, reset)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		shards := make([]string, 0, len(offsets))
+		for s := range offsets {
+			shards = append(shards, s)
+		}
+		sort.Strings(shards)
+
+		for _, s := range shards {
+			fmt.Printf("shard: %s committed: %d\n", s, offsets[s])
+		}
+	},
+}
+
+func bootstrapGroup() {
+	groupCmd.PersistentFlags().StringVarP(
+		&group,
+		"group",
+		"g",
+		"",
+		"Consumer group",
+	)
+
+	groupCmd.PersistentFlags().StringVarP(
+		&topic,
+		"topic",
+		"t",
+		"",
+		"Topic the group consumes",
+	)
+
+	groupResetCmd.PersistentFlags().BoolVar(
+		&resetEarliest,
+		"to-earliest",
+		false,
+		"Reset to the first message in every shard",
+	)
+
+	groupResetCmd.PersistentFlags().BoolVar(
+		&resetLatest,
+		"to-latest",
+		false,
+		"Reset to the head of every shard",
+	)
+
+	groupResetCmd.PersistentFlags().IntVar(
+		&resetSequenceID,
+		"to-sequence-id",
+		0,
+		"Reset to a sequence ID in every shard",
+	)
+
+	groupResetCmd.PersistentFlags().StringVar(
+		&resetTimestamp,
+		"to-timestamp",
+		"",
+		"Reset to the first message appended at or after an RFC3339 timestamp",
+	)
+
+	groupCmd.AddCommand(
+		groupDescribeCmd,
+		groupResetCmd,
+	)
+}
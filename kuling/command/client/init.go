@@ -1,6 +1,8 @@
 package client
 
 import (
+	"os"
+
 	"github.com/fredrikbackstrom/kuling/kuling"
 	"github.com/spf13/cobra"
 )
@@ -17,6 +19,24 @@ var (
 	key            string
 	numShards      int
 	iter           string
+
+	resetEarliest   bool
+	resetLatest     bool
+	resetSequenceID int
+	resetTimestamp  string
+
+	tlsEnabled            bool
+	tlsCAFile             string
+	tlsCertFile           string
+	tlsKeyFile            string
+	tlsServerName         string
+	tlsInsecureSkipVerify bool
+
+	user     string
+	password string
+	token    string
+
+	trace bool
 )
 
 // ServerCmd root cmd for log store commands
@@ -35,6 +55,8 @@ func init() {
 	bootstrapDescribe()
 	bootstrapIters()
 	bootstrapCommit()
+	bootstrapGroup()
+	bootstrapACL()
 
 	ClientCmd.PersistentFlags().StringVarP(
 		&fetchAddress,
@@ -44,6 +66,76 @@ func init() {
 		"Host where server is running",
 	)
 
+	ClientCmd.PersistentFlags().BoolVar(
+		&tlsEnabled,
+		"tls",
+		false,
+		"Connect with TLS, implied by the other --tls flags",
+	)
+
+	ClientCmd.PersistentFlags().StringVar(
+		&tlsCAFile,
+		"tls-ca",
+		"",
+		"PEM CA file to verify the server certificate with instead of the system CAs",
+	)
+
+	ClientCmd.PersistentFlags().StringVar(
+		&tlsCertFile,
+		"tls-cert",
+		"",
+		"PEM client certificate file for servers that require client certificates",
+	)
+
+	ClientCmd.PersistentFlags().StringVar(
+		&tlsKeyFile,
+		"tls-key",
+		"",
+		"PEM private key file of the client certificate",
+	)
+
+	ClientCmd.PersistentFlags().StringVar(
+		&tlsServerName,
+		"tls-server-name",
+		"",
+		"Server name to verify the server certificate against, defaults to the host",
+	)
+
+	ClientCmd.PersistentFlags().BoolVar(
+		&tlsInsecureSkipVerify,
+		"tls-insecure-skip-verify",
+		false,
+		"Do not verify the server certificate, for testing only",
+	)
+
+	ClientCmd.PersistentFlags().StringVar(
+		&user,
+		"user",
+		"",
+		"User to authenticate as",
+	)
+
+	ClientCmd.PersistentFlags().StringVar(
+		&password,
+		"password",
+		"",
+		"Password of the user, defaults to $KULING_PASSWORD",
+	)
+
+	ClientCmd.PersistentFlags().StringVar(
+		&token,
+		"token",
+		"",
+		"Token to authenticate with instead of user and password, defaults to $KULING_TOKEN",
+	)
+
+	ClientCmd.PersistentFlags().BoolVar(
+		&trace,
+		"trace",
+		false,
+		"Log every command sent and reply received, with long strings cut",
+	)
+
 	// Add all commands
 	ClientCmd.AddCommand(
 		pingCmd,
@@ -54,5 +146,31 @@ func init() {
 		getCmd,
 		itersCmd,
 		commitCmd,
+		groupCmd,
+		aclCmd,
 	)
 }
+
+// dial connects to the server with the connection flags shared by all
+// client commands
+func dial() (*kuling.Client, error) {
+	config := kuling.ClientConfig{Address: fetchAddress, Trace: trace}
+
+	config.Credentials = kuling.Credentials{User: user, Password: password, Token: token}
+	if config.Credentials.Password == "" {
+		config.Credentials.Password = os.Getenv("KULING_PASSWORD")
+	}
+	if config.Credentials.Token == "" && user == "" {
+		config.Credentials.Token = os.Getenv("KULING_TOKEN")
+	}
+
+	if tlsEnabled || tlsCAFile != "" || tlsCertFile != "" || tlsKeyFile != "" || tlsServerName != "" || tlsInsecureSkipVerify {
+		tlsConfig, err := kuling.NewClientTLSConfig(tlsCAFile, tlsCertFile, tlsKeyFile, tlsServerName, tlsInsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		config.TLSConfig = tlsConfig
+	}
+
+	return kuling.DialConfig(config)
+}
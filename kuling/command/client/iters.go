@@ -26,7 +26,7 @@ var itersCmd = &cobra.Command{
 			}
 		}()
 
-		c, err := kuling.Dial(fetchAddress)
+		c, err := dial()
 		defer c.Close()
 		if err != nil {
 			log.Println(err)
@@ -40,7 +40,13 @@ var itersCmd = &cobra.Command{
 		}
 
 		for _, i := range iters {
-			fmt.Println(i)
+			it, err := kuling.IterDecode(i)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s shard: %s offset: %d\n", i, it.Shard(), it.Offset())
 		}
 	},
 }
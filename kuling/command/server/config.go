@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fredrikbackstrom/kuling/kuling"
+	"github.com/spf13/pflag"
+)
+
+// envPrefix of the environment variables that set flags, KULING_DATA_DIR
+// sets --data-dir
+const envPrefix = "KULING_"
+
+// configFlag is the flag naming the config file, it cannot be set in the
+// file itself
+const configFlag = "config"
+
+// bootstrapTopic is a topic created on startup when it does not exist
+type bootstrapTopic struct {
+	Name   string `json:"name"`
+	Shards int    `json:"shards"`
+}
+
+// loadConfig sets the flags that were not given on the command line, first
+// from their environment variable and then from the JSON config file named
+// by --config or KULING_CONFIG. The file is an object of flag names and
+// values as they would be given on the command line, strings, numbers or
+// booleans, and a "topics" list of bootstrap topics:
+//
+//	{
+//	  "address": ":7777",
+//	  "data-dir": "/var/lib/kuling",
+//	  "segment-max-bytes": 104857600,
+//	  "retention-age": "168h",
+//	  "topics": [{"name": "emails", "shards": 10}]
+//	}
+func loadConfig(flags *pflag.FlagSet) ([]bootstrapTopic, error) {
+	file := flags.Lookup(configFlag).Value.String()
+	if v, ok := os.LookupEnv(envName(configFlag)); ok && !flags.Changed(configFlag) {
+		file = v
+	}
+
+	values := map[string]string{}
+	var topics []bootstrapTopic
+	if file != "" {
+		var err error
+		if values, topics, err = readConfigFile(file, flags); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Name == configFlag {
+			return
+		}
+
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = fmt.Errorf("config: %s: %s", envName(f.Name), setErr)
+			}
+		} else if v, ok := values[f.Name]; ok {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = fmt.Errorf("config: %s: %s: %s", file, f.Name, setErr)
+			}
+		}
+	})
+
+	return topics, err
+}
+
+// readConfigFile reads the flag values and bootstrap topics of the file.
+// Names that are not flags of the command are errors so that misspelled
+// settings are not silently ignored.
+func readConfigFile(file string, flags *pflag.FlagSet) (map[string]string, []bootstrapTopic, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("config: could not read config file: %s", err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, nil, fmt.Errorf("config: %s: %s", file, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	var topics []bootstrapTopic
+	for name, v := range raw {
+		if name == "topics" {
+			if err := json.Unmarshal(v, &topics); err != nil {
+				return nil, nil, fmt.Errorf("config: %s: topics: %s", file, err)
+			}
+			continue
+		}
+		if name == configFlag || flags.Lookup(name) == nil {
+			return nil, nil, fmt.Errorf("config: %s: unknown setting %s", file, name)
+		}
+
+		d := json.NewDecoder(bytes.NewReader(v))
+		d.UseNumber()
+		var value interface{}
+		if err := d.Decode(&value); err != nil {
+			return nil, nil, fmt.Errorf("config: %s: %s: %s", file, name, err)
+		}
+
+		switch value := value.(type) {
+		case string:
+			values[name] = value
+		case json.Number:
+			values[name] = value.String()
+		case bool:
+			values[name] = strconv.FormatBool(value)
+		default:
+			return nil, nil, fmt.Errorf("config: %s: %s must be a string, number or boolean", file, name)
+		}
+	}
+
+	seen := make(map[string]bool, len(topics))
+	for _, t := range topics {
+		if t.Name == "" || t.Shards < 1 {
+			return nil, nil, fmt.Errorf("config: %s: topics need a name and at least one shard", file)
+		}
+		if kuling.IsInternalTopic(t.Name) {
+			return nil, nil, fmt.Errorf("config: %s: topic %s is internal", file, t.Name)
+		}
+		if seen[t.Name] {
+			return nil, nil, fmt.Errorf("config: %s: topic %s listed twice", file, t.Name)
+		}
+		seen[t.Name] = true
+	}
+
+	return values, topics, nil
+}
+
+// envName is the environment variable of the flag
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
@@ -13,9 +13,13 @@ var ServerCmd = &cobra.Command{
 // Broker command/broker init function that sets up
 func init() {
 	bootstrapServer()
+	bootstrapMigrate()
+	bootstrapPasswd()
 
 	// Add all commands
 	ServerCmd.AddCommand(
 		StandaloneServerCmd,
+		MigrateItersCmd,
+		PasswdCmd,
 	)
 }
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+
+	"github.com/fredrikbackstrom/kuling/kuling"
+	"github.com/spf13/cobra"
+)
+
+// Name of the bolt iter store file in the data directory
+const boltIterStoreFile = "broker.db"
+
+// Name of the iterator signing key file in the data directory
+const iterKeyFile = "iter.key"
+
+// MigrateItersCmd copies all committed iterators from the bolt iter store
+// into the iter topic. The server must not be running.
+var MigrateItersCmd = &cobra.Command{
+	Use:   "migrate-iters",
+	Short: "Migrate iterators from bolt to topic",
+	Long:  "Copy all committed iterators from the bolt iter store into the internal\niterator topic. The server must be stopped while migrating. The bolt file\nis left in place and can be removed once the migration is verified.",
+	Run: func(cmd *cobra.Command, args []string) {
+		migrated, err := migrateIters(dataDir)
+		if err != nil {
+			slog.Error("migrate: migration failed", "migrated", migrated, "err", err)
+			os.Exit(1)
+		}
+
+		slog.Info("migrate: migrated iterators", "migrated", migrated, "topic", kuling.IterTopic)
+	},
+}
+
+// migrateIters commits the iterators of the bolt iter store in the data
+// directory to the iter topic and returns how many were migrated. The stores
+// are closed, and the iter topic fsynced, before it returns.
+func migrateIters(dataDir string) (migrated int, err error) {
+	c := &kuling.Config{
+		PermDirectories: 0755,
+		PermData:        0655,
+		SegmentMaxBytes: kuling.DefaultSegmentMaxBytes,
+	}
+
+	boltPath := path.Join(dataDir, boltIterStoreFile)
+	if _, err := os.Stat(boltPath); err != nil {
+		return 0, fmt.Errorf("no bolt iter store found: %s", err)
+	}
+
+	logStore, err := kuling.OpenLogStore(dataDir, c)
+	if err != nil {
+		return 0, fmt.Errorf("could not open log store: %s", err)
+	}
+	defer func() {
+		if closeErr := logStore.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("could not close log store: %s", closeErr)
+		}
+	}()
+
+	topicStore, err := kuling.OpenTopicIterStore(logStore)
+	if err != nil {
+		return 0, fmt.Errorf("could not open topic iter store: %s", err)
+	}
+	defer topicStore.Close()
+
+	boltStore, err := kuling.OpenBoltIterStore(boltPath, c)
+	if err != nil {
+		return 0, fmt.Errorf("could not open bolt iter store: %s", err)
+	}
+	defer boltStore.Close()
+
+	err = boltStore.ForEach(func(iter string, offset int64) error {
+		if err := topicStore.Commit(iter, offset); err != nil {
+			return err
+		}
+		migrated++
+		return nil
+	})
+
+	return migrated, err
+}
+
+func bootstrapMigrate() {
+	MigrateItersCmd.PersistentFlags().StringVarP(
+		&dataDir,
+		"data-dir",
+		"d",
+		"/tmp/kuling",
+		"Data directory for Kuling persisten storage",
+	)
+}
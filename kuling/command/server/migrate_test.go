@@ -0,0 +1,52 @@
+package server
+
+import (
+	"path"
+	"testing"
+
+	"github.com/fredrikbackstrom/kuling/kuling"
+)
+
+func TestMigrateIters(t *testing.T) {
+	dir := t.TempDir()
+	c := &kuling.Config{PermDirectories: 0755, PermData: 0644, SegmentMaxBytes: kuling.DefaultSegmentMaxBytes}
+
+	if _, err := migrateIters(dir); err == nil {
+		t.Fatal("migrated without a bolt iter store")
+	}
+
+	bolt, err := kuling.OpenBoltIterStore(path.Join(dir, boltIterStoreFile), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, iter := range []string{"a", "b"} {
+		if err := bolt.Commit(iter, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bolt.Close()
+
+	migrated, err := migrateIters(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 {
+		t.Fatalf("migrated %d iterators", migrated)
+	}
+
+	// The stores were closed, the log store opens again with the commits
+	l, err := kuling.OpenLogStore(dir, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	shards, err := l.Shards(kuling.IterTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range shards {
+		if s.Head() != 2 {
+			t.Errorf("iter topic head %d after migrating 2 iterators", s.Head())
+		}
+	}
+}
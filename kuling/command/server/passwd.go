@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/fredrikbackstrom/kuling/kuling"
+	"github.com/spf13/cobra"
+)
+
+// create a token instead of hashing a password
+var passwdToken bool
+
+// PasswdCmd prints a user file entry for the user. The password is read from
+// the first line of stdin so that it does not end up in the shell history.
+var PasswdCmd = &cobra.Command{
+	Use:   "passwd <name>",
+	Short: "Create a user file entry",
+	Long:  "Print a user file entry for the user, append it to the file passed to\nstandalone --users. The password is read from stdin. With --token a random\ntoken is created instead, the token is printed on stderr and only its hash\nis stored in the entry.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		if strings.ContainsAny(name, " \t") {
+			log.Printf("passwd: name may not contain whitespace\n")
+			os.Exit(1)
+		}
+
+		if passwdToken {
+			token, hash, err := kuling.NewToken()
+			if err != nil {
+				log.Printf("passwd: %s\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Fprintf(os.Stderr, "token: %s\n", token)
+			fmt.Printf("token %s %s\n", name, hash)
+			return
+		}
+
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Printf("passwd: could not read password from stdin: %s\n", err)
+			os.Exit(1)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			log.Printf("passwd: empty password\n")
+			os.Exit(1)
+		}
+
+		hash, err := kuling.HashPassword(password)
+		if err != nil {
+			log.Printf("passwd: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("user %s %s\n", name, hash)
+	},
+}
+
+func bootstrapPasswd() {
+	PasswdCmd.Flags().BoolVar(
+		&passwdToken,
+		"token",
+		false,
+		"Create a random token instead of reading a password",
+	)
+}
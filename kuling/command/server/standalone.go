@@ -1,23 +1,84 @@
 package server
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/fredrikbackstrom/kuling/kuling"
+	"github.com/fredrikbackstrom/kuling/kuling/kafka"
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
 	"github.com/spf13/cobra"
 )
 
 // Flag variables
 var (
+	// JSON config file setting the flags that are not given
+	configFile string
 	// Listen address for the log server
 	listenAddress string
 	// Admin listen address for RPC commands
 	commandAddress string
 	// data directory for the log store
 	dataDir string
+	// permissions of created directories and data files, octal
+	permDirectoriesFlag string
+	permDataFlag        string
+	// segments are rolled when larger than the max
+	segmentMaxBytes int64
+	// appends are fsynced at the interval, every append when zero
+	fsyncInterval time.Duration
+	// oldest segments are removed when older or the shard larger, zero keeps
+	retentionAge   time.Duration
+	retentionBytes int64
+	// store for committed iterators, topic or bolt
+	iterStoreType string
+	// idle client connections are closed after the timeout
+	idleTimeout time.Duration
+	// TLS certificate, key and CA for client certificates
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCAFile string
+	// user file, clients must authenticate when set
+	usersFile string
+	// ACL file, commands are authorized against it when set
+	aclFile string
+	// default per client quotas, per second rates, and overrides file
+	quotaProduceBytes  float64
+	quotaFetchBytes    float64
+	quotaRequests      float64
+	quotaOverridesFile string
+	quotaMaxThrottle   time.Duration
+	// address of the HTTP metrics endpoint, no endpoint when empty
+	metricsAddress string
+	// address of the HTTP gateway, no gateway when empty
+	httpAddress string
+	// address of the Kafka listener, no listener when empty, and the address
+	// Kafka clients are told to connect to
+	kafkaAddress           string
+	kafkaAdvertisedAddress string
+	// longest to wait for requests in progress when shutting down
+	shutdownTimeout time.Duration
+	// largest command argument, most arguments, deepest nesting and most
+	// argument bytes read from clients
+	maxBulkBytes    int
+	maxArrayLen     int
+	maxDepth        int
+	maxRequestBytes int
+	// log output format, text or json, and the lowest level logged
+	logFormat string
+	logLevel  string
+	// log every command and reply
+	trace bool
 )
 
 // Server Command will run server on one machine
@@ -26,70 +87,353 @@ var StandaloneServerCmd = &cobra.Command{
 	Short: "Start standalone server",
 	Long:  "Start standalone server",
 	Run: func(cmd *cobra.Command, args []string) {
+		topics, err := loadConfig(cmd.Flags())
+		if err != nil {
+			slog.Error("standalone: could not load config", "err", err)
+			os.Exit(1)
+		}
+
+		// Everything logs through the default logger, including the log
+		// package
+		logger, err := newLogger(os.Stderr, logFormat, logLevel)
+		if err != nil {
+			slog.Error("standalone: invalid logging flags", "err", err)
+			os.Exit(1)
+		}
+		slog.SetDefault(logger)
+
+		permDirectories, err := parsePerm(permDirectoriesFlag)
+		if err != nil {
+			slog.Error("standalone: invalid --perm-directories", "err", err)
+			os.Exit(1)
+		}
+		permData, err := parsePerm(permDataFlag)
+		if err != nil {
+			slog.Error("standalone: invalid --perm-data", "err", err)
+			os.Exit(1)
+		}
 
 		c := &kuling.Config{
-			PermDirectories: 0755,
-			PermData:        0655,
-			SegmentMaxBytes: 1024 * 1000 * 10, // 10MB
+			PermDirectories: permDirectories,
+			PermData:        permData,
+			SegmentMaxBytes: segmentMaxBytes,
+			FsyncInterval:   fsyncInterval,
+			RetentionAge:    retentionAge,
+			RetentionBytes:  retentionBytes,
 		}
 
 		logStore, err := kuling.OpenLogStore(dataDir, c)
+		if err != nil {
+			slog.Error("standalone: could not start server", "err", err)
+			os.Exit(1)
+		}
 
-		iterStore := kuling.OpenBoltIterStore(path.Join(dataDir, "broker.db"), c)
-		broker := kuling.NewBroker(logStore, iterStore)
+		// Topics in the config file are created if missing, existing topics
+		// are left as they are
+		for _, t := range topics {
+			if shards, err := logStore.Shards(t.Name); err == nil {
+				if len(shards) != t.Shards {
+					slog.Warn("standalone: topic has a different number of shards than the config", "topic", t.Name, "shards", len(shards), "config_shards", t.Shards)
+				}
+				continue
+			}
+			if _, err := logStore.CreateTopic(t.Name, t.Shards); err != nil {
+				slog.Error("standalone: could not create topic", "topic", t.Name, "err", err)
+				os.Exit(1)
+			}
+			slog.Info("standalone: created topic", "topic", t.Name, "shards", t.Shards)
+		}
+
+		var iterStore kuling.IterStore
+		switch iterStoreType {
+		case "topic":
+			if _, err := os.Stat(path.Join(dataDir, boltIterStoreFile)); err == nil {
+				slog.Warn("standalone: found bolt iter store, run server migrate-iters to move committed iterators into the iter topic", "file", boltIterStoreFile, "topic", kuling.IterTopic)
+			}
 
+			if iterStore, err = kuling.OpenTopicIterStore(logStore); err != nil {
+				slog.Error("standalone: could not open iter store", "err", err)
+				os.Exit(1)
+			}
+		case "bolt":
+			if iterStore, err = kuling.OpenBoltIterStore(path.Join(dataDir, boltIterStoreFile), c); err != nil {
+				slog.Error("standalone: could not open iter store", "err", err)
+				os.Exit(1)
+			}
+		default:
+			slog.Error("standalone: unknown iter store", "iter_store", iterStoreType)
+			os.Exit(1)
+		}
+
+		// Background fsyncs and expiry start once the iter topic has been
+		// compacted
+		logStore.Start()
+
+		// Iterators are signed with a key that lives next to the data so that
+		// iterators handed out stay valid across restarts. Never readable by
+		// others as it allows forging iterators.
+		iterKey, err := kuling.LoadIterKey(path.Join(dataDir, iterKeyFile), 0600)
 		if err != nil {
-			log.Printf("standalone: could not start server: %s\n", err)
+			slog.Error("standalone: could not load iterator key", "err", err)
 			os.Exit(1)
 		}
 
-		if _, err := logStore.CreateTopic("emails", 10); err != nil {
-			// log.Fatal(err)
+		broker := kuling.NewBroker(logStore, iterStore, iterKey)
+
+		config := kuling.ServerConfig{
+			Address:         listenAddress,
+			IdleTimeout:     idleTimeout,
+			MaxBulkBytes:    maxBulkBytes,
+			MaxArrayLen:     maxArrayLen,
+			MaxDepth:        maxDepth,
+			MaxRequestBytes: maxRequestBytes,
+			Trace:           trace,
 		}
 
-		// for i := 0; i < 500000; i++ {
-		// 	err := logStore.Append("emails", "0", []byte(fmt.Sprintf("john@doe.com_%d", i)), []byte("Has all the stuff"))
-		//
-		// 	if err != nil {
-		// 		panic(err)
-		// 	}
-		// }
+		var serverTLS *kuling.ServerTLS
+		if tlsCertFile != "" || tlsKeyFile != "" {
+			if serverTLS, err = kuling.NewServerTLS(tlsCertFile, tlsKeyFile, tlsClientCAFile); err != nil {
+				slog.Error("standalone: could not load TLS certificates", "err", err)
+				os.Exit(1)
+			}
+			config.TLSConfig = serverTLS.Config()
+		} else if tlsClientCAFile != "" {
+			slog.Error("standalone: --tls-client-ca requires --tls-cert and --tls-key")
+			os.Exit(1)
+		}
 
-		// Run the server in a new go routine
-		go runServer(logStore, broker)
+		// Clients authenticate with the user file or their certificate, a
+		// server that verifies client certificates always requires it
+		var authenticator *kuling.Authenticator
+		if usersFile != "" || tlsClientCAFile != "" {
+			if authenticator, err = kuling.NewAuthenticator(usersFile); err != nil {
+				slog.Error("standalone: could not load users", "err", err)
+				os.Exit(1)
+			}
+			config.Authenticator = authenticator
+		}
+
+		// Rules grant permissions to principals, a server without
+		// authentication has no principals to grant them to
+		var acl *kuling.ACL
+		if aclFile != "" {
+			if authenticator == nil {
+				slog.Error("standalone: --acl requires --users or --tls-client-ca")
+				os.Exit(1)
+			}
+			if acl, err = kuling.NewACL(aclFile); err != nil {
+				slog.Error("standalone: could not load ACL", "err", err)
+				os.Exit(1)
+			}
+			config.ACL = acl
+		}
+
+		var quotas *kuling.Quotas
+		if quotaProduceBytes > 0 || quotaFetchBytes > 0 || quotaRequests > 0 || quotaOverridesFile != "" {
+			quotas, err = kuling.NewQuotas(kuling.QuotaConfig{
+				Default: kuling.Quota{
+					ProduceBytes: quotaProduceBytes,
+					FetchBytes:   quotaFetchBytes,
+					Requests:     quotaRequests,
+				},
+				OverridesFile: quotaOverridesFile,
+				MaxThrottle:   quotaMaxThrottle,
+			})
+			if err != nil {
+				slog.Error("standalone: could not load quotas", "err", err)
+				os.Exit(1)
+			}
+			config.Quotas = quotas
+		}
+
+		// Listeners are shut down together before the stores are closed
+		var shutdowns []func(context.Context) error
+
+		if metricsAddress != "" {
+			metricsServer := kuling.NewMetricsServer(metricsAddress, logStore, broker)
+			shutdowns = append(shutdowns, metricsServer.Shutdown)
+			go func() {
+				if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+					slog.Error("standalone: metrics endpoint stopped", "err", err)
+				}
+			}()
+		}
+
+		// The gateway serves the same store with the same TLS, users and
+		// rules as the server
+		if httpAddress != "" {
+			gatewayConfig := kuling.GatewayConfig{
+				Address:       httpAddress,
+				TLSConfig:     config.TLSConfig,
+				Authenticator: authenticator,
+				ACL:           acl,
+				Quotas:        quotas,
+			}
+			gatewayServer := kuling.NewGatewayServer(gatewayConfig, logStore, broker)
+			shutdowns = append(shutdowns, gatewayServer.Shutdown)
+			go func() {
+				var err error
+				if gatewayConfig.TLSConfig != nil {
+					err = gatewayServer.ListenAndServeTLS("", "")
+				} else {
+					err = gatewayServer.ListenAndServe()
+				}
+				if err != http.ErrServerClosed {
+					slog.Error("standalone: HTTP gateway stopped", "err", err)
+				}
+			}()
+		}
+
+		// Kafka clients get the same store, TLS, users and rules as well
+		if kafkaAddress != "" {
+			kafkaConfig := kuling.KafkaConfig{
+				Address:           kafkaAddress,
+				AdvertisedAddress: kafkaAdvertisedAddress,
+				TLSConfig:         config.TLSConfig,
+				Authenticator:     authenticator,
+				ACL:               acl,
+				IdleTimeout:       idleTimeout,
+			}
+			kafkaServer := kuling.NewKafkaServer(kafkaConfig, logStore, broker)
+			shutdowns = append(shutdowns, kafkaServer.Shutdown)
+			go func() {
+				if err := kafkaServer.ListenAndServe(); err != kafka.ErrServerClosed {
+					slog.Error("standalone: Kafka listener stopped", "err", err)
+				}
+			}()
+		}
+
+		// Run the server in a new go routine, the server is of no use when
+		// it cannot listen
+		server := kuling.NewStandaloneServer(config, logStore, broker)
+		shutdowns = append(shutdowns, server.Shutdown)
+		go func() {
+			if err := server.ListenAndServe(); err != resp.ErrServerClosed {
+				slog.Error("standalone: server stopped", "err", err)
+				os.Exit(1)
+			}
+		}()
 
 		// All Traits have been successfully started, now block on the caller
 		osSignals := make(chan os.Signal, 1)
-		signal.Notify(osSignals, os.Interrupt)
+		signal.Notify(osSignals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 		for {
 			select {
 			case sig := <-osSignals:
-				if sig == os.Interrupt {
-					// Received Interrupt Signal. Stop the scheduler, workers and then shut down.
-					log.Println("standalone: received exit signal, stopping server...")
-					// Stop log store
-					logStore.Close()
-					// Wait for the log store to close down
-					for {
-						select {
-						case <-logStore.Closed():
-							log.Println("standalone: closed")
-							os.Exit(0)
+				if sig == syscall.SIGHUP {
+					// Rotated certificates, changed users, rules and quota
+					// overrides are picked up without a restart
+					if serverTLS != nil {
+						if err := serverTLS.Reload(); err != nil {
+							slog.Error("standalone: could not reload TLS, keeping the current certificates", "err", err)
+						} else {
+							slog.Info("standalone: reloaded TLS certificates")
+						}
+					}
+					if authenticator != nil {
+						if err := authenticator.Reload(); err != nil {
+							slog.Error("standalone: could not reload users, keeping the current users", "err", err)
+						} else {
+							slog.Info("standalone: reloaded users")
+						}
+					}
+					if acl != nil {
+						if err := acl.Reload(); err != nil {
+							slog.Error("standalone: could not reload ACL, keeping the current rules", "err", err)
+						} else {
+							slog.Info("standalone: reloaded ACL")
 						}
 					}
+					if quotas != nil {
+						if err := quotas.Reload(); err != nil {
+							slog.Error("standalone: could not reload quota overrides, keeping the current overrides", "err", err)
+						} else {
+							slog.Info("standalone: reloaded quota overrides")
+						}
+					}
+					continue
 				}
+
+				slog.Info("standalone: shutting down", "signal", sig.String())
+				shutdown(shutdowns, iterStore, logStore)
 			}
 		}
 	},
 }
 
-func runServer(logStore *kuling.LogStore, broker *kuling.Broker) {
-	// Create a new log server and run it
-	kuling.ListenAndServeStandalone(listenAddress, logStore, broker)
+// shutdown stops the listeners from accepting, waits up to the shutdown
+// timeout for requests in progress and then closes the iter store and the
+// log store so that everything appended is synced to disk. Exits the
+// process.
+func shutdown(shutdowns []func(context.Context) error, iterStore kuling.IterStore, logStore *kuling.LogStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, shutdown := range shutdowns {
+		wg.Add(1)
+		go func(shutdown func(context.Context) error) {
+			defer wg.Done()
+			if err := shutdown(ctx); err != nil {
+				slog.Warn("standalone: listener did not shut down cleanly", "err", err)
+			}
+		}(shutdown)
+	}
+	wg.Wait()
+
+	code := 0
+	if err := iterStore.Close(); err != nil {
+		slog.Error("standalone: could not close iter store", "err", err)
+		code = 1
+	}
+	if err := logStore.Close(); err != nil {
+		slog.Error("standalone: could not close log store", "err", err)
+		code = 1
+	}
+
+	slog.Info("standalone: closed")
+	os.Exit(code)
+}
+
+// newLogger creates a logger writing in the format, text or json, at the
+// level and above
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %s", format)
+	}
+}
+
+// parsePerm parses an octal file mode such as 0755
+func parsePerm(s string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("%s is not an octal file mode", s)
+	}
+
+	return os.FileMode(perm), nil
 }
 
 // init sets up flags for the server commands
 func bootstrapServer() {
+	StandaloneServerCmd.PersistentFlags().StringVarP(
+		&configFile,
+		configFlag,
+		"c",
+		"",
+		"JSON config file of flag values and bootstrap topics, flags and KULING_<FLAG> environment variables override it",
+	)
+
 	// host is available for all commands under server
 	StandaloneServerCmd.PersistentFlags().StringVarP(
 		&listenAddress,
@@ -106,4 +450,214 @@ func bootstrapServer() {
 		"/tmp/kuling",
 		"Data directory for Kuling persisten storage",
 	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&permDirectoriesFlag,
+		"perm-directories",
+		"0755",
+		"Octal permissions of created topic and shard directories",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&permDataFlag,
+		"perm-data",
+		"0655",
+		"Octal permissions of created segment and index files",
+	)
+
+	StandaloneServerCmd.PersistentFlags().Int64Var(
+		&segmentMaxBytes,
+		"segment-max-bytes",
+		kuling.DefaultSegmentMaxBytes,
+		"Bytes appended to a segment before a new one is created",
+	)
+
+	StandaloneServerCmd.PersistentFlags().DurationVar(
+		&fsyncInterval,
+		"fsync-interval",
+		0,
+		"Fsync appends at the interval instead of before every reply, 0 fsyncs every append",
+	)
+
+	StandaloneServerCmd.PersistentFlags().DurationVar(
+		&retentionAge,
+		"retention-age",
+		0,
+		"Remove the segments of a shard last appended to longer ago, 0 keeps them",
+	)
+
+	StandaloneServerCmd.PersistentFlags().Int64Var(
+		&retentionBytes,
+		"retention-bytes",
+		0,
+		"Remove the oldest segments of a shard larger than the bytes, 0 keeps them",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&iterStoreType,
+		"iter-store",
+		"topic",
+		"Store for committed iterators, topic or bolt",
+	)
+
+	StandaloneServerCmd.PersistentFlags().DurationVar(
+		&idleTimeout,
+		"idle-timeout",
+		kuling.DefaultIdleTimeout,
+		"Close client connections idle for longer than the timeout, 0 never closes",
+	)
+
+	StandaloneServerCmd.PersistentFlags().IntVar(
+		&maxBulkBytes,
+		"max-bulk-bytes",
+		resp.DefaultMaxBulkBytes,
+		"Largest command argument read from a client, larger arguments close the connection",
+	)
+
+	StandaloneServerCmd.PersistentFlags().IntVar(
+		&maxArrayLen,
+		"max-array-len",
+		resp.DefaultMaxArrayLen,
+		"Most arguments read in one command, more close the connection",
+	)
+
+	StandaloneServerCmd.PersistentFlags().IntVar(
+		&maxDepth,
+		"max-depth",
+		resp.DefaultMaxDepth,
+		"Deepest arrays are nested in one command, deeper close the connection",
+	)
+
+	StandaloneServerCmd.PersistentFlags().IntVar(
+		&maxRequestBytes,
+		"max-request-bytes",
+		resp.DefaultMaxRequestBytes,
+		"Most argument bytes read in one command, more close the connection",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&tlsCertFile,
+		"tls-cert",
+		"",
+		"PEM certificate file, serves TLS when set together with --tls-key. Reloaded on SIGHUP",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&tlsKeyFile,
+		"tls-key",
+		"",
+		"PEM private key file of the certificate",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&tlsClientCAFile,
+		"tls-client-ca",
+		"",
+		"PEM CA file, clients must present a certificate signed by it when set",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&usersFile,
+		"users",
+		"",
+		"User file created with server passwd, clients must authenticate when set. Reloaded on SIGHUP",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&aclFile,
+		"acl",
+		"",
+		"ACL file of principal permissions resource rules, everything else is denied when set. Reloaded on SIGHUP",
+	)
+
+	StandaloneServerCmd.PersistentFlags().Float64Var(
+		&quotaProduceBytes,
+		"quota-produce-bytes",
+		0,
+		"Bytes per second a client may append with PUT and PUT_BATCH, 0 is unlimited",
+	)
+
+	StandaloneServerCmd.PersistentFlags().Float64Var(
+		&quotaFetchBytes,
+		"quota-fetch-bytes",
+		0,
+		"Bytes per second a client may read with GET, 0 is unlimited",
+	)
+
+	StandaloneServerCmd.PersistentFlags().Float64Var(
+		&quotaRequests,
+		"quota-requests",
+		0,
+		"PUT, PUT_BATCH and GET requests per second a client may send, 0 is unlimited",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&quotaOverridesFile,
+		"quota-overrides",
+		"",
+		"File of per client quotas, lines of <client> [produce=<bytes>] [fetch=<bytes>] [requests=<n>]. Reloaded on SIGHUP",
+	)
+
+	StandaloneServerCmd.PersistentFlags().DurationVar(
+		&quotaMaxThrottle,
+		"quota-max-throttle",
+		kuling.DefaultQuotaMaxThrottle,
+		"Longest a request over the quota is delayed",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&metricsAddress,
+		"metrics-address",
+		"",
+		"Address to serve Prometheus metrics on at /metrics, for example :9100",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&httpAddress,
+		"http-address",
+		"",
+		"Address to serve the HTTP/JSON gateway on, for example :8080",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&kafkaAddress,
+		"kafka-address",
+		"",
+		"Address to serve a subset of the Kafka protocol on, for example :9092",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&kafkaAdvertisedAddress,
+		"kafka-advertised-address",
+		"",
+		"host:port Kafka clients are told to connect to, the address they connected to when empty",
+	)
+
+	StandaloneServerCmd.PersistentFlags().DurationVar(
+		&shutdownTimeout,
+		"shutdown-timeout",
+		kuling.DefaultShutdownTimeout,
+		"Longest to wait for requests in progress on SIGINT and SIGTERM before closing their connections",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&logFormat,
+		"log-format",
+		"text",
+		"Log output format, text or json",
+	)
+
+	StandaloneServerCmd.PersistentFlags().StringVar(
+		&logLevel,
+		"log-level",
+		"info",
+		"Lowest level logged, debug, info, warn or error. Debug logs every command served",
+	)
+
+	StandaloneServerCmd.PersistentFlags().BoolVar(
+		&trace,
+		"trace",
+		false,
+		"Log every command and reply, with long strings cut, for debugging clients",
+	)
 }
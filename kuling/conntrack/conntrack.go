@@ -0,0 +1,173 @@
+// Package conntrack keeps the connections of a server so that it can be shut
+// down gracefully: idle connections are closed at once and connections
+// serving a request are closed when the request is done.
+package conntrack
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks for idle connections
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Tracker tracks the listener and the connections of a server. The zero
+// value is ready to use.
+type Tracker struct {
+	mu       sync.Mutex
+	listener net.Listener
+	// conns are the open connections, true while serving a request
+	conns        map[net.Conn]bool
+	shuttingDown bool
+	onShutdown   []func()
+	// ctx is done on Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// init creates the map and the context. Must be called with the lock held.
+func (t *Tracker) init() {
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]bool)
+		t.ctx, t.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// SetListener sets the listener closed on Shutdown, false when already
+// shutting down
+func (t *Tracker) SetListener(listen net.Listener) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.shuttingDown {
+		return false
+	}
+	t.listener = listen
+
+	return true
+}
+
+// ShuttingDown reports if Shutdown has been called
+func (t *Tracker) ShuttingDown() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.shuttingDown
+}
+
+// Context is done when Shutdown is called, for requests that wait until
+// told to stop
+func (t *Tracker) Context() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.init()
+	return t.ctx
+}
+
+// Add an accepted connection as idle, false when shutting down
+func (t *Tracker) Add(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.shuttingDown {
+		return false
+	}
+	t.init()
+	t.conns[conn] = false
+
+	return true
+}
+
+// Remove the connection when it has been closed
+func (t *Tracker) Remove(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns, conn)
+}
+
+// SetActive marks the connection as serving a request or idle. Returns
+// false when the connection should not serve any more requests, as it was
+// closed by Shutdown or the server is shutting down.
+func (t *Tracker) SetActive(conn net.Conn, active bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.conns[conn]; !ok {
+		return false
+	}
+	if t.shuttingDown && !active {
+		return false
+	}
+	t.conns[conn] = active
+
+	return true
+}
+
+// RegisterOnShutdown registers a function to call on Shutdown. The function
+// is called in its own goroutine and should not wait for the requests.
+func (t *Tracker) RegisterOnShutdown(f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.onShutdown = append(t.onShutdown, f)
+}
+
+// Shutdown closes the listener, closes idle connections and waits for
+// requests in progress to be served, after which their connections are
+// closed as well. When the context is done before that the remaining
+// connections are closed and the context error returned. Otherwise returns
+// the error closing the listener.
+func (t *Tracker) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.shuttingDown = true
+	t.init()
+	t.cancel()
+	var err error
+	if t.listener != nil {
+		err = t.listener.Close()
+	}
+	for _, f := range t.onShutdown {
+		go f()
+	}
+	t.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if t.closeIdle() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			t.mu.Lock()
+			for conn := range t.conns {
+				conn.Close()
+			}
+			t.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdle closes and forgets the idle connections, true when there are no
+// connections left
+func (t *Tracker) closeIdle() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for conn, active := range t.conns {
+		if !active {
+			conn.Close()
+			delete(t.conns, conn)
+		}
+	}
+
+	return len(t.conns) == 0
+}
@@ -0,0 +1,120 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe returns the server end of a connection and its client end, closed
+// when the test ends
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	return server, client
+}
+
+// closed reports if the other end of the pipe was closed
+func closed(client net.Conn) bool {
+	client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := client.Read(make([]byte, 1))
+
+	var netErr net.Error
+	return err != nil && !(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func TestShutdownClosesIdleAndWaitsForActive(t *testing.T) {
+	var tr Tracker
+	idle, idleClient := pipe(t)
+	active, activeClient := pipe(t)
+	tr.Add(idle)
+	tr.Add(active)
+	tr.SetActive(active, true)
+
+	done := make(chan error, 1)
+	go func() { done <- tr.Shutdown(context.Background()) }()
+
+	select {
+	case <-tr.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not done on shutdown")
+	}
+	time.Sleep(2 * shutdownPollInterval)
+	if !closed(idleClient) {
+		t.Error("idle connection not closed")
+	}
+	if closed(activeClient) {
+		t.Fatal("active connection closed while serving")
+	}
+
+	// The request ends, the server is told to close the connection
+	if tr.SetActive(active, false) {
+		t.Error("connection may serve more requests while shutting down")
+	}
+	active.Close()
+	tr.Remove(active)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not return after the last request")
+	}
+	if tr.Add(idle) {
+		t.Error("added a connection after shutdown")
+	}
+}
+
+func TestShutdownContextClosesActive(t *testing.T) {
+	var tr Tracker
+	active, activeClient := pipe(t)
+	tr.Add(active)
+	tr.SetActive(active, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*shutdownPollInterval)
+	defer cancel()
+	if err := tr.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown gave %v", err)
+	}
+	if !closed(activeClient) {
+		t.Error("active connection left open after the shutdown deadline")
+	}
+}
+
+func TestShutdownClosesListener(t *testing.T) {
+	var tr Tracker
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tr.SetListener(listen) {
+		t.Fatal("listener refused before shutdown")
+	}
+
+	called := make(chan struct{})
+	tr.RegisterOnShutdown(func() { close(called) })
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := listen.Accept(); err == nil {
+		t.Error("listener open after shutdown")
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Error("shutdown function not called")
+	}
+	if !tr.ShuttingDown() || tr.SetListener(listen) {
+		t.Error("tracker not shutting down")
+	}
+}
@@ -1,5 +1,7 @@
 package kuling
 
+import "time"
+
 // DefaultBrokerPort is the port the broker server defaults to
 const DefaultBrokerPort = 9999
 
@@ -12,6 +14,24 @@ const DefaultCommandPort = 8888
 // DefaultCommandAddress is the address where the broker defaults to
 const DefaultCommandAddress = "localhost:8888"
 
+// DefaultGroupSessionTimeout is how long a group member is considered live
+// after it last asked the broker for iterators
+const DefaultGroupSessionTimeout = 30 * time.Second
+
+// DefaultIdleTimeout is how long the server keeps an idle client connection
+const DefaultIdleTimeout = 5 * time.Minute
+
+// DefaultSegmentMaxBytes is the size segments are rolled at
+const DefaultSegmentMaxBytes = 1024 * 1000 * 10 // 10MB
+
+// DefaultRetentionCheckInterval is how often segments are checked for
+// expiry when retention is configured
+const DefaultRetentionCheckInterval = time.Minute
+
+// DefaultShutdownTimeout is how long the server waits for requests in
+// progress when shutting down
+const DefaultShutdownTimeout = 10 * time.Second
+
 // DefaultBrokerDir the directory where the broker puts its' files
 const DefaultBrokerDir = "/tmp/kuling"
 
@@ -0,0 +1,454 @@
+package kuling
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults for consumer configuration values that are not set
+const (
+	DefaultConsumerMaxMessages       = 100
+	DefaultConsumerPollInterval      = 500 * time.Millisecond
+	DefaultConsumerRebalanceInterval = 10 * time.Second
+	DefaultConsumerReconnectBackoff  = time.Second
+)
+
+var (
+	// ErrConsumerClosed returned when using a consumer that has been closed
+	ErrConsumerClosed = errors.New("consumer: closed")
+	// ErrConsumerNotAssigned returned when committing a message from a shard
+	// that is no longer assigned to the consumer
+	ErrConsumerNotAssigned = errors.New("consumer: shard not assigned")
+)
+
+// MessageHandler is called by the consumer for every message in order per
+// shard. Returning an error stops the consumer from moving past the message
+// in that shard, it is delivered again after the reconnect backoff.
+type MessageHandler func(shard string, m *Message) error
+
+// ConsumerMessage is a message delivered through the consumer's message
+// channel together with the shard it was read from
+type ConsumerMessage struct {
+	Shard string
+	*Message
+}
+
+// ConsumerConfig configures a consumer. Address, Group, ClientID and Topic
+// are required, the rest falls back to defaults when not set.
+type ConsumerConfig struct {
+	// Address of the kuling server
+	Address string
+	// TLSConfig connects with TLS when set
+	TLSConfig *tls.Config
+	// Credentials to authenticate with, if the server requires it
+	Credentials Credentials
+	// Group the consumer joins, shards of the topic are divided between
+	// the members of the group
+	Group string
+	// ClientID identifies the consumer in the group and must be unique
+	// within the group
+	ClientID string
+	// Topic to consume
+	Topic string
+	// MaxMessages fetched from a shard in one request
+	MaxMessages int64
+	// PollInterval is the wait before fetching again from a shard without
+	// new messages
+	PollInterval time.Duration
+	// RebalanceInterval is how often the consumer asks the broker for its
+	// iterators. It must be well below DefaultGroupSessionTimeout or the
+	// consumer is considered dead by the broker.
+	RebalanceInterval time.Duration
+	// ReconnectBackoff is the wait before retrying after a failed request
+	ReconnectBackoff time.Duration
+	// ManualCommit turns off committing after every processed batch, the
+	// user commits with Consumer.Commit instead
+	ManualCommit bool
+	// Handler is called for every message. If nil the messages are
+	// delivered on the Messages channel instead.
+	Handler MessageHandler
+	// OnAssign is called with the shards assigned to the consumer before
+	// it starts fetching from them
+	OnAssign func(shards []string)
+	// OnRevoke is called with the shards taken from the consumer after it
+	// has stopped fetching from, and committed, them
+	OnRevoke func(shards []string)
+}
+
+// clientConfig is the config of the consumer's connections
+func (config ConsumerConfig) clientConfig() ClientConfig {
+	return ClientConfig{Address: config.Address, TLSConfig: config.TLSConfig, ClientID: config.ClientID, Credentials: config.Credentials}
+}
+
+// Consumer joins a group, fetches from the shards of the topic that are
+// assigned to it and commits its position after processing. Every assigned
+// shard is fetched concurrently, messages within a shard are delivered in
+// order. Delivery is at least once, after a rebalance or a failed commit
+// messages may be delivered again.
+type Consumer struct {
+	config   ConsumerConfig
+	messages chan *ConsumerMessage
+	// connection for group requests, fetchers have their own connections
+	conn *persistentClient
+
+	// shard name to the fetcher of that shard
+	fetchers map[string]*fetcher
+	lock     sync.Mutex
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// fetcher fetches messages from one shard assigned to the consumer
+type fetcher struct {
+	shard string
+	// iterator handed out by the broker, used for committing
+	iter string
+	// connection the fetcher gets messages on
+	conn *persistentClient
+
+	// next sequence ID to fetch and the last one committed
+	offset, committed int64
+	lock              sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewConsumer creates a consumer and starts consuming in the background
+func NewConsumer(config ConsumerConfig) (*Consumer, error) {
+	if config.Address == "" || config.Group == "" || config.ClientID == "" || config.Topic == "" {
+		return nil, fmt.Errorf("consumer: address, group, client ID and topic are required")
+	}
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = DefaultConsumerMaxMessages
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultConsumerPollInterval
+	}
+	if config.RebalanceInterval <= 0 {
+		config.RebalanceInterval = DefaultConsumerRebalanceInterval
+	}
+	if config.ReconnectBackoff <= 0 {
+		config.ReconnectBackoff = DefaultConsumerReconnectBackoff
+	}
+
+	c := &Consumer{
+		config:   config,
+		messages: make(chan *ConsumerMessage, config.MaxMessages),
+		conn:     &persistentClient{config: config.clientConfig()},
+		fetchers: make(map[string]*fetcher),
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	go c.run()
+
+	return c, nil
+}
+
+// Messages returns the channel messages are delivered on when the consumer
+// has no handler. The channel is closed when the consumer is closed.
+func (c *Consumer) Messages() <-chan *ConsumerMessage {
+	return c.messages
+}
+
+// Assignment returns the shards currently assigned to the consumer
+func (c *Consumer) Assignment() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	shards := make([]string, 0, len(c.fetchers))
+	for shard := range c.fetchers {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	return shards
+}
+
+// Commit the position of the consumer in the shard of the message such that
+// the group continues after the message
+func (c *Consumer) Commit(m *ConsumerMessage) error {
+	c.lock.Lock()
+	f, ok := c.fetchers[m.Shard]
+	c.lock.Unlock()
+
+	if !ok {
+		return ErrConsumerNotAssigned
+	}
+
+	return c.commit(f, m.SequenceID)
+}
+
+// Close stops fetching, commits the position in all assigned shards, leaves
+// the group and closes the messages channel. Safe to call concurrently, every
+// call waits for the consumer to close and all but the first return
+// ErrConsumerClosed.
+func (c *Consumer) Close() error {
+	err := ErrConsumerClosed
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		err = nil
+	})
+	<-c.closed
+
+	return err
+}
+
+// run keeps the assignment of the consumer up to date until closed
+func (c *Consumer) run() {
+	defer close(c.closed)
+	defer close(c.messages)
+	defer c.conn.Close()
+
+	ticker := time.NewTicker(c.config.RebalanceInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.rebalance(); err != nil {
+			slog.Warn("consumer: rebalance failed", "group", c.config.Group, "err", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.closing:
+			c.revoke(c.Assignment())
+
+			err := c.do(func(cl *Client) error {
+				_, err := cl.Leave(c.config.Group, c.config.ClientID)
+				return err
+			})
+			if err != nil {
+				slog.Warn("consumer: could not leave group", "group", c.config.Group, "err", err)
+			}
+			return
+		}
+	}
+}
+
+// rebalance asks the broker for the iterators of the consumer and stops
+// fetching from revoked shards and starts fetching from assigned shards
+func (c *Consumer) rebalance() error {
+	var iters []string
+	err := c.do(func(cl *Client) error {
+		var err error
+		iters, err = cl.Iters(c.config.Group, c.config.ClientID, c.config.Topic)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	assignment := make(map[string]Iter, len(iters))
+	encoded := make(map[string]string, len(iters))
+	for _, iter := range iters {
+		it, err := IterDecode(iter)
+		if err != nil {
+			return err
+		}
+
+		assignment[it.Shard()] = it
+		encoded[it.Shard()] = iter
+	}
+
+	var revoked, assigned []string
+	for _, shard := range c.Assignment() {
+		if _, ok := assignment[shard]; !ok {
+			revoked = append(revoked, shard)
+		}
+	}
+
+	c.lock.Lock()
+	for shard := range assignment {
+		if _, ok := c.fetchers[shard]; !ok {
+			assigned = append(assigned, shard)
+		}
+	}
+	c.lock.Unlock()
+	sort.Strings(assigned)
+
+	if len(revoked) > 0 {
+		c.revoke(revoked)
+	}
+
+	if len(assigned) > 0 {
+		if c.config.OnAssign != nil {
+			c.config.OnAssign(assigned)
+		}
+
+		c.lock.Lock()
+		for _, shard := range assigned {
+			f := &fetcher{
+				shard:     shard,
+				iter:      encoded[shard],
+				conn:      &persistentClient{config: c.config.clientConfig()},
+				offset:    assignment[shard].Offset(),
+				committed: assignment[shard].Offset(),
+				stop:      make(chan struct{}),
+				done:      make(chan struct{}),
+			}
+			c.fetchers[shard] = f
+			go c.fetch(f)
+		}
+		c.lock.Unlock()
+	}
+
+	return nil
+}
+
+// revoke stops fetching from the shards, commits the position in them and
+// calls the revoke callback
+func (c *Consumer) revoke(shards []string) {
+	var stopped []*fetcher
+
+	c.lock.Lock()
+	for _, shard := range shards {
+		if f, ok := c.fetchers[shard]; ok {
+			close(f.stop)
+			stopped = append(stopped, f)
+			delete(c.fetchers, shard)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, f := range stopped {
+		<-f.done
+
+		if !c.config.ManualCommit {
+			f.lock.Lock()
+			offset := f.offset
+			f.lock.Unlock()
+
+			if err := c.commit(f, offset); err != nil {
+				slog.Warn("consumer: could not commit revoked shard", "shard", f.shard, "err", err)
+			}
+		}
+	}
+
+	if len(stopped) > 0 && c.config.OnRevoke != nil {
+		c.config.OnRevoke(shards)
+	}
+}
+
+// fetch messages from the shard of the fetcher and deliver them until the
+// fetcher is stopped
+func (c *Consumer) fetch(f *fetcher) {
+	defer close(f.done)
+	defer f.conn.Close()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+
+		f.lock.Lock()
+		offset := f.offset
+		f.lock.Unlock()
+
+		var msgs []*Message
+		err := f.conn.do(func(cl *Client) error {
+			var err error
+			msgs, err = cl.Get(c.config.Topic, f.shard, offset, c.config.MaxMessages)
+			return err
+		})
+
+		var wait time.Duration
+		switch {
+		case isNoMessages(err):
+			wait = c.config.PollInterval
+		case err != nil:
+			slog.Warn("consumer: could not fetch from shard", "shard", f.shard, "err", err)
+			wait = c.config.ReconnectBackoff
+		case len(msgs) == 0:
+			wait = c.config.PollInterval
+		default:
+			if !c.deliver(f, msgs) {
+				wait = c.config.ReconnectBackoff
+			}
+		}
+
+		if wait > 0 {
+			select {
+			case <-f.stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// deliver the messages to the handler or channel and commit the position
+// after the batch. Returns false if delivery stopped before the end of the
+// batch.
+func (c *Consumer) deliver(f *fetcher, msgs []*Message) bool {
+	for _, m := range msgs {
+		if c.config.Handler != nil {
+			if err := c.config.Handler(f.shard, m); err != nil {
+				slog.Warn("consumer: handler failed", "shard", f.shard, "sequence_id", m.SequenceID, "err", err)
+				return false
+			}
+		} else {
+			select {
+			case c.messages <- &ConsumerMessage{f.shard, m}:
+			case <-f.stop:
+				return false
+			}
+		}
+
+		// A message with sequence ID n is read by starting at n - 1, the
+		// position after the message is therefore its sequence ID
+		f.lock.Lock()
+		f.offset = m.SequenceID
+		f.lock.Unlock()
+	}
+
+	if !c.config.ManualCommit {
+		if err := c.commit(f, msgs[len(msgs)-1].SequenceID); err != nil {
+			slog.Warn("consumer: could not commit shard", "shard", f.shard, "err", err)
+		}
+	}
+
+	return true
+}
+
+// commit the offset of the fetcher's shard unless it is already committed
+func (c *Consumer) commit(f *fetcher, offset int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if offset == f.committed {
+		return nil
+	}
+
+	err := c.do(func(cl *Client) error {
+		_, err := cl.Commit(f.iter, offset)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	f.committed = offset
+
+	return nil
+}
+
+// do runs the group request against the server
+func (c *Consumer) do(request func(cl *Client) error) error {
+	return c.conn.do(request)
+}
+
+// isNoMessages checks if the error from a fetch is the shard telling that
+// there are no messages at the start sequence ID yet
+func isNoMessages(err error) bool {
+	return errors.Is(err, ErrShardStartSequenceIDNotFound)
+}
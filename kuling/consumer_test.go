@@ -0,0 +1,44 @@
+package kuling
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestConsumerCloseConcurrently(t *testing.T) {
+	// Nothing listens on the address, the consumer retries until closed
+	c, err := NewConsumer(ConsumerConfig{Address: "127.0.0.1:1", Group: "group", ClientID: "client", Topic: "emails"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	closed := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			closed++
+		case !errors.Is(err, ErrConsumerClosed):
+			t.Errorf("close gave %v", err)
+		}
+	}
+	if closed != 1 {
+		t.Errorf("%d calls closed the consumer, want 1", closed)
+	}
+
+	if _, ok := <-c.Messages(); ok {
+		t.Error("messages channel open after close")
+	}
+}
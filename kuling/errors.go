@@ -1,6 +1,10 @@
 package kuling
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
 
 var (
 	// ErrChecksum when a message checksum is not correct
@@ -8,4 +12,114 @@ var (
 
 	// ErrTimeout when a timeout occurs
 	ErrTimeout = errors.New("timeout")
+
+	// ErrUnknownTopic when the topic does not exist
+	ErrUnknownTopic = errors.New("topic: unknown topic")
+
+	// ErrUnknownShard when the shard does not exist in the topic
+	ErrUnknownShard = errors.New("topic: unknown shard")
+
+	// ErrTopicExists when creating a topic that already exists
+	ErrTopicExists = errors.New("logstore: topic already exists")
+
+	// ErrInternalTopic when a client reads, writes or creates an internal
+	// topic
+	ErrInternalTopic = errors.New("topic: internal topic")
+)
+
+// Error codes sent by the server in error replies. Clients match them with
+// errors.Is against the sentinel error the code is mapped to.
+const (
+	CodeUnknownTopic       = "UNKNOWN_TOPIC"
+	CodeUnknownShard       = "UNKNOWN_SHARD"
+	CodeTopicExists        = "TOPIC_EXISTS"
+	CodeInternalTopic      = "INTERNAL_TOPIC"
+	CodeSequenceNotFound   = "SEQUENCE_NOT_FOUND"
+	CodeIllegalSequenceID  = "ILLEGAL_SEQUENCE_ID"
+	CodeIllegalMaxMessages = "ILLEGAL_MAX_MESSAGES"
+	CodeIllegalKey         = "ILLEGAL_KEY"
+	CodeIllegalPayload     = "ILLEGAL_PAYLOAD"
+	CodeMalformedIter      = "MALFORMED_ITER"
+	CodeInvalidIter        = "INVALID_ITER"
+	CodeNotInFlight        = "NOT_IN_FLIGHT"
+	CodeNotMember          = "NOT_MEMBER"
+	CodeNotOwner           = "NOT_OWNER"
+	CodeGroupActive        = "GROUP_ACTIVE"
+	CodeUnknownGroup       = "UNKNOWN_GROUP"
+	CodeUnsupported        = "UNSUPPORTED"
+	// CodeGroupExists is the code Redis uses, stream clients look for it
+	CodeGroupExists = "BUSYGROUP"
+	// CodeAuthRequired and CodeAuthFailed are the codes Redis uses
+	CodeAuthRequired = "NOAUTH"
+	CodeAuthFailed   = "WRONGPASS"
+	// CodePermissionDenied is the code Redis uses for ACL denials
+	CodePermissionDenied = "NOPERM"
 )
+
+// errorCodes maps sentinel errors to the code they are sent with. The codes
+// are part of the protocol, never change the code of an error.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrUnknownTopic, CodeUnknownTopic},
+	{ErrUnknownShard, CodeUnknownShard},
+	{ErrTopicExists, CodeTopicExists},
+	{ErrInternalTopic, CodeInternalTopic},
+	{ErrShardStartSequenceIDNotFound, CodeSequenceNotFound},
+	{ErrShardIllegalStartSequenceID, CodeIllegalSequenceID},
+	{ErrShardIllegalMaxMessages, CodeIllegalMaxMessages},
+	{ErrShardIllegalKey, CodeIllegalKey},
+	{ErrShardIllegalPayload, CodeIllegalPayload},
+	{ErrIterMalformed, CodeMalformedIter},
+	{ErrIterSignature, CodeInvalidIter},
+	{ErrIterNotInFlight, CodeNotInFlight},
+	{ErrNotMember, CodeNotMember},
+	{ErrNotOwner, CodeNotOwner},
+	{ErrGroupActive, CodeGroupActive},
+	{ErrUnknownGroup, CodeUnknownGroup},
+	{ErrHelloUnsupported, CodeUnsupported},
+	{ErrGroupExists, CodeGroupExists},
+	{ErrAuthRequired, CodeAuthRequired},
+	{ErrAuthFailed, CodeAuthFailed},
+	{ErrPermissionDenied, CodePermissionDenied},
+}
+
+// errorCode finds the code of the error, errors without a code of their own
+// are sent with the generic code
+func errorCode(err error) string {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+
+	return resp.CodeErr
+}
+
+// remoteError is an error reply from the server. It matches both the reply,
+// with errors.As into a *resp.Error, and the sentinel error of the code.
+type remoteError struct {
+	reply    *resp.Error
+	sentinel error
+}
+
+// newRemoteError maps the error reply to the sentinel error of its code.
+// Replies with codes that have no sentinel error are returned as they are.
+func newRemoteError(reply *resp.Error) error {
+	for _, ec := range errorCodes {
+		if ec.code == reply.Code {
+			return &remoteError{reply, ec.err}
+		}
+	}
+
+	return reply
+}
+
+func (e *remoteError) Error() string {
+	return e.reply.Error()
+}
+
+func (e *remoteError) Unwrap() []error {
+	return []error{e.reply, e.sentinel}
+}
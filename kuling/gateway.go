@@ -0,0 +1,755 @@
+package kuling
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for gateway configuration values that are not set
+const (
+	DefaultGatewayMaxBodyBytes = 32 << 20
+	DefaultGatewayMaxMessages  = 100
+)
+
+// gatewayHeartbeat is how often an idle tail sends a comment to keep
+// proxies from closing the stream
+const gatewayHeartbeat = 15 * time.Second
+
+// Encodings of keys and values in JSON messages
+const (
+	encodingUTF8   = "utf8"
+	encodingBase64 = "base64"
+)
+
+// gatewayThrottleHeader tells clients how long a request over their quota
+// was delayed, in milliseconds
+const gatewayThrottleHeader = "Kuling-Throttle-Ms"
+
+// ErrGatewayBadRequest when a gateway request cannot be parsed
+var ErrGatewayBadRequest = errors.New("gateway: bad request")
+
+// GatewayConfig configures the HTTP gateway. Address is required.
+type GatewayConfig struct {
+	// Address to listen on
+	Address string
+	// TLSConfig serves HTTPS when set
+	TLSConfig *tls.Config
+	// Authenticator requires requests to authenticate with basic auth, a
+	// bearer token or a client certificate when set
+	Authenticator *Authenticator
+	// ACL authorizes requests when set
+	ACL *ACL
+	// Quotas throttle produce, fetch and tail requests when set, shared with
+	// the server so that clients have one quota over both
+	Quotas *Quotas
+	// MaxBodyBytes is the largest request body accepted
+	MaxBodyBytes int64
+	// MaxMessages is the max number of messages returned by one fetch
+	MaxMessages int64
+}
+
+// gateway serves the log store and the broker over HTTP with JSON bodies
+type gateway struct {
+	config GatewayConfig
+	l      *LogStore
+	b      *Broker
+}
+
+// ListenAndServeGateway serves the HTTP gateway with the config. Blocks like
+// http.ListenAndServe.
+func ListenAndServeGateway(config GatewayConfig, l *LogStore, b *Broker) error {
+	s := NewGatewayServer(config, l, b)
+
+	if config.TLSConfig != nil {
+		return s.ListenAndServeTLS("", "")
+	}
+	return s.ListenAndServe()
+}
+
+// NewGatewayServer creates the HTTP server of the gateway with the config.
+// Serve it with ListenAndServeTLS when the config has TLS. Shutdown ends the
+// tails as they never go idle, clients resume them with Last-Event-ID.
+func NewGatewayServer(config GatewayConfig, l *LogStore, b *Broker) *http.Server {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &http.Server{
+		Addr:        config.Address,
+		Handler:     NewGatewayHandler(config, l, b),
+		TLSConfig:   config.TLSConfig,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	s.RegisterOnShutdown(cancel)
+
+	return s
+}
+
+// NewGatewayHandler creates the handler of the gateway endpoints:
+//
+//	GET    /topics
+//	POST   /topics                                       {"name", "shards"}
+//	GET    /topics/{topic}
+//	GET    /topics/{topic}/shards/{shard}
+//	POST   /topics/{topic}/shards/{shard}/messages       JSON or octet-stream body
+//	GET    /topics/{topic}/shards/{shard}/messages?from=&to=&max=
+//	GET    /topics/{topic}/shards/{shard}/tail?from=     Server-Sent Events
+//	POST   /groups/{group}/members/{client}/iterators?topic=
+//	DELETE /groups/{group}/members/{client}
+//	POST   /groups/{group}/commits                       {"iterator", "offset"}
+//	GET    /groups/{group}/topics/{topic}
+func NewGatewayHandler(config GatewayConfig, l *LogStore, b *Broker) http.Handler {
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = DefaultGatewayMaxBodyBytes
+	}
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = DefaultGatewayMaxMessages
+	}
+
+	g := &gateway{config, l, b}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /topics", g.listTopics)
+	mux.HandleFunc("POST /topics", g.createTopic)
+	mux.HandleFunc("GET /topics/{topic}", g.describeTopic)
+	mux.HandleFunc("GET /topics/{topic}/shards/{shard}", g.describeShard)
+	mux.HandleFunc("POST /topics/{topic}/shards/{shard}/messages", g.produce)
+	mux.HandleFunc("GET /topics/{topic}/shards/{shard}/messages", g.fetch)
+	mux.HandleFunc("GET /topics/{topic}/shards/{shard}/tail", g.tail)
+	mux.HandleFunc("POST /groups/{group}/members/{client}/iterators", g.iters)
+	mux.HandleFunc("DELETE /groups/{group}/members/{client}", g.leave)
+	mux.HandleFunc("POST /groups/{group}/commits", g.commit)
+	mux.HandleFunc("GET /groups/{group}/topics/{topic}", g.describeGroup)
+
+	return mux
+}
+
+// gatewayMessage is a message in JSON. Keys and values are UTF-8 strings or
+// base64 encoded, as chosen by the encoding of the request.
+type gatewayMessage struct {
+	SequenceID int64  `json:"sequence_id,omitempty"`
+	Timestamp  int64  `json:"timestamp,omitempty"`
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+}
+
+type gatewayShard struct {
+	Shard string `json:"shard"`
+	Head  int64  `json:"head"`
+	Size  int64  `json:"size"`
+}
+
+type gatewayIter struct {
+	Iterator string `json:"iterator"`
+	Topic    string `json:"topic"`
+	Shard    string `json:"shard"`
+	Offset   int64  `json:"offset"`
+}
+
+func newGatewayIter(iter string) gatewayIter {
+	it, _ := IterDecode(iter)
+	return gatewayIter{iter, it.Topic(), it.Shard(), it.Offset()}
+}
+
+func (g *gateway) listTopics(w http.ResponseWriter, r *http.Request) {
+	if !g.authorize(w, r) {
+		return
+	}
+
+	names := make([]string, 0, len(g.l.Topics()))
+	for name := range g.l.Topics() {
+		if !IsInternalTopic(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	writeJSON(w, http.StatusOK, names)
+}
+
+func (g *gateway) createTopic(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string `json:"name"`
+		Shards int    `json:"shards"`
+	}
+	if !g.decode(w, r, &req) {
+		return
+	}
+	if !g.authorize(w, r, access{PermCreate, ResourceTopic, req.Name}) {
+		return
+	}
+
+	if _, err := g.l.CreateTopic(req.Name, req.Shards); err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/topics/"+req.Name)
+	g.writeTopic(w, req.Name, http.StatusCreated)
+}
+
+func (g *gateway) describeTopic(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	if !g.authorize(w, r, access{PermRead, ResourceTopic, topic}) {
+		return
+	}
+
+	g.writeTopic(w, topic, http.StatusOK)
+}
+
+func (g *gateway) writeTopic(w http.ResponseWriter, topic string, status int) {
+	shards, err := g.l.Shards(topic)
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	desc := struct {
+		Name   string         `json:"name"`
+		Shards []gatewayShard `json:"shards"`
+	}{Name: topic}
+	for _, name := range sortedShardNames(shards) {
+		desc.Shards = append(desc.Shards, gatewayShard{name, shards[name].Head(), shards[name].Size()})
+	}
+
+	writeJSON(w, status, desc)
+}
+
+func (g *gateway) describeShard(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	if !g.authorize(w, r, access{PermRead, ResourceTopic, topic}) {
+		return
+	}
+
+	s, err := g.shard(topic, r.PathValue("shard"))
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, gatewayShard{r.PathValue("shard"), s.Head(), s.Size()})
+}
+
+// produce appends the messages of the body. An application/octet-stream
+// body is the value of one message with the key in the key query parameter,
+// any other body is JSON with one message or {"messages": [...]}.
+func (g *gateway) produce(w http.ResponseWriter, r *http.Request) {
+	topic, shard := r.PathValue("topic"), r.PathValue("shard")
+	if !g.authorize(w, r, access{PermWrite, ResourceTopic, topic}) {
+		return
+	}
+
+	var keys, values [][]byte
+	if !isBinary(r.Header.Get("Content-Type")) {
+		var req struct {
+			Key      string           `json:"key"`
+			Value    string           `json:"value"`
+			Messages []gatewayMessage `json:"messages"`
+		}
+		if !g.decode(w, r, &req) {
+			return
+		}
+		if req.Messages == nil {
+			req.Messages = []gatewayMessage{{Key: req.Key, Value: req.Value}}
+		}
+
+		for _, m := range req.Messages {
+			key, err := decodeGatewayBytes(m.Key, r)
+			if err != nil {
+				writeGatewayErr(w, err)
+				return
+			}
+			value, err := decodeGatewayBytes(m.Value, r)
+			if err != nil {
+				writeGatewayErr(w, err)
+				return
+			}
+			keys, values = append(keys, key), append(values, value)
+		}
+	} else {
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, g.config.MaxBodyBytes))
+		if err != nil {
+			writeGatewayErr(w, fmt.Errorf("%w: %s", ErrGatewayBadRequest, err))
+			return
+		}
+		keys, values = [][]byte{[]byte(r.URL.Query().Get("key"))}, [][]byte{value}
+	}
+
+	if !g.throttle(w, r, g.config.Quotas.Produce(g.client(r), payloadsSize(keys, values))) {
+		return
+	}
+
+	sequenceIDs, err := g.l.AppendBatch(topic, shard, keys, values)
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]int64{"sequence_ids": sequenceIDs})
+}
+
+// fetch returns the messages with sequence IDs from from to to, both
+// included, at most max of them
+func (g *gateway) fetch(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	if !g.authorize(w, r, access{PermRead, ResourceTopic, topic}) {
+		return
+	}
+
+	s, err := g.shard(topic, r.PathValue("shard"))
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	from, err := queryInt(q.Get("from"), 1)
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+	to, err := queryInt(q.Get("to"), s.Head())
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+	max, err := queryInt(q.Get("max"), g.config.MaxMessages)
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+	if max <= 0 || max > g.config.MaxMessages {
+		max = g.config.MaxMessages
+	}
+
+	// The bytes read are charged after the read and delay the next fetch
+	client := g.client(r)
+	if !g.throttle(w, r, g.config.Quotas.Fetch(client)) {
+		return
+	}
+
+	msgs, err := readStream(s, from, to, max)
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+	g.config.Quotas.FetchBytes(client, messagesSize(msgs))
+
+	out := make([]gatewayMessage, len(msgs))
+	for i, m := range msgs {
+		out[i] = newGatewayMessage(m, r)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"messages": out, "head": s.Head()})
+}
+
+// tail streams the messages of the shard as Server-Sent Events from the
+// sequence ID in from, or the Last-Event-ID header of a reconnecting client,
+// and then new messages as they are appended. Without either the tail
+// starts at the head.
+func (g *gateway) tail(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	if !g.authorize(w, r, access{PermRead, ResourceTopic, topic}) {
+		return
+	}
+
+	s, err := g.shard(topic, r.PathValue("shard"))
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeGatewayErr(w, fmt.Errorf("gateway: streaming not supported"))
+		return
+	}
+
+	next := s.Head() + 1
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if next, err = queryInt(id, 0); err != nil {
+			writeGatewayErr(w, err)
+			return
+		}
+		next++
+	} else if from := r.URL.Query().Get("from"); from != "" {
+		if next, err = queryInt(from, 0); err != nil {
+			writeGatewayErr(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Every read of the tail is charged as a fetch
+	client := g.client(r)
+	heartbeat := time.NewTimer(gatewayHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		if !sleepContext(r.Context(), g.config.Quotas.Fetch(client)) {
+			return
+		}
+
+		// Taken before reading so that appends after the read wake us up
+		appended := s.Appended()
+
+		msgs, err := readStream(s, next, s.Head(), g.config.MaxMessages)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(err.Error(), "\n", " "))
+			flusher.Flush()
+			return
+		}
+		g.config.Quotas.FetchBytes(client, messagesSize(msgs))
+
+		for _, m := range msgs {
+			data, _ := json.Marshal(newGatewayMessage(m, r))
+			fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", m.SequenceID, data)
+			next = m.SequenceID + 1
+		}
+		if len(msgs) > 0 {
+			flusher.Flush()
+			heartbeat.Reset(gatewayHeartbeat)
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-appended:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+			heartbeat.Reset(gatewayHeartbeat)
+		}
+	}
+}
+
+func (g *gateway) iters(w http.ResponseWriter, r *http.Request) {
+	group, client, topic := r.PathValue("group"), r.PathValue("client"), r.URL.Query().Get("topic")
+	if !g.authorize(w, r, access{PermRead, ResourceGroup, group}, access{PermRead, ResourceTopic, topic}) {
+		return
+	}
+
+	iters, err := g.b.Iters(group, client, topic)
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	out := make([]gatewayIter, len(iters))
+	for i, iter := range iters {
+		out[i] = newGatewayIter(iter)
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]gatewayIter{"iterators": out})
+}
+
+func (g *gateway) leave(w http.ResponseWriter, r *http.Request) {
+	group, client := r.PathValue("group"), r.PathValue("client")
+	if !g.authorize(w, r, access{PermRead, ResourceGroup, group}) {
+		return
+	}
+
+	if err := g.b.Leave(group, client); err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *gateway) commit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Iterator string `json:"iterator"`
+		Offset   int64  `json:"offset"`
+	}
+	if !g.decode(w, r, &req) {
+		return
+	}
+
+	it, err := IterDecode(req.Iterator)
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+	// The iterator must belong to the group of the path so that the path
+	// can be trusted by proxies and the ACL
+	if it.Group() != r.PathValue("group") {
+		writeGatewayErr(w, fmt.Errorf("%w: iterator of group %s", ErrGatewayBadRequest, it.Group()))
+		return
+	}
+	if !g.authorize(w, r, access{PermCommit, ResourceGroup, it.Group()}, access{PermRead, ResourceTopic, it.Topic()}) {
+		return
+	}
+
+	iter, err := g.b.Commit(req.Iterator, req.Offset)
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newGatewayIter(iter))
+}
+
+func (g *gateway) describeGroup(w http.ResponseWriter, r *http.Request) {
+	group, topic := r.PathValue("group"), r.PathValue("topic")
+	if !g.authorize(w, r, access{PermRead, ResourceGroup, group}, access{PermRead, ResourceTopic, topic}) {
+		return
+	}
+
+	d, err := g.b.DescribeGroup(group, topic)
+	if err != nil {
+		writeGatewayErr(w, err)
+		return
+	}
+
+	type shard struct {
+		Shard     string `json:"shard"`
+		Owner     string `json:"owner"`
+		Committed int64  `json:"committed"`
+		Head      int64  `json:"head"`
+		Lag       int64  `json:"lag"`
+	}
+	desc := struct {
+		Group   string   `json:"group"`
+		Topic   string   `json:"topic"`
+		Active  bool     `json:"active"`
+		Members []string `json:"members"`
+		Shards  []shard  `json:"shards"`
+	}{d.Group, d.Topic, d.Active, d.Members, nil}
+	for _, s := range d.Shards {
+		desc.Shards = append(desc.Shards, shard{s.Shard, s.Owner, s.Committed, s.Head, s.Lag})
+	}
+
+	writeJSON(w, http.StatusOK, desc)
+}
+
+// shard finds the shard of the topic
+func (g *gateway) shard(topic, shard string) (*Shard, error) {
+	shards, err := g.l.Shards(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := shards[shard]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownShard, shard)
+	}
+
+	return s, nil
+}
+
+// authorize authenticates the request and checks the accesses against the
+// ACL. The error reply is written when the request is not authorized.
+func (g *gateway) authorize(w http.ResponseWriter, r *http.Request, accesses ...access) bool {
+	for _, a := range accesses {
+		if a.kind == ResourceTopic && IsInternalTopic(a.name) {
+			writeGatewayErr(w, fmt.Errorf("%w %s", ErrInternalTopic, a.name))
+			return false
+		}
+	}
+
+	if g.config.Authenticator == nil {
+		return true
+	}
+
+	principal, err := g.principal(r)
+	if err != nil {
+		if errors.Is(err, ErrAuthRequired) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kuling"`)
+		}
+		writeGatewayErr(w, err)
+		return false
+	}
+
+	if g.config.ACL == nil {
+		return true
+	}
+
+	for _, a := range accesses {
+		if !g.config.ACL.Allowed(principal, a.perm, a.kind, a.name) {
+			writeGatewayErr(w, fmt.Errorf("%w: %s has no %s permission on %s", ErrPermissionDenied, principal, a.perm, a.resource()))
+			return false
+		}
+	}
+
+	return true
+}
+
+// principal authenticates the request with its client certificate, bearer
+// token or basic auth, in that order
+func (g *gateway) principal(r *http.Request) (string, error) {
+	if p := certPrincipal(r.TLS); p != "" {
+		return p, nil
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return g.config.Authenticator.AuthenticateToken(token)
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		return g.config.Authenticator.Authenticate(user, password)
+	}
+
+	return "", ErrAuthRequired
+}
+
+// client is who quotas are kept for, as sessionClient for connections: the
+// principal the request authenticated as, else the host it comes from. Used
+// after authorize, the password of basic auth is not checked again.
+func (g *gateway) client(r *http.Request) string {
+	if g.config.Authenticator != nil {
+		if p := certPrincipal(r.TLS); p != "" {
+			return p
+		}
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if p, err := g.config.Authenticator.AuthenticateToken(token); err == nil {
+				return p
+			}
+		}
+		if user, _, ok := r.BasicAuth(); ok {
+			return user
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// throttle delays a request over the quota and tells the client how long in
+// the throttle header. False when the client went away while delayed.
+func (g *gateway) throttle(w http.ResponseWriter, r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	if !sleepContext(r.Context(), d) {
+		return false
+	}
+	w.Header().Set(gatewayThrottleHeader, strconv.FormatInt(int64(d/time.Millisecond), 10))
+
+	return true
+}
+
+// sleepContext sleeps for d, false if the context is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// decode the JSON body into v. The error reply is written when the body
+// cannot be decoded.
+func (g *gateway) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, g.config.MaxBodyBytes))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		writeGatewayErr(w, fmt.Errorf("%w: %s", ErrGatewayBadRequest, err))
+		return false
+	}
+
+	return true
+}
+
+func newGatewayMessage(m *Message, r *http.Request) gatewayMessage {
+	return gatewayMessage{m.SequenceID, m.Timestamp, encodeGatewayBytes(m.Key, r), encodeGatewayBytes(m.Payload, r)}
+}
+
+// encodeGatewayBytes encodes keys and values with the encoding query
+// parameter, UTF-8 unless it is base64
+func encodeGatewayBytes(p []byte, r *http.Request) string {
+	if r.URL.Query().Get("encoding") == encodingBase64 {
+		return base64.StdEncoding.EncodeToString(p)
+	}
+
+	return string(p)
+}
+
+func decodeGatewayBytes(s string, r *http.Request) ([]byte, error) {
+	switch r.URL.Query().Get("encoding") {
+	case "", encodingUTF8:
+		return []byte(s), nil
+	case encodingBase64:
+		p, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrGatewayBadRequest, err)
+		}
+		return p, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown encoding %s", ErrGatewayBadRequest, r.URL.Query().Get("encoding"))
+}
+
+func isBinary(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/octet-stream")
+}
+
+// queryInt parses an integer query parameter, def when it is empty
+func queryInt(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: not an integer %q", ErrGatewayBadRequest, s)
+	}
+
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeGatewayErr writes the error with the status of its code and the code
+// the RESP server would have sent
+func writeGatewayErr(w http.ResponseWriter, err error) {
+	code := errorCode(err)
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrGatewayBadRequest), errors.Is(err, ErrIterMalformed), errors.Is(err, ErrShardIllegalKey),
+		errors.Is(err, ErrShardIllegalPayload), errors.Is(err, ErrShardIllegalStartSequenceID):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrAuthRequired), errors.Is(err, ErrAuthFailed):
+		status = http.StatusUnauthorized
+	case errors.Is(err, ErrPermissionDenied), errors.Is(err, ErrIterSignature), errors.Is(err, ErrInternalTopic):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrUnknownTopic), errors.Is(err, ErrUnknownShard), errors.Is(err, ErrUnknownGroup):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrTopicExists), errors.Is(err, ErrGroupActive), errors.Is(err, ErrIterNotInFlight),
+		errors.Is(err, ErrNotMember), errors.Is(err, ErrNotOwner):
+		status = http.StatusConflict
+	}
+
+	writeJSON(w, status, map[string]string{"code": code, "error": err.Error()})
+}
@@ -0,0 +1,135 @@
+package kuling
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestGateway serves the gateway until the test ends and returns its
+// URL
+func startTestGateway(t *testing.T, config GatewayConfig, l *LogStore) string {
+	t.Helper()
+
+	s := httptest.NewServer(NewGatewayHandler(config, l, newTestBroker(t, l)))
+	t.Cleanup(s.Close)
+
+	return s.URL
+}
+
+func TestGatewayProduceFetch(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	url := startTestGateway(t, GatewayConfig{}, l) + "/topics/emails/shards/" + firstShard + "/messages"
+
+	res, err := http.Post(url, "application/json", strings.NewReader(`{"messages": [{"key": "k", "value": "a"}, {"key": "k", "value": "b"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var produced struct {
+		SequenceIDs []int64 `json:"sequence_ids"`
+	}
+	json.NewDecoder(res.Body).Decode(&produced)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || len(produced.SequenceIDs) != 2 || produced.SequenceIDs[1] != 2 {
+		t.Fatalf("produce replied %d %v", res.StatusCode, produced.SequenceIDs)
+	}
+
+	res, err = http.Get(url + "?from=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched struct {
+		Head     int64            `json:"head"`
+		Messages []gatewayMessage `json:"messages"`
+	}
+	json.NewDecoder(res.Body).Decode(&fetched)
+	res.Body.Close()
+	if fetched.Head != 2 || len(fetched.Messages) != 1 || fetched.Messages[0].Value != "b" {
+		t.Fatalf("fetch replied %+v", fetched)
+	}
+
+	res, err = http.Get(startTestGateway(t, GatewayConfig{}, l) + "/topics/nope/shards/" + firstShard + "/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("fetch from an unknown topic replied %d", res.StatusCode)
+	}
+}
+
+func TestGatewayQuotas(t *testing.T) {
+	q, err := NewQuotas(QuotaConfig{Default: Quota{Requests: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1, "a")
+	url := startTestGateway(t, GatewayConfig{Quotas: q}, l) + "/topics/emails/shards/" + firstShard + "/messages"
+
+	// Produce and fetch share the request quota, the first second of
+	// requests is the burst
+	for i := 0; i < 10; i++ {
+		res, err := http.Post(url, "application/json", strings.NewReader(`{"key": "k", "value": "v"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if h := res.Header.Get(gatewayThrottleHeader); h != "" {
+			t.Fatalf("request %d within the burst throttled %s ms", i, h)
+		}
+	}
+
+	start := time.Now()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get(gatewayThrottleHeader) == "" {
+		t.Error("fetch over the quota has no throttle header")
+	}
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("fetch over the quota took %s", took)
+	}
+}
+
+func TestGatewayTailWakesOnAppend(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	url := startTestGateway(t, GatewayConfig{}, l) + "/topics/emails/shards/" + firstShard + "/tail"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if _, err := l.Append("emails", firstShard, []byte("k"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data: ") {
+			var m gatewayMessage
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.SequenceID != 1 || m.Value != "a" {
+				t.Errorf("tailed %+v", m)
+			}
+			return
+		}
+	}
+	t.Fatalf("tail ended without the appended message: %v", scanner.Err())
+}
@@ -0,0 +1,268 @@
+package kuling
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+// ProtocolVersion is the version of the protocol spoken by this server and
+// client. It is raised when commands change in ways old peers cannot handle.
+const ProtocolVersion int64 = 1
+
+// CodecNone sends messages uncompressed, the only codec so far
+const CodecNone = "none"
+
+// Features that are negotiated with HELLO. Clients only rely on a feature
+// when the server has it in the HELLO reply.
+const (
+	// FeaturePutBatch is the PUT_BATCH command
+	FeaturePutBatch = "put_batch"
+	// FeatureGroupAdmin are the DESCRIBE_GROUP and RESET_GROUP commands
+	FeatureGroupAdmin = "group_admin"
+	// FeatureErrorCodes are the stable error codes in error replies
+	FeatureErrorCodes = "error_codes"
+	// FeatureHelp is the HELP command
+	FeatureHelp = "help"
+	// FeatureThrottle is the THROTTLE status sent before the reply of a
+	// request that was delayed for going over the client's quota
+	FeatureThrottle = "throttle"
+)
+
+// ErrHelloUnsupported returned when client and server have no protocol
+// version or message format in common
+var ErrHelloUnsupported = errors.New("hello: unsupported")
+
+// helloSessionKey is the session key the negotiated Hello is stored under
+const helloSessionKey = "hello"
+
+var (
+	supportedMagics   = []byte{MagicV0, MagicV1}
+	supportedCodecs   = []string{CodecNone}
+	supportedFeatures = []string{FeaturePutBatch, FeatureGroupAdmin, FeatureErrorCodes, FeatureHelp, FeatureThrottle}
+)
+
+// Hello is the outcome of the handshake between a client and a server, what
+// both of them support
+type Hello struct {
+	// Version of the protocol, the lowest of the two
+	Version int64
+	// ClientID the client identified itself with, server side only
+	ClientID string
+	// Magic is the newest message format both support, messages from GET
+	// are converted to it
+	Magic byte
+	// Codecs both support
+	Codecs []string
+	// Features both support
+	Features []string
+}
+
+// HasFeature reports if both client and server support the feature
+func (h *Hello) HasFeature(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiateHello finds what the client and the server have in common. The
+// client sends its version and optionally client_id, magic, codecs and
+// features fields, lists are comma separated. A client that leaves out a
+// list supports what the first version of the protocol did.
+func negotiateHello(version int64, fields map[string]string) (*Hello, error) {
+	if version < 1 {
+		return nil, fmt.Errorf("%w protocol version %d", ErrHelloUnsupported, version)
+	}
+
+	h := &Hello{Version: version, ClientID: fields["client_id"]}
+	if h.Version > ProtocolVersion {
+		h.Version = ProtocolVersion
+	}
+
+	magics := []byte{MagicV0}
+	if s, ok := fields["magic"]; ok {
+		magics = nil
+		for _, m := range splitList(s) {
+			n, err := strconv.ParseUint(m, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%w message format %q", ErrHelloUnsupported, m)
+			}
+			magics = append(magics, byte(n))
+		}
+	}
+
+	found := false
+	for _, m := range magics {
+		for _, sm := range supportedMagics {
+			if m == sm && (!found || m > h.Magic) {
+				h.Magic, found = m, true
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w message formats %v", ErrHelloUnsupported, magics)
+	}
+
+	codecs := []string{CodecNone}
+	if s, ok := fields["codecs"]; ok {
+		codecs = splitList(s)
+	}
+	h.Codecs = intersect(codecs, supportedCodecs)
+	if len(h.Codecs) == 0 {
+		return nil, fmt.Errorf("%w codecs %v", ErrHelloUnsupported, codecs)
+	}
+
+	h.Features = intersect(splitList(fields["features"]), supportedFeatures)
+
+	return h, nil
+}
+
+// helloArgs are the arguments the client sends in HELLO
+func helloArgs(clientID string) []interface{} {
+	magics := make([]string, len(supportedMagics))
+	for i, m := range supportedMagics {
+		magics[i] = strconv.Itoa(int(m))
+	}
+
+	args := []interface{}{"HELLO", ProtocolVersion,
+		"magic", strings.Join(magics, ","),
+		"codecs", strings.Join(supportedCodecs, ","),
+		"features", strings.Join(supportedFeatures, ","),
+	}
+	if clientID != "" {
+		args = append(args, "client_id", clientID)
+	}
+
+	return args
+}
+
+// parseHello parses the HELLO reply of the server
+func parseHello(reply interface{}) (*Hello, error) {
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("hello: malformed reply")
+	}
+
+	h := &Hello{}
+	for i := 0; i < len(fields); i += 2 {
+		name, _ := fields[i].([]byte)
+		switch string(name) {
+		case "version":
+			h.Version, _ = fields[i+1].(int64)
+		case "magic":
+			m, _ := fields[i+1].(int64)
+			h.Magic = byte(m)
+		case "codecs":
+			h.Codecs = stringList(fields[i+1])
+		case "features":
+			h.Features = stringList(fields[i+1])
+		}
+	}
+
+	return h, nil
+}
+
+// sessionHello returns what the client of the session negotiated, nil if it
+// never sent HELLO
+func sessionHello(s *resp.Session) *Hello {
+	h, _ := s.Get(helloSessionKey).(*Hello)
+	return h
+}
+
+// sessionMagic is the message format the client of the session reads.
+// Clients that never sent HELLO predate message format negotiation and only
+// read MagicV0.
+func sessionMagic(s *resp.Session) byte {
+	if h := sessionHello(s); h != nil {
+		return h.Magic
+	}
+	return MagicV0
+}
+
+func createHelloHandler() resp.HandleFunc {
+	return func(w resp.ResponseWriter, r *resp.Request) {
+		fields := make(map[string]string)
+		for i := 1; i < len(r.Args); i += 2 {
+			fields[strings.ToLower(r.String(i))] = r.String(i + 1)
+		}
+
+		h, err := negotiateHello(r.Int64(0), fields)
+		if err != nil {
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
+		}
+
+		r.Session.Set(helloSessionKey, h)
+
+		w.WriteInstruction('*', 8)
+		w.WriteString("version")
+		w.WriteInt64(h.Version)
+		w.WriteString("magic")
+		w.WriteInt64(int64(h.Magic))
+		w.WriteString("codecs")
+		w.WriteArray(toInterfaces(h.Codecs)...)
+		w.WriteString("features")
+		w.WriteArray(toInterfaces(h.Features)...)
+	}
+}
+
+// splitList splits a comma separated list, an empty string is an empty list
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
+
+// intersect returns the sorted elements of a that are also in b
+func intersect(a, b []string) []string {
+	var both []string
+	for _, e := range a {
+		for _, f := range b {
+			if e == f {
+				both = append(both, e)
+				break
+			}
+		}
+	}
+	sort.Strings(both)
+
+	return both
+}
+
+func stringList(v interface{}) []string {
+	arr, _ := v.([]interface{})
+	list := make([]string, 0, len(arr))
+	for _, e := range arr {
+		if p, ok := e.([]byte); ok {
+			list = append(list, string(p))
+		}
+	}
+
+	return list
+}
+
+func toInterfaces(s []string) []interface{} {
+	arr := make([]interface{}, len(s))
+	for i, e := range s {
+		arr[i] = e
+	}
+
+	return arr
+}
@@ -89,7 +89,7 @@ func OpenIndex(path string, permData os.FileMode) (*LogIndex, error) {
 	// The next sequence ID can be calculated from the size which gives
 	// the number of messages in the log and then adding 1 for it to represent
 	// the next id
-	nextSequenceID := fd.Size()/(keyLen+valueLen) + 1
+	nextSequenceID := fd.Size()/(keyLen+valueLen+valueSizeLen) + 1
 
 	// Create log
 	log := &LogIndex{
@@ -105,19 +105,32 @@ func OpenIndex(path string, permData os.FileMode) (*LogIndex, error) {
 	return log, err
 }
 
-// Close the index
-func (idx *LogIndex) Close() {
+// Close the index. Entries are fsynced before the file is closed, reads in
+// progress are waited for. Closing a closed index does nothing.
+func (idx *LogIndex) Close() error {
 	// Write lock the index and defer the unlock
 	idx.lock.Lock()
 	defer idx.lock.Unlock()
-	defer funlock(idx.writeFile)
 
+	if !idx.running {
+		return nil
+	}
 	idx.running = false
-	// Close the write file for writing
-	idx.writeFile.Close()
+
 	// Readers do not acqurie read lock as they can read without checking in
 	// with the writer. However we should wait for all the readers to finish
 	idx.readWaitGroup.Wait()
+
+	syncErr := fsync(idx.writeFile)
+	funlock(idx.writeFile)
+	if err := idx.writeFile.Close(); err != nil {
+		return fmt.Errorf("index: could not close index file %s: %s", idx.path, err)
+	}
+	if syncErr != nil {
+		return fmt.Errorf("index: could not fsync index file %s: %s", idx.path, syncErr)
+	}
+
+	return nil
 }
 
 // Next writes the offset value to the next sequence ID and the segment where
@@ -175,12 +188,21 @@ func (idx *LogIndex) Next(segmentNumber, offsetValue int64) (int64, error) {
 	// Increase the sequence ID for this entry
 	idx.nextSequenceID++
 	// Increase the file size with the size of writing one index entry
-	idx.size += (keyLen + valueLen)
+	idx.size += (keyLen + valueLen + valueSizeLen)
 
 	// return sequcenID for the entry
 	return currentSequenceID, nil
 }
 
+// Head returns the last sequence ID handed out by the index which is also
+// the number of entries in the index. An empty index has head zero.
+func (idx *LogIndex) Head() int64 {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	return idx.nextSequenceID - 1
+}
+
 // SegmentAndOffset finds the offset value stored under the sequenceID key. If
 // The sequence ID cannot be found then ErrSequenceIDNotFound is returned.
 // If any trouble during file operations ErrIndexFileCouldNotBeOpened is
@@ -216,6 +238,7 @@ func (idx *LogIndex) SegmentAndOffset(sequenceID int64) (int64, int64, error) {
 	if err != nil {
 		return 0, 0, ErrIndexFileCouldNotBeOpened
 	}
+	defer readFile.Close()
 
 	// Seek to the seek offset of the sequence ID. As clients are most likely
 	// to be up to speed it's better to seek from the end of the file
@@ -1,11 +1,41 @@
 package kuling
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"strconv"
+	"io/ioutil"
+	"os"
 	"strings"
 )
 
+// iterVersion is the version of iterator IDs and iterEncodingVersion the
+// version of encoded iterators. They are the first byte of each so that the
+// formats can evolve. Version 1 iterators had no owner, they were only
+// valid while in flight and no server has them in flight after an upgrade.
+const (
+	iterVersion         byte = 1
+	iterEncodingVersion byte = 2
+)
+
+// Length of the truncated HMAC-SHA256 that signs an encoded iterator
+const iterMACLen = 16
+
+// Length of the generated iterator signing key
+const iterKeyLen = 32
+
+var (
+	// ErrIterMalformed returned when an iterator cannot be decoded
+	ErrIterMalformed = errors.New("iter: malformed iterator")
+	// ErrIterSignature returned when an iterator was not signed by the server
+	// or has been altered
+	ErrIterSignature = errors.New("iter: invalid iterator signature")
+)
+
 // Iter has an ID for referenceing Iterators between users of the iterator.
 // Iter is a forward iterator that reads a number of messages starting
 // from the start sequence id and reading from there. It reads from a specific
@@ -15,45 +45,190 @@ type Iter struct {
 	topic  string // topic to read from
 	shard  string // shard in the topic for this iterator
 	offset int64  // current offset of the iterator
+	owner  string // client in the group the broker handed the iterator to
 }
 
-func createIter(group, topic, shard string) string {
-	return fmt.Sprintf("%s/%s/%s/%d", group, topic, shard, 0)
+// NewIter creates an iterator for the group in the topic shard at offset
+func NewIter(group, topic, shard string, offset int64) Iter {
+	return Iter{group, topic, shard, offset, ""}
+}
+
+// Group that owns the iterator
+func (i Iter) Group() string { return i.group }
+
+// Topic the iterator reads from
+func (i Iter) Topic() string { return i.topic }
+
+// Shard in the topic the iterator reads from
+func (i Iter) Shard() string { return i.shard }
+
+// Offset is the sequence ID the iterator continues reading from
+func (i Iter) Offset() int64 { return i.offset }
+
+// Owner is the client the broker handed the iterator to, only the owner of
+// the shard may commit it
+func (i Iter) Owner() string { return i.owner }
+
+// ID of the iterator which is what makes the iterator unique.
+func (i Iter) ID() string {
+	return createIterID(i.group, i.topic, i.shard)
 }
 
+// createIterID creates the key iterators are stored under. Group and topic
+// are length prefixed so that no group, topic and shard combination can
+// produce the ID of another, whatever characters the names contain.
 func createIterID(group, topic, shard string) string {
-	return fmt.Sprintf("%s/%s/%s", group, topic, shard)
+	return iterIDPrefix(group, topic) + shard
 }
 
-func createIterFromIDAndOffset(iterID string, offset int64) string {
-	return fmt.Sprintf("%s/%d", iterID, offset)
+// iterIDPrefix is the part of the iterator ID shared by all shards of a
+// topic for a group. Used for prefix scans in iter stores.
+func iterIDPrefix(group, topic string) string {
+	buf := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(group)+len(topic))
+	buf = append(buf, iterVersion)
+	buf = appendString(buf, group)
+	buf = appendString(buf, topic)
+	return string(buf)
 }
 
-// ID of the iterator which is what makes the iterator unique.
-func (i Iter) ID() string {
-	return i.group + i.topic + i.shard
+// legacyIterID converts an iterator ID from the old group/topic/shard format
+// into the current format. Returns false if the ID is already in the current
+// format or cannot be split into exactly a group, topic and shard.
+func legacyIterID(id string) (string, bool) {
+	if len(id) > 0 && id[0] == iterVersion {
+		return "", false
+	}
+
+	arr := strings.Split(id, "/")
+	if len(arr) != 3 {
+		return "", false
+	}
+
+	return createIterID(arr[0], arr[1], arr[2]), true
 }
 
-// IterEncode encodes the iterator into a base64 encoded string
-func IterEncode(i Iter) (string, error) {
-	return fmt.Sprintf("%s/%s/%s/%d", i.group, i.topic, i.shard, i.offset), nil
+// IterEncode encodes the iterator into an opaque base64 encoded string
+// signed with the key so that the server can detect forged iterators.
+func IterEncode(i Iter, key []byte) string {
+	buf := make([]byte, 0, 1+4*binary.MaxVarintLen64+len(i.group)+len(i.topic)+len(i.shard)+len(i.owner)+8+iterMACLen)
+	buf = append(buf, iterEncodingVersion)
+	buf = appendString(buf, i.group)
+	buf = appendString(buf, i.topic)
+	buf = appendString(buf, i.shard)
+	buf = appendString(buf, i.owner)
+
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], uint64(i.offset))
+	buf = append(buf, offset[:]...)
+	buf = append(buf, iterMAC(buf, key)...)
+
+	return base64.RawURLEncoding.EncodeToString(buf)
 }
 
-// IterDecode decodes a base64 string into an iterator
+// IterDecode decodes a base64 string into an iterator without verifying the
+// signature. Clients use it to find the shard and offset of an iterator,
+// the server verifies iterators with IterVerify.
 func IterDecode(iter string) (Iter, error) {
-	arr := strings.Split(iter, "/")
+	it, _, _, err := iterDecode(iter)
+	return it, err
+}
 
-	offset, err := strconv.ParseInt(arr[3], 0, 64)
+// IterVerify decodes a base64 string into an iterator and verifies that it
+// was signed with the key
+func IterVerify(iter string, key []byte) (Iter, error) {
+	it, payload, mac, err := iterDecode(iter)
 	if err != nil {
 		return Iter{}, err
 	}
 
-	it := Iter{
-		group:  arr[0],
-		topic:  arr[1],
-		shard:  arr[2],
-		offset: offset,
+	if !hmac.Equal(mac, iterMAC(payload, key)) {
+		return Iter{}, ErrIterSignature
 	}
 
 	return it, nil
 }
+
+// iterDecode decodes the iterator and returns the signed payload and the
+// signature along with it
+func iterDecode(iter string) (Iter, []byte, []byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(iter)
+	if err != nil || len(buf) < 1+iterMACLen || buf[0] != iterEncodingVersion {
+		return Iter{}, nil, nil, ErrIterMalformed
+	}
+
+	payload, mac := buf[:len(buf)-iterMACLen], buf[len(buf)-iterMACLen:]
+
+	var it Iter
+	var ok bool
+	p := payload[1:]
+	if it.group, p, ok = readString(p); !ok {
+		return Iter{}, nil, nil, ErrIterMalformed
+	}
+	if it.topic, p, ok = readString(p); !ok {
+		return Iter{}, nil, nil, ErrIterMalformed
+	}
+	if it.shard, p, ok = readString(p); !ok {
+		return Iter{}, nil, nil, ErrIterMalformed
+	}
+	if it.owner, p, ok = readString(p); !ok {
+		return Iter{}, nil, nil, ErrIterMalformed
+	}
+	if len(p) != 8 {
+		return Iter{}, nil, nil, ErrIterMalformed
+	}
+	it.offset = int64(binary.BigEndian.Uint64(p))
+
+	return it, payload, mac, nil
+}
+
+func iterMAC(payload, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+	return h.Sum(nil)[:iterMACLen]
+}
+
+// appendString appends the uvarint length of s followed by s
+func appendString(buf []byte, s string) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(s)))
+	buf = append(buf, l[:n]...)
+	return append(buf, s...)
+}
+
+// readString reads a uvarint length prefixed string and returns the rest of
+// the buffer after it
+func readString(p []byte) (string, []byte, bool) {
+	l, n := binary.Uvarint(p)
+	if n <= 0 || uint64(len(p)-n) < l {
+		return "", nil, false
+	}
+
+	return string(p[n : n+int(l)]), p[n+int(l):], true
+}
+
+// LoadIterKey loads the key used to sign iterators from the file, creating
+// the file with a new random key if it does not exist. The key must survive
+// restarts for iterators handed out before a restart to stay valid.
+func LoadIterKey(path string, perm os.FileMode) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) < iterKeyLen {
+			return nil, fmt.Errorf("iter: key file %s too short", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("iter: could not read key file %s: %s", path, err)
+	}
+
+	key = make([]byte, iterKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("iter: could not generate key: %s", err)
+	}
+
+	if err := ioutil.WriteFile(path, key, perm); err != nil {
+		return nil, fmt.Errorf("iter: could not write key file %s: %s", path, err)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,109 @@
+package kuling
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestIterEncodeRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), iterKeyLen)
+	it := NewIter("group/a", "topic/b", firstShard, 42)
+
+	enc := IterEncode(it, key)
+	for _, part := range []string{"group", "topic", firstShard} {
+		if strings.Contains(enc, part) {
+			t.Errorf("encoded iterator %s shows %s", enc, part)
+		}
+	}
+
+	got, err := IterVerify(enc, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != it {
+		t.Fatalf("decoded %+v, encoded %+v", got, it)
+	}
+	if got, _ := IterDecode(enc); got != it {
+		t.Errorf("decoded without key %+v", got)
+	}
+}
+
+func TestIterVerifyRejectsTampering(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), iterKeyLen)
+	enc := IterEncode(NewIter("group", "topic", firstShard, 1), key)
+
+	if _, err := IterVerify(enc, bytes.Repeat([]byte("o"), iterKeyLen)); !errors.Is(err, ErrIterSignature) {
+		t.Errorf("other key gave %v", err)
+	}
+
+	// Raise the offset, the last byte before the signature
+	buf, _ := base64.RawURLEncoding.DecodeString(enc)
+	buf[len(buf)-iterMACLen-1]++
+	forged := base64.RawURLEncoding.EncodeToString(buf)
+	if it, _ := IterDecode(forged); it.Offset() != 2 {
+		t.Fatalf("forged offset %d", it.Offset())
+	}
+	if _, err := IterVerify(forged, key); !errors.Is(err, ErrIterSignature) {
+		t.Errorf("forged offset gave %v", err)
+	}
+
+	for _, bad := range []string{"", "!!!", enc[:len(enc)-4], "A" + enc} {
+		if _, err := IterVerify(bad, key); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestIterIDsDoNotCollide(t *testing.T) {
+	// Slashes in names made these the same ID in the old format
+	a := createIterID("a/b", "c", "d")
+	b := createIterID("a", "b/c", "d")
+	if a == b {
+		t.Fatalf("IDs collide: %q", a)
+	}
+	if !strings.HasPrefix(a, iterIDPrefix("a/b", "c")) || strings.HasPrefix(b, iterIDPrefix("a/b", "c")) {
+		t.Error("prefix matches another group and topic")
+	}
+}
+
+func TestLegacyIterID(t *testing.T) {
+	id, ok := legacyIterID("group/topic/" + firstShard)
+	if !ok || id != createIterID("group", "topic", firstShard) {
+		t.Errorf("converted to %q, %t", id, ok)
+	}
+	if _, ok := legacyIterID(createIterID("group", "topic", firstShard)); ok {
+		t.Error("converted a current ID")
+	}
+	if _, ok := legacyIterID("group/topic"); ok {
+		t.Error("converted an ID without a shard")
+	}
+}
+
+func TestLoadIterKey(t *testing.T) {
+	file := path.Join(t.TempDir(), "iter.key")
+	key, err := LoadIterKey(file, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != iterKeyLen {
+		t.Fatalf("key of %d bytes", len(key))
+	}
+
+	again, err := LoadIterKey(file, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, again) {
+		t.Error("key changed when loaded again")
+	}
+
+	os.WriteFile(file, []byte("short"), 0600)
+	if _, err := LoadIterKey(file, 0600); err == nil {
+		t.Error("loaded a short key")
+	}
+}
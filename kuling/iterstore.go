@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/boltdb/bolt"
 )
@@ -13,6 +13,8 @@ import (
 type IterStore interface {
 	Commit(iter string, offset int64) error
 	GetAll(group, topic string) (map[string]int64, error)
+	// Close the store, commits after close fail
+	Close() error
 }
 
 const (
@@ -21,19 +23,75 @@ const (
 
 // BoltIterStore stores iters in a bolt DB
 type BoltIterStore struct {
-	db *bolt.DB
+	db     *bolt.DB
+	logger *slog.Logger
 }
 
 // OpenBoltIterStore creates a new bolt db backed iter store
-func OpenBoltIterStore(path string, c *Config) *BoltIterStore {
+func OpenBoltIterStore(path string, c *Config) (*BoltIterStore, error) {
 	db, err := bolt.Open(path, c.PermData, nil)
 	if err != nil {
-		log.Fatal("boltiterstore:", err)
+		return nil, fmt.Errorf("boltiterstore: could not open %s: %s", path, err)
 	}
 
-	return &BoltIterStore{
-		db: db,
+	bs := &BoltIterStore{
+		db:     db,
+		logger: c.logger(),
 	}
+
+	if err := bs.migrateLegacyIterIDs(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("boltiterstore: %s", err)
+	}
+
+	return bs, nil
+}
+
+// migrateLegacyIterIDs rewrites iterators stored under the old
+// group/topic/shard keys to the current iterator ID format. IDs that cannot
+// be split into a group, topic and shard are left as they are.
+func (bs *BoltIterStore) migrateLegacyIterIDs() error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(itersBucket))
+		if b == nil {
+			return nil
+		}
+
+		// Collect first as the bucket cannot be modified while iterating it
+		migrated := make(map[string][]byte)
+		err := b.ForEach(func(iterID, v []byte) error {
+			if len(iterID) > 0 && iterID[0] == iterVersion {
+				return nil
+			}
+
+			if _, ok := legacyIterID(string(iterID)); !ok {
+				bs.logger.Warn("boltiterstore: skipping migration of ambiguous iterator", "iter", string(iterID))
+				return nil
+			}
+
+			migrated[string(iterID)] = append([]byte(nil), v...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for legacy, v := range migrated {
+			iterID, _ := legacyIterID(legacy)
+			if err := b.Put([]byte(iterID), v); err != nil {
+				return fmt.Errorf("migrate iterator %q: %s", legacy, err)
+			}
+			if err := b.Delete([]byte(legacy)); err != nil {
+				return fmt.Errorf("migrate iterator %q: %s", legacy, err)
+			}
+		}
+
+		if len(migrated) > 0 {
+			bs.logger.Info("boltiterstore: migrated iterators to the current iterator ID format", "iterators", len(migrated))
+		}
+
+		return nil
+	})
 }
 
 // Commit persists an iterator and it's offset
@@ -62,6 +120,31 @@ func (bs *BoltIterStore) Commit(iter string, offset int64) error {
 	return nil
 }
 
+// ForEach calls fn for every persisted iterator and it's offset. Iteration
+// stops at the first error returned by fn.
+func (bs *BoltIterStore) ForEach(fn func(iter string, offset int64) error) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(itersBucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(iterID, v []byte) error {
+			var offset int64
+			if err := binary.Read(bytes.NewReader(v), binary.BigEndian, &offset); err != nil {
+				return fmt.Errorf("boltiterstore: iterator %s offset not parseable: %s", iterID, err)
+			}
+
+			return fn(string(iterID), offset)
+		})
+	})
+}
+
+// Close the bolt DB and release the file lock
+func (bs *BoltIterStore) Close() error {
+	return bs.db.Close()
+}
+
 // GetAll iterators for a group and topic
 func (bs *BoltIterStore) GetAll(group, topic string) (map[string]int64, error) {
 	iters := make(map[string]int64)
@@ -75,7 +158,7 @@ func (bs *BoltIterStore) GetAll(group, topic string) (map[string]int64, error) {
 
 		// Range Scan Bolt DB bucket with the group and topic, exclude the shard
 		// from the key as that is the part we are looking for.
-		prefix := []byte(group + "/" + topic)
+		prefix := []byte(iterIDPrefix(group, topic))
 		for iterID, v := c.Seek(prefix); bytes.HasPrefix(iterID, prefix); iterID, v = c.Next() {
 			var offset int64
 			if err := binary.Read(bytes.NewReader(v), binary.BigEndian, &offset); err != nil {
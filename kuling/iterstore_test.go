@@ -0,0 +1,55 @@
+package kuling
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestBoltIterStoreCloseReleasesLock(t *testing.T) {
+	file := path.Join(t.TempDir(), "iters.db")
+	config := &Config{PermDirectories: 0755, PermData: 0644}
+
+	bs, err := OpenBoltIterStore(file, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := iterIDPrefix("group", "emails") + firstShard
+	if err := bs.Commit(id, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Commit(id, 4); err == nil {
+		t.Error("committed after close")
+	}
+
+	// Bolt waits for the file lock, a store left open blocks the next open
+	opened := make(chan *BoltIterStore)
+	go func() {
+		bs, err := OpenBoltIterStore(file, config)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- bs
+	}()
+
+	select {
+	case bs = <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("file lock held after close")
+	}
+	if bs == nil {
+		return
+	}
+	defer bs.Close()
+
+	all, err := bs.GetAll("group", "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[id] != 3 {
+		t.Errorf("offset %d after reopen, want 3", all[id])
+	}
+}
@@ -0,0 +1,905 @@
+package kuling
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/kafka"
+)
+
+// Kafka clients are served a subset of the Kafka protocol. The server is a
+// cluster of one broker, a topic's partitions are its shards sorted by name
+// and a message's offset is its sequence ID minus one. Committed offsets are
+// the committed iterators of the broker group with the same name.
+
+// kafkaNodeID is the broker ID the server announces itself as
+const kafkaNodeID = 0
+
+// kafkaClusterID is the cluster ID sent in metadata
+const kafkaClusterID = "kuling"
+
+// kafkaPollInterval is how often fetches waiting for min bytes look for new
+// messages
+const kafkaPollInterval = 50 * time.Millisecond
+
+// kafkaMaxRead is the max number of messages read from a shard at a time
+const kafkaMaxRead = 1000
+
+// SASL mechanisms, PLAIN authenticates users and OAUTHBEARER tokens
+const (
+	saslPlain       = "PLAIN"
+	saslOAuthBearer = "OAUTHBEARER"
+)
+
+// KafkaConfig configures the Kafka listener. Address is required.
+type KafkaConfig struct {
+	// Address to listen on
+	Address string
+	// AdvertisedAddress is the host:port clients are told to connect to,
+	// the address they connected to when empty
+	AdvertisedAddress string
+	// TLSConfig serves TLS connections when set
+	TLSConfig *tls.Config
+	// Authenticator requires clients to authenticate with SASL PLAIN,
+	// SASL OAUTHBEARER or a client certificate when set
+	Authenticator *Authenticator
+	// ACL authorizes requests when set
+	ACL *ACL
+	// IdleTimeout closes connections that have not sent a request within
+	// the timeout
+	IdleTimeout time.Duration
+}
+
+// kafkaBroker serves the log store and the broker to Kafka clients
+type kafkaBroker struct {
+	config KafkaConfig
+	l      *LogStore
+	b      *Broker
+}
+
+// ListenAndServeKafka serves the Kafka protocol with the config. Blocks
+// until the listener fails.
+func ListenAndServeKafka(config KafkaConfig, l *LogStore, b *Broker) error {
+	return NewKafkaServer(config, l, b).ListenAndServe()
+}
+
+// NewKafkaServer creates the Kafka listener with the config, started with
+// ListenAndServe and stopped with Shutdown
+func NewKafkaServer(config KafkaConfig, l *LogStore, b *Broker) *kafka.Server {
+	k := &kafkaBroker{config, l, b}
+
+	mux := kafka.NewServeMux()
+	mux.Handle(kafka.APIProduce, 3, 7, k.produce)
+	mux.Handle(kafka.APIFetch, 4, 11, k.fetch)
+	mux.Handle(kafka.APIListOffsets, 1, 5, k.listOffsets)
+	mux.Handle(kafka.APIMetadata, 0, 7, k.metadata)
+	mux.Handle(kafka.APIOffsetCommit, 2, 7, k.offsetCommit)
+	mux.Handle(kafka.APIOffsetFetch, 1, 5, k.offsetFetch)
+	mux.Handle(kafka.APIFindCoordinator, 0, 2, k.findCoordinator)
+
+	var h kafka.Handler = mux
+	if config.Authenticator != nil {
+		mux.Handle(kafka.APISaslHandshake, 1, 1, k.saslHandshake)
+		mux.Handle(kafka.APISaslAuthenticate, 0, 1, k.saslAuthenticate)
+		h = kafkaRequireAuth{mux}
+	}
+
+	return &kafka.Server{
+		Addr:        config.Address,
+		Handler:     h,
+		TLSConfig:   config.TLSConfig,
+		IdleTimeout: config.IdleTimeout,
+	}
+}
+
+// kafkaRequireAuth closes connections that send anything but ApiVersions and
+// SASL requests before authenticating, as Kafka brokers do. Clients with a
+// verified TLS certificate are authenticated as its common name.
+type kafkaRequireAuth struct {
+	next kafka.Handler
+}
+
+func (h kafkaRequireAuth) ServeKafka(w *kafka.Encoder, r *kafka.Request) error {
+	if r.Session.Principal == "" {
+		r.Session.Principal = certPrincipal(r.Session.TLS)
+	}
+
+	switch {
+	case r.Session.Principal != "":
+	case r.APIKey == kafka.APIVersions, r.APIKey == kafka.APISaslHandshake, r.APIKey == kafka.APISaslAuthenticate:
+	default:
+		return ErrAuthRequired
+	}
+
+	return h.next.ServeKafka(w, r)
+}
+
+// allowed checks the permission against the ACL, everything is allowed
+// without one. Nothing is allowed on internal topics.
+func (k *kafkaBroker) allowed(r *kafka.Request, perm Permission, kind, name string) bool {
+	if kind == ResourceTopic && IsInternalTopic(name) {
+		return false
+	}
+	return k.config.ACL == nil || k.config.ACL.Allowed(r.Session.Principal, perm, kind, name)
+}
+
+// partitions returns the shard names of the topic in partition order
+func (k *kafkaBroker) partitions(topic string) ([]string, error) {
+	shards, err := k.l.Shards(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedShardNames(shards), nil
+}
+
+// shard finds the shard of the partition
+func (k *kafkaBroker) shard(topic string, partition int32) (string, *Shard, error) {
+	shards, err := k.l.Shards(topic)
+	if err != nil {
+		return "", nil, err
+	}
+
+	names := sortedShardNames(shards)
+	if partition < 0 || int(partition) >= len(names) {
+		return "", nil, fmt.Errorf("%w %s partition %d", ErrUnknownShard, topic, partition)
+	}
+
+	return names[partition], shards[names[partition]], nil
+}
+
+// address is the host and port clients are told to connect to
+func (k *kafkaBroker) address(r *kafka.Request) (string, int32) {
+	address := k.config.AdvertisedAddress
+	if address == "" {
+		address = r.Session.LocalAddr.String()
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, 0
+	}
+	p, _ := strconv.ParseInt(port, 10, 32)
+
+	return host, int32(p)
+}
+
+// kafkaErrorCode maps errors to Kafka error codes, errors without a code are
+// logged with the request
+func kafkaErrorCode(r *kafka.Request, err error) int16 {
+	switch {
+	case err == nil:
+		return kafka.CodeNone
+	case errors.Is(err, ErrUnknownTopic), errors.Is(err, ErrUnknownShard):
+		return kafka.CodeUnknownTopicOrPartition
+	case errors.Is(err, ErrShardIllegalKey), errors.Is(err, ErrShardIllegalPayload):
+		return kafka.CodeInvalidRecord
+	case errors.Is(err, ErrShardIllegalStartSequenceID), errors.Is(err, ErrShardStartSequenceIDNotFound):
+		return kafka.CodeOffsetOutOfRange
+	case errors.Is(err, ErrGroupActive):
+		return kafka.CodeUnknownMemberID
+	case errors.Is(err, kafka.ErrUnsupportedCompression):
+		return kafka.CodeUnsupportedCompressionType
+	case errors.Is(err, kafka.ErrMalformed):
+		return kafka.CodeCorruptMessage
+	}
+
+	r.Session.Logger.Error("kafka: request failed", "api", r.APIKey, "err", err)
+	return kafka.CodeUnknownServerError
+}
+
+// metadata describes the broker and the topics. Topics that are not found
+// are created with one shard if the client allows it and may create topics.
+func (k *kafkaBroker) metadata(w *kafka.Encoder, r *kafka.Request) error {
+	d := r.Body
+	n := d.ArrayLen()
+	// Version 0 asks for all topics with an empty list, later versions
+	// with a null list
+	all := n < 0 || r.APIVersion == 0 && n == 0
+	var topics []string
+	for i := 0; i < n; i++ {
+		topics = append(topics, d.Str())
+	}
+	autoCreate := true
+	if r.APIVersion >= 4 {
+		autoCreate = d.Bool()
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+
+	if all {
+		topics = topics[:0]
+		for name := range k.l.Topics() {
+			if k.allowed(r, PermRead, ResourceTopic, name) {
+				topics = append(topics, name)
+			}
+		}
+		sort.Strings(topics)
+	}
+
+	if r.APIVersion >= 3 {
+		w.PutInt32(0) // throttle time
+	}
+
+	host, port := k.address(r)
+	w.PutArrayLen(1)
+	w.PutInt32(kafkaNodeID)
+	w.PutString(host)
+	w.PutInt32(port)
+	if r.APIVersion >= 1 {
+		w.PutNullableString(nil) // rack
+	}
+	if r.APIVersion >= 2 {
+		clusterID := kafkaClusterID
+		w.PutNullableString(&clusterID)
+	}
+	if r.APIVersion >= 1 {
+		w.PutInt32(kafkaNodeID) // controller
+	}
+
+	w.PutArrayLen(len(topics))
+	for _, topic := range topics {
+		var partitions []string
+		code := kafka.CodeNone
+		if !k.allowed(r, PermRead, ResourceTopic, topic) {
+			code = kafka.CodeTopicAuthorizationFailed
+		} else {
+			var err error
+			partitions, err = k.partitions(topic)
+			if errors.Is(err, ErrUnknownTopic) && autoCreate && k.allowed(r, PermCreate, ResourceTopic, topic) {
+				if _, err = k.l.CreateTopic(topic, 1); err == nil {
+					r.Session.Logger.Info("kafka: created topic", "topic", topic, "client_id", r.ClientID)
+					partitions, err = k.partitions(topic)
+				}
+			}
+			code = kafkaErrorCode(r, err)
+		}
+
+		w.PutInt16(code)
+		w.PutString(topic)
+		if r.APIVersion >= 1 {
+			w.PutBool(IsInternalTopic(topic))
+		}
+		w.PutArrayLen(len(partitions))
+		for i := range partitions {
+			w.PutInt16(kafka.CodeNone)
+			w.PutInt32(int32(i))
+			w.PutInt32(kafkaNodeID) // leader
+			if r.APIVersion >= 7 {
+				w.PutInt32(0) // leader epoch
+			}
+			w.PutInt32Array([]int32{kafkaNodeID}) // replicas
+			w.PutInt32Array([]int32{kafkaNodeID}) // in sync replicas
+			if r.APIVersion >= 5 {
+				w.PutInt32Array(nil) // offline replicas
+			}
+		}
+	}
+
+	return nil
+}
+
+// produce appends the records of every partition as one batch. Records must
+// have a key and a value, headers are not supported. Nothing is sent back to
+// clients that do not want acknowledgements.
+func (k *kafkaBroker) produce(w *kafka.Encoder, r *kafka.Request) error {
+	d := r.Body
+	d.NullableStr() // transactional ID
+	acks := d.Int16()
+	d.Int32() // timeout
+
+	var resp kafka.Encoder
+	n := d.ArrayLen()
+	resp.PutArrayLen(n)
+	for i := 0; i < n; i++ {
+		topic := d.Str()
+		resp.PutString(topic)
+
+		m := d.ArrayLen()
+		resp.PutArrayLen(m)
+		for j := 0; j < m; j++ {
+			partition := d.Int32()
+			records := d.Bytes()
+			if d.Err() != nil {
+				return d.Err()
+			}
+
+			var baseOffset int64 = -1
+			code := kafka.CodeTopicAuthorizationFailed
+			if k.allowed(r, PermWrite, ResourceTopic, topic) {
+				var err error
+				baseOffset, err = k.appendRecords(topic, partition, records)
+				code = kafkaErrorCode(r, err)
+			}
+
+			resp.PutInt32(partition)
+			resp.PutInt16(code)
+			resp.PutInt64(baseOffset)
+			resp.PutInt64(-1) // log append time, create times are used
+			if r.APIVersion >= 5 {
+				resp.PutInt64(0) // log start offset
+			}
+		}
+	}
+	resp.PutInt32(0) // throttle time
+
+	if d.Err() != nil {
+		return d.Err()
+	}
+	if acks != 0 {
+		w.PutRaw(resp.Bytes())
+	}
+
+	return nil
+}
+
+// appendRecords appends the records to the shard of the partition and
+// returns the offset of the first
+func (k *kafkaBroker) appendRecords(topic string, partition int32, buf []byte) (int64, error) {
+	shard, _, err := k.shard(topic, partition)
+	if err != nil {
+		return -1, err
+	}
+
+	records, err := kafka.DecodeRecords(buf)
+	if err != nil {
+		return -1, err
+	}
+	if len(records) == 0 {
+		return -1, fmt.Errorf("%w: no records", kafka.ErrMalformed)
+	}
+
+	keys := make([][]byte, len(records))
+	payloads := make([][]byte, len(records))
+	for i, rec := range records {
+		if len(rec.Headers) > 0 {
+			return -1, fmt.Errorf("%w: record headers are not supported", ErrShardIllegalPayload)
+		}
+		keys[i] = rec.Key
+		payloads[i] = rec.Value
+	}
+
+	sequenceIDs, err := k.l.AppendBatch(topic, shard, keys, payloads)
+	if err != nil {
+		return -1, err
+	}
+
+	return sequenceIDs[0] - 1, nil
+}
+
+// kafkaFetchTopic is a topic of a fetch request and its partitions
+type kafkaFetchTopic struct {
+	name       string
+	partitions []kafkaFetchPartition
+}
+
+// kafkaFetchPartition is a partition of a fetch request
+type kafkaFetchPartition struct {
+	partition int32
+	offset    int64
+	maxBytes  int32
+}
+
+// fetch reads messages from the offsets of the partitions. The fetch waits
+// up to max wait for at least min bytes. Fetch sessions are not supported,
+// session ID 0 tells clients to send full fetch requests.
+func (k *kafkaBroker) fetch(w *kafka.Encoder, r *kafka.Request) error {
+	d := r.Body
+	d.Int32() // replica ID
+	maxWait := time.Duration(d.Int32()) * time.Millisecond
+	minBytes := d.Int32()
+	maxBytes := d.Int32()
+	d.Int8() // isolation level
+	var sessionID int32
+	if r.APIVersion >= 7 {
+		sessionID = d.Int32()
+		d.Int32() // session epoch
+	}
+
+	topics := make([]kafkaFetchTopic, d.ArrayLen())
+	for i := range topics {
+		topics[i].name = d.Str()
+		topics[i].partitions = make([]kafkaFetchPartition, d.ArrayLen())
+		for j := range topics[i].partitions {
+			p := &topics[i].partitions[j]
+			p.partition = d.Int32()
+			if r.APIVersion >= 9 {
+				d.Int32() // current leader epoch
+			}
+			p.offset = d.Int64()
+			if r.APIVersion >= 5 {
+				d.Int64() // log start offset
+			}
+			p.maxBytes = d.Int32()
+		}
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+
+	if sessionID != 0 {
+		w.PutInt32(0) // throttle time
+		w.PutInt16(kafka.CodeFetchSessionIDNotFound)
+		w.PutInt32(0)
+		w.PutArrayLen(0)
+		return nil
+	}
+
+	deadline := time.Now().Add(maxWait)
+	for {
+		resp, size := k.fetchPartitions(r, topics, maxBytes)
+		if size >= int64(minBytes) || !time.Now().Add(kafkaPollInterval).Before(deadline) {
+			w.PutInt32(0) // throttle time
+			if r.APIVersion >= 7 {
+				w.PutInt16(kafka.CodeNone)
+				w.PutInt32(0) // session ID
+			}
+			w.PutRaw(resp)
+			return nil
+		}
+
+		time.Sleep(kafkaPollInterval)
+	}
+}
+
+// fetchPartitions encodes the responses of the partitions and returns them
+// with the number of record bytes
+func (k *kafkaBroker) fetchPartitions(r *kafka.Request, topics []kafkaFetchTopic, maxBytes int32) ([]byte, int64) {
+	var w kafka.Encoder
+	var size int64
+
+	w.PutArrayLen(len(topics))
+	for _, t := range topics {
+		topic := t.name
+		w.PutString(topic)
+		w.PutArrayLen(len(t.partitions))
+		for _, p := range t.partitions {
+			var records []byte
+			var head int64
+			code := kafka.CodeTopicAuthorizationFailed
+			if k.allowed(r, PermRead, ResourceTopic, topic) {
+				// The first message is returned even if it is larger
+				// than the max bytes so that clients make progress
+				limit := int64(p.maxBytes)
+				if left := int64(maxBytes) - size; left < limit {
+					limit = left
+				}
+				if size == 0 && limit <= 0 {
+					limit = 1
+				}
+
+				var err error
+				records, head, err = k.readRecords(topic, p.partition, p.offset, limit)
+				code = kafkaErrorCode(r, err)
+				size += int64(len(records))
+			}
+
+			w.PutInt32(p.partition)
+			w.PutInt16(code)
+			w.PutInt64(head) // high watermark
+			w.PutInt64(head) // last stable offset
+			if r.APIVersion >= 5 {
+				w.PutInt64(0) // log start offset
+			}
+			w.PutArrayLen(-1) // aborted transactions
+			if r.APIVersion >= 11 {
+				w.PutInt32(-1) // preferred read replica
+			}
+			if records == nil {
+				records = []byte{}
+			}
+			w.PutBytes(records)
+		}
+	}
+
+	return w.Bytes(), size
+}
+
+// readRecords reads messages from the offset as a record batch of at most
+// limit bytes, the first message is always included. Returns the batch
+// and the head of the shard.
+func (k *kafkaBroker) readRecords(topic string, partition int32, offset, limit int64) ([]byte, int64, error) {
+	shard, s, err := k.shard(topic, partition)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	head := s.Head()
+	if offset < 0 || offset > head {
+		return nil, head, fmt.Errorf("%w: offset %d of %s partition %d, head %d", ErrShardStartSequenceIDNotFound, offset, topic, partition, head)
+	}
+	if offset == head || limit <= 0 {
+		return nil, head, nil
+	}
+
+	msgs, err := k.l.Read(topic, shard, offset, kafkaMaxRead)
+	if err != nil {
+		return nil, head, err
+	}
+
+	var size int64
+	records := make([]kafka.Record, 0, len(msgs))
+	for _, m := range msgs {
+		if size += m.Size(); size > limit && len(records) > 0 {
+			break
+		}
+
+		timestamp := kafka.NoTimestamp
+		if m.Magic >= MagicV1 {
+			timestamp = m.Timestamp
+		}
+		records = append(records, kafka.Record{
+			Offset:    m.SequenceID - 1,
+			Timestamp: timestamp,
+			Key:       m.Key,
+			Value:     m.Payload,
+		})
+	}
+
+	return kafka.AppendRecordBatch(nil, records), head, nil
+}
+
+// listOffsets finds the offset of the first message at or after a timestamp,
+// or the earliest or latest offset of the partitions
+func (k *kafkaBroker) listOffsets(w *kafka.Encoder, r *kafka.Request) error {
+	d := r.Body
+	d.Int32() // replica ID
+	if r.APIVersion >= 2 {
+		d.Int8()      // isolation level
+		w.PutInt32(0) // throttle time
+	}
+
+	n := d.ArrayLen()
+	w.PutArrayLen(n)
+	for i := 0; i < n; i++ {
+		topic := d.Str()
+		w.PutString(topic)
+
+		m := d.ArrayLen()
+		w.PutArrayLen(m)
+		for j := 0; j < m; j++ {
+			partition := d.Int32()
+			if r.APIVersion >= 4 {
+				d.Int32() // current leader epoch
+			}
+			timestamp := d.Int64()
+			if d.Err() != nil {
+				return d.Err()
+			}
+
+			offset, found := int64(-1), kafka.NoTimestamp
+			code := kafka.CodeTopicAuthorizationFailed
+			if k.allowed(r, PermRead, ResourceTopic, topic) {
+				var err error
+				offset, found, err = k.offsetForTime(topic, partition, timestamp)
+				code = kafkaErrorCode(r, err)
+			}
+
+			w.PutInt32(partition)
+			w.PutInt16(code)
+			w.PutInt64(found)
+			w.PutInt64(offset)
+			if r.APIVersion >= 4 {
+				w.PutInt32(0) // leader epoch
+			}
+		}
+	}
+
+	return d.Err()
+}
+
+// offsetForTime resolves the timestamp of a ListOffsets request into an
+// offset and the timestamp of the message at it. Timestamps after the last
+// message have no offset, -1.
+func (k *kafkaBroker) offsetForTime(topic string, partition int32, timestamp int64) (int64, int64, error) {
+	shard, s, err := k.shard(topic, partition)
+	if err != nil {
+		return -1, kafka.NoTimestamp, err
+	}
+
+	switch timestamp {
+	case kafka.TimestampEarliest:
+		return 0, kafka.NoTimestamp, nil
+	case kafka.TimestampLatest:
+		return s.Head(), kafka.NoTimestamp, nil
+	}
+
+	offset, err := s.SequenceIDForTime(time.Unix(0, timestamp*int64(time.Millisecond)))
+	if err != nil {
+		return -1, kafka.NoTimestamp, err
+	}
+	if offset >= s.Head() {
+		return -1, kafka.NoTimestamp, nil
+	}
+
+	msgs, err := k.l.Read(topic, shard, offset, 1)
+	if err != nil || len(msgs) == 0 {
+		return -1, kafka.NoTimestamp, err
+	}
+
+	return offset, msgs[0].Timestamp, nil
+}
+
+// findCoordinator answers that this server coordinates every group
+func (k *kafkaBroker) findCoordinator(w *kafka.Encoder, r *kafka.Request) error {
+	d := r.Body
+	key := d.Str()
+	var keyType int8
+	if r.APIVersion >= 1 {
+		keyType = d.Int8()
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+
+	code := kafka.CodeNone
+	switch {
+	case keyType != 0:
+		// Transactions are not supported
+		code = kafka.CodeCoordinatorNotAvailable
+	case !k.allowed(r, PermRead, ResourceGroup, key):
+		code = kafka.CodeGroupAuthorizationFailed
+	}
+
+	if r.APIVersion >= 1 {
+		w.PutInt32(0) // throttle time
+	}
+	w.PutInt16(code)
+	if r.APIVersion >= 1 {
+		w.PutNullableString(nil) // error message
+	}
+	host, port := k.address(r)
+	w.PutInt32(kafkaNodeID)
+	w.PutString(host)
+	w.PutInt32(port)
+
+	return nil
+}
+
+// offsetCommit commits the offsets as the group's committed iterators. Kafka
+// group membership is not supported, commits are only accepted while the
+// group has no live kuling members.
+func (k *kafkaBroker) offsetCommit(w *kafka.Encoder, r *kafka.Request) error {
+	d := r.Body
+	group := d.Str()
+	d.Int32() // generation ID
+	d.Str()   // member ID
+	if r.APIVersion >= 7 {
+		d.NullableStr() // group instance ID
+	}
+	if r.APIVersion <= 4 {
+		d.Int64() // retention time
+	}
+
+	if r.APIVersion >= 3 {
+		w.PutInt32(0) // throttle time
+	}
+
+	n := d.ArrayLen()
+	w.PutArrayLen(n)
+	for i := 0; i < n; i++ {
+		topic := d.Str()
+		w.PutString(topic)
+
+		m := d.ArrayLen()
+		w.PutArrayLen(m)
+		for j := 0; j < m; j++ {
+			partition := d.Int32()
+			offset := d.Int64()
+			if r.APIVersion >= 6 {
+				d.Int32() // leader epoch
+			}
+			d.NullableStr() // metadata
+			if d.Err() != nil {
+				return d.Err()
+			}
+
+			var code int16
+			switch {
+			case !k.allowed(r, PermCommit, ResourceGroup, group):
+				code = kafka.CodeGroupAuthorizationFailed
+			case !k.allowed(r, PermRead, ResourceTopic, topic):
+				code = kafka.CodeTopicAuthorizationFailed
+			default:
+				code = kafkaErrorCode(r, k.commit(group, topic, partition, offset))
+			}
+
+			w.PutInt32(partition)
+			w.PutInt16(code)
+		}
+	}
+
+	return d.Err()
+}
+
+// commit the offset of the group in the partition
+func (k *kafkaBroker) commit(group, topic string, partition int32, offset int64) error {
+	shard, s, err := k.shard(topic, partition)
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset > s.Head() {
+		return fmt.Errorf("%w: commit of offset %d, head %d", ErrShardIllegalStartSequenceID, offset, s.Head())
+	}
+
+	return k.b.CommitOffset(group, topic, shard, offset)
+}
+
+// offsetFetch returns the committed offsets of the group, -1 for partitions
+// the group has not committed in. A null topic list, from version 2, asks
+// for every topic the group has committed in.
+func (k *kafkaBroker) offsetFetch(w *kafka.Encoder, r *kafka.Request) error {
+	d := r.Body
+	group := d.Str()
+
+	type fetchTopic struct {
+		name       string
+		partitions []int32
+	}
+	var topics []fetchTopic
+	n := d.ArrayLen()
+	for i := 0; i < n; i++ {
+		topics = append(topics, fetchTopic{d.Str(), d.Int32Array()})
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+
+	groupAllowed := k.allowed(r, PermRead, ResourceGroup, group)
+	if n < 0 && groupAllowed {
+		for name := range k.l.Topics() {
+			committed, err := k.b.CommittedOffsets(group, name)
+			if err == nil && len(committed) > 0 {
+				topics = append(topics, fetchTopic{name: name})
+			}
+		}
+	}
+
+	if r.APIVersion >= 3 {
+		w.PutInt32(0) // throttle time
+	}
+
+	w.PutArrayLen(len(topics))
+	for _, t := range topics {
+		partitions, _ := k.partitions(t.name)
+		committed, err := k.b.CommittedOffsets(group, t.name)
+
+		topicCode := kafkaErrorCode(r, err)
+		switch {
+		case !groupAllowed:
+			topicCode = kafka.CodeGroupAuthorizationFailed
+		case !k.allowed(r, PermRead, ResourceTopic, t.name):
+			topicCode = kafka.CodeTopicAuthorizationFailed
+		}
+
+		if t.partitions == nil {
+			for i := range partitions {
+				if _, ok := committed[partitions[i]]; ok {
+					t.partitions = append(t.partitions, int32(i))
+				}
+			}
+		}
+
+		w.PutString(t.name)
+		w.PutArrayLen(len(t.partitions))
+		for _, p := range t.partitions {
+			offset, ok := int64(-1), false
+			code := topicCode
+			if code == kafka.CodeNone {
+				if p < 0 || int(p) >= len(partitions) {
+					code = kafka.CodeUnknownTopicOrPartition
+				} else if offset, ok = committed[partitions[p]]; !ok {
+					offset = -1
+				}
+			}
+
+			w.PutInt32(p)
+			w.PutInt64(offset)
+			if r.APIVersion >= 5 {
+				w.PutInt32(-1) // leader epoch
+			}
+			metadata := ""
+			w.PutNullableString(&metadata)
+			w.PutInt16(code)
+		}
+	}
+
+	if r.APIVersion >= 2 {
+		code := kafka.CodeNone
+		if !groupAllowed {
+			code = kafka.CodeGroupAuthorizationFailed
+		}
+		w.PutInt16(code)
+	}
+
+	return nil
+}
+
+// saslHandshake picks the SASL mechanism for SaslAuthenticate
+func (k *kafkaBroker) saslHandshake(w *kafka.Encoder, r *kafka.Request) error {
+	mechanism := r.Body.Str()
+	if err := r.Body.Err(); err != nil {
+		return err
+	}
+
+	code := kafka.CodeUnsupportedSaslMechanism
+	if mechanism == saslPlain || mechanism == saslOAuthBearer {
+		code = kafka.CodeNone
+		r.Session.SaslMechanism = mechanism
+	}
+
+	w.PutInt16(code)
+	w.PutArrayLen(2)
+	w.PutString(saslPlain)
+	w.PutString(saslOAuthBearer)
+
+	return nil
+}
+
+// saslAuthenticate authenticates the connection with the mechanism picked
+// in the handshake. PLAIN carries a user and password, OAUTHBEARER a token.
+func (k *kafkaBroker) saslAuthenticate(w *kafka.Encoder, r *kafka.Request) error {
+	auth := r.Body.Bytes()
+	if err := r.Body.Err(); err != nil {
+		return err
+	}
+
+	var principal string
+	var err error
+	switch r.Session.SaslMechanism {
+	case saslPlain:
+		// authzid NUL authcid NUL password, the authorization identity
+		// must be empty or the user
+		parts := bytes.Split(auth, []byte{0})
+		if len(parts) != 3 || len(parts[0]) > 0 && !bytes.Equal(parts[0], parts[1]) {
+			err = ErrAuthFailed
+			break
+		}
+		principal, err = k.config.Authenticator.Authenticate(string(parts[1]), string(parts[2]))
+	case saslOAuthBearer:
+		// gs2 header, then key=value pairs separated by 0x01
+		err = ErrAuthFailed
+		for _, kv := range strings.Split(string(auth), "\x01") {
+			if token, ok := strings.CutPrefix(kv, "auth=Bearer "); ok {
+				principal, err = k.config.Authenticator.AuthenticateToken(token)
+			}
+		}
+	default:
+		w.PutInt16(kafka.CodeIllegalSaslState)
+		msg := "SaslHandshake must be sent first"
+		w.PutNullableString(&msg)
+		w.PutBytes([]byte{})
+		if r.APIVersion >= 1 {
+			w.PutInt64(0)
+		}
+		return nil
+	}
+
+	code := kafka.CodeNone
+	var msg *string
+	if err != nil {
+		code = kafka.CodeSaslAuthenticationFailed
+		m := err.Error()
+		msg = &m
+		r.Session.Logger.Warn("kafka: authentication failed", "mechanism", r.Session.SaslMechanism, "err", err)
+	} else {
+		r.Session.Principal = principal
+	}
+
+	w.PutInt16(code)
+	w.PutNullableString(msg)
+	w.PutBytes([]byte{})
+	if r.APIVersion >= 1 {
+		w.PutInt64(0) // session lifetime, sessions do not expire
+	}
+
+	return nil
+}
@@ -0,0 +1,277 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrMalformed returned when a request or record batch cannot be decoded
+var ErrMalformed = errors.New("kafka: malformed data")
+
+// Decoder reads the primitive types of the protocol from a buffer. The first
+// error is kept and every read after it returns zero values so that a whole
+// request can be decoded before checking Err.
+type Decoder struct {
+	buf []byte
+	err error
+}
+
+// NewDecoder creates a decoder reading from the buffer
+func NewDecoder(buf []byte) *Decoder {
+	return &Decoder{buf: buf}
+}
+
+// Err is the first error the decoder ran into
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Remaining is the number of bytes not yet read
+func (d *Decoder) Remaining() int {
+	return len(d.buf)
+}
+
+// take the next n bytes
+func (d *Decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = fmt.Errorf("%w: need %d bytes, have %d", ErrMalformed, n, len(d.buf))
+		return nil
+	}
+
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+
+	return b
+}
+
+// Int8 reads a signed byte
+func (d *Decoder) Int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+// Bool reads a byte that is true when not zero
+func (d *Decoder) Bool() bool {
+	return d.Int8() != 0
+}
+
+// Int16 reads a big endian int16
+func (d *Decoder) Int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// Int32 reads a big endian int32
+func (d *Decoder) Int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+// Int64 reads a big endian int64
+func (d *Decoder) Int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// Varint reads a zigzag encoded variable length integer
+func (d *Decoder) Varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: bad varint", ErrMalformed)
+		return 0
+	}
+	d.buf = d.buf[n:]
+
+	return v
+}
+
+// Str reads a string with an int16 length
+func (d *Decoder) Str() string {
+	s, _ := d.NullableStr()
+	return s
+}
+
+// NullableStr reads a string with an int16 length, false when it is null
+func (d *Decoder) NullableStr() (string, bool) {
+	n := d.Int16()
+	if n < 0 {
+		return "", false
+	}
+
+	return string(d.take(int(n))), true
+}
+
+// Bytes reads bytes with an int32 length, nil when they are null
+func (d *Decoder) Bytes() []byte {
+	n := d.Int32()
+	if n < 0 {
+		return nil
+	}
+
+	return d.take(int(n))
+}
+
+// VarintBytes reads bytes with a varint length, nil when they are null
+func (d *Decoder) VarintBytes() []byte {
+	n := d.Varint()
+	if n < 0 {
+		return nil
+	}
+	if n > int64(len(d.buf)) {
+		d.take(len(d.buf) + 1)
+		return nil
+	}
+
+	return d.take(int(n))
+}
+
+// ArrayLen reads the length of an array, -1 for a null array. Lengths that
+// cannot fit in what is left of the buffer, with every element taking at
+// least one byte, fail the decoder so that callers can allocate by length.
+func (d *Decoder) ArrayLen() int {
+	n := d.Int32()
+	if n > int32(len(d.buf)) {
+		d.err = fmt.Errorf("%w: array of %d elements in %d bytes", ErrMalformed, n, len(d.buf))
+		return 0
+	}
+	if n < -1 {
+		d.err = fmt.Errorf("%w: array length %d", ErrMalformed, n)
+		return 0
+	}
+
+	return int(n)
+}
+
+// Int32Array reads an array of int32
+func (d *Decoder) Int32Array() []int32 {
+	n := d.ArrayLen()
+	if n < 0 {
+		return nil
+	}
+
+	a := make([]int32, n)
+	for i := range a {
+		a[i] = d.Int32()
+	}
+
+	return a
+}
+
+// Encoder appends the primitive types of the protocol to a buffer
+type Encoder struct {
+	buf []byte
+}
+
+// Bytes returns the encoded buffer
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+// Len is the number of bytes encoded
+func (e *Encoder) Len() int {
+	return len(e.buf)
+}
+
+// PutInt8 appends a signed byte
+func (e *Encoder) PutInt8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+// PutBool appends 1 for true and 0 for false
+func (e *Encoder) PutBool(v bool) {
+	if v {
+		e.PutInt8(1)
+	} else {
+		e.PutInt8(0)
+	}
+}
+
+// PutInt16 appends a big endian int16
+func (e *Encoder) PutInt16(v int16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v))
+}
+
+// PutInt32 appends a big endian int32
+func (e *Encoder) PutInt32(v int32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v))
+}
+
+// PutInt64 appends a big endian int64
+func (e *Encoder) PutInt64(v int64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+}
+
+// PutVarint appends a zigzag encoded variable length integer
+func (e *Encoder) PutVarint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+// PutString appends a string with an int16 length
+func (e *Encoder) PutString(s string) {
+	e.PutInt16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// PutNullableString appends a string with an int16 length, null when the
+// string is nil
+func (e *Encoder) PutNullableString(s *string) {
+	if s == nil {
+		e.PutInt16(-1)
+		return
+	}
+	e.PutString(*s)
+}
+
+// PutBytes appends bytes with an int32 length, null when b is nil
+func (e *Encoder) PutBytes(b []byte) {
+	if b == nil {
+		e.PutInt32(-1)
+		return
+	}
+	e.PutInt32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// PutVarintBytes appends bytes with a varint length, null when b is nil
+func (e *Encoder) PutVarintBytes(b []byte) {
+	if b == nil {
+		e.PutVarint(-1)
+		return
+	}
+	e.PutVarint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// PutArrayLen appends the length of an array, -1 for a null array
+func (e *Encoder) PutArrayLen(n int) {
+	e.PutInt32(int32(n))
+}
+
+// PutInt32Array appends an array of int32
+func (e *Encoder) PutInt32Array(a []int32) {
+	e.PutArrayLen(len(a))
+	for _, v := range a {
+		e.PutInt32(v)
+	}
+}
+
+// PutRaw appends bytes as they are
+func (e *Encoder) PutRaw(b []byte) {
+	e.buf = append(e.buf, b...)
+}
@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"fmt"
+	"sort"
+)
+
+// apiVersionsMax is the last ApiVersions version served, later versions get
+// an unsupported version error in the version 0 format so that clients can
+// retry with a version from the list
+const apiVersionsMax = 2
+
+// ServeMux dispatches requests to the handler of their API key and answers
+// ApiVersions with the versions of the registered handlers
+type ServeMux struct {
+	apis map[int16]api
+}
+
+// api is a registered handler and the versions it serves
+type api struct {
+	minVersion int16
+	maxVersion int16
+	handler    HandlerFunc
+}
+
+// NewServeMux creates a mux that serves ApiVersions only
+func NewServeMux() *ServeMux {
+	return &ServeMux{make(map[int16]api)}
+}
+
+// Handle registers the handler for the versions of the API. Registering an
+// API twice panics as it is a programming error.
+func (m *ServeMux) Handle(key, minVersion, maxVersion int16, h HandlerFunc) {
+	if _, ok := m.apis[key]; ok || key == APIVersions {
+		panic(fmt.Sprintf("kafka: API %d registered twice", key))
+	}
+
+	m.apis[key] = api{minVersion, maxVersion, h}
+}
+
+// ServeKafka serves the request with the handler of its API. Requests for
+// APIs or versions that are not registered close the connection.
+func (m *ServeMux) ServeKafka(w *Encoder, r *Request) error {
+	if r.APIKey == APIVersions {
+		m.versions(w, r)
+		return nil
+	}
+
+	a, ok := m.apis[r.APIKey]
+	if !ok || r.APIVersion < a.minVersion || r.APIVersion > a.maxVersion {
+		return fmt.Errorf("%w: API %d version %d", ErrUnsupportedVersion, r.APIKey, r.APIVersion)
+	}
+
+	return a.handler(w, r)
+}
+
+// versions answers ApiVersions. The request body is empty up to version 2.
+func (m *ServeMux) versions(w *Encoder, r *Request) {
+	code := CodeNone
+	if r.APIVersion < 0 || r.APIVersion > apiVersionsMax {
+		code = CodeUnsupportedVersion
+	}
+
+	keys := make([]int, 0, len(m.apis))
+	for key := range m.apis {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+
+	w.PutInt16(code)
+	w.PutArrayLen(len(keys) + 1)
+	w.PutInt16(APIVersions)
+	w.PutInt16(0)
+	w.PutInt16(apiVersionsMax)
+	for _, key := range keys {
+		a := m.apis[int16(key)]
+		w.PutInt16(int16(key))
+		w.PutInt16(a.minVersion)
+		w.PutInt16(a.maxVersion)
+	}
+
+	if code == CodeNone && r.APIVersion >= 1 {
+		w.PutInt32(0) // throttle time
+	}
+}
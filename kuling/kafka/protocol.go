@@ -0,0 +1,51 @@
+// Package kafka speaks a subset of the Kafka wire protocol. It reads and
+// writes the framing, the primitive types and record batches, and serves
+// requests to handlers registered by API key. Only the versions of every API
+// that predate flexible (tagged field) encoding are supported.
+package kafka
+
+// API keys
+const (
+	APIProduce          int16 = 0
+	APIFetch            int16 = 1
+	APIListOffsets      int16 = 2
+	APIMetadata         int16 = 3
+	APIOffsetCommit     int16 = 8
+	APIOffsetFetch      int16 = 9
+	APIFindCoordinator  int16 = 10
+	APISaslHandshake    int16 = 17
+	APIVersions         int16 = 18
+	APISaslAuthenticate int16 = 36
+)
+
+// Error codes sent in responses, CodeNone when there is no error
+const (
+	CodeNone                       int16 = 0
+	CodeUnknownServerError         int16 = -1
+	CodeOffsetOutOfRange           int16 = 1
+	CodeCorruptMessage             int16 = 2
+	CodeUnknownTopicOrPartition    int16 = 3
+	CodeCoordinatorNotAvailable    int16 = 15
+	CodeUnknownMemberID            int16 = 25
+	CodeTopicAuthorizationFailed   int16 = 29
+	CodeGroupAuthorizationFailed   int16 = 30
+	CodeUnsupportedSaslMechanism   int16 = 33
+	CodeIllegalSaslState           int16 = 34
+	CodeUnsupportedVersion         int16 = 35
+	CodeInvalidRequest             int16 = 42
+	CodeSaslAuthenticationFailed   int16 = 58
+	CodeFetchSessionIDNotFound     int16 = 70
+	CodeUnsupportedCompressionType int16 = 76
+	CodeInvalidRecord              int16 = 87
+)
+
+// Special timestamps of ListOffsets requests
+const (
+	// TimestampLatest asks for the offset of the next message
+	TimestampLatest int64 = -1
+	// TimestampEarliest asks for the offset of the first message
+	TimestampEarliest int64 = -2
+)
+
+// NoTimestamp is the timestamp of records that have none
+const NoTimestamp int64 = -1
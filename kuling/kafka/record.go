@@ -0,0 +1,212 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ErrUnsupportedCompression returned when a record batch is compressed with
+// a codec other than gzip
+var ErrUnsupportedCompression = errors.New("kafka: unsupported compression")
+
+// Record batch layout and attributes
+const (
+	compressionMask      = 0x07
+	compressionNone      = 0
+	compressionGzip      = 1
+	attributeControl     = 0x20
+	recordBatchMagic     = 2
+	recordBatchOverhead  = 61
+	recordBatchCRCOffset = 21
+)
+
+// maxBatchBytes is the largest a compressed record batch may be once
+// decompressed
+const maxBatchBytes = 32 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Record is one record of a record batch
+type Record struct {
+	Offset    int64
+	Timestamp int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+}
+
+// Header is a record header
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// DecodeRecords decodes the records of the record batches in buf. Only
+// batches of magic version 2 are supported, control batches are skipped.
+func DecodeRecords(buf []byte) ([]Record, error) {
+	var records []Record
+	for len(buf) > 0 {
+		if len(buf) < recordBatchOverhead {
+			return nil, fmt.Errorf("%w: record batch of %d bytes", ErrMalformed, len(buf))
+		}
+
+		d := NewDecoder(buf)
+		baseOffset := d.Int64()
+		length := d.Int32()
+		if length < recordBatchOverhead-12 || int(length) > d.Remaining() {
+			return nil, fmt.Errorf("%w: record batch length %d", ErrMalformed, length)
+		}
+		batch := buf[:12+length]
+		buf = buf[12+length:]
+
+		d = NewDecoder(batch[12:])
+		d.Int32() // partition leader epoch
+		if magic := d.Int8(); magic != recordBatchMagic {
+			return nil, fmt.Errorf("%w: record batch magic %d", ErrMalformed, magic)
+		}
+		crc := uint32(d.Int32())
+		if crc32.Checksum(batch[recordBatchCRCOffset:], castagnoli) != crc {
+			return nil, fmt.Errorf("%w: record batch checksum mismatch", ErrMalformed)
+		}
+
+		attributes := d.Int16()
+		d.Int32() // last offset delta
+		baseTimestamp := d.Int64()
+		d.Int64() // max timestamp
+		d.Int64() // producer ID
+		d.Int16() // producer epoch
+		d.Int32() // base sequence
+		count := d.Int32()
+		if d.Err() != nil {
+			return nil, d.Err()
+		}
+		if attributes&attributeControl != 0 {
+			continue
+		}
+
+		data := batch[recordBatchOverhead:]
+		switch attributes & compressionMask {
+		case compressionNone:
+		case compressionGzip:
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+			}
+			if data, err = io.ReadAll(io.LimitReader(zr, maxBatchBytes+1)); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+			}
+			if len(data) > maxBatchBytes {
+				return nil, fmt.Errorf("%w: record batch larger than %d bytes uncompressed", ErrMalformed, maxBatchBytes)
+			}
+		default:
+			return nil, fmt.Errorf("%w: codec %d", ErrUnsupportedCompression, attributes&compressionMask)
+		}
+
+		// Every record takes at least one byte
+		if count < 0 || int(count) > len(data) {
+			return nil, fmt.Errorf("%w: %d records in %d bytes", ErrMalformed, count, len(data))
+		}
+
+		d = NewDecoder(data)
+		for i := int32(0); i < count; i++ {
+			r, err := decodeRecord(d, baseOffset, baseTimestamp)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+		}
+	}
+
+	return records, nil
+}
+
+// decodeRecord decodes one record of a batch
+func decodeRecord(d *Decoder, baseOffset, baseTimestamp int64) (Record, error) {
+	length := d.Varint()
+	if d.Err() != nil {
+		return Record{}, d.Err()
+	}
+	if length < 0 || length > int64(d.Remaining()) {
+		return Record{}, fmt.Errorf("%w: record length %d", ErrMalformed, length)
+	}
+	rd := NewDecoder(d.take(int(length)))
+
+	rd.Int8() // attributes
+	r := Record{
+		Timestamp: baseTimestamp + rd.Varint(),
+		Offset:    baseOffset + rd.Varint(),
+		Key:       rd.VarintBytes(),
+		Value:     rd.VarintBytes(),
+	}
+
+	headers := rd.Varint()
+	if headers < 0 || headers > int64(rd.Remaining()) {
+		return Record{}, fmt.Errorf("%w: %d record headers", ErrMalformed, headers)
+	}
+	for i := int64(0); i < headers; i++ {
+		key := rd.VarintBytes()
+		r.Headers = append(r.Headers, Header{string(key), rd.VarintBytes()})
+	}
+
+	return r, rd.Err()
+}
+
+// AppendRecordBatch appends the records as one uncompressed batch of magic
+// version 2. The records must be in offset order. Timestamps are create
+// times, one per record.
+func AppendRecordBatch(buf []byte, records []Record) []byte {
+	if len(records) == 0 {
+		return buf
+	}
+
+	first := records[0]
+	maxTimestamp := first.Timestamp
+	var body Encoder
+	for _, r := range records {
+		if r.Timestamp > maxTimestamp {
+			maxTimestamp = r.Timestamp
+		}
+
+		var rec Encoder
+		rec.PutInt8(0) // attributes
+		rec.PutVarint(r.Timestamp - first.Timestamp)
+		rec.PutVarint(r.Offset - first.Offset)
+		rec.PutVarintBytes(r.Key)
+		rec.PutVarintBytes(r.Value)
+		rec.PutVarint(int64(len(r.Headers)))
+		for _, h := range r.Headers {
+			rec.PutVarintBytes([]byte(h.Key))
+			rec.PutVarintBytes(h.Value)
+		}
+
+		body.PutVarint(int64(rec.Len()))
+		body.PutRaw(rec.Bytes())
+	}
+
+	start := len(buf)
+	e := Encoder{buf}
+	e.PutInt64(first.Offset)
+	e.PutInt32(int32(recordBatchOverhead - 12 + body.Len()))
+	e.PutInt32(0) // partition leader epoch
+	e.PutInt8(recordBatchMagic)
+	e.PutInt32(0) // crc, set below
+	e.PutInt16(0) // attributes, uncompressed create times
+	e.PutInt32(int32(records[len(records)-1].Offset - first.Offset))
+	e.PutInt64(first.Timestamp)
+	e.PutInt64(maxTimestamp)
+	e.PutInt64(-1) // producer ID
+	e.PutInt16(-1) // producer epoch
+	e.PutInt32(-1) // base sequence
+	e.PutArrayLen(len(records))
+	e.PutRaw(body.Bytes())
+
+	buf = e.Bytes()
+	binary.BigEndian.PutUint32(buf[start+17:], crc32.Checksum(buf[start+recordBatchCRCOffset:], castagnoli))
+
+	return buf
+}
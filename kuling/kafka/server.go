@@ -0,0 +1,268 @@
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/conntrack"
+)
+
+// DefaultMaxRequestBytes is the largest request a server reads when the max
+// is not set, the default of Kafka brokers
+const DefaultMaxRequestBytes = 100 << 20
+
+// ErrUnsupportedVersion returned when a client sends an API or version the
+// server does not serve
+var ErrUnsupportedVersion = errors.New("kafka: unsupported API version")
+
+// ErrServerClosed returned by ListenAndServe after Shutdown
+var ErrServerClosed = errors.New("kafka: server closed")
+
+// Request read from a client. Body decodes the request after the header.
+type Request struct {
+	APIKey        int16
+	APIVersion    int16
+	CorrelationID int32
+	ClientID      string
+	Body          *Decoder
+	// Session of the connection the request came in on
+	Session *Session
+}
+
+// Session is the state of one client connection. Requests on a connection
+// are served one at a time so handlers may change it without locking.
+type Session struct {
+	RemoteAddr net.Addr
+	// LocalAddr is the address the client connected to
+	LocalAddr net.Addr
+	// TLS is the state of the TLS connection, nil for plain connections
+	TLS *tls.ConnectionState
+	// Principal the client authenticated as, empty until it has
+	Principal string
+	// SaslMechanism chosen with SaslHandshake
+	SaslMechanism string
+	// Logger logs with the client address
+	Logger *slog.Logger
+}
+
+// Handler serves a request by encoding the response body into w, the server
+// frames it with the correlation ID. A handler that encodes nothing sends no
+// response, as for produce requests with acks 0. Returning an error closes
+// the connection, which is how Kafka brokers answer requests they cannot
+// serve.
+type Handler interface {
+	ServeKafka(w *Encoder, r *Request) error
+}
+
+// HandlerFunc is a function that serves requests
+type HandlerFunc func(w *Encoder, r *Request) error
+
+// ServeKafka calls f(w, r)
+func (f HandlerFunc) ServeKafka(w *Encoder, r *Request) error {
+	return f(w, r)
+}
+
+// Server serves the Kafka protocol
+type Server struct {
+	Addr    string // Listen address
+	Handler Handler
+	// TLSConfig serves TLS connections only when set
+	TLSConfig *tls.Config
+	// MaxRequestBytes is the largest request read, larger requests close
+	// the connection. DefaultMaxRequestBytes when zero.
+	MaxRequestBytes int32
+	// IdleTimeout closes connections that have not sent a request within
+	// the timeout. Zero means connections are never closed for being idle.
+	IdleTimeout time.Duration
+	// Logger for the server and its sessions, slog.Default() when nil
+	Logger *slog.Logger
+
+	// conns are the listener and the open connections
+	conns conntrack.Tracker
+}
+
+// ListenAndServe listens on the address and serves connections until the
+// listener fails. Returns ErrServerClosed after Shutdown.
+func (s *Server) ListenAndServe() error {
+	listen, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("kafka: could not listen: %s", err)
+	}
+
+	return s.Serve(listen)
+}
+
+// Serve serves connections accepted on the listener until it fails and
+// closes the listener when it returns. Returns ErrServerClosed after
+// Shutdown.
+func (s *Server) Serve(listen net.Listener) error {
+	if s.TLSConfig != nil {
+		listen = tls.NewListener(listen, s.TLSConfig)
+	}
+
+	if !s.conns.SetListener(listen) {
+		listen.Close()
+		return ErrServerClosed
+	}
+
+	defer listen.Close()
+
+	s.logger().Info("kafka: listening", "address", listen.Addr().String())
+
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			if s.conns.ShuttingDown() {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				s.logger().Warn("kafka: error accepting", "err", err)
+				continue
+			}
+			return fmt.Errorf("kafka: could not accept: %s", err)
+		}
+
+		if !s.conns.Add(conn) {
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer s.conns.Remove(conn)
+			defer conn.Close()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Shutdown stops the server from accepting connections, closes idle
+// connections and waits for requests in progress to be served, after which
+// their connections are closed as well. When the context is done before
+// that the remaining connections are closed and the context error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.conns.Shutdown(ctx)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+// handleConn serves requests from the connection in the order they were
+// read until the client closes it or a handler fails
+func (s *Server) handleConn(conn net.Conn) {
+	maxRequestBytes := s.MaxRequestBytes
+	if maxRequestBytes <= 0 {
+		maxRequestBytes = DefaultMaxRequestBytes
+	}
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	logger := s.logger().With("client", conn.RemoteAddr().String())
+	session := &Session{RemoteAddr: conn.RemoteAddr(), LocalAddr: conn.LocalAddr(), Logger: logger}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if s.IdleTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Warn("kafka: TLS handshake failed", "err", err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+
+		state := tlsConn.ConnectionState()
+		session.TLS = &state
+	}
+
+	var size [4]byte
+	for {
+		// Connections are closed between requests when shutting down
+		if !s.conns.SetActive(conn, false) {
+			return
+		}
+
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+
+		_, err := io.ReadFull(r, size[:])
+		// Connections closed as idle by Shutdown are done
+		if !s.conns.SetActive(conn, true) {
+			return
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				logger.Info("kafka: closing idle connection")
+			} else if err != io.EOF {
+				logger.Warn("kafka: unable to read request", "err", err)
+			}
+			return
+		}
+
+		n := int32(binary.BigEndian.Uint32(size[:]))
+		if n < 8 || n > maxRequestBytes {
+			logger.Warn("kafka: request too large, closing connection", "bytes", n)
+			return
+		}
+
+		// The buffer grows with the bytes that arrive rather than the size
+		// the client claims, which may be up to the max
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+			logger.Warn("kafka: unable to read request", "err", err)
+			return
+		}
+
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Time{})
+		}
+
+		d := NewDecoder(buf.Bytes())
+		req := &Request{
+			APIKey:        d.Int16(),
+			APIVersion:    d.Int16(),
+			CorrelationID: d.Int32(),
+			ClientID:      d.Str(),
+			Body:          d,
+			Session:       session,
+		}
+		if d.Err() != nil {
+			logger.Warn("kafka: malformed request header", "err", d.Err())
+			return
+		}
+
+		var resp Encoder
+		start := time.Now()
+		if err := s.Handler.ServeKafka(&resp, req); err != nil {
+			logger.Warn("kafka: closing connection", "api", req.APIKey, "version", req.APIVersion, "err", err)
+			return
+		}
+		logger.Debug("kafka: served request", "api", req.APIKey, "version", req.APIVersion, "duration", time.Since(start))
+		if resp.Len() == 0 {
+			continue
+		}
+
+		var header Encoder
+		header.PutInt32(int32(4 + resp.Len()))
+		header.PutInt32(req.CorrelationID)
+		w.Write(header.Bytes())
+		w.Write(resp.Bytes())
+		if err := w.Flush(); err != nil {
+			logger.Warn("kafka: unable to write response", "err", err)
+			return
+		}
+	}
+}
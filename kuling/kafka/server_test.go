@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer serves the handler on a free local port until the test ends
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listen)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	return listen.Addr().String()
+}
+
+// echoClientID replies with the client ID of the request
+var echoClientID = HandlerFunc(func(w *Encoder, r *Request) error {
+	w.PutString(r.ClientID)
+	return nil
+})
+
+// request frames a request header with the client ID
+func request(correlationID int32, clientID string) []byte {
+	var body Encoder
+	body.PutInt16(18)
+	body.PutInt16(0)
+	body.PutInt32(correlationID)
+	body.PutString(clientID)
+
+	var framed Encoder
+	framed.PutInt32(int32(body.Len()))
+	return append(framed.Bytes(), body.Bytes()...)
+}
+
+// readResponse reads a response and returns its correlation ID and body
+func readResponse(t *testing.T, r io.Reader) (int32, *Decoder) {
+	t.Helper()
+
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder(buf)
+	return d.Int32(), d
+}
+
+func TestServerReadsRequestsInPieces(t *testing.T) {
+	addr := startServer(t, &Server{Handler: echoClientID})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// One byte at a time, then two requests in one write
+	for _, b := range request(1, "slow") {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := conn.Write(append(request(2, "a"), request(3, "b")...)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	for _, want := range []struct {
+		correlationID int32
+		clientID      string
+	}{{1, "slow"}, {2, "a"}, {3, "b"}} {
+		id, d := readResponse(t, r)
+		if id != want.correlationID || d.Str() != want.clientID {
+			t.Errorf("response %d, want %d %s", id, want.correlationID, want.clientID)
+		}
+	}
+}
+
+func TestServerClosesOnOversizedRequest(t *testing.T) {
+	addr := startServer(t, &Server{Handler: echoClientID, MaxRequestBytes: 64})
+
+	for _, size := range []uint32{65, 1 << 31, 4} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], size)
+		conn.Write(header[:])
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("request of %d bytes gave %v, want the connection closed", size, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerShutdownClosesIdleConnections(t *testing.T) {
+	s := &Server{Handler: echoClientID}
+	addr := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(request(1, "c")); err != nil {
+		t.Fatal(err)
+	}
+	readResponse(t, conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection gave %v after shutdown, want closed", err)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
 // PreCopy function that will be called before a copy action is carried
@@ -26,6 +29,41 @@ type Config struct {
 	// Maximum bytes that will get squezed into one segment file before
 	// a new one is created
 	SegmentMaxBytes int64
+	// Logger for the store, topics, shards and segments. slog.Default()
+	// when nil.
+	Logger *slog.Logger
+	// FsyncInterval is how often appends are fsynced once the store is
+	// started, zero fsyncs every append before it is acknowledged. Otherwise
+	// appends acknowledged since the last fsync may be lost when the
+	// machine crashes.
+	FsyncInterval time.Duration
+	// RetentionAge and RetentionBytes remove the oldest segments of a shard
+	// when their last append is older than the age or the shard is larger
+	// than the bytes, zero keeps them. Segments expire once the store is
+	// started, internal topics are kept.
+	RetentionAge   time.Duration
+	RetentionBytes int64
+	// RetentionCheckInterval is how often segments are checked for expiry,
+	// DefaultRetentionCheckInterval when zero
+	RetentionCheckInterval time.Duration
+}
+
+// logger is the configured logger or the default
+func (c *Config) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.Default()
+	}
+	return c.Logger
+}
+
+// internalTopicPrefix starts the names of the topics the server keeps its
+// own state in, like IterTopic
+const internalTopicPrefix = "__"
+
+// IsInternalTopic reports if the topic is internal. Internal topics are
+// only read and written by the server, clients cannot see or use them.
+func IsInternalTopic(topic string) bool {
+	return strings.HasPrefix(topic, internalTopicPrefix)
 }
 
 // Sharder can give you the shards for a topic
@@ -41,8 +79,16 @@ type LogStore struct {
 	dir string
 	// Map of topic names to file system topics structs
 	topics map[string]*Topic
+	// topicsLock guards the topics map
+	topicsLock sync.RWMutex
 	// Channel that will broadcast when the log store has closed down
 	closed chan struct{}
+	logger *slog.Logger
+	// stop ends the background fsyncs and expiry, stopped is closed when
+	// they have ended
+	stop, stopped chan struct{}
+	// started is set by Start, guarded by topicsLock
+	started bool
 }
 
 // OpenLogStore opens or create ile system topic log store
@@ -56,7 +102,7 @@ func OpenLogStore(dir string, c *Config) (*LogStore, error) {
 
 	stat, err := os.Stat(dir)
 	if err != nil || !stat.IsDir() {
-		log.Println("logstore: path is not a directory")
+		c.logger().Error("logstore: path is not a directory", "dir", dir)
 		return nil, err
 	}
 
@@ -64,7 +110,12 @@ func OpenLogStore(dir string, c *Config) (*LogStore, error) {
 		c,
 		dir,
 		make(map[string]*Topic),
+		sync.RWMutex{},
 		make(chan (struct{})),
+		c.logger(),
+		make(chan struct{}),
+		make(chan struct{}),
+		false,
 	}
 
 	// Load all existing topics from the file system
@@ -83,7 +134,7 @@ func OpenLogStore(dir string, c *Config) (*LogStore, error) {
 			continue
 		}
 
-		log.Println("logstore: found existing topic", f.Name())
+		logStore.logger.Info("logstore: found existing topic", "topic", f.Name())
 
 		topic, err := OpenTopic(path.Join(dir, f.Name()), c)
 		if err != nil {
@@ -96,9 +147,101 @@ func OpenLogStore(dir string, c *Config) (*LogStore, error) {
 	return logStore, nil
 }
 
+// Start fsyncs the shards every FsyncInterval and removes expired segments
+// in the background until the store is closed. Until then every append is
+// fsynced and no segment expires. Call it once the store has been set up,
+// after OpenTopicIterStore which may swap the shard of the iter topic.
+func (ls *LogStore) Start() {
+	ls.topicsLock.Lock()
+	if ls.started {
+		ls.topicsLock.Unlock()
+		return
+	}
+	ls.started = true
+	topics := make([]*Topic, 0, len(ls.topics))
+	for _, t := range ls.topics {
+		topics = append(topics, t)
+	}
+	ls.topicsLock.Unlock()
+
+	if ls.config.FsyncInterval > 0 {
+		for _, t := range topics {
+			t.deferFsync()
+		}
+	}
+
+	go ls.background()
+}
+
+// background fsyncs the shards every FsyncInterval and removes expired
+// segments every RetentionCheckInterval until the store is closed
+func (ls *LogStore) background() {
+	defer close(ls.stopped)
+
+	var fsyncs, expiry <-chan time.Time
+	if ls.config.FsyncInterval > 0 {
+		ticker := time.NewTicker(ls.config.FsyncInterval)
+		defer ticker.Stop()
+		fsyncs = ticker.C
+	}
+	if ls.config.RetentionAge > 0 || ls.config.RetentionBytes > 0 {
+		interval := ls.config.RetentionCheckInterval
+		if interval <= 0 {
+			interval = DefaultRetentionCheckInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		expiry = ticker.C
+	}
+
+	for {
+		select {
+		case <-ls.stop:
+			return
+		case <-fsyncs:
+			ls.sync()
+		case now := <-expiry:
+			ls.expire(now)
+		}
+	}
+}
+
+// sync fsyncs the active segment of every shard
+func (ls *LogStore) sync() {
+	for name, t := range ls.Topics() {
+		for shardName, s := range t.Shards() {
+			if err := s.Sync(); err != nil {
+				ls.logger.Error("logstore: could not fsync shard", "topic", name, "shard", shardName, "err", err)
+			}
+		}
+	}
+}
+
+// expire removes the expired segments of every shard but the internal ones
+func (ls *LogStore) expire(now time.Time) {
+	for name, t := range ls.Topics() {
+		if IsInternalTopic(name) {
+			continue
+		}
+		for shardName, s := range t.Shards() {
+			removed, err := s.Expire(ls.config.RetentionAge, ls.config.RetentionBytes, now)
+			if err != nil {
+				ls.logger.Error("logstore: could not expire segments", "topic", name, "shard", shardName, "err", err)
+			}
+			if removed > 0 {
+				ls.logger.Info("logstore: removed expired segments", "topic", name, "shard", shardName, "segments", removed)
+			}
+		}
+	}
+}
+
 // CreateTopic a new topic with given name. Name must not contain
 // spaces or non file system ok chars
 func (ls *LogStore) CreateTopic(topicName string, numShards int) (*Topic, error) {
+	if _, ok := ls.topic(topicName); ok {
+		return nil, fmt.Errorf("%w: %s", ErrTopicExists, topicName)
+	}
+
 	topic, err := OpenTopic(path.Join(ls.dir, topicName), ls.config)
 	if err != nil {
 		return nil, err
@@ -121,58 +264,117 @@ func (ls *LogStore) CreateTopic(topicName string, numShards int) (*Topic, error)
 		}
 	}
 
+	ls.topicsLock.Lock()
+	if _, ok := ls.topics[topicName]; ok {
+		ls.topicsLock.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrTopicExists, topicName)
+	}
 	ls.topics[topicName] = topic
+	started := ls.started
+	ls.topicsLock.Unlock()
+
+	// Topics created after Start are fsynced like the others
+	if started && ls.config.FsyncInterval > 0 {
+		topic.deferFsync()
+	}
+
 	return topic, nil
 }
 
 // Topics returns a map of topic names to topics
 func (ls *LogStore) Topics() map[string]*Topic {
-	return ls.topics
+	ls.topicsLock.RLock()
+	defer ls.topicsLock.RUnlock()
+
+	topics := make(map[string]*Topic, len(ls.topics))
+	for name, t := range ls.topics {
+		topics[name] = t
+	}
+
+	return topics
+}
+
+// topic returns the topic with the name
+func (ls *LogStore) topic(name string) (*Topic, bool) {
+	ls.topicsLock.RLock()
+	defer ls.topicsLock.RUnlock()
+
+	t, ok := ls.topics[name]
+	return t, ok
 }
 
 // DeleteTopic deletes topic with given name
 func (ls *LogStore) DeleteTopic(topic string) error {
-	if t, ok := ls.topics[topic]; ok {
+	if t, ok := ls.topic(topic); ok {
 		return t.Delete()
 	}
 
-	return fmt.Errorf("topic: unknown topic %s", topic)
+	return fmt.Errorf("%w %s", ErrUnknownTopic, topic)
 }
 
 // Shards get a list of shards for a topic
 func (ls *LogStore) Shards(topic string) (map[string]*Shard, error) {
-	if t, ok := ls.topics[topic]; ok {
+	if t, ok := ls.topic(topic); ok {
 		return t.Shards(), nil
 	}
 
-	return nil, fmt.Errorf("topic: unknown topic %s", topic)
+	return nil, fmt.Errorf("%w %s", ErrUnknownTopic, topic)
 }
 
-// Append data to log store in given topic and shard
-func (ls *LogStore) Append(topic, shard string, key, payload []byte) error {
-	if t, ok := ls.topics[topic]; ok {
-		return t.Append(shard, key, payload)
+// Append data to log store in given topic and shard. Returns the sequence ID
+// of the appended message.
+func (ls *LogStore) Append(topic, shard string, key, payload []byte) (int64, error) {
+	if t, ok := ls.topic(topic); ok {
+		sequenceID, err := t.Append(shard, key, payload)
+		if err == nil {
+			metricAppendedMessages.With(topic).Inc()
+			metricBytesIn.With(topic).Add(float64(len(key) + len(payload)))
+		}
+		return sequenceID, err
+	}
+
+	return 0, fmt.Errorf("%w %s", ErrUnknownTopic, topic)
+}
+
+// AppendBatch appends keys and payloads to the log store in given topic and
+// shard in order. Returns the sequence IDs of the appended messages.
+func (ls *LogStore) AppendBatch(topic, shard string, keys, payloads [][]byte) ([]int64, error) {
+	if t, ok := ls.topic(topic); ok {
+		sequenceIDs, err := t.AppendBatch(shard, keys, payloads)
+		if err == nil {
+			metricAppendedMessages.With(topic).Add(float64(len(sequenceIDs)))
+			metricBytesIn.With(topic).Add(float64(payloadsSize(keys, payloads)))
+		}
+		return sequenceIDs, err
 	}
 
-	return fmt.Errorf("topic: unknown topic %s", topic)
+	return nil, fmt.Errorf("%w %s", ErrUnknownTopic, topic)
 }
 
 // Read messages into message array
 func (ls *LogStore) Read(topic, shard string, startSequenceID, maxMessages int64) ([]*Message, error) {
-	if t, ok := ls.topics[topic]; ok {
-		return t.Read(shard, startSequenceID, maxMessages)
+	if t, ok := ls.topic(topic); ok {
+		defer metricFetchDuration.With(topic).ObserveSince(time.Now())
+
+		msgs, err := t.Read(shard, startSequenceID, maxMessages)
+		metricBytesOut.With(topic).Add(float64(messagesSize(msgs)))
+		return msgs, err
 	}
 
-	return nil, fmt.Errorf("topic: unknown topic %s", topic)
+	return nil, fmt.Errorf("%w %s", ErrUnknownTopic, topic)
 }
 
 // Copy data from the topic, shard into the io writer
 func (ls *LogStore) Copy(topic, shard string, startSequenceID, maxMessages int64, w io.Writer, preC PreCopy, postC PostCopy) (int64, error) {
-	if t, ok := ls.topics[topic]; ok {
-		return t.Copy(shard, startSequenceID, maxMessages, w, preC, postC)
+	if t, ok := ls.topic(topic); ok {
+		defer metricFetchDuration.With(topic).ObserveSince(time.Now())
+
+		n, err := t.Copy(shard, startSequenceID, maxMessages, w, preC, postC)
+		metricBytesOut.With(topic).Add(float64(n))
+		return n, err
 	}
 
-	return 0, fmt.Errorf("topic: unknown topic %s", topic)
+	return 0, fmt.Errorf("%w %s", ErrUnknownTopic, topic)
 }
 
 // Closed returns closing channel that will broadcast when the log store
@@ -181,13 +383,30 @@ func (ls *LogStore) Closed() <-chan struct{} {
 	return ls.closed
 }
 
-// Close the file system topics down
+// Close the file system topics down. Every topic is closed even if closing
+// one fails, the first error is returned.
 func (ls *LogStore) Close() error {
-	defer close(ls.closed)
 	// Close the closed channel
-	for _, t := range ls.topics {
-		t.Close()
+	defer close(ls.closed)
+
+	// The shards are fsynced when they are closed
+	close(ls.stop)
+	ls.topicsLock.RLock()
+	started := ls.started
+	ls.topicsLock.RUnlock()
+	if started {
+		<-ls.stopped
+	}
+
+	var err error
+	for name, t := range ls.Topics() {
+		if topicErr := t.Close(); topicErr != nil {
+			ls.logger.Error("logstore: could not close topic", "topic", name, "err", topicErr)
+			if err == nil {
+				err = topicErr
+			}
+		}
 	}
 
-	return nil
+	return err
 }
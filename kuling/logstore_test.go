@@ -0,0 +1,156 @@
+package kuling
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// firstShard is the name of the first shard of a topic
+const firstShard = "0000000000_shard"
+
+// openTestStore opens a log store in the directory, a new temporary one
+// when empty, closed when the test ends
+func openTestStore(t *testing.T, dir string) *LogStore {
+	t.Helper()
+
+	if dir == "" {
+		dir = t.TempDir()
+	}
+	l, err := OpenLogStore(dir, &Config{PermDirectories: 0755, PermData: 0644, SegmentMaxBytes: DefaultSegmentMaxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+// createTestTopic creates the topic and appends the payloads to its first
+// shard
+func createTestTopic(t *testing.T, l *LogStore, topic string, shards int, payloads ...string) {
+	t.Helper()
+
+	if _, err := l.CreateTopic(topic, shards); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range payloads {
+		if _, err := l.Append(topic, firstShard, []byte("key"), []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// memIterStore keeps committed iterators in memory
+type memIterStore struct {
+	mu    sync.Mutex
+	iters map[string]int64
+}
+
+func newMemIterStore() *memIterStore {
+	return &memIterStore{iters: make(map[string]int64)}
+}
+
+func (s *memIterStore) Commit(iter string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.iters[iter] = offset
+	return nil
+}
+
+func (s *memIterStore) GetAll(group, topic string) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := make(map[string]int64)
+	prefix := iterIDPrefix(group, topic)
+	for id, offset := range s.iters {
+		if len(id) >= len(prefix) && id[:len(prefix)] == prefix {
+			all[id] = offset
+		}
+	}
+	return all, nil
+}
+
+func (s *memIterStore) Close() error { return nil }
+
+func TestLogStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLogStore(dir, &Config{PermDirectories: 0755, PermData: 0644, SegmentMaxBytes: DefaultSegmentMaxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestTopic(t, l, "emails", 2, "a", "b")
+	l.Close()
+
+	l = openTestStore(t, dir)
+	shards, err := l.Shards("emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 2 {
+		t.Fatalf("%d shards, want 2", len(shards))
+	}
+
+	msgs, err := l.Read("emails", firstShard, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(msgs); len(got) != 2 || got[1] != "b" {
+		t.Fatalf("read %q", got)
+	}
+
+	if _, err := l.Shards("nope"); !errors.Is(err, ErrUnknownTopic) {
+		t.Errorf("unknown topic gave %v", err)
+	}
+}
+
+func TestLogStoreFsyncIntervalAndRetention(t *testing.T) {
+	l, err := OpenLogStore(t.TempDir(), &Config{
+		PermDirectories:        0755,
+		PermData:               0644,
+		SegmentMaxBytes:        1,
+		FsyncInterval:          10 * time.Millisecond,
+		RetentionBytes:         1,
+		RetentionCheckInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	createTestTopic(t, l, "emails", 1, "a", "b", "c")
+
+	// Until the store is started every append is fsynced
+	shards, _ := l.Shards("emails")
+	if !shards[firstShard].fsyncOnAppend {
+		t.Error("appends not fsynced before start")
+	}
+	l.Start()
+	if shards[firstShard].fsyncOnAppend {
+		t.Error("appends fsynced with an fsync interval")
+	}
+
+	// Topics created after start leave the fsyncs to the store
+	createTestTopic(t, l, "events", 1)
+	if shards, _ = l.Shards("events"); shards[firstShard].fsyncOnAppend {
+		t.Error("appends to a topic created after start fsynced")
+	}
+
+	// Expiry keeps the active segment
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msgs, err := l.Read("emails", firstShard, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := payloads(msgs); len(got) == 1 && got[0] == "c" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("read %q, the oldest segments were not removed", payloads(msgs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -3,8 +3,10 @@ package kuling
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 	"io"
+	"time"
 )
 
 var (
@@ -12,14 +14,26 @@ var (
 	table = crc32.MakeTable(crc32.IEEE)
 )
 
+const (
+	// MagicV0 is the original message format without a timestamp
+	MagicV0 byte = 0
+	// MagicV1 adds the append timestamp after the sequence ID
+	MagicV1 byte = 1
+	// CurrentMagic is the message format used for all new appends
+	CurrentMagic = MagicV1
+)
+
 // Message struct containing the fields that will be written to disk
 // The magic contains the version of the message
 // sequence ID is the sequence id in the topic it is written to. This
 // is needed when log compaction is carried out on a stream.
+// timestamp is the unix time in milliseconds when the message was appended,
+// it is only present from magic version 1 and is zero for older messages.
 // crc is calculated on the payload of the message
 type Message struct {
 	Magic         byte   // 1
 	SequenceID    int64  // 8
+	Timestamp     int64  // 8 (magic >= 1)
 	Crc           int32  // 4
 	KeyLength     int32  // 4
 	Key           []byte // N
@@ -29,12 +43,10 @@ type Message struct {
 
 // NewMessage creates a new message from a byte array payload
 func NewMessage(sequenceID int64, key, payload []byte) *Message {
-	c := crc32.New(table)
-	c.Write(payload)
-
 	return &Message{
-		0,
+		CurrentMagic,
 		sequenceID,
+		time.Now().UnixNano() / int64(time.Millisecond),
 		int32(crc32.Checksum(payload, table)),
 		int32(len(key)),
 		key,
@@ -43,6 +55,39 @@ func NewMessage(sequenceID int64, key, payload []byte) *Message {
 	}
 }
 
+// Size returns the number of bytes the message takes when written
+func (m *Message) Size() int64 {
+	size := int64(1 + 8 + 4 + 4 + len(m.Key) + 4 + len(m.Payload))
+	if m.Magic >= MagicV1 {
+		size += 8
+	}
+
+	return size
+}
+
+// Time returns the append time of the message. Messages written before
+// magic version 1 have no timestamp and return the zero time.
+func (m *Message) Time() time.Time {
+	if m.Magic < MagicV1 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, m.Timestamp*int64(time.Millisecond))
+}
+
+// Convert returns a copy of the message in the format of the magic version
+// for readers that do not understand the format it was written in. Fields
+// the older format lacks are dropped.
+func (m *Message) Convert(magic byte) *Message {
+	c := *m
+	c.Magic = magic
+	if magic < MagicV1 {
+		c.Timestamp = 0
+	}
+
+	return &c
+}
+
 // MessageWriter writes messages to a io Writer
 type MessageWriter struct {
 	*bufio.Writer
@@ -63,38 +108,45 @@ func (w *MessageWriter) WriteMessage(m *Message) (int64, error) {
 	// Write magic byte
 	err := w.WriteByte(m.Magic)
 	if err != nil {
-		panic("Unable to write Magic")
+		return 0, fmt.Errorf("message: unable to write magic: %w", err)
 	}
 
 	// Write sequence ID
 	err = binary.Write(w, binary.BigEndian, &m.SequenceID)
 	if err != nil {
-		panic("Unable to write sequenceID")
+		return 0, fmt.Errorf("message: unable to write sequenceid: %w", err)
+	}
+	// Write timestamp, only part of the message from magic version 1
+	if m.Magic >= MagicV1 {
+		err = binary.Write(w, binary.BigEndian, &m.Timestamp)
+		if err != nil {
+			return 0, fmt.Errorf("message: unable to write timestamp: %w", err)
+		}
 	}
 	// Write checksum
 	err = binary.Write(w, binary.BigEndian, &m.Crc)
 	if err != nil {
-		panic("Unable to write checksum")
+		return 0, fmt.Errorf("message: unable to write checksum: %w", err)
 	}
 	// Write key length
 	err = binary.Write(w, binary.BigEndian, &m.KeyLength)
 	if err != nil {
-		panic("Unable to write key length")
+		return 0, fmt.Errorf("message: unable to write key length: %w", err)
 	}
 	// Write key
 	_, err = w.Write(m.Key)
 	if err != nil {
-		panic("Unable to write key")
+		return 0, fmt.Errorf("message: unable to write key: %w", err)
 	}
 	// Write payload length
 	err = binary.Write(w, binary.BigEndian, &m.PayloadLength)
 	if err != nil {
-		panic("Unable to write payload length")
+		return 0, fmt.Errorf("message: unable to write payload length: %w", err)
 	}
 	// Write payload
 	_, err = w.Write(m.Payload)
 	if err != nil {
-		panic("Unable to write payload")
+		return 0, fmt.Errorf("message: unable to write payload: %w", err)
 	}
 
 	// The total length of the written message
@@ -133,7 +185,7 @@ func (r *MessageReader) ReadMessages() ([]*Message, error) {
 		}
 
 		if err != nil {
-			panic(err)
+			return messages, err
 		}
 
 		messages = append(messages, m)
@@ -149,6 +201,10 @@ func (r *MessageReader) ReadMessage() (*Message, error) {
 		return nil, err
 	}
 
+	if magic > CurrentMagic {
+		return nil, fmt.Errorf("message: unknown magic version %d", magic)
+	}
+
 	// Sequence id
 	var sequenceID int64
 	err = binary.Read(r, binary.BigEndian, &sequenceID) // Reads 8
@@ -156,6 +212,15 @@ func (r *MessageReader) ReadMessage() (*Message, error) {
 		return nil, err
 	}
 
+	// Timestamp, only present from magic version 1
+	var timestamp int64
+	if magic >= MagicV1 {
+		err = binary.Read(r, binary.BigEndian, &timestamp) // Reads 8
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Crc
 	var crc int32
 	err = binary.Read(r, binary.BigEndian, &crc) // Reads 8
@@ -170,8 +235,11 @@ func (r *MessageReader) ReadMessage() (*Message, error) {
 		return nil, err
 	}
 
-	key := make([]byte, keyLength) // Reads len payload
-	_, err = r.Read(key)
+	key := make([]byte, keyLength) // Reads len key
+	_, err = io.ReadFull(r, key)
+	if err != nil {
+		return nil, err
+	}
 
 	// Payload
 	var payloadLength int32
@@ -181,7 +249,7 @@ func (r *MessageReader) ReadMessage() (*Message, error) {
 	}
 
 	payload := make([]byte, payloadLength) // Reads len payload
-	_, err = r.Read(payload)
+	_, err = io.ReadFull(r, payload)
 
 	if err != nil {
 		return nil, err
@@ -190,6 +258,7 @@ func (r *MessageReader) ReadMessage() (*Message, error) {
 	return &Message{
 			magic,
 			sequenceID,
+			timestamp,
 			crc,
 			keyLength,
 			key,
@@ -0,0 +1,86 @@
+package kuling
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+// encodeV0 encodes a message the way it was written before magic version 1
+func encodeV0(sequenceID int64, key, payload []byte) []byte {
+	var b bytes.Buffer
+	b.WriteByte(MagicV0)
+	binary.Write(&b, binary.BigEndian, sequenceID)
+	binary.Write(&b, binary.BigEndian, int32(crc32.Checksum(payload, table)))
+	binary.Write(&b, binary.BigEndian, int32(len(key)))
+	b.Write(key)
+	binary.Write(&b, binary.BigEndian, int32(len(payload)))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+func TestReadMessageV0(t *testing.T) {
+	p := encodeV0(7, []byte("key"), []byte("payload"))
+
+	m, err := NewMessageReader(bytes.NewReader(p)).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Magic != MagicV0 || m.SequenceID != 7 || string(m.Key) != "key" || string(m.Payload) != "payload" {
+		t.Fatalf("got %+v", m)
+	}
+	if !m.Time().IsZero() {
+		t.Errorf("V0 message has time %s", m.Time())
+	}
+	if m.Size() != int64(len(p)) {
+		t.Errorf("size %d, encoded %d bytes", m.Size(), len(p))
+	}
+}
+
+func TestWriteMessageV0Unchanged(t *testing.T) {
+	m := NewMessage(7, []byte("key"), []byte("payload")).Convert(MagicV0)
+
+	var b bytes.Buffer
+	if _, err := NewMessageWriter(&b).WriteMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	if want := encodeV0(7, []byte("key"), []byte("payload")); !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("V0 encoding changed\ngot  %x\nwant %x", b.Bytes(), want)
+	}
+}
+
+func TestMessageV1RoundTrip(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	m := NewMessage(3, []byte("k"), []byte("v"))
+
+	var b bytes.Buffer
+	n, err := NewMessageWriter(&b).WriteMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != m.Size() {
+		t.Errorf("wrote %d bytes, size %d", n, m.Size())
+	}
+
+	got, err := NewMessageReader(&b).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Magic != MagicV1 || got.Timestamp != m.Timestamp || string(got.Payload) != "v" {
+		t.Fatalf("got %+v, wrote %+v", got, m)
+	}
+	if got.Time().Before(before) {
+		t.Errorf("time %s before %s", got.Time(), before)
+	}
+}
+
+func TestReadMessageUnknownMagic(t *testing.T) {
+	p := encodeV0(1, []byte("k"), []byte("v"))
+	p[0] = CurrentMagic + 1
+
+	if _, err := NewMessageReader(bytes.NewReader(p)).ReadMessage(); err == nil {
+		t.Fatal("read a message of unknown magic")
+	}
+}
@@ -0,0 +1,113 @@
+package kuling
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/fredrikbackstrom/kuling/kuling/metrics"
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+var (
+	metricAppendedMessages = metrics.DefaultRegistry.CounterVec("kuling_appended_messages_total",
+		"Messages appended to the topic", "topic")
+	metricBytesIn = metrics.DefaultRegistry.CounterVec("kuling_bytes_in_total",
+		"Key and payload bytes appended to the topic", "topic")
+	metricBytesOut = metrics.DefaultRegistry.CounterVec("kuling_bytes_out_total",
+		"Message bytes read from the topic", "topic")
+	metricFetchDuration = metrics.DefaultRegistry.HistogramVec("kuling_fetch_duration_seconds",
+		"Time to read messages from the topic", metrics.LatencyBuckets, "topic")
+	metricFsyncDuration = metrics.DefaultRegistry.Histogram("kuling_segment_fsync_duration_seconds",
+		"Time to fsync a segment after appending", metrics.LatencyBuckets)
+	metricSegmentRolls = metrics.DefaultRegistry.Counter("kuling_segment_rolls_total",
+		"New segments created because the active segment was full")
+	metricOpenConnections = metrics.DefaultRegistry.Gauge("kuling_open_connections",
+		"Client connections open to the server")
+	metricGroupCommits = metrics.DefaultRegistry.CounterVec("kuling_group_commits_total",
+		"Iterators committed by the group in the topic", "group", "topic")
+)
+
+// ServeMetrics serves the metrics in the Prometheus text format on /metrics
+// at the address. Gauges for the shards of the log store and the lag of the
+// groups of the broker are collected when scraped. Blocks like
+// http.ListenAndServe.
+func ServeMetrics(address string, l *LogStore, b *Broker) error {
+	return NewMetricsServer(address, l, b).ListenAndServe()
+}
+
+// NewMetricsServer creates the HTTP server of the metrics endpoint at the
+// address, see ServeMetrics
+func NewMetricsServer(address string, l *LogStore, b *Broker) *http.Server {
+	registerStoreMetrics(metrics.DefaultRegistry, l, b)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.DefaultRegistry.Handler())
+
+	return &http.Server{Addr: address, Handler: mux}
+}
+
+// registerStoreMetrics registers the gauges that are read from the log store
+// and the broker
+func registerStoreMetrics(r *metrics.Registry, l *LogStore, b *Broker) {
+	r.GaugeFunc("kuling_shard_size_bytes", "Bytes in the segments of the shard",
+		[]string{"topic", "shard"}, func(emit func(float64, ...string)) {
+			for name, t := range l.Topics() {
+				for shard, s := range t.Shards() {
+					emit(float64(s.Size()), name, shard)
+				}
+			}
+		})
+
+	r.GaugeFunc("kuling_shard_head_sequence_id", "Sequence ID of the last message in the shard",
+		[]string{"topic", "shard"}, func(emit func(float64, ...string)) {
+			for name, t := range l.Topics() {
+				for shard, s := range t.Shards() {
+					emit(float64(s.Head()), name, shard)
+				}
+			}
+		})
+
+	r.GaugeFunc("kuling_group_lag", "Messages between the committed iterator of the group and the head of the shard",
+		[]string{"group", "topic", "shard"}, func(emit func(float64, ...string)) {
+			for _, gt := range b.groupTopics() {
+				d, err := b.DescribeGroup(gt[0], gt[1])
+				if err != nil {
+					continue
+				}
+				for _, s := range d.Shards {
+					emit(float64(s.Lag), d.Group, d.Topic, s.Shard)
+				}
+			}
+		})
+}
+
+// countConnections keeps the open connections gauge, it is the ConnState
+// hook of the server
+func countConnections(conn net.Conn, state resp.ConnState) {
+	switch state {
+	case resp.StateNew:
+		metricOpenConnections.Inc()
+	case resp.StateClosed:
+		metricOpenConnections.Dec()
+	}
+}
+
+// messagesSize is the number of bytes of the messages
+func messagesSize(msgs []*Message) int64 {
+	var n int64
+	for _, m := range msgs {
+		n += m.Size()
+	}
+
+	return n
+}
+
+// payloadsSize is the number of bytes of the keys and payloads
+func payloadsSize(keys, payloads [][]byte) int64 {
+	var n int
+	for i := range keys {
+		n += len(keys[i]) + len(payloads[i])
+	}
+
+	return int64(n)
+}
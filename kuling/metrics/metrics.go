@@ -0,0 +1,351 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRegistry is the registry the kuling packages register their
+// metrics with
+var DefaultRegistry = NewRegistry()
+
+// LatencyBuckets are histogram buckets in seconds for disk and request
+// latencies, from 100µs to 10s
+var LatencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric types in the exposition format
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry holds metrics by name and writes them sorted by name
+type Registry struct {
+	families map[string]*family
+	lock     sync.RWMutex
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is a metric and its series, one per combination of label values
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	series map[string]*series
+	// collect, when set, produces the series at the time of writing
+	collect func(emit func(value float64, labelValues ...string))
+	lock    sync.RWMutex
+}
+
+// series is one time series of a family
+type series struct {
+	labelValues []string
+	// value of counters and gauges as float64 bits
+	value uint64
+	// bucket counts, sum bits and count of histograms
+	buckets []uint64
+	sum     uint64
+	count   uint64
+}
+
+// register adds the family, registering a name twice panics as it is a
+// programming error
+func (r *Registry) register(f *family) *family {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.families[f.name]; ok {
+		panic(fmt.Sprintf("metrics: %s registered twice", f.name))
+	}
+	f.series = make(map[string]*series)
+	r.families[f.name] = f
+
+	return f
+}
+
+// with returns the series for the label values, creating it if needed
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.lock.RLock()
+	s, ok := f.series[key]
+	f.lock.RUnlock()
+	if ok {
+		return s
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if s, ok = f.series[key]; !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.typ == typeHistogram {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// addFloat adds v to the float64 stored as bits in addr
+func addFloat(addr *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Counter is a value that only goes up
+type Counter struct{ s *series }
+
+// Inc adds one to the counter
+func (c Counter) Inc() { c.Add(1) }
+
+// Add v to the counter, v must not be negative
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	addFloat(&c.s.value, v)
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct{ s *series }
+
+// Set the gauge to v
+func (g Gauge) Set(v float64) { atomic.StoreUint64(&g.s.value, math.Float64bits(v)) }
+
+// Inc adds one to the gauge
+func (g Gauge) Inc() { addFloat(&g.s.value, 1) }
+
+// Dec subtracts one from the gauge
+func (g Gauge) Dec() { addFloat(&g.s.value, -1) }
+
+// Add v to the gauge
+func (g Gauge) Add(v float64) { addFloat(&g.s.value, v) }
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe adds the value to the histogram
+func (h Histogram) Observe(v float64) {
+	for i, upper := range h.buckets {
+		if v <= upper {
+			atomic.AddUint64(&h.s.buckets[i], 1)
+			break
+		}
+	}
+	addFloat(&h.s.sum, v)
+	atomic.AddUint64(&h.s.count, 1)
+}
+
+// ObserveSince adds the seconds since the start to the histogram
+func (h Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// CounterVec is a counter with labels
+type CounterVec struct{ f *family }
+
+// With returns the counter for the label values
+func (v CounterVec) With(labelValues ...string) Counter { return Counter{v.f.with(labelValues)} }
+
+// GaugeVec is a gauge with labels
+type GaugeVec struct{ f *family }
+
+// With returns the gauge for the label values
+func (v GaugeVec) With(labelValues ...string) Gauge { return Gauge{v.f.with(labelValues)} }
+
+// HistogramVec is a histogram with labels
+type HistogramVec struct{ f *family }
+
+// With returns the histogram for the label values
+func (v HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{v.f.with(labelValues), v.f.buckets}
+}
+
+// Counter registers a counter
+func (r *Registry) Counter(name, help string) Counter {
+	return r.CounterVec(name, help).With()
+}
+
+// CounterVec registers a counter with the labels
+func (r *Registry) CounterVec(name, help string, labels ...string) CounterVec {
+	return CounterVec{r.register(&family{name: name, help: help, typ: typeCounter, labels: labels})}
+}
+
+// Gauge registers a gauge
+func (r *Registry) Gauge(name, help string) Gauge {
+	return r.GaugeVec(name, help).With()
+}
+
+// GaugeVec registers a gauge with the labels
+func (r *Registry) GaugeVec(name, help string, labels ...string) GaugeVec {
+	return GaugeVec{r.register(&family{name: name, help: help, typ: typeGauge, labels: labels})}
+}
+
+// Histogram registers a histogram with the upper bounds of the buckets in
+// increasing order
+func (r *Registry) Histogram(name, help string, buckets []float64) Histogram {
+	return r.HistogramVec(name, help, buckets).With()
+}
+
+// HistogramVec registers a histogram with the labels
+func (r *Registry) HistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: %s buckets are not sorted", name))
+	}
+	return HistogramVec{r.register(&family{name: name, help: help, typ: typeHistogram, labels: labels, buckets: buckets})}
+}
+
+// GaugeFunc registers a gauge whose series are produced by collect every
+// time the metrics are written. Collect emits one value per combination of
+// label values.
+func (r *Registry) GaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.register(&family{name: name, help: help, typ: typeGauge, labels: labels, collect: collect})
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.lock.RLock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.lock.RUnlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler serves the metrics of the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+func (f *family) write(w *bufio.Writer) {
+	var all []*series
+	if f.collect != nil {
+		f.collect(func(value float64, labelValues ...string) {
+			if len(labelValues) != len(f.labels) {
+				panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+			}
+			all = append(all, &series{labelValues: labelValues, value: math.Float64bits(value)})
+		})
+	} else {
+		f.lock.RLock()
+		for _, s := range f.series {
+			all = append(all, s)
+		}
+		f.lock.RUnlock()
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labelValues, "\xff") < strings.Join(all[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+
+	for _, s := range all {
+		if f.typ != typeHistogram {
+			writeSample(w, f.name, f.labels, s.labelValues, "", "", math.Float64frombits(atomic.LoadUint64(&s.value)))
+			continue
+		}
+
+		// Buckets are cumulative in the exposition format
+		var cumulative uint64
+		for i, upper := range f.buckets {
+			cumulative += atomic.LoadUint64(&s.buckets[i])
+			writeSample(w, f.name+"_bucket", f.labels, s.labelValues, "le", formatFloat(upper), float64(cumulative))
+		}
+		count := atomic.LoadUint64(&s.count)
+		writeSample(w, f.name+"_bucket", f.labels, s.labelValues, "le", "+Inf", float64(count))
+		writeSample(w, f.name+"_sum", f.labels, s.labelValues, "", "", math.Float64frombits(atomic.LoadUint64(&s.sum)))
+		writeSample(w, f.name+"_count", f.labels, s.labelValues, "", "", float64(count))
+	}
+}
+
+// writeSample writes one sample line, extra is an additional label such as
+// le of histogram buckets
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, extra, extraValue string, value float64) {
+	w.WriteString(name)
+
+	if len(labels) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(labelValues[i]))
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extra, extraValue)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
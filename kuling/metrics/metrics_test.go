@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("requests_total", "Requests served").Add(3)
+	g := r.GaugeVec("queue_length", "Length of the \\ queue\nper name", "name")
+	g.With(`b"q`).Set(2.5)
+	g.With("a\nq").Inc()
+	h := r.Histogram("latency_seconds", "Latency", []float64{.1, 1})
+	h.Observe(.05)
+	h.Observe(.5)
+	h.Observe(5)
+	r.GaugeFunc("collected", "Collected on write", []string{"shard"}, func(emit func(float64, ...string)) {
+		emit(math.Inf(1), "0")
+	})
+
+	var b bytes.Buffer
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP collected Collected on write
+# TYPE collected gauge
+collected{shard="0"} +Inf
+# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP queue_length Length of the \\ queue\nper name
+# TYPE queue_length gauge
+queue_length{name="a\nq"} 1
+queue_length{name="b\"q"} 2.5
+# HELP requests_total Requests served
+# TYPE requests_total counter
+requests_total 3
+`
+	if b.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("requests_total", "Requests served")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice did not panic")
+		}
+	}()
+	r.Gauge("requests_total", "Requests served")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.CounterVec("appends_total", "Appends", "topic").With("emails").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), `appends_total{topic="emails"} 1`) {
+		t.Errorf("served\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,45 @@
+package kuling
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/fredrikbackstrom/kuling/kuling/metrics"
+)
+
+func TestStoreMetrics(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1, "a", "b")
+	b := newTestBroker(t, l)
+	addr := startTestServer(t, ServerConfig{}, l, b)
+
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Put("emails", firstShard, []byte("k"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := metrics.NewRegistry()
+	registerStoreMetrics(r, l, b)
+	var store bytes.Buffer
+	if err := r.WriteText(&store); err != nil {
+		t.Fatal(err)
+	}
+	if want := `kuling_shard_head_sequence_id{topic="emails",shard="` + firstShard + `"} 3`; !strings.Contains(store.String(), want) {
+		t.Errorf("no %s in\n%s", want, store.String())
+	}
+
+	var global bytes.Buffer
+	if err := metrics.DefaultRegistry.WriteText(&global); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`kuling_appended_messages_total{topic="emails"}`, `kuling_open_connections`} {
+		if !strings.Contains(global.String(), want) {
+			t.Errorf("no %s in the default registry", want)
+		}
+	}
+}
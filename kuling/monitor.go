@@ -0,0 +1,123 @@
+package kuling
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+// ErrMonitorClosed returned by MONITOR when the server is shutting down
+var ErrMonitorClosed = errors.New("monitor: server shutting down")
+
+// monitorBuffer is how many commands are queued for a monitoring connection.
+// Commands are dropped for connections that fall further behind so that a
+// slow monitor never holds up the commands it watches.
+const monitorBuffer = 1024
+
+// monitors streams the commands served to the connections that sent
+// MONITOR
+type monitors struct {
+	mu     sync.Mutex
+	subs   map[chan string]bool
+	closed bool
+	done   chan struct{}
+}
+
+func newMonitors() *monitors {
+	return &monitors{subs: make(map[chan string]bool), done: make(chan struct{})}
+}
+
+// middleware sends every command to the monitors before it runs. Used after
+// the ACL so that denied commands are not shown.
+func (m *monitors) middleware(c *resp.Command, next resp.HandleFunc) resp.HandleFunc {
+	return func(w resp.ResponseWriter, r *resp.Request) {
+		m.publish(r)
+		next(w, r)
+	}
+}
+
+// publish formats the command as Redis does,
+// 1700000000.123456 [127.0.0.1:50000] "PUT" "emails" ...
+func (m *monitors) publish(r *resp.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.subs) == 0 {
+		return
+	}
+
+	now := time.Now()
+	line := fmt.Sprintf("%d.%06d [%s] %s", now.Unix(), now.Nanosecond()/1000,
+		r.Session.RemoteAddr, resp.FormatCommand(r.Cmd, r.Args))
+	for sub := range m.subs {
+		select {
+		case sub <- line:
+		default:
+		}
+	}
+}
+
+// subscribe adds a monitor, false when shutting down
+func (m *monitors) subscribe() (chan string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, false
+	}
+	sub := make(chan string, monitorBuffer)
+	m.subs[sub] = true
+
+	return sub, true
+}
+
+func (m *monitors) unsubscribe(sub chan string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.subs, sub)
+}
+
+// close ends the MONITOR commands so their connections can be closed on
+// shutdown
+func (m *monitors) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+	}
+}
+
+// handler answers OK and then streams every command served, one status
+// reply per command, until the client goes away or the server shuts down.
+// The connection serves no other commands.
+func (m *monitors) handler(w resp.ResponseWriter, r *resp.Request) {
+	sub, ok := m.subscribe()
+	if !ok {
+		w.WriteErr(errorCode(ErrMonitorClosed), fmt.Sprintf("%s : %s", r.Cmd, ErrMonitorClosed))
+		return
+	}
+	defer m.unsubscribe(sub)
+
+	w.WriteStatus("OK")
+	if err := w.Flush(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case line := <-sub:
+			w.WriteStatus(line)
+			if err := w.Flush(); err != nil {
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
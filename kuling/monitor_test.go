@@ -0,0 +1,46 @@
+package kuling
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMonitorStreamsCommands(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	addr := startTestServer(t, ServerConfig{}, l, newTestBroker(t, l))
+
+	_, mw, mr := dialTestConn(t, addr)
+	mw.WriteArray("MONITOR")
+	if err := mw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := mr.Read(); err != nil || v != "OK" {
+		t.Fatalf("MONITOR replied %v, %v", v, err)
+	}
+
+	_, w, r := dialTestConn(t, addr)
+	w.WriteArray("PUT", "emails", firstShard, "key", strings.Repeat("p", 100))
+	w.WriteArray("AUTH", "user", "secret")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		r.Read()
+	}
+
+	// Long arguments are cut and the arguments of AUTH hidden
+	for _, want := range []string{
+		`"PUT" "emails" "` + firstShard + `" "key" "` + strings.Repeat("p", 64) + `"... (100 bytes)`,
+		`"AUTH" (hidden)`,
+	} {
+		v, err := mr.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, _ := v.(string)
+		if !strings.HasSuffix(line, want) || !strings.Contains(line, "[127.0.0.1:") {
+			t.Errorf("monitored %q, want it to end with %s", line, want)
+		}
+	}
+}
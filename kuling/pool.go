@@ -0,0 +1,525 @@
+package kuling
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Defaults for pool configuration values that are not set
+const (
+	DefaultPoolMaxConns            = 10
+	DefaultPoolIdleTimeout         = time.Minute
+	DefaultPoolHealthCheckInterval = 30 * time.Second
+	DefaultPoolHealthCheckTimeout  = 5 * time.Second
+)
+
+// ErrPoolClosed returned when using a pool that has been closed
+var ErrPoolClosed = errors.New("pool: closed")
+
+// PoolConfig configures a pool. Address is required, the rest falls back to
+// defaults when not set.
+type PoolConfig struct {
+	// Address of the kuling server
+	Address string
+	// TLSConfig connects with TLS when set
+	TLSConfig *tls.Config
+	// Credentials to authenticate with, if the server requires it
+	Credentials Credentials
+	// MinConns is the number of connections kept open even when idle
+	MinConns int
+	// MaxConns is the max number of open connections, calls wait for a
+	// connection to be released when all are in use
+	MaxConns int
+	// IdleTimeout closes connections above MinConns that have not been used
+	// within the timeout. Keep it below the server's idle timeout.
+	IdleTimeout time.Duration
+	// HealthCheckInterval is how often idle connections are pinged, broken
+	// connections are closed and replaced
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout is how long a ping may take before the connection
+	// is considered broken
+	HealthCheckTimeout time.Duration
+}
+
+// Pool is a client that is safe for concurrent use. Every call borrows a
+// connection from the pool for the duration of the call so concurrent calls
+// run on separate connections.
+type Pool struct {
+	config PoolConfig
+
+	// idle connections, the most recently used last
+	idle []*pooledConn
+	// number of open connections, idle and in use
+	open   int
+	closed bool
+	lock   sync.Mutex
+
+	// one token per connection that may be open, taken while a connection
+	// is in use
+	tokens chan struct{}
+	done   chan struct{}
+}
+
+type pooledConn struct {
+	cl       *Client
+	lastUsed time.Time
+}
+
+// NewPool creates a pool and opens the min number of connections
+func NewPool(config PoolConfig) (*Pool, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("pool: address is required")
+	}
+	if config.MaxConns <= 0 {
+		config.MaxConns = DefaultPoolMaxConns
+	}
+	if config.MinConns < 0 || config.MinConns > config.MaxConns {
+		return nil, fmt.Errorf("pool: min connections must be between 0 and %d", config.MaxConns)
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultPoolIdleTimeout
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = DefaultPoolHealthCheckInterval
+	}
+	if config.HealthCheckTimeout <= 0 {
+		config.HealthCheckTimeout = DefaultPoolHealthCheckTimeout
+	}
+
+	p := &Pool{
+		config: config,
+		tokens: make(chan struct{}, config.MaxConns),
+		done:   make(chan struct{}),
+	}
+
+	for i := 0; i < config.MinConns; i++ {
+		cl, err := p.dial(context.Background())
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		p.idle = append(p.idle, &pooledConn{cl, time.Now()})
+		p.open++
+	}
+
+	go p.maintain()
+
+	return p, nil
+}
+
+// Do runs the request on a connection from the pool. The connection must not
+// be used after the request returns. A connection that fails with a
+// connection error is closed and the error returned, the request may or may
+// not have been served.
+func (p *Pool) Do(request func(cl *Client) error) error {
+	return p.DoContext(context.Background(), request)
+}
+
+// DoContext runs the request on a connection from the pool like Do. Waiting
+// for a free connection stops when the context is done, the request should
+// pass the context on to the client calls it makes.
+func (p *Pool) DoContext(ctx context.Context, request func(cl *Client) error) error {
+	return p.do(ctx, false, request)
+}
+
+// DoIdempotent runs the request like Do, but if it fails with a connection
+// error on a connection that had been idle in the pool, which the server may
+// have closed, it is retried once on a new connection. Only for requests
+// that can be served twice without harm, like reads and commits.
+func (p *Pool) DoIdempotent(request func(cl *Client) error) error {
+	return p.DoIdempotentContext(context.Background(), request)
+}
+
+// DoIdempotentContext is DoIdempotent within the context
+func (p *Pool) DoIdempotentContext(ctx context.Context, request func(cl *Client) error) error {
+	return p.do(ctx, true, request)
+}
+
+func (p *Pool) do(ctx context.Context, idempotent bool, request func(cl *Client) error) error {
+	for attempt := 0; ; attempt++ {
+		pc, reused, err := p.acquire(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = request(pc.cl)
+		broken := err != nil && isRetriable(err)
+		p.release(pc, broken)
+
+		if !broken || !idempotent || !reused || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// acquire waits for a free token and returns an idle connection or dials a
+// new one. Reports if the connection has been used before.
+func (p *Pool) acquire(ctx context.Context) (*pooledConn, bool, error) {
+	select {
+	case p.tokens <- struct{}{}:
+	case <-p.done:
+		return nil, false, ErrPoolClosed
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		<-p.tokens
+		return nil, false, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		pc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+		return pc, true, nil
+	}
+	p.open++
+	p.lock.Unlock()
+
+	cl, err := p.dial(ctx)
+	if err != nil {
+		p.lock.Lock()
+		p.open--
+		p.lock.Unlock()
+		<-p.tokens
+		return nil, false, err
+	}
+
+	return &pooledConn{cl, time.Now()}, false, nil
+}
+
+// release hands the connection back to the pool, or closes it if it is
+// broken or the pool has been closed, and frees the token
+func (p *Pool) release(pc *pooledConn, broken bool) {
+	defer func() { <-p.tokens }()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if broken || p.closed {
+		pc.cl.Close()
+		p.open--
+		return
+	}
+
+	pc.lastUsed = time.Now()
+	p.idle = append(p.idle, pc)
+}
+
+// maintain runs health checks and idle eviction until the pool is closed
+func (p *Pool) maintain() {
+	ticker := time.NewTicker(p.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.check()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// check closes connections idle for longer than the idle timeout, above the
+// min number of connections, pings the remaining idle connections and opens
+// new connections up to the min number of connections
+func (p *Pool) check() {
+	p.lock.Lock()
+	var checking, idle []*pooledConn
+	for _, pc := range p.idle {
+		// The idle list is ordered by last use, evict from the oldest
+		if time.Since(pc.lastUsed) > p.config.IdleTimeout && p.open > p.config.MinConns {
+			pc.cl.Close()
+			p.open--
+			continue
+		}
+
+		// A connection being checked is in use and takes a token, if none
+		// is free the connection is checked next time
+		select {
+		case p.tokens <- struct{}{}:
+			checking = append(checking, pc)
+		default:
+			idle = append(idle, pc)
+		}
+	}
+	p.idle = idle
+	p.lock.Unlock()
+
+	for _, pc := range checking {
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.HealthCheckTimeout)
+		_, err := pc.cl.PingContext(ctx)
+		cancel()
+
+		p.lock.Lock()
+		if err != nil || p.closed {
+			if err != nil {
+				slog.Warn("pool: closing unhealthy connection", "err", err)
+			}
+			pc.cl.Close()
+			p.open--
+		} else {
+			// Keep the last use, a ping does not count as use
+			p.idle = append([]*pooledConn{pc}, p.idle...)
+		}
+		p.lock.Unlock()
+		<-p.tokens
+	}
+
+	for {
+		p.lock.Lock()
+		if p.closed || p.open >= p.config.MinConns {
+			p.lock.Unlock()
+			return
+		}
+		p.open++
+		p.lock.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.HealthCheckTimeout)
+		cl, err := p.dial(ctx)
+		cancel()
+
+		p.lock.Lock()
+		if err != nil {
+			p.open--
+			p.lock.Unlock()
+			slog.Warn("pool: could not open min connections", "err", err)
+			return
+		}
+		if p.closed {
+			cl.Close()
+			p.open--
+		} else {
+			p.idle = append([]*pooledConn{{cl, time.Now()}}, p.idle...)
+		}
+		p.lock.Unlock()
+	}
+}
+
+// dial opens a new connection for the pool within the context
+func (p *Pool) dial(ctx context.Context) (*Client, error) {
+	return DialConfigContext(ctx, ClientConfig{Address: p.config.Address, TLSConfig: p.config.TLSConfig, Credentials: p.config.Credentials})
+}
+
+// Close all idle connections. Connections in use are closed when released.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	p.closed = true
+	close(p.done)
+
+	for _, pc := range p.idle {
+		pc.cl.Close()
+		p.open--
+	}
+	p.idle = nil
+
+	return nil
+}
+
+// Ping the server
+func (p *Pool) Ping() (string, error) {
+	return p.PingContext(context.Background())
+}
+
+// PingContext is Ping within the context
+func (p *Pool) PingContext(ctx context.Context) (string, error) {
+	var res string
+	err := p.DoIdempotentContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.PingContext(ctx)
+		return err
+	})
+	return res, err
+}
+
+// Create topic with given number of shards
+func (p *Pool) Create(topic string, numShards int64) (string, error) {
+	return p.CreateContext(context.Background(), topic, numShards)
+}
+
+// CreateContext is Create within the context
+func (p *Pool) CreateContext(ctx context.Context, topic string, numShards int64) (string, error) {
+	var res string
+	err := p.DoContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.CreateContext(ctx, topic, numShards)
+		return err
+	})
+	return res, err
+}
+
+// List lists all topic names
+func (p *Pool) List() ([]string, error) {
+	return p.ListContext(context.Background())
+}
+
+// ListContext is List within the context
+func (p *Pool) ListContext(ctx context.Context) ([]string, error) {
+	var res []string
+	err := p.DoIdempotentContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.ListContext(ctx)
+		return err
+	})
+	return res, err
+}
+
+// Describe list all shards for a topic
+func (p *Pool) Describe(topic string) ([]string, error) {
+	return p.DescribeContext(context.Background(), topic)
+}
+
+// DescribeContext is Describe within the context
+func (p *Pool) DescribeContext(ctx context.Context, topic string) ([]string, error) {
+	var res []string
+	err := p.DoIdempotentContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.DescribeContext(ctx, topic)
+		return err
+	})
+	return res, err
+}
+
+// Put keyed message into shard of the topic
+func (p *Pool) Put(topic, shard string, key, message []byte) (string, error) {
+	return p.PutContext(context.Background(), topic, shard, key, message)
+}
+
+// PutContext is Put within the context
+func (p *Pool) PutContext(ctx context.Context, topic, shard string, key, message []byte) (string, error) {
+	var res string
+	err := p.DoContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.PutContext(ctx, topic, shard, key, message)
+		return err
+	})
+	return res, err
+}
+
+// PutBatch puts keyed messages into shard of the topic in order
+func (p *Pool) PutBatch(topic, shard string, keys, messages [][]byte) ([]int64, error) {
+	return p.PutBatchContext(context.Background(), topic, shard, keys, messages)
+}
+
+// PutBatchContext is PutBatch within the context
+func (p *Pool) PutBatchContext(ctx context.Context, topic, shard string, keys, messages [][]byte) ([]int64, error) {
+	var res []int64
+	err := p.DoContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.PutBatchContext(ctx, topic, shard, keys, messages)
+		return err
+	})
+	return res, err
+}
+
+// Get messages from the topic shard starting from the start ID
+func (p *Pool) Get(topic, shard string, startID, maxNumMessages int64) ([]*Message, error) {
+	return p.GetContext(context.Background(), topic, shard, startID, maxNumMessages)
+}
+
+// GetContext is Get within the context
+func (p *Pool) GetContext(ctx context.Context, topic, shard string, startID, maxNumMessages int64) ([]*Message, error) {
+	var res []*Message
+	err := p.DoIdempotentContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.GetContext(ctx, topic, shard, startID, maxNumMessages)
+		return err
+	})
+	return res, err
+}
+
+// Iters gets a set of iterators belonging to the client ID for the topic and
+// group
+func (p *Pool) Iters(group, client, topic string) ([]string, error) {
+	return p.ItersContext(context.Background(), group, client, topic)
+}
+
+// ItersContext is Iters within the context
+func (p *Pool) ItersContext(ctx context.Context, group, client, topic string) ([]string, error) {
+	var res []string
+	err := p.DoIdempotentContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.ItersContext(ctx, group, client, topic)
+		return err
+	})
+	return res, err
+}
+
+// Commit an iterator at a offset
+func (p *Pool) Commit(iter string, offset int64) (string, error) {
+	return p.CommitContext(context.Background(), iter, offset)
+}
+
+// CommitContext is Commit within the context
+func (p *Pool) CommitContext(ctx context.Context, iter string, offset int64) (string, error) {
+	var res string
+	err := p.DoIdempotentContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.CommitContext(ctx, iter, offset)
+		return err
+	})
+	return res, err
+}
+
+// Leave the group
+func (p *Pool) Leave(group, client string) (string, error) {
+	return p.LeaveContext(context.Background(), group, client)
+}
+
+// LeaveContext is Leave within the context
+func (p *Pool) LeaveContext(ctx context.Context, group, client string) (string, error) {
+	var res string
+	err := p.DoContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.LeaveContext(ctx, group, client)
+		return err
+	})
+	return res, err
+}
+
+// DescribeGroup gets the members and position of the group in the topic
+func (p *Pool) DescribeGroup(group, topic string) (*GroupDescription, error) {
+	return p.DescribeGroupContext(context.Background(), group, topic)
+}
+
+// DescribeGroupContext is DescribeGroup within the context
+func (p *Pool) DescribeGroupContext(ctx context.Context, group, topic string) (*GroupDescription, error) {
+	var res *GroupDescription
+	err := p.DoIdempotentContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.DescribeGroupContext(ctx, group, topic)
+		return err
+	})
+	return res, err
+}
+
+// ResetGroup moves the committed iterators of an inactive group
+func (p *Pool) ResetGroup(group, topic string, reset OffsetReset) (map[string]int64, error) {
+	return p.ResetGroupContext(context.Background(), group, topic, reset)
+}
+
+// ResetGroupContext is ResetGroup within the context
+func (p *Pool) ResetGroupContext(ctx context.Context, group, topic string, reset OffsetReset) (map[string]int64, error) {
+	var res map[string]int64
+	err := p.DoContext(ctx, func(cl *Client) error {
+		var err error
+		res, err = cl.ResetGroupContext(ctx, group, topic, reset)
+		return err
+	})
+	return res, err
+}
@@ -0,0 +1,82 @@
+package kuling
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+func TestPoolRetriesOnlyIdempotentRequests(t *testing.T) {
+	l := openTestStore(t, "")
+	addr := startTestServer(t, ServerConfig{}, l, newTestBroker(t, l))
+
+	p, err := NewPool(PoolConfig{Address: addr, MinConns: 1, MaxConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The request fails as if the server had closed the idle connection
+	calls := 0
+	broken := func(cl *Client) error {
+		calls++
+		return io.ErrUnexpectedEOF
+	}
+
+	if err := p.Do(broken); err != io.ErrUnexpectedEOF {
+		t.Fatalf("do gave %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("request sent %d times, want once", calls)
+	}
+
+	// The broken connection was closed, start from a reused one again
+	if _, err := p.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	if err := p.DoIdempotent(broken); err != io.ErrUnexpectedEOF {
+		t.Fatalf("do idempotent gave %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("idempotent request sent %d times, want twice", calls)
+	}
+}
+
+func TestPoolHealthCheckTimesOut(t *testing.T) {
+	// The server answers the handshake and then never replies
+	addr := startFakeServer(t, func(n int64, r *resp.Reader, w *resp.Writer) {
+		answerHello(r, w)
+		r.Read()
+		r.Read()
+	})
+
+	p, err := NewPool(PoolConfig{Address: addr, MinConns: 1, HealthCheckInterval: time.Hour,
+		HealthCheckTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	idle := p.idle[0]
+
+	done := make(chan struct{})
+	go func() {
+		p.check()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("health check did not time out")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, pc := range p.idle {
+		if pc == idle {
+			t.Error("unresponsive connection kept")
+		}
+	}
+}
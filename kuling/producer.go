@@ -0,0 +1,374 @@
+package kuling
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults for producer configuration values that are not set
+const (
+	DefaultProducerBatchMaxMessages = 500
+	DefaultProducerBatchMaxBytes    = 1024 * 1024
+	DefaultProducerLinger           = 5 * time.Millisecond
+	DefaultProducerMaxRetries       = 5
+	DefaultProducerRetryBackoff     = 100 * time.Millisecond
+	DefaultProducerQueueSize        = 10000
+)
+
+// ErrProducerClosed returned when producing on a producer that has been
+// closed
+var ErrProducerClosed = errors.New("producer: closed")
+
+// ProducerMessage is a message to produce. Shard, SequenceID and Err are
+// set by the producer when the message has been delivered or has failed.
+type ProducerMessage struct {
+	Topic   string
+	Key     []byte
+	Payload []byte
+
+	// Metadata is not sent, it is handed back in the delivery report
+	Metadata interface{}
+
+	// Shard the message was routed to
+	Shard string
+	// SequenceID assigned to the message in the shard
+	SequenceID int64
+	// Err is set if the message could not be delivered
+	Err error
+}
+
+// ProducerConfig configures a producer. Address is required, the rest falls
+// back to defaults when not set.
+type ProducerConfig struct {
+	// Address of the kuling server
+	Address string
+	// TLSConfig connects with TLS when set
+	TLSConfig *tls.Config
+	// Credentials to authenticate with, if the server requires it
+	Credentials Credentials
+	// BatchMaxMessages is the max number of messages sent to a shard in
+	// one request
+	BatchMaxMessages int
+	// BatchMaxBytes is the max number of key and payload bytes sent to a
+	// shard in one request
+	BatchMaxBytes int
+	// Linger is how long a batch waits for more messages before it is sent
+	Linger time.Duration
+	// MaxRetries of a batch that failed with a retriable error. A batch
+	// that failed with a network error may still have been stored by the
+	// server, retrying it stores the messages twice. Consumers that must
+	// not see duplicates dedupe, by key for example.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, it doubles for
+	// every following retry
+	RetryBackoff time.Duration
+	// QueueSize is the number of messages that can be waiting to be routed
+	// before Produce blocks
+	QueueSize int
+	// OnDelivery is called for every message when it has been delivered or
+	// has failed
+	OnDelivery func(m *ProducerMessage)
+	// ReportDeliveries sends every message on the Deliveries channel when
+	// it has been delivered or has failed. The channel must be drained.
+	ReportDeliveries bool
+}
+
+// clientConfig is the config of the producer's connections
+func (config ProducerConfig) clientConfig() ClientConfig {
+	return ClientConfig{Address: config.Address, TLSConfig: config.TLSConfig, Credentials: config.Credentials}
+}
+
+// Producer produces messages asynchronously. Messages are routed to a shard
+// of the topic by hashing the key and batched per shard. Each shard has at
+// most one batch in flight and retries it until it succeeds or gives up, so
+// messages with the same key are stored in the order they were produced.
+// Delivery is at least once. A PUT_BATCH retried after a network error may
+// already have been stored by the server before the connection failed, in
+// which case the messages are stored twice with different sequence IDs.
+type Producer struct {
+	config ProducerConfig
+
+	input      chan *ProducerMessage
+	deliveries chan *ProducerMessage
+	// connection for topic metadata, batchers have their own connections
+	conn *persistentClient
+
+	// topic to sorted shard names
+	shards map[string][]string
+	// topic and shard to the batcher of that shard
+	batchers map[string]chan *ProducerMessage
+	wg       sync.WaitGroup
+
+	// isClosed is set by Close, Produce sends on input while holding the
+	// read lock so that input is never closed under a sender
+	isClosed bool
+	lock     sync.RWMutex
+	closed   chan struct{}
+}
+
+// NewProducer creates a producer and starts routing messages in the
+// background
+func NewProducer(config ProducerConfig) (*Producer, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("producer: address is required")
+	}
+	if config.BatchMaxMessages <= 0 {
+		config.BatchMaxMessages = DefaultProducerBatchMaxMessages
+	}
+	if config.BatchMaxBytes <= 0 {
+		config.BatchMaxBytes = DefaultProducerBatchMaxBytes
+	}
+	if config.Linger <= 0 {
+		config.Linger = DefaultProducerLinger
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = DefaultProducerMaxRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = DefaultProducerRetryBackoff
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultProducerQueueSize
+	}
+
+	p := &Producer{
+		config:     config,
+		input:      make(chan *ProducerMessage, config.QueueSize),
+		deliveries: make(chan *ProducerMessage, config.QueueSize),
+		conn:       &persistentClient{config: config.clientConfig()},
+		shards:     make(map[string][]string),
+		batchers:   make(map[string]chan *ProducerMessage),
+		closed:     make(chan struct{}),
+	}
+
+	go p.route()
+
+	return p, nil
+}
+
+// Produce queues the message for delivery. It blocks if the queue is full.
+// Returns ErrProducerClosed once Close has been called.
+func (p *Producer) Produce(m *ProducerMessage) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.isClosed {
+		return ErrProducerClosed
+	}
+
+	// route reads input until it is closed, so a blocked send always
+	// finishes and lets Close take the lock
+	p.input <- m
+	return nil
+}
+
+// Deliveries returns the channel delivery reports are sent on when
+// ReportDeliveries is set. The channel is closed when the producer is
+// closed.
+func (p *Producer) Deliveries() <-chan *ProducerMessage {
+	return p.deliveries
+}
+
+// Close stops accepting messages and waits for all queued messages to be
+// delivered or to fail
+func (p *Producer) Close() error {
+	p.lock.Lock()
+	if !p.isClosed {
+		p.isClosed = true
+		close(p.input)
+	}
+	p.lock.Unlock()
+	<-p.closed
+
+	return nil
+}
+
+// route sends every queued message to the batcher of the shard its key
+// hashes to
+func (p *Producer) route() {
+	defer close(p.closed)
+	defer close(p.deliveries)
+	defer p.conn.Close()
+
+	for m := range p.input {
+		shards, err := p.topicShards(m.Topic)
+		if err != nil {
+			m.Err = err
+			p.report(m)
+			continue
+		}
+		if len(m.Key) == 0 {
+			m.Err = ErrShardIllegalKey
+			p.report(m)
+			continue
+		}
+
+		m.Shard = shards[int(crc32.Checksum(m.Key, table)%uint32(len(shards)))]
+
+		batchKey := m.Topic + "/" + m.Shard
+		batcher, ok := p.batchers[batchKey]
+		if !ok {
+			batcher = make(chan *ProducerMessage, p.config.BatchMaxMessages)
+			p.batchers[batchKey] = batcher
+			p.wg.Add(1)
+			go p.batch(m.Topic, m.Shard, batcher)
+		}
+
+		batcher <- m
+	}
+
+	for _, batcher := range p.batchers {
+		close(batcher)
+	}
+	p.wg.Wait()
+}
+
+// topicShards returns the shards of the topic, asking the server the first
+// time the topic is produced to
+func (p *Producer) topicShards(topic string) ([]string, error) {
+	if shards, ok := p.shards[topic]; ok {
+		return shards, nil
+	}
+
+	var shards []string
+	err := p.retry(func() error {
+		return p.conn.do(func(cl *Client) error {
+			var err error
+			shards, err = cl.Describe(topic)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("producer: could not get shards for topic %s: %w", topic, err)
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("producer: topic %s has no shards", topic)
+	}
+
+	p.shards[topic] = shards
+
+	return shards, nil
+}
+
+// batch collects messages for the shard until the batch is full or has
+// lingered long enough and then sends it
+func (p *Producer) batch(topic, shard string, in <-chan *ProducerMessage) {
+	defer p.wg.Done()
+
+	conn := &persistentClient{config: p.config.clientConfig()}
+	defer conn.Close()
+
+	var batch []*ProducerMessage
+	var batchBytes int
+	var linger <-chan time.Time
+
+	flush := func() {
+		if len(batch) > 0 {
+			p.send(conn, topic, shard, batch)
+		}
+		batch, batchBytes, linger = nil, 0, nil
+	}
+
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+
+			size := len(m.Key) + len(m.Payload)
+			if len(batch) > 0 && batchBytes+size > p.config.BatchMaxBytes {
+				flush()
+			}
+
+			batch = append(batch, m)
+			batchBytes += size
+			if len(batch) == 1 {
+				linger = time.After(p.config.Linger)
+			}
+			if len(batch) >= p.config.BatchMaxMessages {
+				flush()
+			}
+		case <-linger:
+			flush()
+		}
+	}
+}
+
+// send the batch to the shard, retrying retriable errors, and report the
+// outcome of every message
+func (p *Producer) send(conn *persistentClient, topic, shard string, batch []*ProducerMessage) {
+	keys := make([][]byte, len(batch))
+	payloads := make([][]byte, len(batch))
+	for i, m := range batch {
+		keys[i] = m.Key
+		payloads[i] = m.Payload
+	}
+
+	var sequenceIDs []int64
+	err := p.retry(func() error {
+		return conn.do(func(cl *Client) error {
+			var err error
+			sequenceIDs, err = cl.PutBatch(topic, shard, keys, payloads)
+			return err
+		})
+	})
+	if err == nil && len(sequenceIDs) != len(batch) {
+		err = fmt.Errorf("producer: got %d sequence IDs for %d messages", len(sequenceIDs), len(batch))
+	}
+
+	for i, m := range batch {
+		if err != nil {
+			m.Err = err
+		} else {
+			m.SequenceID = sequenceIDs[i]
+		}
+		p.report(m)
+	}
+}
+
+// retry the request with exponential backoff as long as it fails with a
+// retriable error and retries are left
+func (p *Producer) retry(request func() error) error {
+	backoff := p.config.RetryBackoff
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = request(); err == nil || !isRetriable(err) || attempt >= p.config.MaxRetries {
+			return err
+		}
+
+		slog.Warn("producer: retrying", "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// report the outcome of the message to the delivery callback and channel
+func (p *Producer) report(m *ProducerMessage) {
+	if m.Err != nil && p.config.OnDelivery == nil && !p.config.ReportDeliveries {
+		slog.Error("producer: could not deliver message", "topic", m.Topic, "err", m.Err)
+	}
+
+	if p.config.OnDelivery != nil {
+		p.config.OnDelivery(m)
+	}
+	if p.config.ReportDeliveries {
+		p.deliveries <- m
+	}
+}
+
+// isRetriable checks if the error is from the connection to the server
+// rather than an error reply from the server, which would fail again
+func isRetriable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,55 @@
+package kuling
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProducerProduceWhileClosing(t *testing.T) {
+	// Nothing listens on the address, every message fails and is reported
+	var reported atomic.Int64
+	p, err := NewProducer(ProducerConfig{Address: "127.0.0.1:1", MaxRetries: 1, RetryBackoff: time.Millisecond,
+		QueueSize: 4, OnDelivery: func(m *ProducerMessage) { reported.Add(1) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var accepted atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := p.Produce(&ProducerMessage{Topic: "emails", Key: []byte("key"), Payload: []byte("payload")})
+				if errors.Is(err, ErrProducerClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("produce gave %v", err)
+					return
+				}
+				accepted.Add(1)
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if accepted.Load() != reported.Load() {
+		t.Errorf("%d messages accepted, %d reported", accepted.Load(), reported.Load())
+	}
+	if err := p.Produce(&ProducerMessage{Topic: "emails", Key: []byte("key")}); !errors.Is(err, ErrProducerClosed) {
+		t.Errorf("produce after close gave %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("second close gave %v", err)
+	}
+}
@@ -0,0 +1,320 @@
+package kuling
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+// DefaultQuotaMaxThrottle is the longest a request is delayed
+const DefaultQuotaMaxThrottle = 10 * time.Second
+
+// quotaIdleTimeout drops the buckets of clients that have not been seen for
+// longer, they start over with full buckets
+const quotaIdleTimeout = 10 * time.Minute
+
+// throttleHint is the status clients that negotiated the throttle feature
+// get before the reply of a throttled request
+const throttleHint = "THROTTLE"
+
+// Quota limits the rate of a client. Rates are per second, zero is
+// unlimited. A client may burst up to one second of its rate.
+type Quota struct {
+	// ProduceBytes appended with PUT and PUT_BATCH
+	ProduceBytes float64
+	// FetchBytes read with GET
+	FetchBytes float64
+	// Requests of PUT, PUT_BATCH and GET
+	Requests float64
+}
+
+// QuotaConfig configures the quotas. Clients without an override get the
+// default quota.
+type QuotaConfig struct {
+	Default Quota
+	// OverridesFile holds a quota per client, one per line
+	//
+	//	<client> [produce=<bytes>] [fetch=<bytes>] [requests=<n>]
+	//
+	// Rates left out are unlimited. Blank lines and lines starting with #
+	// are ignored.
+	OverridesFile string
+	// MaxThrottle is the longest a request is delayed
+	MaxThrottle time.Duration
+}
+
+// Quotas throttles clients that go over their quota. Clients are the
+// authenticated principal of the connection, else the client ID sent in
+// HELLO, else the host the connection comes from. A nil Quotas throttles
+// nothing.
+type Quotas struct {
+	config QuotaConfig
+
+	overrides map[string]Quota
+	clients   map[string]*clientQuota
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+// clientQuota are the buckets of one client
+type clientQuota struct {
+	produce  tokenBucket
+	fetch    tokenBucket
+	requests tokenBucket
+	seen     time.Time
+}
+
+// NewQuotas creates quotas with the config, loading the overrides file if
+// there is one
+func NewQuotas(config QuotaConfig) (*Quotas, error) {
+	if config.MaxThrottle <= 0 {
+		config.MaxThrottle = DefaultQuotaMaxThrottle
+	}
+
+	q := &Quotas{
+		config:    config,
+		overrides: make(map[string]Quota),
+		clients:   make(map[string]*clientQuota),
+		lastSweep: time.Now(),
+	}
+	if err := q.Reload(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Reload the overrides file. Clients start over with full buckets of their
+// new quota. On error the current overrides are kept.
+func (q *Quotas) Reload() error {
+	overrides := make(map[string]Quota)
+
+	if q.config.OverridesFile != "" {
+		f, err := os.Open(q.config.OverridesFile)
+		if err != nil {
+			return fmt.Errorf("quota: could not open overrides file: %s", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			fields := strings.Fields(line)
+			quota, err := parseQuota(fields[1:])
+			if err != nil {
+				return fmt.Errorf("quota: %s:%d: %s", q.config.OverridesFile, n, err)
+			}
+			overrides[fields[0]] = quota
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("quota: could not read overrides file: %s", err)
+		}
+	}
+
+	q.lock.Lock()
+	q.overrides = overrides
+	q.clients = make(map[string]*clientQuota)
+	q.lock.Unlock()
+
+	return nil
+}
+
+// parseQuota parses name=rate fields
+func parseQuota(fields []string) (Quota, error) {
+	var quota Quota
+	for _, field := range fields {
+		name, value, _ := strings.Cut(field, "=")
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			return Quota{}, fmt.Errorf("malformed rate %q", field)
+		}
+
+		switch name {
+		case "produce":
+			quota.ProduceBytes = rate
+		case "fetch":
+			quota.FetchBytes = rate
+		case "requests":
+			quota.Requests = rate
+		default:
+			return Quota{}, fmt.Errorf("unknown rate %q", name)
+		}
+	}
+
+	return quota, nil
+}
+
+// client returns the buckets of the client, creating them if needed. Must
+// be called with the lock held.
+func (q *Quotas) client(name string, now time.Time) *clientQuota {
+	// Forget clients that have been gone for a while so that the map does
+	// not grow with every client ever seen
+	if now.Sub(q.lastSweep) > quotaIdleTimeout {
+		for n, c := range q.clients {
+			if now.Sub(c.seen) > quotaIdleTimeout {
+				delete(q.clients, n)
+			}
+		}
+		q.lastSweep = now
+	}
+
+	c, ok := q.clients[name]
+	if !ok {
+		quota, ok := q.overrides[name]
+		if !ok {
+			quota = q.config.Default
+		}
+
+		c = &clientQuota{
+			produce:  newTokenBucket(quota.ProduceBytes, now),
+			fetch:    newTokenBucket(quota.FetchBytes, now),
+			requests: newTokenBucket(quota.Requests, now),
+		}
+		q.clients[name] = c
+	}
+	c.seen = now
+
+	return c
+}
+
+// Produce charges a request appending n bytes to the client and returns how
+// long the request must be delayed
+func (q *Quotas) Produce(client string, n int64) time.Duration {
+	if q == nil {
+		return 0
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	c := q.client(client, now)
+
+	return q.max(c.requests.take(1, now), c.produce.take(float64(n), now))
+}
+
+// Fetch charges a request to the client and returns how long the request
+// must be delayed. The bytes of a fetch are not known until it has been
+// read, they are charged with FetchBytes and delay the next request.
+func (q *Quotas) Fetch(client string) time.Duration {
+	if q == nil {
+		return 0
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	c := q.client(client, now)
+
+	return q.max(c.requests.take(1, now), c.fetch.take(0, now))
+}
+
+// FetchBytes charges n fetched bytes to the client
+func (q *Quotas) FetchBytes(client string, n int64) {
+	if q == nil {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	q.client(client, now).fetch.take(float64(n), now)
+}
+
+// max returns the longest of the delays, capped at the max throttle
+func (q *Quotas) max(delays ...time.Duration) time.Duration {
+	var d time.Duration
+	for _, delay := range delays {
+		if delay > d {
+			d = delay
+		}
+	}
+	if d > q.config.MaxThrottle {
+		d = q.config.MaxThrottle
+	}
+
+	return d
+}
+
+// tokenBucket holds up to one second of tokens and is refilled at the rate.
+// Taking more tokens than there are puts the bucket in debt, the debt is the
+// time to wait before the next take.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) tokenBucket {
+	return tokenBucket{rate, rate, now}
+}
+
+// take n tokens and return how long until the bucket is out of debt
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= n
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+
+	return wait
+}
+
+// sessionClient is who quotas are kept for, the principal, the client ID or
+// the host of the session
+func sessionClient(s *resp.Session) string {
+	if p := sessionPrincipal(s); p != "" {
+		return p
+	}
+	if h := sessionHello(s); h != nil && h.ClientID != "" {
+		return h.ClientID
+	}
+	if s.RemoteAddr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(s.RemoteAddr.String())
+	if err != nil {
+		return s.RemoteAddr.String()
+	}
+
+	return host
+}
+
+// throttle delays the request and, if the client negotiated the throttle
+// feature, tells it how long it was delayed before the reply
+func throttle(w resp.ResponseWriter, r *resp.Request, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	time.Sleep(d)
+
+	if h := sessionHello(r.Session); h != nil && h.HasFeature(FeatureThrottle) {
+		w.WriteStatus(fmt.Sprintf("%s %d", throttleHint, d/time.Millisecond))
+	}
+}
@@ -0,0 +1,105 @@
+package kuling
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(100, now)
+
+	// A full second of burst goes through
+	if wait := b.take(100, now); wait != 0 {
+		t.Fatalf("burst waited %s", wait)
+	}
+	// Going over puts the bucket in debt
+	if wait := b.take(50, now); wait != 500*time.Millisecond {
+		t.Fatalf("debt of 50 waited %s, want 500ms", wait)
+	}
+	// Refilled at the rate
+	if wait := b.take(0, now.Add(time.Second)); wait != 0 {
+		t.Fatalf("waited %s after paying the debt", wait)
+	}
+	// Never more than one second of tokens
+	if wait := b.take(150, now.Add(time.Hour)); wait != 500*time.Millisecond {
+		t.Errorf("waited %s after idling, want the burst capped at the rate", wait)
+	}
+
+	unlimited := newTokenBucket(0, now)
+	if wait := unlimited.take(1e9, now); wait != 0 {
+		t.Errorf("unlimited bucket waited %s", wait)
+	}
+}
+
+func TestQuotasOverridesAndMaxThrottle(t *testing.T) {
+	file := path.Join(t.TempDir(), "quotas")
+	if err := os.WriteFile(file, []byte("# batch jobs\nbatch produce=10 requests=1000\nfree\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQuotas(QuotaConfig{Default: Quota{ProduceBytes: 1000}, OverridesFile: file, MaxThrottle: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := q.Produce("other", 1000); d != 0 {
+		t.Errorf("default quota burst throttled %s", d)
+	}
+	if d := q.Produce("free", 1e9); d != 0 {
+		t.Errorf("unlimited override throttled %s", d)
+	}
+	if d := q.Produce("batch", 10); d != 0 {
+		t.Errorf("override burst throttled %s", d)
+	}
+	if d := q.Produce("batch", 1000); d != time.Second {
+		t.Errorf("throttled %s, want the max throttle", d)
+	}
+
+	var none *Quotas
+	if d := none.Produce("batch", 1e9); d != 0 {
+		t.Errorf("nil quotas throttled %s", d)
+	}
+
+	if err := os.WriteFile(file, []byte("batch produce=ten\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Reload(); err == nil {
+		t.Fatal("reloaded a malformed overrides file")
+	}
+}
+
+func TestQuotaThrottlesPut(t *testing.T) {
+	q, err := NewQuotas(QuotaConfig{Default: Quota{Requests: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	addr := startTestServer(t, ServerConfig{Quotas: q}, l, newTestBroker(t, l))
+
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The first second of requests is the burst, the next waits a tenth of
+	// a second and the client is told so
+	for i := 0; i < 10; i++ {
+		if _, err := c.Put("emails", firstShard, []byte("k"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	if _, err := c.Put("emails", firstShard, []byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("request over the quota took %s", took)
+	}
+	if c.Throttled() <= 0 {
+		t.Error("client not told it was throttled")
+	}
+}
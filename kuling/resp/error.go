@@ -0,0 +1,43 @@
+package resp
+
+import "strings"
+
+// Error codes used by the protocol itself. Servers add their own codes for
+// errors from handling commands.
+const (
+	// CodeErr is the generic error code for errors without a specific code
+	CodeErr = "ERR"
+	// CodeUnknownCmd is sent when no handler is registered for the command
+	CodeUnknownCmd = "UNKNOWN_CMD"
+	// CodeProtocol is sent when the client breaks the protocol, the server
+	// closes the connection after sending it
+	CodeProtocol = "PROTOCOL"
+)
+
+// Error is an error reply. On the wire it is the error code followed by the
+// message on one line, -UNKNOWN_TOPIC topic: unknown topic emails\r\n
+type Error struct {
+	Code    string
+	Message string
+}
+
+// parseError splits an error line into code and message. A line without
+// space is only a code.
+func parseError(line string) *Error {
+	code, msg, _ := strings.Cut(line, " ")
+	return &Error{code, msg}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + " " + e.Message
+}
+
+// Is reports if the target is an error with the same code so that replies
+// can be matched with errors.Is(err, &resp.Error{Code: resp.CodeProtocol})
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
@@ -0,0 +1,241 @@
+package resp
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CodeWrongArgs is sent when a command has the wrong number or types of
+// arguments
+const CodeWrongArgs = "WRONGARGS"
+
+// ArgType is the type a command argument is decoded into
+type ArgType int
+
+// Argument types
+const (
+	// ArgBytes is a bulk string, decoded into []byte
+	ArgBytes ArgType = iota
+	// ArgInt is an integer, decoded into int64. Bulk strings holding a base
+	// 10 integer are accepted as well.
+	ArgInt
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case ArgBytes:
+		return "string"
+	case ArgInt:
+		return "integer"
+	}
+	return fmt.Sprintf("ArgType(%d)", int(t))
+}
+
+// Command describes a command and its arguments. The mux validates and
+// decodes the arguments before the handler is called so that the handler can
+// read them with Request.Bytes, Request.String and Request.Int64.
+type Command struct {
+	// Name of the command, matched case insensitively
+	Name string
+	// Args are the types of the arguments every request must have
+	Args []ArgType
+	// Rest are the types of a group of arguments that may follow Args any
+	// number of times, at least MinRest and, unless zero, at most MaxRest
+	// times
+	Rest    []ArgType
+	MinRest int
+	MaxRest int
+	// Usage describes the arguments, for example "topic :shards"
+	Usage string
+	// Help is a one line description of the command
+	Help    string
+	Handler HandleFunc
+}
+
+// validate checks the number of arguments and decodes them into their types
+func (c *Command) validate(args []interface{}) error {
+	if len(args) < len(c.Args) {
+		return fmt.Errorf("expected %d arguments, got %d", len(c.Args)+c.MinRest*len(c.Rest), len(args))
+	}
+
+	rest := len(args) - len(c.Args)
+	switch {
+	case len(c.Rest) == 0 && rest > 0:
+		return fmt.Errorf("expected %d arguments, got %d", len(c.Args), len(args))
+	case len(c.Rest) > 0 && (rest%len(c.Rest) != 0 || rest/len(c.Rest) < c.MinRest):
+		return fmt.Errorf("expected %d arguments followed by at least %d groups of %d, got %d",
+			len(c.Args), c.MinRest, len(c.Rest), len(args))
+	case len(c.Rest) > 0 && c.MaxRest > 0 && rest/len(c.Rest) > c.MaxRest:
+		return fmt.Errorf("expected %d arguments followed by at most %d groups of %d, got %d",
+			len(c.Args), c.MaxRest, len(c.Rest), len(args))
+	}
+
+	for i := range args {
+		var t ArgType
+		if i < len(c.Args) {
+			t = c.Args[i]
+		} else {
+			t = c.Rest[(i-len(c.Args))%len(c.Rest)]
+		}
+
+		arg, err := decodeArg(args[i], t)
+		if err != nil {
+			return fmt.Errorf("argument %d: %s", i+1, err)
+		}
+		args[i] = arg
+	}
+
+	return nil
+}
+
+// decodeArg converts the argument as read from the wire into the type
+func decodeArg(arg interface{}, t ArgType) (interface{}, error) {
+	switch t {
+	case ArgBytes:
+		if p, ok := arg.([]byte); ok {
+			return p, nil
+		}
+	case ArgInt:
+		switch a := arg.(type) {
+		case int64:
+			return a, nil
+		case []byte:
+			if n, err := strconv.ParseInt(string(a), 10, 64); err == nil {
+				return n, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("expected %s", t)
+}
+
+// usage of the command as shown by HELP
+func (c *Command) usage() string {
+	s := c.Name
+	if c.Usage != "" {
+		s += " " + c.Usage
+	}
+	if c.Help != "" {
+		s += " - " + c.Help
+	}
+	return s
+}
+
+// Middleware wraps the handler of a command. Middlewares run after the
+// arguments are validated, in the order they were added.
+type Middleware func(c *Command, next HandleFunc) HandleFunc
+
+// ServeMux multiplexes request by the command name to a specific handler
+type ServeMux struct {
+	commands    map[string]*Command
+	middlewares []Middleware
+}
+
+// NewServeMux creates a new mux with the HELP command registered
+func NewServeMux() ServeMux {
+	m := ServeMux{commands: make(map[string]*Command)}
+	m.Register(Command{
+		Name:    "HELP",
+		Rest:    []ArgType{ArgBytes},
+		Usage:   "[command]",
+		Help:    "Describe all commands or one command",
+		Handler: m.helpHandler,
+	})
+
+	return m
+}
+
+// Serve takes the cmd and checks if any handler is registered for that command.
+// If no command is registered for the cmd then an err is sent back to the client.
+// The arguments are validated against the command before the handler is
+// called. A handler that panics is answered with an error instead of what
+// it had written, the connection is kept. When part of the reply was
+// already sent the connection is closed instead.
+func (m ServeMux) Serve(w ResponseWriter, r *Request) {
+	c, ok := m.commands[strings.ToUpper(r.Cmd)]
+	if !ok {
+		w.WriteErr(CodeUnknownCmd, r.Cmd)
+		return
+	}
+	r.Cmd = c.Name
+
+	// Commands registered without argument types get the arguments as read
+	if c.Args != nil || c.Rest != nil {
+		if err := c.validate(r.Args); err != nil {
+			w.WriteErr(CodeWrongArgs, fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
+		}
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			r.Session.Logger.Error("server: panic serving command", "cmd", r.Cmd, "panic", err, "stack", string(debug.Stack()))
+			if rw, ok := w.(*Writer); ok && !rw.discard() {
+				return
+			}
+			w.WriteErr(CodeErr, fmt.Sprintf("%s : internal error", r.Cmd))
+		}
+	}()
+
+	h := c.Handler
+	for i := len(m.middlewares) - 1; i >= 0; i-- {
+		h = m.middlewares[i](c, h)
+	}
+
+	h(w, r)
+}
+
+// Use adds the middleware to every command
+func (m *ServeMux) Use(mw Middleware) {
+	m.middlewares = append(m.middlewares, mw)
+}
+
+// Register the command. Registering a command with the name of an already
+// registered command replaces it.
+func (m *ServeMux) Register(c Command) {
+	c.Name = strings.ToUpper(c.Name)
+	m.commands[c.Name] = &c
+}
+
+// Handle registers a handler for the cmd
+func (m *ServeMux) Handle(cmd string, h Handler) {
+	m.HandleFunc(cmd, func(w ResponseWriter, r *Request) {
+		h.Serve(w, r)
+	})
+}
+
+// HandleFunc registers a handler function for the cmd. The arguments are
+// passed to the handler without validation.
+func (m *ServeMux) HandleFunc(cmd string, f HandleFunc) {
+	m.Register(Command{Name: cmd, Handler: f})
+}
+
+// helpHandler answers with the usage of all commands, sorted by name, or of
+// the given commands
+func (m ServeMux) helpHandler(w ResponseWriter, r *Request) {
+	var names []string
+	for i := range r.Args {
+		names = append(names, strings.ToUpper(r.String(i)))
+	}
+	if len(names) == 0 {
+		for name := range m.commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	usages := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		c, ok := m.commands[name]
+		if !ok {
+			w.WriteErr(CodeUnknownCmd, name)
+			return
+		}
+		usages = append(usages, c.usage())
+	}
+
+	w.WriteArray(usages...)
+}
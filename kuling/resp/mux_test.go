@@ -0,0 +1,124 @@
+package resp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// serve runs the command through the mux and returns the reply
+func serve(m ServeMux, cmd string, args ...interface{}) string {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	m.Serve(w, &Request{Cmd: cmd, Args: args, Session: NewSession(&net.TCPAddr{})})
+	w.Flush()
+	return b.String()
+}
+
+func TestCommandValidate(t *testing.T) {
+	c := Command{Name: "PUT_BATCH", Args: []ArgType{ArgBytes, ArgInt}, Rest: []ArgType{ArgBytes, ArgBytes}, MinRest: 1, MaxRest: 2}
+
+	for _, tc := range []struct {
+		args []interface{}
+		ok   bool
+	}{
+		{[]interface{}{[]byte("t"), int64(1), []byte("k"), []byte("v")}, true},
+		{[]interface{}{[]byte("t"), []byte("1"), []byte("k"), []byte("v"), []byte("k"), []byte("v")}, true},
+		// missing, odd and too many rest groups
+		{[]interface{}{[]byte("t"), int64(1)}, false},
+		{[]interface{}{[]byte("t"), int64(1), []byte("k")}, false},
+		{[]interface{}{[]byte("t"), int64(1), []byte("k"), []byte("v"), []byte("k"), []byte("v"), []byte("k"), []byte("v")}, false},
+		// wrong types
+		{[]interface{}{int64(1), int64(1), []byte("k"), []byte("v")}, false},
+		{[]interface{}{[]byte("t"), []byte("one"), []byte("k"), []byte("v")}, false},
+		{[]interface{}{[]byte("t"), int64(1), []byte("k"), int64(2)}, false},
+	} {
+		err := c.validate(tc.args)
+		if (err == nil) != tc.ok {
+			t.Errorf("validate %v gave %v", tc.args, err)
+		}
+	}
+
+	// Integers sent as bulk strings are decoded
+	args := []interface{}{[]byte("t"), []byte("42"), []byte("k"), []byte("v")}
+	if err := c.validate(args); err != nil || args[1] != int64(42) {
+		t.Errorf("decoded %v, %v", args[1], err)
+	}
+}
+
+func TestServeMuxRejectsWrongArgs(t *testing.T) {
+	m := NewServeMux()
+	m.Register(Command{Name: "GET", Args: []ArgType{ArgBytes, ArgInt}, Handler: func(w ResponseWriter, r *Request) {
+		w.WriteInt64(r.Int64(1))
+	}})
+
+	if got := serve(m, "get", []byte("t"), []byte("7")); got != ":7\r\n" {
+		t.Errorf("GET replied %q", got)
+	}
+	if got := serve(m, "GET", []byte("t")); !strings.HasPrefix(got, "-"+CodeWrongArgs+" GET") {
+		t.Errorf("GET with missing argument replied %q", got)
+	}
+	if got := serve(m, "GET", []byte("t"), []byte("x")); !strings.HasPrefix(got, "-"+CodeWrongArgs) {
+		t.Errorf("GET with a string for an integer replied %q", got)
+	}
+	if got := serve(m, "NOPE"); !strings.HasPrefix(got, "-"+CodeUnknownCmd) {
+		t.Errorf("unknown command replied %q", got)
+	}
+}
+
+func TestServeMuxRecoversHandlerPanic(t *testing.T) {
+	m := NewServeMux()
+	m.Register(Command{Name: "BOOM", Args: []ArgType{}, Handler: func(w ResponseWriter, r *Request) {
+		panic("boom")
+	}})
+
+	if got := serve(m, "BOOM"); !strings.HasPrefix(got, "-"+CodeErr+" BOOM : internal error") {
+		t.Errorf("panicking handler replied %q", got)
+	}
+
+	// What the handler wrote before panicking is dropped
+	m.Register(Command{Name: "HALF", Args: []ArgType{}, Handler: func(w ResponseWriter, r *Request) {
+		w.WriteInstruction('*', 2)
+		w.WriteInt64(1)
+		panic("half")
+	}})
+	if got, want := serve(m, "HALF"), "-"+CodeErr+" HALF : internal error\r\n"; got != want {
+		t.Errorf("handler panicking in a reply replied %q, want %q", got, want)
+	}
+}
+
+func TestServeMuxMiddlewareOrder(t *testing.T) {
+	m := NewServeMux()
+	var order []string
+	m.Register(Command{Name: "PING", Args: []ArgType{}, Handler: func(w ResponseWriter, r *Request) {
+		order = append(order, "handler")
+		w.WriteStatus("PONG")
+	}})
+	for _, name := range []string{"first", "second"} {
+		name := name
+		m.Use(func(c *Command, next HandleFunc) HandleFunc {
+			return func(w ResponseWriter, r *Request) {
+				order = append(order, name)
+				next(w, r)
+			}
+		})
+	}
+
+	serve(m, "PING")
+	if strings.Join(order, " ") != "first second handler" {
+		t.Errorf("ran in order %v", order)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	m := NewServeMux()
+	m.Register(Command{Name: "PING", Args: []ArgType{}, Help: "Ping the server"})
+
+	if got := serve(m, "HELP", []byte("ping")); !strings.Contains(got, "PING - Ping the server") {
+		t.Errorf("HELP PING replied %q", got)
+	}
+	if got := serve(m, "HELP"); !strings.Contains(got, "HELP [command]") || !strings.Contains(got, "PING") {
+		t.Errorf("HELP replied %q", got)
+	}
+}
@@ -2,28 +2,106 @@ package resp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
 )
 
+// Defaults for reader limits that are not set
+const (
+	// DefaultMaxBulkBytes is the largest bulk string read, as in Redis
+	DefaultMaxBulkBytes = 512 << 20
+	// DefaultMaxArrayLen is the most elements read in one array
+	DefaultMaxArrayLen = 1 << 20
+	// DefaultMaxDepth is how deep arrays are read inside arrays
+	DefaultMaxDepth = 16
+	// DefaultMaxRequestBytes is the most bulk string bytes read in one
+	// value, as the Redis query buffer limit
+	DefaultMaxRequestBytes = 1 << 30
+)
+
+// bulkChunk is how much of a bulk string is allocated before its bytes have
+// arrived. Longer strings grow as they are read so that a peer announcing a
+// large string has to send it before the memory is used.
+const bulkChunk = 64 << 10
+
+// maxRetainedBytes is the largest command buffer kept for the next command,
+// larger buffers are dropped so that idle connections do not hold on to them
+const maxRetainedBytes = 1 << 20
+
+// ErrOverLimit returned when a peer announces a value over the limits of the
+// reader. The stream cannot be read any further.
+var ErrOverLimit = errors.New("protocol: value over the limit")
+
 // Reader reads command responses from server
 type Reader struct {
 	r *bufio.Reader
+
+	// MaxBulkBytes is the largest bulk string read, DefaultMaxBulkBytes when
+	// zero
+	MaxBulkBytes int
+	// MaxArrayLen is the most elements read in one array,
+	// DefaultMaxArrayLen when zero
+	MaxArrayLen int
+	// MaxDepth is how deep arrays are read inside arrays, DefaultMaxDepth
+	// when zero
+	MaxDepth int
+	// MaxRequestBytes is the most bulk string bytes read in one value,
+	// across all of its elements, DefaultMaxRequestBytes when zero
+	MaxRequestBytes int
+
+	// buf and args are reused by ReadCommand
+	buf  []byte
+	args []interface{}
+	// left is what remains of MaxRequestBytes for the value being read
+	left int
 }
 
 // NewReader creates a new client command response reader
 // that will interpret the response from the server and create a corresponding
 // struct for the type of response
 func NewReader(r io.Reader) *Reader {
-	return &Reader{bufio.NewReader(r)}
+	return &Reader{r: bufio.NewReader(r)}
 }
 
+// Read the next value. Bulk strings and arrays are allocated for the caller
+// to keep.
 func (ccr *Reader) Read() (interface{}, error) {
-	line, _, err := ccr.r.ReadLine()
+	return ccr.read(0, false)
+}
+
+// ReadCommand reads the next value like Read, but the bulk strings and the
+// array of a command are read into buffers that are reused by the next call.
+// The command is only valid until then.
+func (ccr *Reader) ReadCommand() (interface{}, error) {
+	if cap(ccr.buf) > maxRetainedBytes {
+		ccr.buf = nil
+	}
+	ccr.buf = ccr.buf[:0]
+
+	return ccr.read(0, true)
+}
 
+// peek waits until there is something to read, without reading it
+func (ccr *Reader) peek() error {
+	_, err := ccr.r.Peek(1)
+	return err
+}
+
+// read a value at the depth, into the reused buffers when reuse is set
+func (ccr *Reader) read(depth int, reuse bool) (interface{}, error) {
+	if depth == 0 {
+		ccr.left = limit(ccr.MaxRequestBytes, DefaultMaxRequestBytes)
+	}
+
+	line, isPrefix, err := ccr.r.ReadLine()
 	if err != nil {
 		return nil, err
 	}
+	if isPrefix {
+		return nil, fmt.Errorf("%w: line longer than %d bytes", ErrOverLimit, ccr.r.Size())
+	}
 
 	if len(line) == 0 {
 		return nil, fmt.Errorf("protocol: empty response line received from server")
@@ -40,20 +118,31 @@ func (ccr *Reader) Read() (interface{}, error) {
 			return string(line[1:]), nil
 		}
 	case '-':
-		return nil, fmt.Errorf("%s", string(line[1:]))
+		return nil, parseError(string(line[1:]))
 	case ':':
 		return parseInt(line[1:])
 	case '$':
 		// Length information line
-		n, err := parseLen(line[1:])
+		n, err := parseLen(line[1:], limit(ccr.MaxBulkBytes, DefaultMaxBulkBytes))
 		if n < 0 || err != nil {
 			return nil, err
 		}
-		p := make([]byte, n)
-		_, err = io.ReadFull(ccr.r, p)
-		if err != nil {
+		if n > ccr.left {
+			return nil, fmt.Errorf("%w: request over %d bytes", ErrOverLimit, limit(ccr.MaxRequestBytes, DefaultMaxRequestBytes))
+		}
+		ccr.left -= n
+
+		var p []byte
+		if reuse && depth == 1 {
+			start := len(ccr.buf)
+			if ccr.buf, err = ccr.readBulk(ccr.buf, n); err != nil {
+				return nil, err
+			}
+			p = ccr.buf[start:len(ccr.buf):len(ccr.buf)]
+		} else if p, err = ccr.readBulk(nil, n); err != nil {
 			return nil, err
 		}
+
 		if line, _, err := ccr.r.ReadLine(); err != nil {
 			return nil, err
 		} else if len(line) != 0 {
@@ -62,25 +151,87 @@ func (ccr *Reader) Read() (interface{}, error) {
 		return p, nil
 	case '*':
 		// Number of arguments line
-		n, err := parseLen(line[1:])
+		n, err := parseLen(line[1:], limit(ccr.MaxArrayLen, DefaultMaxArrayLen))
 		if n < 0 || err != nil {
 			return nil, err
 		}
-		r := make([]interface{}, n)
-		for i := range r {
-			r[i], err = ccr.Read()
+		if depth >= limit(ccr.MaxDepth, DefaultMaxDepth) {
+			return nil, fmt.Errorf("%w: arrays nested deeper than %d", ErrOverLimit, depth)
+		}
+
+		// Elements take at least three bytes each, the array grows as they
+		// arrive rather than by the announced length
+		var r []interface{}
+		if reuse && depth == 0 {
+			r = ccr.args[:0]
+		} else {
+			r = make([]interface{}, 0, min(n, bulkChunk/16))
+		}
+
+		var replyErr error
+		for i := 0; i < n; i++ {
+			v, err := ccr.read(depth+1, reuse)
+			if _, ok := err.(*Error); ok {
+				// An error reply inside the array, read the rest of the array
+				// so the next reply starts at the right place
+				if replyErr == nil {
+					replyErr = err
+				}
+				r = append(r, nil)
+				continue
+			}
 			if err != nil {
 				return nil, err
 			}
+			r = append(r, v)
+		}
+
+		if reuse && depth == 0 {
+			ccr.args = r
+		}
+		if replyErr != nil {
+			return nil, replyErr
 		}
 		return r, nil
 	}
 
-	return nil, nil
+	return nil, fmt.Errorf("protocol: unknown type %q", line[0])
+}
+
+// readBulk appends the next n bytes to p. The bytes are allocated in chunks
+// as they are read.
+func (ccr *Reader) readBulk(p []byte, n int) ([]byte, error) {
+	end := len(p) + n
+	for len(p) < end {
+		if len(p) == cap(p) {
+			// Double up to what is left of the string, at least a chunk
+			p = slices.Grow(p, min(end-len(p), max(cap(p), bulkChunk)))
+		}
+
+		m := min(end, cap(p))
+		if _, err := io.ReadFull(ccr.r, p[len(p):m]); err != nil {
+			return nil, err
+		}
+		p = p[:m]
+	}
+
+	if p == nil {
+		p = []byte{}
+	}
+
+	return p, nil
+}
+
+// limit is the limit when set, otherwise the default
+func limit(limit, def int) int {
+	if limit <= 0 {
+		return def
+	}
+	return limit
 }
 
-// parseLen parses bulk string and array lengths.
-func parseLen(p []byte) (int, error) {
+// parseLen parses bulk string and array lengths up to the max, -1 is null
+func parseLen(p []byte, maxLen int) (int, error) {
 	if len(p) == 0 {
 		return -1, fmt.Errorf("protocol: malformed length")
 	}
@@ -91,11 +242,13 @@ func parseLen(p []byte) (int, error) {
 
 	var n int
 	for _, b := range p {
-		n *= 10
 		if b < '0' || b > '9' {
 			return -1, fmt.Errorf("protocol: illegal bytes in length")
 		}
-		n += int(b - '0')
+		n = n*10 + int(b-'0')
+		if n > maxLen {
+			return -1, fmt.Errorf("%w: length %s over %d", ErrOverLimit, p, maxLen)
+		}
 	}
 
 	return n, nil
@@ -115,6 +268,10 @@ func parseInt(p []byte) (interface{}, error) {
 		}
 	}
 
+	if len(p) > 19 {
+		return 0, fmt.Errorf("protocol: integer out of range")
+	}
+
 	var n int64
 	for _, b := range p {
 		n *= 10
@@ -123,6 +280,9 @@ func parseInt(p []byte) (interface{}, error) {
 		}
 		n += int64(b - '0')
 	}
+	if n < 0 {
+		return 0, fmt.Errorf("protocol: integer out of range")
+	}
 
 	if negate {
 		n = -n
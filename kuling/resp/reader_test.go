@@ -0,0 +1,81 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReaderLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		r     Reader
+		over  bool
+	}{
+		{"within limits", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", Reader{MaxBulkBytes: 3, MaxArrayLen: 2, MaxDepth: 1, MaxRequestBytes: 4}, false},
+		{"bulk", "*1\r\n$4\r\nPING\r\n", Reader{MaxBulkBytes: 3}, true},
+		{"array", "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", Reader{MaxArrayLen: 2}, true},
+		{"depth", "*1\r\n*1\r\n$1\r\na\r\n", Reader{MaxDepth: 1}, true},
+		{"request bytes", "*2\r\n$3\r\nGET\r\n$2\r\nab\r\n", Reader{MaxRequestBytes: 4}, true},
+		{"length overflow", "$99999999999999999999999\r\n", Reader{}, true},
+		{"long line", "+" + strings.Repeat("a", 8192) + "\r\n", Reader{}, true},
+	} {
+		r := tc.r
+		r.r = NewReader(strings.NewReader(tc.input)).r
+		_, err := r.ReadCommand()
+		if over := errors.Is(err, ErrOverLimit); over != tc.over {
+			t.Errorf("%s: read gave %v", tc.name, err)
+		}
+	}
+}
+
+func TestReaderRequestBytesPerCommand(t *testing.T) {
+	// The budget is per command, not per connection
+	r := NewReader(strings.NewReader("*1\r\n$3\r\nabc\r\n*1\r\n$3\r\ndef\r\n"))
+	r.MaxRequestBytes = 3
+	for _, want := range []string{"abc", "def"} {
+		v, err := r.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args := v.([]interface{}); string(args[0].([]byte)) != want {
+			t.Fatalf("read %q, want %s", args[0], want)
+		}
+	}
+}
+
+func FuzzReadCommand(f *testing.F) {
+	for _, seed := range []string{
+		"*2\r\n$4\r\nPING\r\n$1\r\na\r\n",
+		"*1\r\n*1\r\n$-1\r\n",
+		"+OK\r\n",
+		"-ERR bad\r\n",
+		":-12\r\n",
+		"$5\r\nhello\r\n",
+		"*-1\r\n",
+		"*3\r\n$1\r\na\r\n-ERR x\r\n:1\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		r := NewReader(bytes.NewReader(input))
+		r.MaxBulkBytes = 1 << 10
+		r.MaxArrayLen = 1 << 10
+		r.MaxDepth = 4
+		r.MaxRequestBytes = 1 << 12
+
+		// Read until the input runs out or is rejected, never panic
+		for i := 0; i < len(input)+1; i++ {
+			v, err := r.ReadCommand()
+			if err != nil {
+				return
+			}
+			if args, ok := v.([]interface{}); ok && len(args) > r.MaxArrayLen {
+				t.Fatalf("read %d elements over the limit", len(args))
+			}
+		}
+	})
+}
@@ -1,18 +1,72 @@
 package resp
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"os"
+	"strings"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/conntrack"
 )
 
-// Request coming from the client to a server
+// ErrServerClosed returned by ListenAndServe after Shutdown
+var ErrServerClosed = errors.New("resp: server closed")
+
+// A deadline in the past that makes a blocked read return immediately
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Request coming from the client to a server. The arguments are read into
+// buffers of the connection that are reused for the next command, handlers
+// copy what they keep after returning.
 type Request struct {
 	Writer io.Writer
 	Cmd    string
 	Args   []interface{}
+	// Session of the connection the request came in on
+	Session *Session
+
+	ctx context.Context
+	// watch starts watching the connection for the client going away, set
+	// until Context is first called
+	watch func()
+}
+
+// Context of the request, done when the client closes the connection or the
+// server shuts down. Asking for the context starts reading ahead on the
+// connection to notice the client going away, so only handlers that wait
+// for long, like blocking reads, should use it.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	if r.watch != nil {
+		r.watch()
+		r.watch = nil
+	}
+	return r.ctx
+}
+
+// Bytes returns the argument at index i. Only for arguments validated as
+// ArgBytes by the command.
+func (r *Request) Bytes(i int) []byte {
+	return r.Args[i].([]byte)
+}
+
+// String returns the argument at index i as a string. Only for arguments
+// validated as ArgBytes by the command.
+func (r *Request) String(i int) string {
+	return string(r.Args[i].([]byte))
+}
+
+// Int64 returns the argument at index i. Only for arguments validated as
+// ArgInt by the command.
+func (r *Request) Int64(i int) int64 {
+	return r.Args[i].(int64)
 }
 
 // ResponseWriter writes client command responses to io writer
@@ -29,6 +83,11 @@ type ResponseWriter interface {
 
 	WriteStatus(string) error
 	WriteErr(errType, msg string) error
+
+	// Flush sends what has been written. The server flushes after every
+	// command, handlers only flush before writing to Request.Writer or
+	// between the replies they stream.
+	Flush() error
 }
 
 // Handler for request.
@@ -39,100 +98,291 @@ type Handler interface {
 // HandleFunc definition for functions that can handle cmd requests
 type HandleFunc func(ResponseWriter, *Request)
 
-// ServeMux multiplexes request by the command name to a specific handler
-type ServeMux struct {
-	handlers map[string]HandleFunc
-}
+// ConnState is the state of a client connection
+type ConnState int
 
-// NewServeMux creates a new must handler
-func NewServeMux() ServeMux {
-	return ServeMux{make(map[string]HandleFunc)}
-}
-
-// Serve takes the cmd and checks if any handler is registered for that command.
-// If no command is registered for the cmd then an err is sent back to the client.
-func (m ServeMux) Serve(w ResponseWriter, r *Request) {
-	if h, ok := m.handlers[r.Cmd]; ok {
-		h(w, r)
-		return
-	}
-
-	w.WriteErr("UNKNOWN_CMD", r.Cmd)
-}
-
-// Handle registers a handler for the cmd
-func (m *ServeMux) Handle(cmd string, h Handler) {
-	m.handlers[cmd] = func(w ResponseWriter, r *Request) {
-		h.Serve(w, r)
-	}
-}
-
-// HandleFunc registers a handler function for the cmd
-func (m *ServeMux) HandleFunc(cmd string, f HandleFunc) {
-	m.handlers[cmd] = f
-}
+const (
+	// StateNew is a connection that has just been accepted
+	StateNew ConnState = iota
+	// StateClosed is a connection that has been closed
+	StateClosed
+)
 
 // Server struct
 type Server struct {
 	Addr    string // Listen address
 	Handler Handler
+	// IdleTimeout closes connections that have not sent a command within the
+	// timeout. Zero means connections are never closed for being idle.
+	IdleTimeout time.Duration
+	// TLSConfig serves TLS connections only when set
+	TLSConfig *tls.Config
+	// ConnState is called when a connection changes state, if set
+	ConnState func(net.Conn, ConnState)
+	// Logger for the server and its sessions, slog.Default() when nil
+	Logger *slog.Logger
+	// MaxBulkBytes is the largest argument read, DefaultMaxBulkBytes when
+	// zero. Clients sending larger arguments are disconnected.
+	MaxBulkBytes int
+	// MaxArrayLen is the most arguments read in one command,
+	// DefaultMaxArrayLen when zero
+	MaxArrayLen int
+	// MaxDepth is how deep arrays are read inside a command,
+	// DefaultMaxDepth when zero
+	MaxDepth int
+	// MaxRequestBytes is the most argument bytes read in one command,
+	// DefaultMaxRequestBytes when zero
+	MaxRequestBytes int
+	// Trace logs every command and its reply with long strings cut, for
+	// debugging clients
+	Trace bool
+
+	// conns are the listener and the open connections, the contexts of
+	// requests derive from its context
+	conns conntrack.Tracker
 }
 
-// ListenAndServe starts the server in a blocking call.
-func (s *Server) ListenAndServe() {
+// ListenAndServe listens on the address and serves connections in a blocking
+// call. Returns ErrServerClosed after Shutdown, otherwise the error that
+// stopped the listener.
+func (s *Server) ListenAndServe() error {
 	// Start a tcp listener on the host and port that were defined
 	listen, err := net.Listen("tcp", s.Addr)
-
 	if err != nil {
-		log.Println("server: error listening:", err.Error())
-		panic(err)
+		return fmt.Errorf("resp: could not listen: %s", err)
+	}
+
+	return s.Serve(listen)
+}
+
+// Serve serves connections accepted on the listener in a blocking call and
+// closes the listener when it returns. Returns ErrServerClosed after
+// Shutdown, otherwise the error that stopped the listener.
+func (s *Server) Serve(listen net.Listener) error {
+	if s.TLSConfig != nil {
+		listen = tls.NewListener(listen, s.TLSConfig)
+	}
+
+	if !s.conns.SetListener(listen) {
+		listen.Close()
+		return ErrServerClosed
 	}
 
 	// Close the listener when the application closes.
 	defer listen.Close()
 
-	log.Println("server: listening on", s.Addr)
+	s.logger().Info("server: listening", "address", listen.Addr().String())
 
 	for {
-		// Listen for an incoming connection forever.
+		// Listen for an incoming connection until shut down
 		conn, err := listen.Accept()
 		if err != nil {
-			log.Println("server: error accepting:", err.Error())
+			if s.conns.ShuttingDown() {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				s.logger().Warn("server: error accepting", "err", err)
+				continue
+			}
+			return fmt.Errorf("resp: could not accept: %s", err)
+		}
+
+		if !s.conns.Add(conn) {
+			conn.Close()
 			continue
 		}
 
-		// Handle connections in a new goroutine and close the connection after
-		// the request has been handled
+		// Handle connections in a new goroutine and close the connection when
+		// the client is done with it
 		go func() {
+			s.setState(conn, StateNew)
+			defer s.setState(conn, StateClosed)
+			defer s.conns.Remove(conn)
 			defer conn.Close()
-			s.handleRequest(conn)
+			s.handleConn(conn)
 		}()
 	}
 }
 
-func (s *Server) handleRequest(conn net.Conn) {
+// Shutdown stops the server from accepting connections, closes idle
+// connections and waits for commands in progress to be served, after which
+// their connections are closed as well. When the context is done before
+// that the remaining connections are closed and the context error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.conns.Shutdown(ctx)
+}
+
+// RegisterOnShutdown registers a function to call on Shutdown, for
+// handlers that serve a connection until told to stop. The function is
+// called in its own goroutine and should not wait for the handlers.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.conns.RegisterOnShutdown(f)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+func (s *Server) setState(conn net.Conn, state ConnState) {
+	if s.ConnState != nil {
+		s.ConnState(conn, state)
+	}
+}
+
+// handleConn serves commands from the connection until the client closes it,
+// sends QUIT, is idle for too long or breaks the protocol. Commands are
+// served one at a time in the order they were read so clients can pipeline
+// commands and read the responses in the same order.
+func (s *Server) handleConn(conn net.Conn) {
 	r := NewReader(conn)
-	// TODO remove multiwriter
-	mw := io.MultiWriter(conn, os.Stdout)
-	w := &Writer{w: bufio.NewWriter(mw)}
+	r.MaxBulkBytes = s.MaxBulkBytes
+	r.MaxArrayLen = s.MaxArrayLen
+	r.MaxDepth = s.MaxDepth
+	r.MaxRequestBytes = s.MaxRequestBytes
+	session := NewSession(conn.RemoteAddr())
+	session.Logger = s.logger().With("client", conn.RemoteAddr().String())
+	logger := session.Logger
 
-	resp, err := r.Read()
-	if err != nil {
-		log.Printf("server: unable to read client command: %s", err)
-		err = w.WriteErr("PROTOCOL", "unable to read client command")
+	// Replies, including what handlers write to Request.Writer, go through
+	// the tracer when tracing
+	var out io.Writer = conn
+	var t *tracer
+	if s.Trace {
+		t = &tracer{w: conn}
+		out = t
+	}
+	w := NewWriter(out)
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Handshake up front so that the session knows the client's
+		// certificates before the first command
+		if s.IdleTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Warn("server: TLS handshake failed", "err", err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+
+		state := tlsConn.ConnectionState()
+		session.TLS = &state
+	}
+
+	for {
+		// Connections are closed between commands when shutting down
+		if !s.conns.SetActive(conn, false) {
+			return
+		}
+
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+
+		resp, err := r.ReadCommand()
+		if err == io.EOF {
+			// Client closed the connection between commands
+			return
+		}
+		// Connections closed as idle by Shutdown are done
+		if !s.conns.SetActive(conn, true) {
+			return
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			logger.Info("server: closing idle connection")
+			return
+		}
 		if err != nil {
-			log.Printf("server: unable to response with error to client: %s", err)
+			logger.Warn("server: unable to read client command", "err", err)
+			w.WriteErr(CodeProtocol, "unable to read client command")
+			if err := w.Flush(); err != nil {
+				logger.Warn("server: unable to respond with error to client", "err", err)
+			}
+			return
 		}
-		return
+
+		// The handler may take longer than the idle timeout, the timeout only
+		// applies while waiting for the next command
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Time{})
+		}
+
+		args, ok := resp.([]interface{})
+		if !ok || len(args) == 0 {
+			logger.Warn("server: client sent empty command")
+			w.WriteErr(CodeProtocol, "expected command array")
+			w.Flush()
+			return
+		}
+
+		cmd, ok := args[0].([]byte)
+		if !ok {
+			logger.Warn("server: client sent command name that is not a string")
+			w.WriteErr(CodeProtocol, "expected command name")
+			w.Flush()
+			return
+		}
+
+		if strings.EqualFold(string(cmd), "QUIT") {
+			w.WriteStatus(okReply)
+			w.Flush()
+			return
+		}
+
+		if t != nil {
+			logger.Info("server: command", "command", FormatCommand(string(cmd), args[1:]))
+		}
+
+		start := time.Now()
+		ctx, cancel := context.WithCancel(s.conns.Context())
+		watcher := &disconnectWatcher{conn: conn, r: r, cancel: cancel}
+		w.begin()
+		s.Handler.Serve(w, &Request{w.out, string(cmd), args[1:], session, ctx, watcher.start})
+		watcher.stop()
+		cancel()
+		if err := w.Flush(); err != nil {
+			logger.Warn("server: unable to write reply", "cmd", string(cmd), "err", err)
+			return
+		}
+		if t != nil {
+			logger.Info("server: reply", "cmd", string(cmd), "reply", t.reply())
+		}
+		logger.Debug("server: served command", "cmd", string(cmd), "duration", time.Since(start))
 	}
+}
+
+// disconnectWatcher cancels the context of a request when the client closes
+// the connection while the request is served. It reads ahead on the
+// connection, what it reads is left buffered for the next command.
+type disconnectWatcher struct {
+	conn   net.Conn
+	r      *Reader
+	cancel context.CancelFunc
+	done   chan struct{}
+}
 
-	args := resp.([]interface{})
-	if len(args) == 0 {
-		log.Printf("server: client sent empty command")
+func (d *disconnectWatcher) start() {
+	d.done = make(chan struct{})
+	go func() {
+		defer close(d.done)
+		// A pipelined command is not a disconnect, only errors are
+		if err := d.r.peek(); err != nil {
+			d.cancel()
+		}
+	}()
+}
+
+// stop waits for the read ahead to end, interrupting it if it is blocked
+func (d *disconnectWatcher) stop() {
+	if d.done == nil {
 		return
 	}
 
-	cmd := string(args[0].([]byte))
-
-	s.Handler.Serve(w, &Request{conn, cmd, args[1:]})
+	d.conn.SetReadDeadline(aLongTimeAgo)
+	<-d.done
+	d.conn.SetReadDeadline(time.Time{})
 }
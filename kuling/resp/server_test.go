@@ -0,0 +1,240 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer serves the mux on a free local port until the test ends
+func startServer(t *testing.T, m ServeMux) (*Server, string) {
+	t.Helper()
+
+	s := &Server{Handler: m}
+	return s, serveTest(t, s)
+}
+
+// serveTest serves the configured server on a free local port until the
+// test ends and returns its address
+func serveTest(t *testing.T, s *Server) string {
+	t.Helper()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listen)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	return listen.Addr().String()
+}
+
+// lockedBuffer is a buffer the server can log to while the test reads it
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// waitHandler waits for the context of the request and reports when it is
+// done
+func waitHandler(done chan<- struct{}) HandleFunc {
+	return func(w ResponseWriter, r *Request) {
+		<-r.Context().Done()
+		close(done)
+		w.WriteStatus("DONE")
+	}
+}
+
+func TestRequestContextDoneOnDisconnect(t *testing.T) {
+	done := make(chan struct{})
+	m := NewServeMux()
+	m.HandleFunc("WAIT", waitHandler(done))
+	_, addr := startServer(t, m)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(conn)
+	w.WriteArray("WAIT")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request context not done after the client closed the connection")
+	}
+}
+
+func TestRequestContextDoneOnShutdown(t *testing.T) {
+	done := make(chan struct{})
+	m := NewServeMux()
+	m.HandleFunc("WAIT", waitHandler(done))
+	s, addr := startServer(t, m)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	w := NewWriter(conn)
+	w.WriteArray("WAIT")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown with a waiting request gave %v", err)
+	}
+	if v, err := NewReader(bufio.NewReader(conn)).Read(); err != nil || v != "DONE" {
+		t.Fatalf("WAIT replied %v, %v", v, err)
+	}
+}
+
+func TestRequestContextKeepsPipelinedCommand(t *testing.T) {
+	m := NewServeMux()
+	m.HandleFunc("CTX", func(w ResponseWriter, r *Request) {
+		// Starts reading ahead on the connection
+		r.Context()
+		time.Sleep(50 * time.Millisecond)
+		w.WriteStatus("CTX")
+	})
+	m.HandleFunc("PING", func(w ResponseWriter, r *Request) { w.WriteStatus("PONG") })
+	_, addr := startServer(t, m)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	w := NewWriter(conn)
+	w.WriteArray("CTX")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	w.WriteArray("PING")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(bufio.NewReader(conn))
+	for _, want := range []string{"CTX", "PONG"} {
+		if v, err := r.Read(); err != nil || v != want {
+			t.Fatalf("replied %v, %v, want %s", v, err, want)
+		}
+	}
+}
+
+func TestServerLogsCommandsWithClient(t *testing.T) {
+	m := NewServeMux()
+	m.HandleFunc("PING", func(w ResponseWriter, r *Request) { w.WriteStatus("PONG") })
+	var logs lockedBuffer
+	addr := serveTest(t, &Server{Handler: m, Logger: slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	w := NewWriter(conn)
+	w.WriteArray("PING")
+	w.WriteArray("PING")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(bufio.NewReader(conn))
+	for i := 0; i < 2; i++ {
+		if v, err := r.Read(); err != nil || v != "PONG" {
+			t.Fatalf("replied %v, %v", v, err)
+		}
+	}
+
+	// Commands are logged after they are served, the first one has been
+	// logged once the second reply is read
+	var served struct {
+		Level  string `json:"level"`
+		Msg    string `json:"msg"`
+		Client string `json:"client"`
+		Cmd    string `json:"cmd"`
+	}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "served command") {
+			if err := json.Unmarshal([]byte(line), &served); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if served.Level != "DEBUG" || served.Cmd != "PING" || served.Client != conn.LocalAddr().String() {
+		t.Errorf("logged %+v in\n%s", served, logs.String())
+	}
+}
+
+func TestServerClosesConnOnPanicAfterSent(t *testing.T) {
+	m := NewServeMux()
+	m.HandleFunc("GET", func(w ResponseWriter, r *Request) {
+		w.WriteInstruction('$', 5)
+		w.Flush()
+		panic("get")
+	})
+	_, addr := startServer(t, m)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	w := NewWriter(conn)
+	w.WriteArray("GET")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The length line went out, no error may follow it as the body
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "$5\r\n" {
+		t.Errorf("replied %q before closing", got)
+	}
+}
@@ -0,0 +1,48 @@
+package resp
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// Session is the state of one client connection. It lives as long as the
+// connection and is handed to every request on it, handlers keep what the
+// client has negotiated in it.
+type Session struct {
+	RemoteAddr net.Addr
+	// TLS is the state of the TLS connection, nil for plain connections
+	TLS *tls.ConnectionState
+	// Logger logs with the client address, handlers add their own fields
+	Logger *slog.Logger
+
+	values map[string]interface{}
+	lock   sync.RWMutex
+}
+
+// NewSession creates an empty session for the connection from the address
+// logging to the default logger
+func NewSession(remoteAddr net.Addr) *Session {
+	return &Session{
+		RemoteAddr: remoteAddr,
+		Logger:     slog.Default().With("client", remoteAddr.String()),
+		values:     make(map[string]interface{}),
+	}
+}
+
+// Get the value stored under the key, nil if none
+func (s *Session) Get(key string) interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.values[key]
+}
+
+// Set the value under the key for the rest of the connection
+func (s *Session) Set(key string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.values[key] = value
+}
@@ -0,0 +1,145 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// traceBytes is how much of a bulk string is shown in traces, the rest is
+// cut and only counted
+const traceBytes = 64
+
+// traceReplyBytes is the largest reply decoded for a trace, larger replies
+// are only counted
+const traceReplyBytes = 1 << 20
+
+// hiddenArgs are the commands whose arguments are secrets and never shown
+var hiddenArgs = []string{"AUTH"}
+
+// FormatCommand formats a command for traces and MONITOR as quoted
+// arguments, "PUT" "emails" "0000000000_shard" "key" "payload". Long
+// arguments are cut and the arguments of AUTH are hidden.
+func FormatCommand(cmd string, args []interface{}) string {
+	var b strings.Builder
+	b.WriteString(strconv.Quote(cmd))
+
+	for _, hidden := range hiddenArgs {
+		if strings.EqualFold(cmd, hidden) {
+			if len(args) > 0 {
+				b.WriteString(" (hidden)")
+			}
+			return b.String()
+		}
+	}
+
+	for _, arg := range args {
+		b.WriteByte(' ')
+		switch arg := arg.(type) {
+		case []byte:
+			writeQuoted(&b, arg)
+		case string:
+			writeQuoted(&b, []byte(arg))
+		default:
+			writeQuoted(&b, fmt.Append(nil, arg))
+		}
+	}
+
+	return b.String()
+}
+
+// FormatValue formats a value as returned by Reader.Read for traces, status
+// replies as is, bulk strings quoted and cut when long, arrays in brackets
+// and error replies as (error) followed by the error
+func FormatValue(v interface{}) string {
+	var b strings.Builder
+	writeValue(&b, v)
+	return b.String()
+}
+
+func writeValue(b *strings.Builder, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("(nil)")
+	case string:
+		b.WriteString(v)
+	case []byte:
+		writeQuoted(b, v)
+	case []interface{}:
+		b.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			writeValue(b, e)
+		}
+		b.WriteByte(']')
+	case error:
+		b.WriteString("(error) ")
+		b.WriteString(v.Error())
+	default:
+		fmt.Fprint(b, v)
+	}
+}
+
+// writeQuoted writes the string quoted, cut at traceBytes
+func writeQuoted(b *strings.Builder, p []byte) {
+	if len(p) <= traceBytes {
+		b.WriteString(strconv.Quote(string(p)))
+		return
+	}
+
+	b.WriteString(strconv.Quote(string(p[:traceBytes])))
+	fmt.Fprintf(b, "... (%d bytes)", len(p))
+}
+
+// tracer passes writes to the connection and keeps a copy of the reply
+// being written so that it can be decoded for the trace
+type tracer struct {
+	w   io.Writer
+	buf bytes.Buffer
+	n   int
+}
+
+func (t *tracer) Write(p []byte) (int, error) {
+	t.n += len(p)
+	if room := traceReplyBytes - t.buf.Len(); room > 0 {
+		t.buf.Write(p[:min(len(p), room)])
+	}
+
+	return t.w.Write(p)
+}
+
+// reply formats what was written since the last call, replies too large to
+// decode are only counted
+func (t *tracer) reply() string {
+	defer func() {
+		t.buf.Reset()
+		t.n = 0
+	}()
+
+	if t.n > t.buf.Len() {
+		return fmt.Sprintf("(%d bytes)", t.n)
+	}
+
+	var values []string
+	r := NewReader(&t.buf)
+	for {
+		v, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if _, ok := err.(*Error); ok {
+			v = err
+		} else if err != nil {
+			values = append(values, fmt.Sprintf("(undecodable) %s", err))
+			break
+		}
+		values = append(values, FormatValue(v))
+	}
+
+	return strings.Join(values, " ")
+}
@@ -0,0 +1,83 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatCommand(t *testing.T) {
+	long := strings.Repeat("a", traceBytes+10)
+
+	for _, tc := range []struct {
+		cmd  string
+		args []interface{}
+		want string
+	}{
+		{"PUT", []interface{}{[]byte("emails"), int64(1), "k\n"}, `"PUT" "emails" "1" "k\n"`},
+		{"PUT", []interface{}{[]byte(long)}, `"PUT" "` + long[:traceBytes] + `"... (74 bytes)`},
+		{"auth", []interface{}{[]byte("user"), []byte("secret")}, `"auth" (hidden)`},
+		{"PING", nil, `"PING"`},
+	} {
+		if got := FormatCommand(tc.cmd, tc.args); got != tc.want {
+			t.Errorf("formatted %s, want %s", got, tc.want)
+		}
+	}
+}
+
+func TestTracerReply(t *testing.T) {
+	tr := &tracer{w: io.Discard}
+	w := NewWriter(tr)
+	w.WriteInstruction('*', 2)
+	w.WriteInt64(1)
+	w.WriteBytes([]byte("a"))
+	w.WriteErr(CodeProtocol, "bad")
+	w.Flush()
+	if got, want := tr.reply(), `[1 "a"] (error) `+CodeProtocol+` bad`; got != want {
+		t.Errorf("traced %s, want %s", got, want)
+	}
+
+	// Replies over the trace buffer are only counted
+	tr.Write(make([]byte, traceReplyBytes+1))
+	if got, want := tr.reply(), "(1048577 bytes)"; got != want {
+		t.Errorf("traced %s, want %s", got, want)
+	}
+}
+
+func TestServerTrace(t *testing.T) {
+	m := NewServeMux()
+	m.HandleFunc("PING", func(w ResponseWriter, r *Request) { w.WriteStatus("PONG") })
+	var logs lockedBuffer
+	addr := serveTest(t, &Server{Handler: m, Trace: true, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	w := NewWriter(conn)
+	w.WriteArray("PING", strings.Repeat("b", 100))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := NewReader(bufio.NewReader(conn)).Read(); err != nil || v != "PONG" {
+		t.Fatalf("replied %v, %v", v, err)
+	}
+
+	// The reply is logged after it is written
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "reply=PONG") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, want := range []string{`... (100 bytes)`, "reply=PONG"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("no %s in the trace\n%s", want, logs.String())
+		}
+	}
+}
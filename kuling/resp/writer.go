@@ -2,7 +2,7 @@ package resp
 
 import (
 	"bufio"
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
@@ -24,14 +24,24 @@ const (
 
 var crlfBytes = []byte("\r\n")
 
+// errReplyAborted is returned by Flush once a reply was given up after part
+// of it was sent, the connection can not be answered on any more
+var errReplyAborted = errors.New("resp: reply aborted after it was partly sent")
+
 const (
 	okReply   = "OK"
 	pongReply = "PONG"
 )
 
-// Writer writes client command KUSP format to a io writer
+// Writer writes client command KUSP format to a io writer. Values are
+// buffered until Flush so that a whole reply is written at once, a write
+// error is kept and returned by every write after it.
 type Writer struct {
 	w *bufio.Writer
+	// out notes when bytes reach the io writer
+	out *sentWriter
+	// err is set when the reply was aborted
+	err error
 	// Scratch space for formatting argument length.
 	// '*' or '$', length, "\r\n"
 	lenScratch [32]byte
@@ -42,7 +52,46 @@ type Writer struct {
 
 // NewWriter wraps the io Writer with buffered writer and
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{w: bufio.NewWriter(w)}
+	out := &sentWriter{w: w}
+	return &Writer{w: bufio.NewWriter(out), out: out}
+}
+
+// Flush writes the buffered values to the io writer
+func (c *Writer) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.w.Flush()
+}
+
+// begin starts a new reply, nothing of it has been sent
+func (c *Writer) begin() {
+	c.out.sent = false
+}
+
+// discard drops what is buffered of the reply. It returns false when part
+// of the reply was already sent, the reply is then aborted and every Flush
+// after it fails.
+func (c *Writer) discard() bool {
+	if c.out.sent {
+		c.err = errReplyAborted
+		return false
+	}
+	c.w.Reset(c.out)
+	return true
+}
+
+// sentWriter notes that bytes were written to the io writer
+type sentWriter struct {
+	w    io.Writer
+	sent bool
+}
+
+func (s *sentWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		s.sent = true
+	}
+	return s.w.Write(p)
 }
 
 // WriteInterface takes any value and writes the RESP encoding of that
@@ -65,9 +114,7 @@ func (c *Writer) WriteInterface(i interface{}) error {
 	case nil:
 		return c.WriteString("")
 	default:
-		var buf bytes.Buffer
-		fmt.Fprint(&buf, i)
-		return c.WriteBytes(buf.Bytes())
+		return c.WriteBytes(fmt.Append(c.numScratch[:0], i))
 	}
 }
 
@@ -83,31 +130,30 @@ func (c *Writer) WriteArray(args ...interface{}) error {
 	// Write the lenght * indicator followed by the number of elements
 	c.WriteInstruction('*', len(args))
 	for _, arg := range args {
-		if err := c.w.Flush(); err != nil {
+		if err := c.WriteInterface(arg); err != nil {
 			return err
 		}
-
-		c.WriteInterface(arg)
 	}
 
-	return c.w.Flush()
+	return nil
 }
 
 // WriteInstruction writes only the first instructing line. Instructions
 // include but are not limited to *, $.
 // *5\r\n
 func (c *Writer) WriteInstruction(prefix byte, n int) error {
-	c.w.WriteByte(prefix)
-	c.w.Write([]byte(strconv.Itoa(n)))
-	c.w.Write(crlfBytes)
-	return c.w.Flush()
+	b := append(c.lenScratch[:0], prefix)
+	b = strconv.AppendInt(b, int64(n), 10)
+	b = append(b, crlfBytes...)
+	_, err := c.w.Write(b)
+	return err
 }
 
 // WriteEnd writes the ending part of a result or instruction
 // \r\n
 func (c *Writer) WriteEnd() error {
-	c.w.Write(crlfBytes)
-	return c.w.Flush()
+	_, err := c.w.Write(crlfBytes)
+	return err
 }
 
 // WriteString writes a string value on a single line
@@ -116,8 +162,8 @@ func (c *Writer) WriteEnd() error {
 func (c *Writer) WriteString(s string) error {
 	c.WriteInstruction('$', len(s))
 	c.w.WriteString(s)
-	c.w.Write(crlfBytes)
-	return c.w.Flush()
+	_, err := c.w.Write(crlfBytes)
+	return err
 }
 
 // WriteBytes writes a byte array value using a length instruction and the
@@ -127,8 +173,8 @@ func (c *Writer) WriteString(s string) error {
 func (c *Writer) WriteBytes(p []byte) error {
 	c.WriteInstruction('$', len(p))
 	c.w.Write(p)
-	c.w.Write(crlfBytes)
-	return c.w.Flush()
+	_, err := c.w.Write(crlfBytes)
+	return err
 }
 
 // WriteInt64 writes a integer in textual format with the length of the
@@ -136,10 +182,11 @@ func (c *Writer) WriteBytes(p []byte) error {
 // $3\r\n
 // 123\r\n
 func (c *Writer) WriteInt64(n int64) error {
-	c.w.WriteByte(':')
-	c.w.Write(strconv.AppendInt(c.numScratch[:0], n, 10))
-	c.w.Write(crlfBytes)
-	return c.w.Flush()
+	b := append(c.numScratch[:0], ':')
+	b = strconv.AppendInt(b, n, 10)
+	b = append(b, crlfBytes...)
+	_, err := c.w.Write(b)
+	return err
 }
 
 // WriteStatus write a string that is prefixed with the OK byte + to indicate
@@ -149,8 +196,8 @@ func (c *Writer) WriteInt64(n int64) error {
 func (c *Writer) WriteStatus(s string) error {
 	c.w.WriteByte('+')
 	c.w.WriteString(s)
-	c.w.Write(crlfBytes)
-	return c.w.Flush()
+	_, err := c.w.Write(crlfBytes)
+	return err
 }
 
 // WriteErr writes an err type and message prefixed with the error instruction -
@@ -158,7 +205,9 @@ func (c *Writer) WriteStatus(s string) error {
 // -ERR not working\r\n
 func (c *Writer) WriteErr(errType, msg string) error {
 	c.w.WriteByte('-')
-	c.w.WriteString(fmt.Sprintf("%s %s", errType, msg))
-	c.w.Write(crlfBytes)
-	return c.w.Flush()
+	c.w.WriteString(errType)
+	c.w.WriteByte(' ')
+	c.w.WriteString(msg)
+	_, err := c.w.Write(crlfBytes)
+	return err
 }
@@ -0,0 +1,136 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// countingConn counts the writes that reach the connection
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+// benchConn returns a loopback TCP connection whose peer discards what it
+// reads, so that every write is a syscall as it is for the server
+func benchConn(b *testing.B) *countingConn {
+	b.Helper()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listen.Close()
+
+	go func() {
+		peer, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, peer)
+		peer.Close()
+	}()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+
+	return &countingConn{Conn: conn}
+}
+
+// flushEach flushes after every value, as the writer did before it
+// buffered whole replies
+type flushEach struct {
+	*Writer
+}
+
+func (w flushEach) WriteInstruction(prefix byte, n int) error {
+	w.Writer.WriteInstruction(prefix, n)
+	return w.Flush()
+}
+
+func (w flushEach) WriteInt64(n int64) error {
+	w.Writer.WriteInt64(n)
+	return w.Flush()
+}
+
+func (w flushEach) WriteEnd() error {
+	w.Writer.WriteEnd()
+	return w.Flush()
+}
+
+// putBatchReply writes the reply of a PUT_BATCH of n messages, as the
+// handler does
+func putBatchReply(w ResponseWriter, n int) {
+	w.WriteInstruction('*', n)
+	for i := 0; i < n; i++ {
+		w.WriteInt64(int64(i + 1))
+	}
+}
+
+// getReply writes the reply of a GET, the length line is flushed before
+// the messages are copied to the connection past the writer
+func getReply(w ResponseWriter, conn io.Writer, body []byte) {
+	w.WriteInstruction('$', len(body))
+	w.Flush()
+	conn.Write(body)
+	w.WriteEnd()
+}
+
+func BenchmarkPutBatchReply(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		w    func(*Writer) ResponseWriter
+	}{
+		{"flush-each", func(w *Writer) ResponseWriter { return flushEach{w} }},
+		{"buffered", func(w *Writer) ResponseWriter { return w }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			conn := benchConn(b)
+			w := bc.w(NewWriter(conn))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				putBatchReply(w, 100)
+				w.Flush()
+			}
+			b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func BenchmarkGetReply(b *testing.B) {
+	body := bytes.Repeat([]byte("m"), 4096)
+
+	for _, bc := range []struct {
+		name string
+		w    func(*Writer) ResponseWriter
+	}{
+		{"flush-each", func(w *Writer) ResponseWriter { return flushEach{w} }},
+		{"buffered", func(w *Writer) ResponseWriter { return w }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			conn := benchConn(b)
+			w := bc.w(NewWriter(conn))
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+
+			// Pipelined GETs, the buffered writer sends the end of a reply
+			// with the length line of the next one
+			for i := 0; i < b.N; i++ {
+				getReply(w, conn, body)
+			}
+			w.Flush()
+			b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -4,8 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -35,15 +36,30 @@ type Segment struct {
 	// segment file handle used for writing
 	whandle *os.File
 	// size of segment in bytes
-	size int64
+	size   int64
+	logger *slog.Logger
+	// fsyncOnAppend fsyncs every append, otherwise appends are fsynced by
+	// Sync
+	fsyncOnAppend bool
+
+	// readers holding the segment and whether it expired, an expired
+	// segment is removed by the last reader
+	refLock sync.Mutex
+	refs    int
+	expired bool
 }
 
-// OpenSegment opens or creates a new file system segment
-func OpenSegment(fileName string, perm os.FileMode) (*Segment, error) {
+// OpenSegment opens or creates a new file system segment that logs to the
+// logger, slog.Default() when nil
+func OpenSegment(fileName string, perm os.FileMode, logger *slog.Logger) (*Segment, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	// Check if the file exists, if not log that it will be created
 	_, err := os.Stat(fileName)
 	if err != nil {
-		log.Printf("segment: creating segment file %s", fileName)
+		logger.Info("segment: creating segment file", "file", fileName)
 	}
 	// Open or create the segment file.
 	segmentFile, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
@@ -68,6 +84,11 @@ func OpenSegment(fileName string, perm os.FileMode) (*Segment, error) {
 			fileName,
 			segmentFile,
 			fd.Size(),
+			logger,
+			true,
+			sync.Mutex{},
+			0,
+			false,
 		},
 		nil
 }
@@ -78,17 +99,63 @@ func (ss *Segment) Append(m *Message) error {
 
 	bytesWritten, err := mw.WriteMessage(m)
 	if err != nil {
-		log.Fatalf("segment: could not write message to segment %v", ss.whandle.Name())
-		return SegmentError{err, ss}
+		ss.logger.Error("segment: could not write message", "file", ss.FilePath, "err", err)
+		return SegmentError{fmt.Errorf("segment: could not write message to %s: %w", ss.FilePath, err), ss}
 	}
 
-	if err = fsync(ss.whandle); err != nil {
-		log.Printf("segment: could not fsync segment file %s: %s", ss.whandle.Name(), err)
+	// Increment the segments size with the number of bytes written
+	ss.size += bytesWritten
+
+	if !ss.fsyncOnAppend {
+		return nil
+	}
+	if err := ss.Sync(); err != nil {
+		ss.logger.Error("segment: could not fsync segment file", "file", ss.FilePath, "err", err)
 		return err
 	}
 
-	// Increment the segments size with the number of bytes written
-	ss.size += bytesWritten
+	return nil
+}
+
+// AppendBatch appends the messages to the segment in order and fsyncs the
+// segment once after all messages have been written, unless the fsyncs are
+// left to Sync.
+func (ss *Segment) AppendBatch(msgs []*Message) error {
+	mw := NewMessageWriter(ss.whandle)
+
+	var written int64
+	for _, m := range msgs {
+		bytesWritten, err := mw.WriteMessage(m)
+		written += bytesWritten
+		if err != nil {
+			ss.size += written
+			return SegmentError{err, ss}
+		}
+	}
+
+	// Messages that have been written are part of the segment even if the
+	// fsync fails
+	ss.size += written
+
+	if !ss.fsyncOnAppend {
+		return nil
+	}
+	if err := ss.Sync(); err != nil {
+		ss.logger.Error("segment: could not fsync segment file", "file", ss.FilePath, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// Sync fsyncs the messages appended to the segment
+func (ss *Segment) Sync() error {
+	start := time.Now()
+	err := fsync(ss.whandle)
+	metricFsyncDuration.ObserveSince(start)
+	if err != nil {
+		return fmt.Errorf("segment: could not fsync segment file %s: %s", ss.FilePath, err)
+	}
 
 	return nil
 }
@@ -102,8 +169,8 @@ func (ss *Segment) Read(offset, endOffset int64) ([]*Message, error) {
 		mr := NewMessageReader(readHandle)
 		messages, err = mr.ReadMessages()
 		if err != nil {
-			log.Fatalf("segment: could not read message from segment %v", ss.whandle.Name())
-			return SegmentError{err, ss}
+			ss.logger.Error("segment: could not read messages", "file", ss.FilePath, "offset", offset, "err", err)
+			return SegmentError{fmt.Errorf("segment: could not read messages from %s at offset %d: %w", ss.FilePath, offset, err), ss}
 		}
 
 		return nil
@@ -135,16 +202,16 @@ func (ss *Segment) readAction(offset, endOffset int64, action func(readHandle *o
 
 	readHandle, err := os.OpenFile(ss.FilePath, os.O_RDONLY, 0500)
 	if err != nil {
-		log.Fatalf("segment: could not get read file handle %v", ss.whandle.Name())
-		return SegmentError{err, ss}
+		ss.logger.Error("segment: could not open segment file for reading", "file", ss.FilePath, "err", err)
+		return SegmentError{fmt.Errorf("segment: could not open %s for reading: %w", ss.FilePath, err), ss}
 	}
 	defer readHandle.Close()
 
 	// Seek to the offset position
 	_, err = readHandle.Seek(offset, os.SEEK_SET)
 	if err != nil {
-		log.Fatalf("segment: could not seek to offset in segment %v", ss.whandle.Name())
-		return SegmentError{err, ss}
+		ss.logger.Error("segment: could not seek in segment file", "file", ss.FilePath, "offset", offset, "err", err)
+		return SegmentError{fmt.Errorf("segment: could not seek to offset %d in %s: %w", offset, ss.FilePath, err), ss}
 	}
 
 	return action(readHandle)
@@ -155,9 +222,68 @@ func (ss *Segment) Size() int64 {
 	return ss.size
 }
 
-// Close segment
+// Close segment after an fsync so that nothing written is lost
 func (ss *Segment) Close() error {
-	return ss.whandle.Close()
+	syncErr := fsync(ss.whandle)
+	funlock(ss.whandle)
+	if err := ss.whandle.Close(); err != nil {
+		return fmt.Errorf("segment: could not close segment file %s: %s", ss.FilePath, err)
+	}
+	if syncErr != nil {
+		return fmt.Errorf("segment: could not fsync segment file %s: %s", ss.FilePath, syncErr)
+	}
+
+	return nil
+}
+
+// acquire holds the segment for a read so that it is not removed while
+// read
+func (ss *Segment) acquire() {
+	ss.refLock.Lock()
+	defer ss.refLock.Unlock()
+
+	ss.refs++
+}
+
+// release the segment after a read, the last reader of an expired segment
+// removes it
+func (ss *Segment) release() {
+	ss.refLock.Lock()
+	ss.refs--
+	last := ss.expired && ss.refs == 0
+	ss.refLock.Unlock()
+
+	if !last {
+		return
+	}
+	if err := ss.remove(); err != nil {
+		ss.logger.Warn("segment: could not remove expired segment", "file", ss.FilePath, "err", err)
+	}
+}
+
+// expire closes and removes the segment, once the last reader releases it
+// when it is being read
+func (ss *Segment) expire() error {
+	ss.refLock.Lock()
+	ss.expired = true
+	readers := ss.refs
+	ss.refLock.Unlock()
+
+	if readers > 0 {
+		return nil
+	}
+	return ss.remove()
+}
+
+func (ss *Segment) remove() error {
+	if err := ss.Close(); err != nil {
+		ss.logger.Warn("segment: could not close expired segment", "file", ss.FilePath, "err", err)
+	}
+	if err := os.Remove(ss.FilePath); err != nil {
+		return fmt.Errorf("segment: could not remove expired segment %s: %s", ss.FilePath, err)
+	}
+
+	return nil
 }
 
 // String from stringer interface
@@ -0,0 +1,50 @@
+package kuling
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSegmentReadCorruptReturnsError(t *testing.T) {
+	var logs bytes.Buffer
+	file := path.Join(t.TempDir(), createSegmentName(1))
+	s, err := OpenSegment(file, 0644, slog.New(slog.NewTextHandler(&logs, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Append(NewMessage(1, []byte("key"), []byte("a"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the magic byte with an unknown version
+	f, err := os.OpenFile(file, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{CurrentMagic + 1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// The read fails instead of taking the process down, and the error is
+	// logged with the file
+	_, err = s.Read(0, s.Size())
+	var segErr SegmentError
+	if !errors.As(err, &segErr) || segErr.Segment != s {
+		t.Fatalf("read of a corrupt segment gave %v", err)
+	}
+	if !strings.Contains(logs.String(), "segment: could not read messages") || !strings.Contains(logs.String(), "file="+file) {
+		t.Errorf("read error not logged in\n%s", logs.String())
+	}
+
+	// The segment can still be appended to
+	if err := s.Append(NewMessage(2, []byte("key"), []byte("b"))); err != nil {
+		t.Fatal(err)
+	}
+}
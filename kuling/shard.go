@@ -5,18 +5,19 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	// ErrShardIllegalKey returned when the key is not set
 	ErrShardIllegalKey = errors.New("shard: illegal key")
 	// ErrShardIllegalPayload returned when the payload is not set
-	ErrShardIllegalPayload = errors.New("shard: illegal key")
+	ErrShardIllegalPayload = errors.New("shard: illegal payload")
 	// ErrShardIllegalStartSequenceID returned when start sequence is negative
 	ErrShardIllegalStartSequenceID = errors.New("shard: illegal start sequence ID")
 	// ErrShardStartSequenceIDNotFound returned when start sequence is not found
@@ -32,8 +33,10 @@ type Shard struct {
 	dir string
 	// index that spans all segments with sequence ID to offset mapping
 	index *LogIndex
-	// array of segments
+	// array of segments by segment number, nil when removed by Expire
 	segments []*Segment
+	// segLock guards the segments for readers, writers hold wlock as well
+	segLock sync.RWMutex
 	// active segment
 	activeSegment *Segment
 	// segment max size
@@ -41,15 +44,27 @@ type Shard struct {
 	// data files and directories permissions
 	permDirectories, permData os.FileMode
 	// mutex for writes, reads do not use this mutex
-	wlock *sync.Mutex
+	wlock  *sync.Mutex
+	logger *slog.Logger
+	// appended is closed and replaced after every append
+	appended   chan struct{}
+	appendLock sync.Mutex
+	// fsyncOnAppend fsyncs every append, otherwise appends are fsynced by
+	// Sync
+	fsyncOnAppend bool
 }
 
-// OpenShard opens or creates a shard from the file path
-func OpenShard(dir string, segmentMaxByteSize int64, permDirectories, permData os.FileMode) (*Shard, error) {
+// OpenShard opens or creates a shard from the file path. The shard and its
+// segments log to the logger, slog.Default() when nil.
+func OpenShard(dir string, segmentMaxByteSize int64, permDirectories, permData os.FileMode, logger *slog.Logger) (*Shard, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	// Check that the shard directory exist, if not then create the directory
 	stat, err := os.Stat(dir)
 	if err != nil || !stat.IsDir() {
-		log.Printf("shard: creating shard directory %s", dir)
+		logger.Info("shard: creating shard directory", "dir", dir)
 		err := os.Mkdir(dir, permDirectories)
 
 		if err != nil {
@@ -80,20 +95,30 @@ func OpenShard(dir string, segmentMaxByteSize int64, permDirectories, permData o
 			continue
 		}
 
-		segment, err := OpenSegment(path.Join(dir, f.Name()), permData)
+		var number int
+		if _, err := fmt.Sscanf(f.Name(), "%d.seg", &number); err != nil || number <= len(segments) {
+			return nil, fmt.Errorf("shard: unexpected segment file %s", path.Join(dir, f.Name()))
+		}
+
+		segment, err := OpenSegment(path.Join(dir, f.Name()), permData, logger)
 		if err != nil {
 			return nil, fmt.Errorf("shard: could not load segment file(s): %s\n", err)
 		}
 
+		// Segments before this one that are missing were removed by Expire,
+		// keep their numbers so that the index still points right
+		for len(segments) < number-1 {
+			segments = append(segments, nil)
+		}
 		segments = append(segments, segment)
 	}
 
 	if len(segments) == 0 {
 		// If no segments found then this is a new shard, create the initial
 		// segment file
-		segment, err := OpenSegment(path.Join(dir, createSegmentName(1)), permData)
+		segment, err := OpenSegment(path.Join(dir, createSegmentName(1)), permData, logger)
 		if err != nil {
-			log.Printf("shard: could not load segment file(s): %s", err)
+			logger.Error("shard: could not create the first segment file", "err", err)
 			return nil, err
 		}
 
@@ -104,22 +129,40 @@ func OpenShard(dir string, segmentMaxByteSize int64, permDirectories, permData o
 			dir,
 			index,
 			segments,
+			sync.RWMutex{},
 			segments[len(segments)-1],
 			segmentMaxByteSize,
 			permDirectories,
 			permData,
 			&sync.Mutex{},
+			logger,
+			make(chan struct{}),
+			sync.Mutex{},
+			true,
 		},
 		nil
 }
 
-// Append key and payload message
-func (s *Shard) Append(key, payload []byte) error {
-	if len(key) == 0 {
-		return ErrShardIllegalKey
+// Append key and payload message. Returns the sequence ID of the message.
+func (s *Shard) Append(key, payload []byte) (int64, error) {
+	sequenceIDs, err := s.AppendBatch([][]byte{key}, [][]byte{payload})
+	if err != nil {
+		return 0, err
+	}
+
+	return sequenceIDs[0], nil
+}
+
+// AppendBatch appends the keyed payloads as messages in order with a single
+// fsync for the whole batch. Returns the sequence IDs of the messages.
+func (s *Shard) AppendBatch(keys, payloads [][]byte) ([]int64, error) {
+	if len(keys) != len(payloads) {
+		return nil, fmt.Errorf("shard: %d keys given for %d payloads", len(keys), len(payloads))
 	}
-	if len(key) == 0 {
-		return ErrShardIllegalPayload
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, ErrShardIllegalKey
+		}
 	}
 	// Acquire and release lock after append is done
 	s.wlock.Lock()
@@ -127,34 +170,69 @@ func (s *Shard) Append(key, payload []byte) error {
 
 	if s.activeSegment.Size() > s.segmentMaxByteSize {
 		segmentName := path.Join(s.dir, createSegmentName(len(s.segments)+1))
-		newSegment, err := OpenSegment(segmentName, s.permData)
+		newSegment, err := OpenSegment(segmentName, s.permData, s.logger)
 		if err != nil {
 			// Could not create shard, most likely due to out of disk or permissions
 			// in segment directory has changed from the outside
-			return fmt.Errorf("shard: %s", err)
+			return nil, fmt.Errorf("shard: %s", err)
+		}
+		// The rolled segment is no longer synced by Sync
+		if !s.fsyncOnAppend {
+			if err := s.activeSegment.Sync(); err != nil {
+				newSegment.Close()
+				return nil, fmt.Errorf("shard: %s", err)
+			}
 		}
+		newSegment.fsyncOnAppend = s.fsyncOnAppend
+
+		s.segLock.Lock()
 		s.segments = append(s.segments, newSegment)
+		s.segLock.Unlock()
 		s.activeSegment = newSegment
+		metricSegmentRolls.Inc()
 	}
 
-	// Get next sequenceID from index
-	sequenceID, err := s.index.Next(int64(len(s.segments)-1), s.activeSegment.Size())
-	if err != nil {
-		return err
+	msgs := make([]*Message, len(keys))
+	sequenceIDs := make([]int64, len(keys))
+	offset := s.activeSegment.Size()
+	for i := range keys {
+		// Get next sequenceID from index
+		sequenceID, err := s.index.Next(int64(len(s.segments)-1), offset)
+		if err != nil {
+			return nil, err
+		}
+
+		// Create message from key and payload
+		msgs[i] = NewMessage(sequenceID, keys[i], payloads[i])
+		sequenceIDs[i] = sequenceID
+		offset += msgs[i].Size()
 	}
 
-	// Create message from key and payload
-	m := NewMessage(sequenceID, key, payload)
-	// Append the message to the active segment
-	err = s.activeSegment.Append(m)
+	// Append the messages to the active segment
+	err := s.activeSegment.AppendBatch(msgs)
 	if err != nil {
 		// TODO: Not an ideal situation where we could not append the message to the
 		// active segment and have already commited the next sequenceID meaning that
 		// the id will not be used and may be confusing or cause errors down the line
-		return fmt.Errorf("shard: warn: could not append message to active segment. Index id %d will be empty: %s", sequenceID, err)
+		return nil, fmt.Errorf("shard: warn: could not append messages to active segment. Index ids %d to %d will be empty: %s", sequenceIDs[0], sequenceIDs[len(sequenceIDs)-1], err)
 	}
 
-	return nil
+	s.appendLock.Lock()
+	close(s.appended)
+	s.appended = make(chan struct{})
+	s.appendLock.Unlock()
+
+	return sequenceIDs, nil
+}
+
+// Appended returns a channel that is closed when messages are next appended
+// to the shard. Readers waiting for new messages get the channel before they
+// read, so that messages appended after the read are not missed.
+func (s *Shard) Appended() <-chan struct{} {
+	s.appendLock.Lock()
+	defer s.appendLock.Unlock()
+
+	return s.appended
 }
 
 // Read messages starting from start sequence ID and max number of messages
@@ -176,13 +254,22 @@ func (s *Shard) readAction(startSequenceID, maxMessages int64, action func(start
 		return err
 	}
 
-	segment := s.segments[segmentNumber]
-
-	if err != nil {
-		return errors.New("shard: could not find segment for start sequence ID, have the file been removed?")
+	segment := s.acquireSegment(segmentNumber)
+	for segment == nil {
+		// The start segment was removed by Expire, read from the oldest
+		// message kept. Expire may remove that one as well before it is
+		// held, it never removes the active segment.
+		if startSequenceID, err = s.firstKept(startSequenceID); err != nil {
+			return err
+		}
+		if segmentNumber, startOffset, err = s.index.SegmentAndOffset(startSequenceID); err != nil {
+			return err
+		}
+		segment = s.acquireSegment(segmentNumber)
 	}
+	defer segment.release()
 
-	_, endOffset, err := s.index.SegmentAndOffset(startSequenceID + maxMessages)
+	endSegmentNumber, endOffset, err := s.index.SegmentAndOffset(startSequenceID + maxMessages)
 	if err == ErrSequenceIDNotFound {
 		// Fewer messages than max messages in shard, take the whole shard
 		err = nil
@@ -190,11 +277,62 @@ func (s *Shard) readAction(startSequenceID, maxMessages int64, action func(start
 		endOffset = segment.Size()
 	} else if err != nil {
 		return err
+	} else if endSegmentNumber != segmentNumber {
+		// The end sequence ID lives in a later segment, reads never span
+		// segments so read the rest of the start segment
+		endOffset = segment.Size()
 	}
 
 	return action(startOffset, endOffset, segment)
 }
 
+// acquireSegment returns the segment with the number held for a read, nil
+// when it has been removed. The segment is released after the read.
+func (s *Shard) acquireSegment(number int64) *Segment {
+	s.segLock.RLock()
+	defer s.segLock.RUnlock()
+
+	if number < 0 || number >= int64(len(s.segments)) || s.segments[number] == nil {
+		return nil
+	}
+	segment := s.segments[number]
+	segment.acquire()
+
+	return segment
+}
+
+// firstKept finds the first sequence ID after the removed one that is in a
+// segment not removed by Expire
+func (s *Shard) firstKept(removedSequenceID int64) (int64, error) {
+	s.segLock.RLock()
+	first := int64(len(s.segments) - 1)
+	for i, segment := range s.segments {
+		if segment != nil {
+			first = int64(i)
+			break
+		}
+	}
+	s.segLock.RUnlock()
+
+	// Binary search as the segment numbers increase with the sequence IDs
+	lo, hi := removedSequenceID+1, s.Head()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		segmentNumber, _, err := s.index.SegmentAndOffset(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		if segmentNumber < first {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	return lo, nil
+}
+
 // Read messages starting from start sequence ID and max number of messages
 // forwards
 func (s *Shard) Read(startSequenceID, maxMessages int64) ([]*Message, error) {
@@ -228,23 +366,137 @@ func (s *Shard) Copy(startSequenceID, maxMessages int64, w io.Writer, pre PreCop
 	return copied, err
 }
 
+// Head returns the sequence ID of the last message appended to the shard,
+// zero when the shard is empty. Readers that have consumed up to head are
+// caught up with the shard.
+func (s *Shard) Head() int64 {
+	return s.index.Head()
+}
+
+// SequenceIDForTime finds the first start sequence ID whose message was
+// appended at or after t. Messages without timestamp are treated as older
+// than any time. If all messages are older than t the head is returned.
+func (s *Shard) SequenceIDForTime(t time.Time) (int64, error) {
+	// Binary search over the sequence IDs as the append time is increasing
+	// along with the sequence IDs
+	lo, hi := int64(0), s.Head()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		msgs, err := s.Read(mid, 1)
+		if err != nil {
+			return 0, err
+		}
+		if len(msgs) == 0 {
+			return 0, fmt.Errorf("shard: no message at sequence ID %d", mid)
+		}
+
+		if msgs[0].Time().Before(t) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	return lo, nil
+}
+
 // Size returns the total size of all segments
 func (s *Shard) Size() int64 {
+	s.segLock.RLock()
+	defer s.segLock.RUnlock()
+
 	var total int64
 	for _, segment := range s.segments {
-		total += segment.Size()
+		if segment != nil {
+			total += segment.Size()
+		}
 	}
 
 	return total
 }
 
-// Close down the shard
+// deferFsync stops fsyncing every append, the appends are fsynced when Sync
+// is called or the segment is rolled
+func (s *Shard) deferFsync() {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	s.fsyncOnAppend = false
+	s.activeSegment.fsyncOnAppend = false
+}
+
+// Sync fsyncs the messages appended to the active segment
+func (s *Shard) Sync() error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	return s.activeSegment.Sync()
+}
+
+// Expire removes the oldest segments while the shard is larger than
+// maxBytes or their last append is older than maxAge, zero is no limit.
+// Whole segments are removed so the shard may stay up to a segment over
+// maxBytes, and the active segment is never removed. Segments being read
+// are removed when the reads are done. Reads from a removed sequence ID
+// start at the oldest message kept. Returns the number of segments removed.
+func (s *Shard) Expire(maxAge time.Duration, maxBytes int64, now time.Time) (int, error) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	size := s.Size()
+	removed := 0
+	for i, segment := range s.segments {
+		if segment == nil {
+			continue
+		}
+		if segment == s.activeSegment {
+			break
+		}
+
+		expired := maxBytes > 0 && size > maxBytes
+		if !expired && maxAge > 0 {
+			stat, err := os.Stat(segment.FilePath)
+			if err != nil {
+				return removed, fmt.Errorf("shard: could not stat segment file %s: %s", segment.FilePath, err)
+			}
+			expired = now.Sub(stat.ModTime()) > maxAge
+		}
+		if !expired {
+			break
+		}
+
+		s.segLock.Lock()
+		s.segments[i] = nil
+		s.segLock.Unlock()
+
+		// Segments being read are removed by their last reader
+		size -= segment.Size()
+		if err := segment.expire(); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Close down the shard. Appends in progress finish first, the index and the
+// segments are fsynced and closed. Returns the first error.
 func (s *Shard) Close() error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	err := s.index.Close()
 	for _, p := range s.segments {
-		p.Close()
+		if p == nil {
+			continue
+		}
+		if segErr := p.Close(); segErr != nil && err == nil {
+			err = segErr
+		}
 	}
 
-	return nil
+	return err
 }
 
 // String from stringer interface
@@ -0,0 +1,293 @@
+package kuling
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeV0Shard writes a shard directory holding the payloads as V0
+// messages, as written before magic version 1
+func writeV0Shard(t *testing.T, dir string, payloads ...string) {
+	t.Helper()
+
+	var seg, idx bytes.Buffer
+	for i, p := range payloads {
+		binary.Write(&idx, binary.BigEndian, int64(i+1))
+		binary.Write(&idx, binary.BigEndian, int64(seg.Len()))
+		binary.Write(&idx, binary.BigEndian, int64(0))
+		seg.Write(encodeV0(int64(i+1), []byte("key"), []byte(p)))
+	}
+
+	if err := os.WriteFile(path.Join(dir, createSegmentName(1)), seg.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "shard.idx"), idx.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openTestShard(t *testing.T, dir string) *Shard {
+	t.Helper()
+
+	s, err := OpenShard(dir, DefaultSegmentMaxBytes, 0755, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func payloads(msgs []*Message) []string {
+	var ps []string
+	for _, m := range msgs {
+		ps = append(ps, string(m.Payload))
+	}
+	return ps
+}
+
+func TestShardReadsV0Segments(t *testing.T) {
+	dir := t.TempDir()
+	writeV0Shard(t, dir, "a", "b", "c")
+
+	s := openTestShard(t, dir)
+	if s.Head() != 3 {
+		t.Fatalf("head %d, want 3", s.Head())
+	}
+
+	msgs, err := s.Read(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(msgs); len(got) != 3 || got[0] != "a" || got[2] != "c" {
+		t.Fatalf("read %q", got)
+	}
+	for _, m := range msgs {
+		if m.Magic != MagicV0 {
+			t.Errorf("message %d has magic %d", m.SequenceID, m.Magic)
+		}
+	}
+}
+
+func TestShardAppendsAfterV0Segments(t *testing.T) {
+	dir := t.TempDir()
+	writeV0Shard(t, dir, "a", "b")
+
+	s := openTestShard(t, dir)
+	start := time.Now()
+	id, err := s.Append([]byte("key"), []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 3 {
+		t.Errorf("appended sequence ID %d, want 3", id)
+	}
+	s.Close()
+
+	// Reopen to read the mixed segment from disk
+	s = openTestShard(t, dir)
+	msgs, err := s.Read(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(msgs); len(got) != 3 || got[2] != "c" {
+		t.Fatalf("read %q", got)
+	}
+	if msgs[1].Magic != MagicV0 || msgs[2].Magic != CurrentMagic {
+		t.Errorf("magics %d and %d", msgs[1].Magic, msgs[2].Magic)
+	}
+
+	// Messages without a timestamp are older than any time
+	n, err := s.SequenceIDForTime(start.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("sequence ID for time %d, want 2", n)
+	}
+}
+
+func TestShardReadSpansSegments(t *testing.T) {
+	s, err := OpenShard(t.TempDir(), 1, 0755, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, p := range []string{"a", "b", "c"} {
+		if _, err := s.Append([]byte("key"), []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every message rolls a new segment, reads stop at the segment end
+	for i, want := range []string{"a", "b", "c"} {
+		msgs, err := s.Read(int64(i), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := payloads(msgs); len(got) != 1 || got[0] != want {
+			t.Errorf("read from %d got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestShardClose(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenShard(dir, DefaultSegmentMaxBytes, 0755, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append([]byte("key"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index is closed with the shard, appends after close fail
+	if _, err := s.Append([]byte("key"), []byte("b")); !errors.Is(err, ErrIndexClosed) {
+		t.Fatalf("append after close gave %v", err)
+	}
+
+	// And the lock on the index is released for the next open
+	s = openTestShard(t, dir)
+	msgs, err := s.Read(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(msgs); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("read %q after reopen", got)
+	}
+}
+
+func TestShardExpire(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenShard(dir, 1, 0755, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a", "b", "c", "d"} {
+		if _, err := s.Append([]byte("key"), []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every message is a segment, over two messages the oldest go
+	size := s.Size() / 4
+	removed, err := s.Expire(0, 2*size, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 || s.Size() != 2*size {
+		t.Fatalf("removed %d segments, %d bytes left", removed, s.Size())
+	}
+
+	// Reads from a removed sequence ID start at the oldest message kept
+	for _, start := range []int64{0, 1, 2} {
+		msgs, err := s.Read(start, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := payloads(msgs); len(got) != 1 || got[0] != "c" {
+			t.Errorf("read from %d got %q", start, got)
+		}
+	}
+
+	// Reopened with the first segments missing the index still points right
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = OpenShard(dir, 1, 0755, 0644, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Append([]byte("key"), []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	for start, want := range map[int64]string{0: "c", 3: "d", 4: "e"} {
+		msgs, err := s.Read(start, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := payloads(msgs); len(got) != 1 || got[0] != want {
+			t.Errorf("read from %d after reopen got %q, want %s", start, got, want)
+		}
+	}
+
+	// By age every segment but the active one goes
+	removed, err = s.Expire(time.Hour, 0, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 || s.Size() != size {
+		t.Fatalf("removed %d segments by age, %d bytes left", removed, s.Size())
+	}
+	msgs, err := s.Read(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(msgs); len(got) != 1 || got[0] != "e" {
+		t.Errorf("read %q after expiry by age", got)
+	}
+}
+
+func TestShardExpireWhileReading(t *testing.T) {
+	s, err := OpenShard(t.TempDir(), 1, 0755, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	const n = 200
+	for i := 0; i < n; i++ {
+		if _, err := s.Append([]byte("key"), []byte("p")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every message is a segment, expire them one by one while reading from
+	// the start
+	size := s.Size() / n
+	done := make(chan error)
+	go func() {
+		for i := n - 1; i > 0; i-- {
+			if _, err := s.Expire(0, int64(i)*size, time.Now()); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for reading := true; reading; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			reading = false
+		default:
+		}
+
+		msgs, err := s.Read(0, 1)
+		if err != nil {
+			t.Fatalf("read while expiring: %s", err)
+		}
+		if len(msgs) != 1 {
+			t.Fatalf("read %d messages while expiring", len(msgs))
+		}
+		var b bytes.Buffer
+		if _, err := s.Copy(0, 1, &b, func(int64) {}, func(int64) {}); err != nil {
+			t.Fatalf("copy while expiring: %s", err)
+		}
+	}
+
+	if s.Size() != size {
+		t.Errorf("%d bytes left after expiring all but the active segment", s.Size())
+	}
+}
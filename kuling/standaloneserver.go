@@ -1,29 +1,136 @@
 package kuling
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/fredrikbackstrom/kuling/kuling/resp"
 )
 
-// ListenAndServeStandalone starts a standalone server on the address
-func ListenAndServeStandalone(addr string, l *LogStore, b *Broker) {
+// ServerConfig configures the standalone server
+type ServerConfig struct {
+	// Address to listen on
+	Address string
+	// IdleTimeout closes client connections that have been idle for longer,
+	// zero never closes them
+	IdleTimeout time.Duration
+	// TLSConfig serves TLS only when set
+	TLSConfig *tls.Config
+	// Authenticator requires clients to authenticate before any other
+	// command when set
+	Authenticator *Authenticator
+	// ACL authorizes the commands of authenticated clients when set
+	ACL *ACL
+	// Quotas throttle the PUT and GET requests of clients when set
+	Quotas *Quotas
+	// MaxBulkBytes, MaxArrayLen, MaxDepth and MaxRequestBytes limit the
+	// size of an argument, the number of arguments, the nesting of arrays
+	// and the size of all arguments of a command, the resp defaults when
+	// zero
+	MaxBulkBytes    int
+	MaxArrayLen     int
+	MaxDepth        int
+	MaxRequestBytes int
+	// Trace logs every command and its reply
+	Trace bool
+}
+
+// ListenAndServeStandalone starts a standalone server with the config.
+// Blocks until the listener fails.
+func ListenAndServeStandalone(config ServerConfig, l *LogStore, b *Broker) error {
+	return NewStandaloneServer(config, l, b).ListenAndServe()
+}
+
+// NewStandaloneServer creates a standalone server with the config, started
+// with ListenAndServe and stopped with Shutdown
+func NewStandaloneServer(config ServerConfig, l *LogStore, b *Broker) *resp.Server {
 	m := resp.NewServeMux()
-	m.HandleFunc("PING", pingHandler)
+	for _, c := range append(standaloneCommands(l, b, config.ACL, config.Quotas), streamCommands(l, b)...) {
+		m.Register(c)
+	}
+	m.Register(resp.Command{Name: "AUTH", Args: []resp.ArgType{resp.ArgBytes}, Rest: []resp.ArgType{resp.ArgBytes}, MaxRest: 1,
+		Usage: "token | user password",
+		Help:  "Authenticate the connection", Handler: createAuthHandler(config.Authenticator)})
+	m.Register(resp.Command{Name: "ACL", Args: []resp.ArgType{resp.ArgBytes}, Rest: []resp.ArgType{resp.ArgBytes},
+		Usage: "LIST | ADD principal permissions resource | DEL principal permissions resource | RELOAD | WHOAMI",
+		Help:  "Manage the ACL rules", Handler: createACLHandler(config.ACL)})
 
-	m.HandleFunc("CREATE", createTopicHandler(l))
-	m.HandleFunc("LIST", createListTopicsHandler(l))
-	m.HandleFunc("DESCRIBE", createDescribeTopicHandler(l))
+	mon := newMonitors()
+	m.Register(resp.Command{Name: "MONITOR", Args: []resp.ArgType{},
+		Help: "Stream every command served by the server", Handler: mon.handler})
 
-	m.HandleFunc("PUT", createAppendHandler(l))
-	m.HandleFunc("GET", createFetchHandler(l))
+	m.Use(internalTopicGuard(l))
+	if config.ACL != nil {
+		z := &aclAuthorizer{config.ACL, l}
+		m.Use(z.middleware)
+	}
+	m.Use(mon.middleware)
 
-	// Broker commands
-	m.HandleFunc("ITERS", createItersHandler(b))
-	m.HandleFunc("ITER_COMMIT", createIterCommitHandler(b))
+	var h resp.Handler = m
+	if config.Authenticator != nil {
+		h = requireAuth{m}
+	}
+
+	s := &resp.Server{
+		Addr:        config.Address,
+		Handler:     h,
+		IdleTimeout: config.IdleTimeout,
+		TLSConfig:   config.TLSConfig,
+		ConnState:   countConnections,
 
-	s := &resp.Server{Addr: addr, Handler: m}
-	s.ListenAndServe()
+		MaxBulkBytes:    config.MaxBulkBytes,
+		MaxArrayLen:     config.MaxArrayLen,
+		MaxDepth:        config.MaxDepth,
+		MaxRequestBytes: config.MaxRequestBytes,
+		Trace:           config.Trace,
+	}
+	s.RegisterOnShutdown(mon.close)
+
+	return s
+}
+
+// standaloneCommands are the commands served by the standalone server. PUT,
+// PUT_BATCH and GET are throttled by the quotas, LIST is filtered by the ACL.
+func standaloneCommands(l *LogStore, b *Broker, acl *ACL, q *Quotas) []resp.Command {
+	str, num := resp.ArgBytes, resp.ArgInt
+
+	return []resp.Command{
+		{Name: "PING", Args: []resp.ArgType{},
+			Help: "Ping the server", Handler: pingHandler},
+		{Name: "HELLO", Args: []resp.ArgType{num}, Rest: []resp.ArgType{str, str},
+			Usage: ":version [field value ...]",
+			Help:  "Negotiate protocol version, message formats, codecs and features", Handler: createHelloHandler()},
+
+		{Name: "CREATE", Args: []resp.ArgType{str, num}, Usage: "topic :shards",
+			Help: "Create topic with the number of shards", Handler: createTopicHandler(l)},
+		{Name: "LIST", Args: []resp.ArgType{},
+			Help: "List topics", Handler: createListTopicsHandler(l, acl)},
+		{Name: "DESCRIBE", Args: []resp.ArgType{str}, Usage: "topic",
+			Help: "List the shards of the topic", Handler: createDescribeTopicHandler(l)},
+
+		{Name: "PUT", Args: []resp.ArgType{str, str, str, str}, Usage: "topic shard key payload",
+			Help: "Append a message to the shard", Handler: createAppendHandler(l, q)},
+		{Name: "PUT_BATCH", Args: []resp.ArgType{str, str}, Rest: []resp.ArgType{str, str}, MinRest: 1,
+			Usage: "topic shard key payload [key payload ...]",
+			Help:  "Append messages to the shard in order", Handler: createAppendBatchHandler(l, q)},
+		{Name: "GET", Args: []resp.ArgType{str, str, num, num}, Usage: "topic shard :startSequenceID :maxMessages",
+			Help: "Get messages from the shard", Handler: createFetchHandler(l, q)},
+
+		// Broker commands
+		{Name: "ITERS", Args: []resp.ArgType{str, str, str}, Usage: "group client topic",
+			Help: "Join the group and get the iterators of the client", Handler: createItersHandler(b)},
+		{Name: "ITER_COMMIT", Args: []resp.ArgType{str, num}, Usage: "iterator :offset",
+			Help: "Commit the iterator at the offset", Handler: createIterCommitHandler(b)},
+		{Name: "GRP_LEAVE", Args: []resp.ArgType{str, str}, Usage: "group client",
+			Help: "Leave the group", Handler: createGroupLeaveHandler(b)},
+		{Name: "DESCRIBE_GROUP", Args: []resp.ArgType{str, str}, Usage: "group topic",
+			Help: "Describe the members and position of the group", Handler: createDescribeGroupHandler(b)},
+		{Name: "RESET_GROUP", Args: []resp.ArgType{str, str, str}, Rest: []resp.ArgType{num}, MaxRest: 1, Usage: "group topic mode [:value]",
+			Help: "Move the committed iterators of an inactive group", Handler: createResetGroupHandler(b)},
+	}
 }
 
 func pingHandler(w resp.ResponseWriter, r *resp.Request) {
@@ -33,52 +140,71 @@ func pingHandler(w resp.ResponseWriter, r *resp.Request) {
 func createTopicHandler(l *LogStore) resp.HandleFunc {
 	return func(w resp.ResponseWriter, r *resp.Request) {
 		_, err := l.CreateTopic(
-			string(r.Args[0].([]byte)),
-			int(r.Args[1].(int64)),
+			r.String(0),
+			int(r.Int64(1)),
 		)
 		if err != nil {
-			w.WriteErr("ERR", err.Error())
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
 		}
 
 		w.WriteStatus("OK")
 	}
 }
 
-func createListTopicsHandler(l *LogStore) resp.HandleFunc {
+// createListTopicsHandler lists the topics, only those the principal may
+// read when the ACL is set
+func createListTopicsHandler(l *LogStore, acl *ACL) resp.HandleFunc {
 	return func(w resp.ResponseWriter, r *resp.Request) {
-		m := l.Topics()
-
-		w.WriteInstruction('*', len(m))
+		principal := sessionPrincipal(r.Session)
 
-		for k := range m {
-			w.WriteString(k)
+		var names []string
+		for name := range l.Topics() {
+			if IsInternalTopic(name) {
+				continue
+			}
+			if acl != nil && !acl.Allowed(principal, PermRead, ResourceTopic, name) {
+				continue
+			}
+			names = append(names, name)
 		}
 
-		w.WriteEnd()
+		w.WriteInstruction('*', len(names))
+
+		for _, name := range names {
+			w.WriteString(name)
+		}
 	}
 }
 
 func createDescribeTopicHandler(l *LogStore) resp.HandleFunc {
 	return func(w resp.ResponseWriter, r *resp.Request) {
-		shards, err := l.Shards(string(r.Args[0].([]byte)))
+		shards, err := l.Shards(r.String(0))
 		if err != nil {
-			fmt.Println(err)
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
 		}
 
-		w.WriteInterface(len(shards))
+		names := sortedShardNames(shards)
+		w.WriteInstruction('*', len(names))
+		for _, name := range names {
+			w.WriteString(name)
+		}
 	}
 }
 
-func createAppendHandler(l *LogStore) resp.HandleFunc {
+func createAppendHandler(l *LogStore, q *Quotas) resp.HandleFunc {
 	return func(w resp.ResponseWriter, r *resp.Request) {
-		err := l.Append(
-			string(r.Args[0].([]byte)),
-			string(r.Args[1].([]byte)),
-			r.Args[2].([]byte),
-			r.Args[3].([]byte))
+		throttle(w, r, q.Produce(sessionClient(r.Session), int64(len(r.Bytes(2))+len(r.Bytes(3)))))
+
+		_, err := l.Append(
+			r.String(0),
+			r.String(1),
+			r.Bytes(2),
+			r.Bytes(3))
 
 		if err != nil {
-			w.WriteErr("ERR", err.Error())
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
 			return
 		}
 
@@ -86,12 +212,72 @@ func createAppendHandler(l *LogStore) resp.HandleFunc {
 	}
 }
 
-func createFetchHandler(l *LogStore) resp.HandleFunc {
+func createAppendBatchHandler(l *LogStore, q *Quotas) resp.HandleFunc {
+	return func(w resp.ResponseWriter, r *resp.Request) {
+		topic := r.String(0)
+		shard := r.String(1)
+
+		// The rest of the arguments are key and payload pairs
+		keys := make([][]byte, 0, (len(r.Args)-2)/2)
+		payloads := make([][]byte, 0, (len(r.Args)-2)/2)
+		var size int64
+		for i := 2; i < len(r.Args); i += 2 {
+			keys = append(keys, r.Bytes(i))
+			payloads = append(payloads, r.Bytes(i+1))
+			size += int64(len(r.Bytes(i)) + len(r.Bytes(i+1)))
+		}
+
+		throttle(w, r, q.Produce(sessionClient(r.Session), size))
+
+		sequenceIDs, err := l.AppendBatch(topic, shard, keys, payloads)
+		if err != nil {
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
+		}
+
+		w.WriteInstruction('*', len(sequenceIDs))
+		for _, sequenceID := range sequenceIDs {
+			w.WriteInt64(sequenceID)
+		}
+	}
+}
+
+func createFetchHandler(l *LogStore, q *Quotas) resp.HandleFunc {
 	return func(w resp.ResponseWriter, r *resp.Request) {
-		topic := string(r.Args[0].([]byte))
-		shard := string(r.Args[1].([]byte))
-		startID := r.Args[2].(int64)
-		maxNumMessages := r.Args[3].(int64)
+		topic := r.String(0)
+		shard := r.String(1)
+		startID := r.Int64(2)
+		maxNumMessages := r.Int64(3)
+
+		// The bytes read are charged after the read and delay the next GET
+		client := sessionClient(r.Session)
+		throttle(w, r, q.Fetch(client))
+
+		// Clients that read an older message format get the messages
+		// converted, the others get the stored bytes as they are
+		if magic := sessionMagic(r.Session); magic < CurrentMagic {
+			msgs, err := l.Read(topic, shard, startID, maxNumMessages)
+			if err != nil {
+				w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+				return
+			}
+
+			var buf bytes.Buffer
+			mw := NewMessageWriter(&buf)
+			for _, m := range msgs {
+				if m.Magic > magic {
+					m = m.Convert(magic)
+				}
+				if _, err := mw.WriteMessage(m); err != nil {
+					w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+					return
+				}
+			}
+
+			q.FetchBytes(client, int64(buf.Len()))
+			w.WriteBytes(buf.Bytes())
+			return
+		}
 
 		_, err := l.Copy(
 			topic,
@@ -99,41 +285,49 @@ func createFetchHandler(l *LogStore) resp.HandleFunc {
 			startID,
 			maxNumMessages,
 			r.Writer, // Special handling to get speed? from using the underlying raw connection this needs to be improved
-			func(totalBytesToRead int64) { w.WriteInstruction('$', int(totalBytesToRead)) },
+			func(totalBytesToRead int64) {
+				q.FetchBytes(client, totalBytesToRead)
+				w.WriteInstruction('$', int(totalBytesToRead))
+				// The body is copied to the connection, past the writer
+				w.Flush()
+			},
 			func(totalBytesRead int64) { w.WriteEnd() },
 		)
 
 		if err != nil {
-			w.WriteErr("ERR", fmt.Sprintf("%s : %s", r.Cmd, err))
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
 		}
 	}
 }
 
 func createItersHandler(b *Broker) resp.HandleFunc {
 	return func(w resp.ResponseWriter, r *resp.Request) {
-		group := string(r.Args[0].([]byte))
-		client := string(r.Args[1].([]byte))
-		topic := string(r.Args[2].([]byte))
+		group := r.String(0)
+		client := r.String(1)
+		topic := r.String(2)
 
 		var iters []string
 		var err error
 		if iters, err = b.Iters(group, client, topic); err != nil {
-			w.WriteErr("ERR", fmt.Sprintf("%s : %s", r.Cmd, err))
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
 			return
 		}
 
-		w.WriteArray(iters)
+		w.WriteInstruction('*', len(iters))
+		for _, iter := range iters {
+			w.WriteString(iter)
+		}
 	}
 }
 
 func createIterCommitHandler(b *Broker) resp.HandleFunc {
 	return func(w resp.ResponseWriter, r *resp.Request) {
-		iter := string(r.Args[0].([]byte))
-		offset := r.Args[1].(int64)
+		iter := r.String(0)
+		offset := r.Int64(1)
 
 		var err error
 		if iter, err = b.Commit(iter, offset); err != nil {
-			w.WriteErr("ERR", fmt.Sprintf("%s : %s", r.Cmd, err))
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
 			return
 		}
 
@@ -141,3 +335,89 @@ func createIterCommitHandler(b *Broker) resp.HandleFunc {
 		w.WriteStatus("OK")
 	}
 }
+
+func createGroupLeaveHandler(b *Broker) resp.HandleFunc {
+	return func(w resp.ResponseWriter, r *resp.Request) {
+		group := r.String(0)
+		client := r.String(1)
+
+		if err := b.Leave(group, client); err != nil {
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
+		}
+
+		w.WriteStatus("OK")
+	}
+}
+
+func createDescribeGroupHandler(b *Broker) resp.HandleFunc {
+	return func(w resp.ResponseWriter, r *resp.Request) {
+		group := r.String(0)
+		topic := r.String(1)
+
+		d, err := b.DescribeGroup(group, topic)
+		if err != nil {
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
+		}
+
+		var active int64
+		if d.Active {
+			active = 1
+		}
+
+		w.WriteInstruction('*', 5)
+		w.WriteString(d.Group)
+		w.WriteString(d.Topic)
+		w.WriteInt64(active)
+
+		w.WriteInstruction('*', len(d.Members))
+		for _, m := range d.Members {
+			w.WriteString(m)
+		}
+
+		w.WriteInstruction('*', len(d.Shards))
+		for _, s := range d.Shards {
+			w.WriteArray(s.Shard, s.Owner, s.Committed, s.Head, s.Lag)
+		}
+	}
+}
+
+func createResetGroupHandler(b *Broker) resp.HandleFunc {
+	return func(w resp.ResponseWriter, r *resp.Request) {
+		group := r.String(0)
+		topic := r.String(1)
+		reset := OffsetReset{Mode: r.String(2)}
+
+		// The value is only given for the modes that need one
+		switch reset.Mode {
+		case ResetSequenceID, ResetTimestamp:
+			if len(r.Args) != 4 {
+				w.WriteErr(resp.CodeWrongArgs, fmt.Sprintf("%s : mode %s needs a value", r.Cmd, reset.Mode))
+				return
+			}
+			if reset.Mode == ResetSequenceID {
+				reset.SequenceID = r.Int64(3)
+			} else {
+				reset.Timestamp = time.Unix(0, r.Int64(3)*int64(time.Millisecond))
+			}
+		}
+
+		offsets, err := b.ResetGroup(group, topic, reset)
+		if err != nil {
+			w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+			return
+		}
+
+		shards := make([]string, 0, len(offsets))
+		for shard := range offsets {
+			shards = append(shards, shard)
+		}
+		sort.Strings(shards)
+
+		w.WriteInstruction('*', len(shards))
+		for _, shard := range shards {
+			w.WriteArray(shard, offsets[shard])
+		}
+	}
+}
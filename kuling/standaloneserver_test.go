@@ -0,0 +1,219 @@
+package kuling
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+// startTestServer serves a standalone server on a free local port until the
+// test ends and returns its address
+func startTestServer(t *testing.T, config ServerConfig, l *LogStore, b *Broker) string {
+	t.Helper()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStandaloneServer(config, l, b)
+	go s.Serve(listen)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	return listen.Addr().String()
+}
+
+func TestListThenCommandOnSameConnection(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	createTestTopic(t, l, "orders", 1)
+	addr := startTestServer(t, ServerConfig{}, l, newTestBroker(t, l))
+
+	// Pipeline both commands and read the replies back to back, anything
+	// left after the LIST reply shows up in front of PONG
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	w := resp.NewWriter(conn)
+	w.WriteArray("LIST")
+	w.WriteArray("PING")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := resp.NewReader(bufio.NewReader(conn))
+	topics, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, ok := topics.([]interface{}); !ok || len(list) != 2 {
+		t.Fatalf("LIST replied %s", resp.FormatValue(topics))
+	}
+	pong, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong != "PONG" {
+		t.Fatalf("PING after LIST replied %s", resp.FormatValue(pong))
+	}
+
+	// And through the client
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if topics, err := c.List(); err != nil || len(topics) != 2 {
+			t.Fatalf("list %d gave %q, %v", i, topics, err)
+		}
+		if _, err := c.Ping(); err != nil {
+			t.Fatalf("ping after list %d gave %v", i, err)
+		}
+	}
+}
+
+func TestGetConvertsToNegotiatedMagic(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1, "a", "b")
+	addr := startTestServer(t, ServerConfig{}, l, newTestBroker(t, l))
+
+	for _, tc := range []struct {
+		name  string
+		hello []interface{}
+		magic byte
+	}{
+		{"without HELLO", nil, MagicV0},
+		{"HELLO magic 0", []interface{}{"HELLO", int64(1), "magic", "0"}, MagicV0},
+		{"HELLO magic 0,1", []interface{}{"HELLO", int64(1), "magic", "0,1"}, MagicV1},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		w, r := resp.NewWriter(conn), resp.NewReader(conn)
+
+		if tc.hello != nil {
+			w.WriteArray(tc.hello...)
+		}
+		w.WriteArray("GET", "emails", firstShard, int64(0), int64(10))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if tc.hello != nil {
+			if _, err := r.Read(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reply, err := r.Read()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		p, _ := reply.([]byte)
+		msgs, err := NewMessageReader(bytes.NewReader(p)).ReadMessages()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(msgs) != 2 {
+			t.Fatalf("%s: got %d messages", tc.name, len(msgs))
+		}
+		for _, m := range msgs {
+			if m.Magic != tc.magic {
+				t.Errorf("%s: message %d has magic %d, want %d", tc.name, m.SequenceID, m.Magic, tc.magic)
+			}
+		}
+	}
+}
+
+func TestStandaloneServerShutdown(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStandaloneServer(ServerConfig{}, l, newTestBroker(t, l))
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(listen) }()
+
+	c, err := Dial(listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-served:
+		if err != resp.ErrServerClosed {
+			t.Errorf("serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+
+	// The idle connection was closed and no new ones are accepted
+	if _, err := c.Ping(); err == nil {
+		t.Error("ping on a connection after shutdown")
+	}
+	if _, err := Dial(listen.Addr().String()); err == nil {
+		t.Error("connected after shutdown")
+	}
+}
+
+func TestResetGroupValueOnlyForSequenceAndTimestamp(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1, "a", "b")
+	addr := startTestServer(t, ServerConfig{}, l, newTestBroker(t, l))
+
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	offsets, err := c.ResetGroup("g", "emails", OffsetReset{Mode: ResetLatest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offsets[firstShard] != 2 {
+		t.Errorf("latest reset to %v", offsets)
+	}
+	if offsets, err = c.ResetGroup("g", "emails", OffsetReset{Mode: ResetSequenceID, SequenceID: 1}); err != nil || offsets[firstShard] != 1 {
+		t.Errorf("sequence reset to %v, %v", offsets, err)
+	}
+
+	_, w, r := dialTestConn(t, addr)
+	w.WriteArray("RESET_GROUP", "g", "emails", ResetSequenceID)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); !errors.Is(err, &resp.Error{Code: resp.CodeWrongArgs}) {
+		t.Errorf("sequence reset without a value gave %v", err)
+	}
+}
@@ -0,0 +1,915 @@
+package kuling
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+// Redis streams commands so that Redis tooling can produce to and consume
+// from kuling. A stream is one topic shard, the key is either the topic name
+// for topics with a single shard or topic/shard where shard is the shard
+// name or its index among the sorted shard names. Stream IDs are 0-<sequence
+// ID>, the millisecond part is always zero and ignored when parsed.
+
+// streamMaxRead is the max number of messages read from a shard at a time
+const streamMaxRead = 1000
+
+// ErrStreamSyntax returned when a streams command cannot be parsed
+var ErrStreamSyntax = errors.New("streams: syntax error")
+
+// streams serves the streams commands. Consumer groups are broker groups,
+// what has been delivered to a group but not acknowledged is only kept in
+// memory, acknowledging commits the group's iterator.
+type streams struct {
+	l *LogStore
+	b *Broker
+
+	// iterator ID to the sequence ID last delivered to the group in the shard
+	delivered map[string]int64
+	// iterator ID to the iterator last handed to the group for the shard,
+	// acknowledgements are committed with it
+	iters map[string]string
+	lock  sync.Mutex
+}
+
+// stream is the topic shard a stream key refers to
+type stream struct {
+	key   string
+	topic string
+	shard string
+	s     *Shard
+}
+
+func streamCommands(l *LogStore, b *Broker) []resp.Command {
+	st := &streams{
+		l,
+		b,
+		make(map[string]int64),
+		make(map[string]string),
+		sync.Mutex{},
+	}
+	str := resp.ArgBytes
+
+	return []resp.Command{
+		{Name: "XADD", Args: []resp.ArgType{str}, Rest: []resp.ArgType{str}, MinRest: 3,
+			Usage: "key [NOMKSTREAM] * field value [field value ...]",
+			Help:  "Append an entry to the stream, the first value is the message key", Handler: st.xadd},
+		{Name: "XRANGE", Args: []resp.ArgType{str, str, str}, Rest: []resp.ArgType{str},
+			Usage: "key start end [COUNT count]",
+			Help:  "Get the entries of the stream between two IDs", Handler: st.xrange},
+		{Name: "XLEN", Args: []resp.ArgType{str}, Usage: "key",
+			Help: "Get the number of entries in the stream", Handler: st.xlen},
+		{Name: "XINFO", Args: []resp.ArgType{str, str}, Usage: "STREAM key",
+			Help: "Describe the stream", Handler: st.xinfo},
+		{Name: "XREAD", Args: []resp.ArgType{}, Rest: []resp.ArgType{str}, MinRest: 3,
+			Usage: "[COUNT count] [BLOCK ms] STREAMS key [key ...] id [id ...]",
+			Help:  "Read entries after the IDs, waiting up to BLOCK ms for new entries", Handler: st.xread},
+		{Name: "XGROUP", Args: []resp.ArgType{str, str, str}, Rest: []resp.ArgType{str},
+			Usage: "CREATE key group id [MKSTREAM] | SETID key group id | DELCONSUMER key group consumer",
+			Help:  "Manage the consumer groups of the stream's topic", Handler: st.xgroup},
+		{Name: "XREADGROUP", Args: []resp.ArgType{}, Rest: []resp.ArgType{str}, MinRest: 6,
+			Usage: "GROUP group consumer [COUNT count] [BLOCK ms] [NOACK] STREAMS key [key ...] id [id ...]",
+			Help:  "Read entries as a member of the group, > reads new entries", Handler: st.xreadgroup},
+		{Name: "XACK", Args: []resp.ArgType{str, str, str}, Rest: []resp.ArgType{str},
+			Usage: "key group id [id ...]",
+			Help:  "Acknowledge entries, the group is committed up to the highest ID", Handler: st.xack},
+	}
+}
+
+// xadd appends the fields as one message. Kuling assigns the IDs, only * is
+// accepted as ID, and trimming is left to the retention of the log store.
+func (st *streams) xadd(w resp.ResponseWriter, r *resp.Request) {
+	create := true
+	i := 1
+	for ; i < len(r.Args); i++ {
+		opt := strings.ToUpper(r.String(i))
+		if opt == "NOMKSTREAM" {
+			create = false
+			continue
+		}
+		if opt == "MAXLEN" || opt == "MINID" {
+			writeStreamErr(w, r, fmt.Errorf("%w: trimming is not supported", ErrStreamSyntax))
+			return
+		}
+		break
+	}
+
+	if i >= len(r.Args) || r.String(i) != "*" {
+		writeStreamErr(w, r, fmt.Errorf("%w: only * is supported as ID", ErrStreamSyntax))
+		return
+	}
+
+	fields := r.Args[i+1:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		writeStreamErr(w, r, fmt.Errorf("%w: expected field value pairs", ErrStreamSyntax))
+		return
+	}
+
+	str, err := st.resolve(r.String(0), create)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	var payload bytes.Buffer
+	pw := resp.NewWriter(&payload)
+	pw.WriteArray(fields...)
+	if err := pw.Flush(); err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	sequenceID, err := st.l.Append(str.topic, str.shard, r.Bytes(i+2), payload.Bytes())
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	w.WriteString(streamID(sequenceID))
+}
+
+func (st *streams) xrange(w resp.ResponseWriter, r *resp.Request) {
+	str, err := st.resolve(r.String(0), false)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	start, err := parseRangeID(r.String(1), 1, str.s.Head(), true)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+	end, err := parseRangeID(r.String(2), 1, str.s.Head(), false)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	var count int64
+	if rest := r.Args[3:]; len(rest) > 0 {
+		if len(rest) != 2 || !strings.EqualFold(r.String(3), "COUNT") {
+			writeStreamErr(w, r, ErrStreamSyntax)
+			return
+		}
+		if count, err = parseStreamInt(r.String(4)); err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+	}
+
+	msgs, err := readStream(str.s, start, end, count)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	writeStreamEntries(w, msgs)
+}
+
+// xlen answers zero for streams that do not exist, as Redis does
+func (st *streams) xlen(w resp.ResponseWriter, r *resp.Request) {
+	str, err := st.resolve(r.String(0), false)
+	if errors.Is(err, ErrUnknownTopic) {
+		w.WriteInt64(0)
+		return
+	}
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	w.WriteInt64(str.s.Head())
+}
+
+func (st *streams) xinfo(w resp.ResponseWriter, r *resp.Request) {
+	if !strings.EqualFold(r.String(0), "STREAM") {
+		writeStreamErr(w, r, fmt.Errorf("%w: unknown subcommand %s", ErrStreamSyntax, r.String(0)))
+		return
+	}
+
+	str, err := st.resolve(r.String(1), false)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	head := str.s.Head()
+	var first, last []*Message
+	if head > 0 {
+		if first, err = readStream(str.s, 1, head, 1); err == nil {
+			last, err = readStream(str.s, head, head, 1)
+		}
+		if err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+	}
+
+	w.WriteInstruction('*', 10)
+	w.WriteString("length")
+	w.WriteInt64(head)
+	w.WriteString("last-generated-id")
+	w.WriteString(streamID(head))
+	w.WriteString("entries-added")
+	w.WriteInt64(head)
+	w.WriteString("first-entry")
+	writeStreamEntry(w, first)
+	w.WriteString("last-entry")
+	writeStreamEntry(w, last)
+}
+
+func (st *streams) xread(w resp.ResponseWriter, r *resp.Request) {
+	opts, err := parseStreamRead(r, 0)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	strs := make([]stream, len(opts.keys))
+	after := make([]int64, len(opts.keys))
+	for i, key := range opts.keys {
+		if strs[i], err = st.resolve(key, false); err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+
+		// $ reads only entries added after the call
+		if opts.ids[i] == "$" {
+			after[i] = strs[i].s.Head()
+		} else if after[i], err = parseStreamID(opts.ids[i]); err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+	}
+
+	read := func() ([][]*Message, error) {
+		results := make([][]*Message, len(strs))
+		for i, str := range strs {
+			msgs, err := readStream(str.s, after[i]+1, str.s.Head(), opts.count)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = msgs
+		}
+		return results, nil
+	}
+
+	results, err := waitStreams(blockContext(r, opts), opts, strs, read)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	writeStreamResults(w, strs, results)
+}
+
+func (st *streams) xgroup(w resp.ResponseWriter, r *resp.Request) {
+	sub := strings.ToUpper(r.String(0))
+	key, group := r.String(1), r.String(2)
+	rest := r.Args[3:]
+
+	switch sub {
+	case "CREATE", "SETID":
+		if len(rest) < 1 || len(rest) > 2 {
+			writeStreamErr(w, r, ErrStreamSyntax)
+			return
+		}
+		create := len(rest) == 2 && sub == "CREATE" && strings.EqualFold(r.String(4), "MKSTREAM")
+		if len(rest) == 2 && !create {
+			writeStreamErr(w, r, ErrStreamSyntax)
+			return
+		}
+
+		str, err := st.resolve(key, create)
+		if err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+
+		reset, err := parseGroupID(r.String(3))
+		if err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+
+		// Groups are per topic, the position is set in every shard
+		if sub == "CREATE" {
+			_, err = st.b.CreateGroup(group, str.topic, reset)
+		} else {
+			_, err = st.b.ResetGroup(group, str.topic, reset)
+		}
+		if err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+
+		st.forget(group, str.topic)
+		w.WriteStatus("OK")
+	case "DELCONSUMER":
+		if len(rest) != 1 {
+			writeStreamErr(w, r, ErrStreamSyntax)
+			return
+		}
+
+		// Pending entries are kept per group, the consumer never has any
+		err := st.b.Leave(group, r.String(3))
+		if err != nil && !errors.Is(err, ErrNotMember) {
+			writeStreamErr(w, r, err)
+			return
+		}
+
+		w.WriteInt64(0)
+	default:
+		writeStreamErr(w, r, fmt.Errorf("%w: unknown subcommand %s", ErrStreamSyntax, r.String(0)))
+	}
+}
+
+// xreadgroup reads as a member of the broker group. With > the entries
+// after the last delivered to the group are read from the shards the broker
+// assigns to the consumer, other streams come back empty. With an ID the
+// entries delivered to the group but not yet acknowledged after the ID are
+// read again.
+func (st *streams) xreadgroup(w resp.ResponseWriter, r *resp.Request) {
+	if !strings.EqualFold(r.String(0), "GROUP") {
+		writeStreamErr(w, r, ErrStreamSyntax)
+		return
+	}
+	group, consumer := r.String(1), r.String(2)
+
+	opts, err := parseStreamRead(r, 3)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	strs := make([]stream, len(opts.keys))
+	for i, key := range opts.keys {
+		if strs[i], err = st.resolve(key, false); err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+	}
+
+	// Joining the group, or staying in it, also hands out the iterators of
+	// the shards assigned to the consumer
+	assigned := make(map[string]bool)
+	for _, topic := range uniqueTopics(strs) {
+		iters, err := st.b.Iters(group, consumer, topic)
+		if err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+
+		st.lock.Lock()
+		for _, iter := range iters {
+			it, err := IterDecode(iter)
+			if err != nil {
+				st.lock.Unlock()
+				writeStreamErr(w, r, err)
+				return
+			}
+			st.iters[it.ID()] = iter
+			assigned[it.ID()] = true
+		}
+		st.lock.Unlock()
+	}
+
+	read := func() ([][]*Message, error) {
+		results := make([][]*Message, len(strs))
+		for i, str := range strs {
+			iterID := createIterID(group, str.topic, str.shard)
+			if !assigned[iterID] {
+				continue
+			}
+
+			msgs, err := st.readGroup(iterID, str, opts.ids[i], opts.count, opts.noack)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = msgs
+		}
+		return results, nil
+	}
+
+	// Pending entries are there or not, only new entries are waited for
+	for _, id := range opts.ids {
+		if id != ">" {
+			opts.block = -1
+		}
+	}
+
+	results, err := waitStreams(blockContext(r, opts), opts, strs, read)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	writeStreamResults(w, strs, results)
+}
+
+// readGroup reads the entries for the group in the shard of the iterator ID
+func (st *streams) readGroup(iterID string, str stream, id string, count int64, noack bool) ([]*Message, error) {
+	st.lock.Lock()
+	iter := st.iters[iterID]
+	delivered := st.delivered[iterID]
+	st.lock.Unlock()
+
+	it, err := IterDecode(iter)
+	if err != nil {
+		return nil, err
+	}
+
+	// The group may have been moved past what was delivered, by a reset or
+	// another server, the committed position then wins
+	if delivered < it.Offset() {
+		delivered = it.Offset()
+	}
+
+	if id != ">" {
+		after, err := parseStreamID(id)
+		if err != nil {
+			return nil, err
+		}
+		if after < it.Offset() {
+			after = it.Offset()
+		}
+
+		return readStream(str.s, after+1, delivered, count)
+	}
+
+	msgs, err := readStream(str.s, delivered+1, str.s.Head(), count)
+	if err != nil || len(msgs) == 0 {
+		return msgs, err
+	}
+
+	last := msgs[len(msgs)-1].SequenceID
+	st.lock.Lock()
+	st.delivered[iterID] = last
+	st.lock.Unlock()
+
+	if noack {
+		if _, err := st.ack(iterID, []int64{last}); err != nil {
+			return nil, err
+		}
+	}
+
+	return msgs, nil
+}
+
+func (st *streams) xack(w resp.ResponseWriter, r *resp.Request) {
+	str, err := st.resolve(r.String(0), false)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	ids := make([]int64, 0, len(r.Args)-2)
+	for i := 2; i < len(r.Args); i++ {
+		id, err := parseStreamID(r.String(i))
+		if err != nil {
+			writeStreamErr(w, r, err)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	acked, err := st.ack(createIterID(r.String(1), str.topic, str.shard), ids)
+	if err != nil {
+		writeStreamErr(w, r, err)
+		return
+	}
+
+	w.WriteInt64(acked)
+}
+
+// ack commits the group's iterator up to the highest of the delivered IDs.
+// Returns the number of IDs that were delivered and not yet acknowledged.
+// Acknowledging is cumulative, it acknowledges all entries before the ID.
+func (st *streams) ack(iterID string, ids []int64) (int64, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	iter, ok := st.iters[iterID]
+	if !ok {
+		return 0, nil
+	}
+	it, err := IterDecode(iter)
+	if err != nil {
+		return 0, err
+	}
+
+	var acked, highest int64
+	for _, id := range ids {
+		if id > it.Offset() && id <= st.delivered[iterID] {
+			acked++
+			if id > highest {
+				highest = id
+			}
+		}
+	}
+	if acked == 0 {
+		return 0, nil
+	}
+
+	if st.iters[iterID], err = st.b.Commit(iter, highest); err != nil {
+		return 0, err
+	}
+
+	return acked, nil
+}
+
+// forget what was delivered to the group in the topic after its position has
+// been moved
+func (st *streams) forget(group, topic string) {
+	prefix := iterIDPrefix(group, topic)
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	for iterID := range st.iters {
+		if strings.HasPrefix(iterID, prefix) {
+			delete(st.iters, iterID)
+			delete(st.delivered, iterID)
+		}
+	}
+}
+
+// resolve finds the topic shard of the stream key. If create is set a topic
+// with a single shard is created for keys without a shard.
+func (st *streams) resolve(key string, create bool) (stream, error) {
+	topic, shard, explicit := strings.Cut(key, "/")
+
+	shards, err := st.l.Shards(topic)
+	if errors.Is(err, ErrUnknownTopic) && create && !explicit {
+		if _, err = st.l.CreateTopic(topic, 1); err == nil {
+			shards, err = st.l.Shards(topic)
+		}
+	}
+	if err != nil {
+		return stream{}, err
+	}
+
+	if !explicit {
+		if len(shards) != 1 {
+			return stream{}, fmt.Errorf("streams: topic %s has %d shards, use %s/<shard> as key", topic, len(shards), topic)
+		}
+		for name, s := range shards {
+			return stream{key, topic, name, s}, nil
+		}
+	}
+
+	if s, ok := shards[shard]; ok {
+		return stream{key, topic, shard, s}, nil
+	}
+	if i, err := strconv.Atoi(shard); err == nil && i >= 0 && i < len(shards) {
+		name := sortedShardNames(shards)[i]
+		return stream{key, topic, name, shards[name]}, nil
+	}
+
+	return stream{}, fmt.Errorf("%w %s", ErrUnknownShard, shard)
+}
+
+// streamRead are the options of XREAD and XREADGROUP
+type streamRead struct {
+	count int64
+	// block is the max wait for new entries, zero waits forever and a
+	// negative block does not wait
+	block time.Duration
+	noack bool
+	keys  []string
+	ids   []string
+}
+
+// blockContext is the context a blocking read waits within. Only reads that
+// block watch for the client going away.
+func blockContext(r *resp.Request, opts *streamRead) context.Context {
+	if opts.block < 0 {
+		return context.Background()
+	}
+	return r.Context()
+}
+
+// parseStreamRead parses the options from the argument at index i
+func parseStreamRead(r *resp.Request, i int) (*streamRead, error) {
+	opts := &streamRead{block: -1}
+
+	for ; i < len(r.Args); i++ {
+		switch strings.ToUpper(r.String(i)) {
+		case "COUNT", "BLOCK":
+			if i+1 >= len(r.Args) {
+				return nil, ErrStreamSyntax
+			}
+			n, err := parseStreamInt(r.String(i + 1))
+			if err != nil {
+				return nil, err
+			}
+			if strings.EqualFold(r.String(i), "COUNT") {
+				opts.count = n
+			} else {
+				opts.block = time.Duration(n) * time.Millisecond
+			}
+			i++
+		case "NOACK":
+			opts.noack = true
+		case "STREAMS":
+			rest := r.Args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return nil, fmt.Errorf("%w: expected as many IDs as keys", ErrStreamSyntax)
+			}
+			for j := range rest {
+				if j < len(rest)/2 {
+					opts.keys = append(opts.keys, r.String(i+1+j))
+				} else {
+					opts.ids = append(opts.ids, r.String(i+1+j))
+				}
+			}
+			return opts, nil
+		default:
+			return nil, fmt.Errorf("%w: unknown option %s", ErrStreamSyntax, r.String(i))
+		}
+	}
+
+	return nil, fmt.Errorf("%w: STREAMS is required", ErrStreamSyntax)
+}
+
+// waitStreams reads until any stream has entries, the block time is up or
+// the context is done, when the client goes away or the server shuts down.
+// Between reads it waits for messages to be appended to the streams.
+// Returns nil results if there were no entries.
+func waitStreams(ctx context.Context, opts *streamRead, strs []stream, read func() ([][]*Message, error)) ([][]*Message, error) {
+	var timeout <-chan time.Time
+	if opts.block > 0 {
+		timer := time.NewTimer(opts.block)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		appended := make([]<-chan struct{}, len(strs))
+		for i, str := range strs {
+			appended[i] = str.s.Appended()
+		}
+
+		results, err := read()
+		if err != nil {
+			return nil, err
+		}
+		for _, msgs := range results {
+			if len(msgs) > 0 {
+				return results, nil
+			}
+		}
+
+		if opts.block < 0 {
+			return nil, nil
+		}
+
+		stop := make(chan struct{})
+		select {
+		case <-anyClosed(appended, stop):
+		case <-ctx.Done():
+			close(stop)
+			return nil, nil
+		case <-timeout:
+			close(stop)
+			return nil, nil
+		}
+		close(stop)
+	}
+}
+
+// anyClosed returns a channel that is closed when any of the channels is.
+// Closing stop ends the wait.
+func anyClosed(chs []<-chan struct{}, stop <-chan struct{}) <-chan struct{} {
+	if len(chs) == 1 {
+		return chs[0]
+	}
+
+	closed := make(chan struct{})
+	var once sync.Once
+	for _, ch := range chs {
+		go func(ch <-chan struct{}) {
+			select {
+			case <-ch:
+				once.Do(func() { close(closed) })
+			case <-closed:
+			case <-stop:
+			}
+		}(ch)
+	}
+
+	return closed
+}
+
+// readStream reads up to count entries, all if count is zero, with sequence
+// IDs from start to end, both included
+func readStream(s *Shard, start, end, count int64) ([]*Message, error) {
+	if start < 1 {
+		start = 1
+	}
+
+	var msgs []*Message
+	for start <= end && (count <= 0 || int64(len(msgs)) < count) {
+		max := end - start + 1
+		if count > 0 && count-int64(len(msgs)) < max {
+			max = count - int64(len(msgs))
+		}
+		if max > streamMaxRead {
+			max = streamMaxRead
+		}
+
+		batch, err := s.Read(start-1, max)
+		if errors.Is(err, ErrShardStartSequenceIDNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, m := range batch {
+			if m.SequenceID > end || (count > 0 && int64(len(msgs)) >= count) {
+				return msgs, nil
+			}
+			msgs = append(msgs, m)
+		}
+		start = batch[len(batch)-1].SequenceID + 1
+	}
+
+	return msgs, nil
+}
+
+// streamFields decodes the fields of an entry. Messages that were not added
+// with XADD have the fields key and value.
+func streamFields(m *Message) [][]byte {
+	v, err := resp.NewReader(bytes.NewReader(m.Payload)).Read()
+	if arr, ok := v.([]interface{}); ok && err == nil && len(arr)%2 == 0 {
+		fields := make([][]byte, 0, len(arr))
+		for _, f := range arr {
+			p, ok := f.([]byte)
+			if !ok {
+				break
+			}
+			fields = append(fields, p)
+		}
+		if len(fields) == len(arr) {
+			return fields
+		}
+	}
+
+	return [][]byte{[]byte("key"), m.Key, []byte("value"), m.Payload}
+}
+
+func writeStreamEntries(w resp.ResponseWriter, msgs []*Message) {
+	w.WriteInstruction('*', len(msgs))
+	for _, m := range msgs {
+		fields := streamFields(m)
+
+		w.WriteInstruction('*', 2)
+		w.WriteString(streamID(m.SequenceID))
+		w.WriteInstruction('*', len(fields))
+		for _, f := range fields {
+			w.WriteBytes(f)
+		}
+	}
+}
+
+// writeStreamEntry writes the first of the messages as a single entry, or
+// nil if there is none
+func writeStreamEntry(w resp.ResponseWriter, msgs []*Message) {
+	if len(msgs) == 0 {
+		w.WriteInstruction('$', -1)
+		return
+	}
+
+	fields := streamFields(msgs[0])
+	w.WriteInstruction('*', 2)
+	w.WriteString(streamID(msgs[0].SequenceID))
+	w.WriteInstruction('*', len(fields))
+	for _, f := range fields {
+		w.WriteBytes(f)
+	}
+}
+
+// writeStreamResults writes the entries per stream key for the streams
+// with entries, or a nil array if none has
+func writeStreamResults(w resp.ResponseWriter, strs []stream, results [][]*Message) {
+	var n int
+	for _, msgs := range results {
+		if len(msgs) > 0 {
+			n++
+		}
+	}
+	if n == 0 {
+		w.WriteInstruction('*', -1)
+		return
+	}
+
+	w.WriteInstruction('*', n)
+	for i, msgs := range results {
+		if len(msgs) == 0 {
+			continue
+		}
+
+		w.WriteInstruction('*', 2)
+		w.WriteString(strs[i].key)
+		writeStreamEntries(w, msgs)
+	}
+}
+
+func writeStreamErr(w resp.ResponseWriter, r *resp.Request, err error) {
+	w.WriteErr(errorCode(err), fmt.Sprintf("%s : %s", r.Cmd, err))
+}
+
+func streamID(sequenceID int64) string {
+	return "0-" + strconv.FormatInt(sequenceID, 10)
+}
+
+// parseStreamID parses a 0-<sequence ID> stream ID. An ID without - is
+// taken as the sequence ID.
+func parseStreamID(id string) (int64, error) {
+	_, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		seq = id
+	}
+
+	n, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: invalid stream ID %s", ErrStreamSyntax, id)
+	}
+
+	return n, nil
+}
+
+// parseRangeID parses an XRANGE bound. - and + are the first and last
+// sequence ID and ( excludes the ID.
+func parseRangeID(id string, first, last int64, start bool) (int64, error) {
+	switch id {
+	case "-":
+		return first, nil
+	case "+":
+		return last, nil
+	}
+
+	exclusive := strings.HasPrefix(id, "(")
+	n, err := parseStreamID(strings.TrimPrefix(id, "("))
+	if err != nil {
+		return 0, err
+	}
+
+	if exclusive && start {
+		n++
+	} else if exclusive {
+		n--
+	}
+
+	return n, nil
+}
+
+// parseGroupID parses the ID a group is created at or moved to. $ is the
+// end of the stream and an ID is the last entry the group has read.
+func parseGroupID(id string) (OffsetReset, error) {
+	if id == "$" {
+		return OffsetReset{Mode: ResetLatest}, nil
+	}
+
+	n, err := parseStreamID(id)
+	if err != nil {
+		return OffsetReset{}, err
+	}
+
+	return OffsetReset{Mode: ResetSequenceID, SequenceID: n}, nil
+}
+
+func parseStreamInt(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: invalid number %s", ErrStreamSyntax, s)
+	}
+
+	return n, nil
+}
+
+func uniqueTopics(strs []stream) []string {
+	var topics []string
+	seen := make(map[string]bool)
+	for _, str := range strs {
+		if !seen[str.topic] {
+			seen[str.topic] = true
+			topics = append(topics, str.topic)
+		}
+	}
+
+	return topics
+}
@@ -0,0 +1,104 @@
+package kuling
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fredrikbackstrom/kuling/kuling/resp"
+)
+
+// dialTestConn opens a raw connection to the server that is closed when the
+// test ends
+func dialTestConn(t *testing.T, addr string) (net.Conn, *resp.Writer, *resp.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return conn, resp.NewWriter(conn), resp.NewReader(bufio.NewReader(conn))
+}
+
+func TestXReadBlockZeroWakesOnAppend(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	addr := startTestServer(t, ServerConfig{}, l, newTestBroker(t, l))
+
+	_, w, r := dialTestConn(t, addr)
+	w.WriteArray("XREAD", "BLOCK", "0", "STREAMS", "emails", "$")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	replied := make(chan interface{}, 1)
+	go func() {
+		v, err := r.Read()
+		if err != nil {
+			v = err
+		}
+		replied <- v
+	}()
+
+	select {
+	case v := <-replied:
+		t.Fatalf("BLOCK 0 replied %s before any append", resp.FormatValue(v))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, aw, ar := dialTestConn(t, addr)
+	aw.WriteArray("XADD", "emails", "*", "key", "a")
+	if err := aw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ar.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-replied:
+		if streams, ok := v.([]interface{}); !ok || len(streams) != 1 {
+			t.Fatalf("XREAD replied %s", resp.FormatValue(v))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("XREAD BLOCK 0 did not wake up on XADD")
+	}
+}
+
+func TestXReadBlockEndsOnShutdown(t *testing.T) {
+	l := openTestStore(t, "")
+	createTestTopic(t, l, "emails", 1)
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStandaloneServer(ServerConfig{}, l, newTestBroker(t, l))
+	go s.Serve(listen)
+
+	_, w, r := dialTestConn(t, listen.Addr().String())
+	w.WriteArray("XREAD", "BLOCK", "0", "STREAMS", "emails", "$")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown with a blocked XREAD gave %v", err)
+	}
+
+	// The blocked read replies with no entries before the connection closes
+	v, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil {
+		t.Errorf("XREAD replied %s on shutdown, want nil", resp.FormatValue(v))
+	}
+}
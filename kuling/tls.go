@@ -0,0 +1,122 @@
+package kuling
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// ServerTLS is the TLS configuration of a server loaded from files. The files
+// are loaded again on Reload so certificates can be rotated without a
+// restart, connections made after the reload use the new certificates.
+type ServerTLS struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	config *tls.Config
+	lock   sync.RWMutex
+}
+
+// NewServerTLS loads the certificate and key. If a client CA file is given
+// clients must present a certificate signed by one of its CAs.
+func NewServerTLS(certFile, keyFile, clientCAFile string) (*ServerTLS, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("tls: certificate and key files are required")
+	}
+
+	s := &ServerTLS{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload the files. On error the previously loaded configuration is kept.
+func (s *ServerTLS) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: could not load certificate: %s", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if s.clientCAFile != "" {
+		pool, err := loadCertPool(s.clientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	s.lock.Lock()
+	s.config = config
+	s.lock.Unlock()
+
+	return nil
+}
+
+// Config returns the configuration to serve with. It always hands out the
+// last loaded configuration.
+func (s *ServerTLS) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+
+			return s.config, nil
+		},
+	}
+}
+
+// NewClientTLSConfig creates the TLS configuration for clients. The server
+// certificate is verified against the CAs in the CA file, or the system CAs
+// if no file is given. The certificate and key are presented to servers that
+// require client certificates.
+func NewClientTLSConfig(caFile, certFile, keyFile, serverName string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: could not load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// loadCertPool loads the PEM encoded certificates in the file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("tls: could not read CA file %s: %s", file, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates found in CA file %s", file)
+	}
+
+	return pool, nil
+}
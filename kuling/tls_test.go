@@ -0,0 +1,193 @@
+package kuling
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+// newTestCA creates a CA and writes its certificate to ca.pem in a temporary
+// directory
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kuling test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{cert, key, t.TempDir()}
+	writePEM(t, ca.file("ca.pem"), "CERTIFICATE", der)
+
+	return ca
+}
+
+func (ca *testCA) file(name string) string {
+	return path.Join(ca.dir, name)
+}
+
+// issue signs a certificate for the common name, valid for localhost, and
+// writes it to name.pem and its key to name.key
+func (ca *testCA) issue(t *testing.T, name, commonName string, serial int64) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := ca.file(name+".pem"), ca.file(name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSMutualAuthentication(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server", "server", 2)
+	clientCert, clientKey := ca.issue(t, "client", "client", 3)
+
+	st, err := NewServerTLS(serverCert, serverKey, ca.file("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := openTestStore(t, "")
+	addr := startTestServer(t, ServerConfig{TLSConfig: st.Config()}, l, newTestBroker(t, l))
+
+	config, err := NewClientTLSConfig(ca.file("ca.pem"), clientCert, clientKey, "localhost", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := DialConfig(ClientConfig{Address: addr, TLSConfig: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Ping(); err != nil {
+		t.Fatalf("ping over TLS gave %v", err)
+	}
+
+	// Without a client certificate the server ends the handshake
+	config, err = NewClientTLSConfig(ca.file("ca.pem"), "", "", "localhost", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := DialConfig(ClientConfig{Address: addr, TLSConfig: config}); err == nil {
+		_, err = c.Ping()
+		c.Close()
+		if err == nil {
+			t.Fatal("connected without a client certificate")
+		}
+	}
+
+	// Servers not signed by the CA are rejected by the client
+	if c, err := DialConfig(ClientConfig{Address: addr, TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}}); err == nil {
+		c.Close()
+		t.Fatal("connected to a server not signed by a known CA")
+	}
+}
+
+func TestServerTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server", "before", 2)
+
+	st, err := NewServerTLS(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		config, err := st.Config().GetConfigForClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Subject.CommonName
+	}
+
+	if name := commonName(); name != "before" {
+		t.Fatalf("serving %s", name)
+	}
+
+	ca.issue(t, "server", "after", 3)
+	if err := st.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(); name != "after" {
+		t.Errorf("serving %s after reload, want the rotated certificate", name)
+	}
+
+	// A broken file keeps the loaded certificate
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Reload(); err == nil {
+		t.Fatal("reloaded a broken key file")
+	}
+	if name := commonName(); name != "after" {
+		t.Errorf("serving %s after a failed reload", name)
+	}
+}
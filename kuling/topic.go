@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"path"
+	"strings"
+	"sync"
 )
 
 // Topic handles an entire topic
@@ -16,6 +18,12 @@ type Topic struct {
 	dir string
 	// map of shard name to shard
 	shards map[string]*Shard
+	logger *slog.Logger
+	// shardsLock guards shards and fsyncDeferred
+	shardsLock sync.RWMutex
+	// fsyncDeferred shards leave the fsyncs of appends to the log store's
+	// background loop
+	fsyncDeferred bool
 }
 
 // OpenTopic opens or creates a new file system topic
@@ -27,9 +35,11 @@ func OpenTopic(dir string, config *Config) (*Topic, error) {
 		panic("topic: files must have read and write permissions for running user")
 	}
 
+	logger := config.logger().With("topic", path.Base(dir))
+
 	stat, err := os.Stat(dir)
 	if err != nil || !stat.IsDir() {
-		log.Printf("topic: creating topic directory %s", dir)
+		logger.Info("topic: creating topic directory", "dir", dir)
 		// The directory does not exist, lets create it
 		err := os.Mkdir(dir, config.PermDirectories)
 
@@ -42,6 +52,9 @@ func OpenTopic(dir string, config *Config) (*Topic, error) {
 		config,
 		dir,
 		make(map[string]*Shard),
+		logger,
+		sync.RWMutex{},
+		false,
 	}
 
 	// Load all existing shards
@@ -55,8 +68,12 @@ func OpenTopic(dir string, config *Config) (*Topic, error) {
 			// We only want dirs!
 			continue
 		}
+		if strings.Contains(f.Name(), ".") {
+			// Shards being rewritten, like a compacted iter topic
+			continue
+		}
 
-		shard, err := OpenShard(path.Join(dir, f.Name()), config.SegmentMaxBytes, config.PermDirectories, config.PermData)
+		shard, err := topic.openShard(f.Name())
 		if err != nil {
 			return nil, fmt.Errorf("topic: could not load shard: %s\n", err)
 		}
@@ -70,19 +87,68 @@ func OpenTopic(dir string, config *Config) (*Topic, error) {
 // CreateShard adds a folder under the topic directory with the name
 // of the shard and adds it to the topic
 func (t *Topic) CreateShard(shardName string) error {
-	shard, err := OpenShard(path.Join(t.dir, shardName), t.config.SegmentMaxBytes, t.config.PermDirectories, t.config.PermData)
+	shard, err := t.openShard(shardName)
 	if err != nil {
 		return err
 	}
 
+	t.shardsLock.Lock()
+	defer t.shardsLock.Unlock()
 	t.shards[shardName] = shard
 
 	return nil
 }
 
+// openShard opens or creates the shard of the topic with the configured
+// fsync policy
+func (t *Topic) openShard(shardName string) (*Shard, error) {
+	shard, err := OpenShard(path.Join(t.dir, shardName), t.config.SegmentMaxBytes, t.config.PermDirectories, t.config.PermData,
+		t.logger.With("shard", shardName))
+	if err != nil {
+		return nil, err
+	}
+	t.shardsLock.RLock()
+	deferred := t.fsyncDeferred
+	t.shardsLock.RUnlock()
+	if deferred {
+		shard.deferFsync()
+	}
+
+	return shard, nil
+}
+
+// deferFsync leaves the fsyncs of appends to the shards, and of shards
+// created later, to the log store's background loop
+func (t *Topic) deferFsync() {
+	t.shardsLock.Lock()
+	defer t.shardsLock.Unlock()
+
+	t.fsyncDeferred = true
+	for _, s := range t.shards {
+		s.deferFsync()
+	}
+}
+
 // Shards gets a all shards for the topic
 func (t *Topic) Shards() map[string]*Shard {
-	return t.shards
+	t.shardsLock.RLock()
+	defer t.shardsLock.RUnlock()
+
+	shards := make(map[string]*Shard, len(t.shards))
+	for name, s := range t.shards {
+		shards[name] = s
+	}
+
+	return shards
+}
+
+// shard returns the shard with the name
+func (t *Topic) shard(name string) (*Shard, bool) {
+	t.shardsLock.RLock()
+	defer t.shardsLock.RUnlock()
+
+	s, ok := t.shards[name]
+	return s, ok
 }
 
 // Delete the topic and all the shards in it
@@ -91,42 +157,55 @@ func (t *Topic) Delete() error {
 }
 
 // Append key and payload to topic
-func (t *Topic) Append(shard string, key, payload []byte) error {
-	if s, ok := t.shards[shard]; ok {
+func (t *Topic) Append(shard string, key, payload []byte) (int64, error) {
+	if s, ok := t.shard(shard); ok {
 		return s.Append(key, payload)
 	}
 
-	return fmt.Errorf("topic: unknown shard %s", shard)
+	return 0, fmt.Errorf("%w %s", ErrUnknownShard, shard)
+}
+
+// AppendBatch appends keys and payloads to the topic shard in order
+func (t *Topic) AppendBatch(shard string, keys, payloads [][]byte) ([]int64, error) {
+	if s, ok := t.shard(shard); ok {
+		return s.AppendBatch(keys, payloads)
+	}
+
+	return nil, fmt.Errorf("%w %s", ErrUnknownShard, shard)
 }
 
 // Read from topic shard from start sequence id and max messages
 func (t *Topic) Read(shard string, startSequenceID, maxMessages int64) ([]*Message, error) {
-	if s, ok := t.shards[shard]; ok {
+	if s, ok := t.shard(shard); ok {
 		return s.Read(startSequenceID, maxMessages)
 	}
 
-	return nil, fmt.Errorf("topic: unknown shard %s", shard)
+	return nil, fmt.Errorf("%w %s", ErrUnknownShard, shard)
 }
 
 // Copy from topic shard from start sequence id and max messages into io writer
 func (t *Topic) Copy(shard string, startSequenceID, maxMessages int64, w io.Writer, preC PreCopy, postC PostCopy) (int64, error) {
-	if s, ok := t.shards[shard]; ok {
+	if s, ok := t.shard(shard); ok {
 		return s.Copy(startSequenceID, maxMessages, w, preC, postC)
 	}
 
-	return 0, fmt.Errorf("topic: unknown shard %s", shard)
+	return 0, fmt.Errorf("%w %s", ErrUnknownShard, shard)
 }
 
-// Close down the file system topic by closing all shards
+// Close down the file system topic by closing all shards. Returns the first
+// error.
 func (t *Topic) Close() error {
-	for _, p := range t.shards {
-		p.Close()
+	var err error
+	for _, p := range t.Shards() {
+		if shardErr := p.Close(); shardErr != nil && err == nil {
+			err = shardErr
+		}
 	}
 
-	return nil
+	return err
 }
 
 // String from stringer interface
 func (t *Topic) String() string {
-	return fmt.Sprintf("path: %s shards: %d", t.dir, len(t.shards))
+	return fmt.Sprintf("path: %s shards: %d", t.dir, len(t.Shards()))
 }
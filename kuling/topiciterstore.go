@@ -0,0 +1,281 @@
+package kuling
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IterTopic is the internal topic where the topic iter store persists
+// committed iterators
+const IterTopic = "__iterators"
+
+// iterTopicShard is the one shard of the iter topic
+const iterTopicShard = "0000000000_shard"
+
+// Number of messages read per batch when materializing the iter topic
+const iterTopicReadBatch = 1000
+
+// The iter topic is compacted when it is opened with at least
+// iterTopicCompactMin commits and iterTopicCompactRatio times as many
+// commits as iterators
+const (
+	iterTopicCompactMin   = 10000
+	iterTopicCompactRatio = 2
+)
+
+// Suffixes of the shard directories of a compaction in progress, topics do
+// not load directories with a dot in the name
+const (
+	compactingSuffix = ".compacting"
+	compactedSuffix  = ".compacted"
+)
+
+// TopicIterStore stores iters as messages in an internal kuling topic so that
+// committed iterators live, and are backed up, together with the rest of the
+// log. Every commit appends a message keyed by the iterator ID with the
+// offset as payload. On open the topic is read from start to end and
+// materialized into memory where the last commit for an iterator wins,
+// after which the topic is compacted down to the last commit of every
+// iterator when it has grown large.
+type TopicIterStore struct {
+	shard  *Shard
+	iters  map[string]int64
+	closed bool
+	lock   sync.RWMutex
+	logger *slog.Logger
+}
+
+// OpenTopicIterStore opens the iter topic in the log store, creating it if
+// it does not exist, and materializes all committed iterators into memory
+func OpenTopicIterStore(l *LogStore) (*TopicIterStore, error) {
+	topic, ok := l.Topics()[IterTopic]
+	if !ok {
+		var err error
+		if topic, err = l.CreateTopic(IterTopic, 1); err != nil {
+			return nil, fmt.Errorf("topiciterstore: could not create iter topic: %s", err)
+		}
+	}
+
+	if err := recoverCompaction(topic); err != nil {
+		return nil, err
+	}
+
+	shard, ok := topic.Shards()[iterTopicShard]
+	if !ok || len(topic.Shards()) != 1 {
+		return nil, fmt.Errorf("topiciterstore: iter topic must have exactly the shard %s, has %d shards", iterTopicShard, len(topic.Shards()))
+	}
+
+	ts := &TopicIterStore{
+		shard:  shard,
+		iters:  make(map[string]int64),
+		logger: topic.logger,
+	}
+
+	if err := ts.materialize(); err != nil {
+		return nil, err
+	}
+
+	l.logger.Info("topiciterstore: loaded iterators", "iterators", len(ts.iters), "commits", shard.Head())
+
+	if head := shard.Head(); head >= iterTopicCompactMin && head >= iterTopicCompactRatio*int64(len(ts.iters)) {
+		if err := ts.compact(topic); err != nil {
+			return nil, err
+		}
+		l.logger.Info("topiciterstore: compacted iter topic", "commits", head, "iterators", len(ts.iters))
+	}
+
+	return ts, nil
+}
+
+// materialize reads the whole iter topic and keeps the last offset
+// committed for every iterator
+func (ts *TopicIterStore) materialize() error {
+	head := ts.shard.Head()
+	for sequenceID := int64(0); sequenceID < head; {
+		msgs, err := ts.shard.Read(sequenceID, iterTopicReadBatch)
+		if err != nil {
+			return fmt.Errorf("topiciterstore: could not read iter topic at %d: %s", sequenceID, err)
+		}
+		if len(msgs) == 0 {
+			return fmt.Errorf("topiciterstore: iter topic ended at %d before head %d", sequenceID, head)
+		}
+
+		for _, m := range msgs {
+			// Only the store writes the topic, a record it cannot parse is
+			// logged and skipped rather than keeping the server from starting
+			var offset int64
+			if len(m.Payload) != 8 {
+				ts.logger.Warn("topiciterstore: skipping commit with malformed offset", "sequence_id", m.SequenceID, "bytes", len(m.Payload))
+				continue
+			}
+			binary.Read(bytes.NewReader(m.Payload), binary.BigEndian, &offset)
+
+			// Commits made before the current iterator ID format are mapped
+			// to the current format, later commits for the iterator win
+			iterID := string(m.Key)
+			if migrated, ok := legacyIterID(iterID); ok {
+				iterID = migrated
+			}
+
+			ts.iters[iterID] = offset
+		}
+
+		sequenceID += int64(len(msgs))
+	}
+
+	return nil
+}
+
+// compact rewrites the iter topic with the last commit of every iterator.
+// The compacted shard is written next to the current one and swapped in by
+// renaming the directories, a compaction interrupted half way is finished
+// by recoverCompaction on the next open.
+func (ts *TopicIterStore) compact(topic *Topic) error {
+	dir := ts.shard.dir
+	compacting, compacted := dir+compactingSuffix, dir+compactedSuffix
+	if err := os.RemoveAll(compacting); err != nil {
+		return fmt.Errorf("topiciterstore: could not remove earlier compaction: %s", err)
+	}
+
+	c := topic.config
+	s, err := OpenShard(compacting, c.SegmentMaxBytes, c.PermDirectories, c.PermData, ts.logger)
+	if err != nil {
+		return fmt.Errorf("topiciterstore: could not create compacted shard: %s", err)
+	}
+
+	ids := make([]string, 0, len(ts.iters))
+	for id := range ts.iters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for len(ids) > 0 {
+		n := min(len(ids), iterTopicReadBatch)
+		keys, payloads := make([][]byte, n), make([][]byte, n)
+		for i, id := range ids[:n] {
+			keys[i], payloads[i] = []byte(id), encodeOffset(ts.iters[id])
+		}
+		if _, err := s.AppendBatch(keys, payloads); err != nil {
+			s.Close()
+			return fmt.Errorf("topiciterstore: could not write compacted shard: %s", err)
+		}
+		ids = ids[n:]
+	}
+	if err := s.Close(); err != nil {
+		return fmt.Errorf("topiciterstore: could not close compacted shard: %s", err)
+	}
+
+	// The compacted shard is complete, swap it in
+	if err := ts.shard.Close(); err != nil {
+		return fmt.Errorf("topiciterstore: could not close iter topic: %s", err)
+	}
+	if err := os.Rename(dir, compacted); err != nil {
+		return fmt.Errorf("topiciterstore: could not move iter topic: %s", err)
+	}
+	if err := os.Rename(compacting, dir); err != nil {
+		return fmt.Errorf("topiciterstore: could not move compacted iter topic: %s", err)
+	}
+	if err := os.RemoveAll(compacted); err != nil {
+		ts.logger.Warn("topiciterstore: could not remove the iter topic before compaction", "dir", compacted, "err", err)
+	}
+
+	if err := topic.CreateShard(iterTopicShard); err != nil {
+		return fmt.Errorf("topiciterstore: could not open compacted iter topic: %s", err)
+	}
+	ts.shard = topic.Shards()[iterTopicShard]
+
+	return nil
+}
+
+// recoverCompaction finishes a compaction that was interrupted. When the
+// iter topic's shard was moved away the compacted shard is moved in place,
+// and the shard from before the compaction is removed once the compacted
+// one is in place.
+func recoverCompaction(topic *Topic) error {
+	dir := path.Join(topic.dir, iterTopicShard)
+	if len(topic.Shards()) == 0 {
+		if _, err := os.Stat(dir + compactingSuffix); err != nil {
+			return nil
+		}
+		if err := os.Rename(dir+compactingSuffix, dir); err != nil {
+			return fmt.Errorf("topiciterstore: could not finish compaction: %s", err)
+		}
+		topic.logger.Warn("topiciterstore: finished interrupted compaction")
+
+		if err := topic.CreateShard(iterTopicShard); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(dir + compactedSuffix); err != nil {
+		return nil
+	}
+	if err := os.RemoveAll(dir + compactedSuffix); err != nil {
+		return fmt.Errorf("topiciterstore: could not remove the iter topic before compaction: %s", err)
+	}
+	topic.logger.Warn("topiciterstore: removed the iter topic left from before compaction")
+
+	return nil
+}
+
+// encodeOffset is the payload of a commit
+func encodeOffset(offset int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(offset))
+}
+
+// Commit persists an iterator and it's offset by appending it to the iter
+// topic
+func (ts *TopicIterStore) Commit(iter string, offset int64) error {
+
+	// Hold the lock over the append so that the order of the commits in the
+	// topic is the same as the order they are applied in memory
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.closed {
+		return fmt.Errorf("topiciterstore: commit: iter store is closed")
+	}
+	if _, err := ts.shard.Append([]byte(iter), encodeOffset(offset)); err != nil {
+		return fmt.Errorf("topiciterstore: commit: %s", err)
+	}
+
+	ts.iters[iter] = offset
+
+	return nil
+}
+
+// Close waits for commits in progress and fails later commits. The iter
+// topic itself is closed with the log store.
+func (ts *TopicIterStore) Close() error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.closed = true
+
+	return nil
+}
+
+// GetAll iterators for a group and topic
+func (ts *TopicIterStore) GetAll(group, topic string) (map[string]int64, error) {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+
+	// Same prefix match as the bolt iter store, the shard is the part of the
+	// iterator ID we are looking for
+	prefix := iterIDPrefix(group, topic)
+	iters := make(map[string]int64)
+	for iterID, offset := range ts.iters {
+		if strings.HasPrefix(iterID, prefix) {
+			iters[iterID] = offset
+		}
+	}
+
+	return iters, nil
+}
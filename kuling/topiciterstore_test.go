@@ -0,0 +1,164 @@
+package kuling
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func openTestIterStore(t *testing.T, l *LogStore) *TopicIterStore {
+	t.Helper()
+
+	ts, err := OpenTopicIterStore(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestTopicIterStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLogStore(dir, &Config{PermDirectories: 0755, PermData: 0644, SegmentMaxBytes: DefaultSegmentMaxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := openTestIterStore(t, l)
+	id := iterIDPrefix("group", "emails") + firstShard
+	for _, offset := range []int64{1, 5, 9} {
+		if err := ts.Commit(id, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	l = openTestStore(t, dir)
+	ts = openTestIterStore(t, l)
+	all, err := ts.GetAll("group", "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[id] != 9 {
+		t.Errorf("offset %d, want the last commit 9", all[id])
+	}
+}
+
+func TestTopicIterStoreSkipsMalformedCommits(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenLogStore(dir, &Config{PermDirectories: 0755, PermData: 0644, SegmentMaxBytes: DefaultSegmentMaxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := openTestIterStore(t, l)
+	good := iterIDPrefix("group", "emails") + firstShard
+	if err := ts.Commit(good, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Append(IterTopic, iterTopicShard, []byte(good), []byte("bad")); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l = openTestStore(t, dir)
+	ts = openTestIterStore(t, l)
+	all, err := ts.GetAll("group", "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[good] != 4 {
+		t.Errorf("offset %d, want 4 from before the malformed commit", all[good])
+	}
+}
+
+func TestTopicIterStoreCompact(t *testing.T) {
+	l := openTestStore(t, "")
+	ts := openTestIterStore(t, l)
+
+	a := iterIDPrefix("group", "emails") + "0000000000_shard"
+	b := iterIDPrefix("group", "emails") + "0000000001_shard"
+	for i := int64(1); i <= 10; i++ {
+		ts.Commit(a, i)
+		ts.Commit(b, i*2)
+	}
+
+	if err := ts.compact(l.Topics()[IterTopic]); err != nil {
+		t.Fatal(err)
+	}
+	if head := ts.shard.Head(); head != 2 {
+		t.Errorf("head %d after compaction, want one commit per iterator", head)
+	}
+
+	// Commits go to the compacted shard and are read back on open
+	if err := ts.Commit(a, 11); err != nil {
+		t.Fatal(err)
+	}
+	ts.iters = make(map[string]int64)
+	if err := ts.materialize(); err != nil {
+		t.Fatal(err)
+	}
+	if ts.iters[a] != 11 || ts.iters[b] != 20 {
+		t.Errorf("offsets %d and %d after compaction, want 11 and 20", ts.iters[a], ts.iters[b])
+	}
+
+	entries, err := os.ReadDir(l.Topics()[IterTopic].dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d directories left in the iter topic, want 1", len(entries))
+	}
+}
+
+func TestTopicIterStoreRecoversCompaction(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// crash leaves the shard directories as a compaction stopped at
+		// that point would
+		crash func(shard string) error
+	}{
+		{"compacted shard not moved in", func(shard string) error {
+			if err := os.Mkdir(shard+compactedSuffix, 0755); err != nil {
+				return err
+			}
+			return os.Rename(shard, shard+compactingSuffix)
+		}},
+		{"shard before compaction not removed", func(shard string) error {
+			return os.Mkdir(shard+compactedSuffix, 0755)
+		}},
+		{"only the compacted shard left", func(shard string) error {
+			return os.Rename(shard, shard+compactingSuffix)
+		}},
+	} {
+		dir := t.TempDir()
+		l, err := OpenLogStore(dir, &Config{PermDirectories: 0755, PermData: 0644, SegmentMaxBytes: DefaultSegmentMaxBytes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := openTestIterStore(t, l)
+		id := iterIDPrefix("group", "emails") + firstShard
+		ts.Commit(id, 7)
+		l.Close()
+
+		shard := path.Join(dir, IterTopic, iterTopicShard)
+		if err := tc.crash(shard); err != nil {
+			t.Fatal(err)
+		}
+
+		l = openTestStore(t, dir)
+		ts = openTestIterStore(t, l)
+		all, err := ts.GetAll("group", "emails")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if all[id] != 7 {
+			t.Errorf("%s: offset %d after recovery, want 7", tc.name, all[id])
+		}
+
+		entries, err := os.ReadDir(path.Join(dir, IterTopic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("%s: %d directories left in the iter topic, want 1", tc.name, len(entries))
+		}
+	}
+}